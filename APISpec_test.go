@@ -0,0 +1,647 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"Quanta-Ledger/devpeer"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// API_SPEC_SYSTEM_CONTRACT is the contract contractapi adds to every chaincode; it is left out of the spec
+const API_SPEC_SYSTEM_CONTRACT = "org.hyperledger.fabric"
+
+// API_SPEC_DIFF_LINES is how many changed lines of each side a stale spec file's diff shows
+const API_SPEC_DIFF_LINES = 40
+
+// apiSpecSchemas are the types also published as standalone JSON Schemas
+var apiSpecSchemas = []string{"Product", "ProductHistory"}
+
+/**
+*@dev apiSpecSource() locates the Go source of a contract, which names the parameters and describes the transactions its metadata leaves anonymous
+*/
+
+type apiSpecSource struct {
+	Dir      string
+	Receiver string
+}
+
+var apiSpecSources = map[string]apiSpecSource{
+	"ProductDetailsContract": {Dir: ".", Receiver: "ProductDetailsContract"},
+	"saga":                   {Dir: "saga", Receiver: "Contract"},
+}
+
+/**
+*@dev chaincodeMetadata() represents the parts of contractapi's GetMetadata answer the spec is built from
+*/
+
+type chaincodeMetadata struct {
+	Info struct {
+		Version string `json:"version"`
+	} `json:"info"`
+	Contracts map[string]struct {
+		Name         string `json:"name"`
+		Default      bool   `json:"default"`
+		Transactions []struct {
+			Name       string `json:"name"`
+			Parameters []struct {
+				Name   string                 `json:"name"`
+				Schema map[string]interface{} `json:"schema"`
+			} `json:"parameters"`
+			Returns map[string]interface{} `json:"returns"`
+		} `json:"transactions"`
+	} `json:"contracts"`
+	Components struct {
+		Schemas map[string]map[string]interface{} `json:"schemas"`
+	} `json:"components"`
+}
+
+/**
+*@dev apiSourceMethod() holds what the Go source says about a transaction
+*/
+
+type apiSourceMethod struct {
+	Params      []string
+	Summary     string
+	Description string
+}
+
+/**
+*@dev apiSource() holds what the Go source says about a contract's transactions and the enums its types use
+*/
+
+type apiSource struct {
+	methods    map[string]map[string]apiSourceMethod
+	enums      map[string][]string
+	enumFields map[string]map[string]string
+}
+
+var apiSpecUpdate = flag.Bool("update", false, "write the generated API spec to api instead of checking it")
+
+/**
+*@dev TestAPISpec() regenerates the OpenAPI document and JSON Schemas from the chaincode's metadata and diffs them against api
+*
+* Run `go test -run TestAPISpec . -update` after changing a transaction or a type it takes or returns, and commit the result.
+*/
+
+func TestAPISpec(t *testing.T) {
+	chaincode, err := newChaincode(new(ProductDetailsContract))
+	if err != nil {
+		t.Fatalf("failed to create chaincode: %v", err)
+	}
+
+	files, err := generateAPISpec(chaincode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := filepath.Join("api", name)
+		if *apiSpecUpdate {
+			err = os.MkdirAll(filepath.Dir(path), 0755)
+			if err != nil {
+				t.Fatalf("failed to create spec directory: %v", err)
+			}
+
+			err = os.WriteFile(path, files[name], 0644)
+			if err != nil {
+				t.Fatalf("failed to write %s: %v", name, err)
+			}
+			t.Logf("wrote %s", path)
+			continue
+		}
+
+		current, err := os.ReadFile(path)
+		if err != nil {
+			t.Errorf("%s is missing; run `go test -run TestAPISpec . -update` and commit the result", path)
+			continue
+		}
+		if diff := diffAPISpec(current, files[name]); diff != "" {
+			t.Errorf("%s is out of date with the contract; run `go test -run TestAPISpec . -update` and commit the result\n%s", path, diff)
+		}
+	}
+}
+
+/**
+*@dev diffAPISpec() describes the first lines where a checked-in spec file and the generated one differ, or returns "" if they match
+*/
+
+func diffAPISpec(current []byte, generated []byte) string {
+	if bytes.Equal(current, generated) {
+		return ""
+	}
+
+	currentLines := strings.Split(string(current), "\n")
+	generatedLines := strings.Split(string(generated), "\n")
+
+	// Skip the lines both files start and end with, leaving the changed region
+	start := 0
+	for start < len(currentLines) && start < len(generatedLines) && currentLines[start] == generatedLines[start] {
+		start++
+	}
+	currentEnd, generatedEnd := len(currentLines), len(generatedLines)
+	for currentEnd > start && generatedEnd > start && currentLines[currentEnd-1] == generatedLines[generatedEnd-1] {
+		currentEnd--
+		generatedEnd--
+	}
+
+	var diff strings.Builder
+	fmt.Fprintf(&diff, "@@ line %d @@\n", start+1)
+	for i, line := range currentLines[start:currentEnd] {
+		if i == API_SPEC_DIFF_LINES {
+			fmt.Fprintf(&diff, "-... %d more lines\n", currentEnd-start-i)
+			break
+		}
+		fmt.Fprintf(&diff, "-%s\n", line)
+	}
+	for i, line := range generatedLines[start:generatedEnd] {
+		if i == API_SPEC_DIFF_LINES {
+			fmt.Fprintf(&diff, "+... %d more lines\n", generatedEnd-start-i)
+			break
+		}
+		fmt.Fprintf(&diff, "+%s\n", line)
+	}
+	return diff.String()
+}
+
+/**
+*@dev generateAPISpec() builds the spec files from the metadata the chaincode reports, keyed by their path under the spec directory
+*/
+
+func generateAPISpec(chaincode *contractapi.ContractChaincode) (map[string][]byte, error) {
+	peer, err := devpeer.NewPeer(chaincode, "")
+	if err != nil {
+		return nil, err
+	}
+
+	metadataBytes, err := peer.Evaluate(devpeer.Identity{MSPID: "apispec"}, API_SPEC_SYSTEM_CONTRACT+":GetMetadata")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chaincode metadata: %v", err)
+	}
+
+	var metadata chaincodeMetadata
+	err = json.Unmarshal(metadataBytes, &metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal chaincode metadata JSON: %v", err)
+	}
+
+	dirs := []string{}
+	for _, source := range apiSpecSources {
+		dirs = append(dirs, source.Dir)
+	}
+	source, err := parseAPISource(dirs)
+	if err != nil {
+		return nil, err
+	}
+
+	schemas := make(map[string]interface{})
+	for name, schema := range metadata.Components.Schemas {
+		delete(schema, "$id")
+		rewriteSchemaRefs(schema, "#/components/schemas/")
+
+		properties, _ := schema["properties"].(map[string]interface{})
+		for field, enum := range source.enumFields[name] {
+			if properties[field] != nil {
+				properties[field] = map[string]interface{}{"$ref": "#/components/schemas/" + enum}
+				schemas[enum] = enumSchema(enum, source.enums[enum])
+			}
+		}
+		schemas[name] = schema
+	}
+
+	paths := make(map[string]interface{})
+	for contractName, contract := range metadata.Contracts {
+		if contractName == API_SPEC_SYSTEM_CONTRACT {
+			continue
+		}
+
+		for _, transaction := range contract.Transactions {
+			function := transaction.Name
+			if !contract.Default {
+				function = contractName + ":" + transaction.Name
+			}
+
+			method := source.methods[apiSpecSources[contractName].Receiver][transaction.Name]
+			if len(method.Params) != len(transaction.Parameters) {
+				method.Params = nil
+			}
+
+			operation := map[string]interface{}{
+				"operationId": strings.ReplaceAll(function, ":", "."),
+				"tags":        []string{contractName},
+				"summary":     method.Summary,
+				"responses": map[string]interface{}{
+					"200":     transactionResponse(transaction.Returns),
+					"default": map[string]interface{}{"$ref": "#/components/responses/Rejected"},
+				},
+			}
+			if method.Description != "" {
+				operation["description"] = method.Description
+			}
+
+			arguments := []string{}
+			properties := make(map[string]interface{})
+			for i, parameter := range transaction.Parameters {
+				name := parameter.Name
+				if method.Params != nil {
+					name = method.Params[i]
+				}
+				rewriteSchemaRefs(parameter.Schema, "#/components/schemas/")
+				arguments = append(arguments, name)
+				properties[name] = parameter.Schema
+			}
+			operation["x-fabric-function"] = function
+			operation["x-fabric-arguments"] = arguments
+			if len(arguments) > 0 {
+				operation["requestBody"] = map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type":                 "object",
+								"properties":           properties,
+								"required":             arguments,
+								"additionalProperties": false,
+							},
+						},
+					},
+				}
+			}
+
+			paths["/"+function] = map[string]interface{}{"post": operation}
+		}
+	}
+
+	document := map[string]interface{}{
+		"openapi": "3.1.0",
+		"info": map[string]interface{}{
+			"title":   "Quanta Ledger product details chaincode",
+			"version": metadata.Info.Version,
+			"description": "Each path is a chaincode function. Gateway clients submit or evaluate the function named by `x-fabric-function`, " +
+				"passing the request body's values in `x-fabric-arguments` order and JSON-encoding those that are not strings. " +
+				"The local peer emulator takes the same function and arguments at POST /submit and POST /evaluate.",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"responses": map[string]interface{}{
+				"Rejected": map[string]interface{}{
+					"description": "The chaincode rejected the transaction",
+					"content": map[string]interface{}{
+						"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+					},
+				},
+			},
+		},
+	}
+
+	files := make(map[string][]byte)
+	files["openapi.json"], err = marshalAPISpec(document)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range apiSpecSchemas {
+		if schemas[name] == nil {
+			return nil, fmt.Errorf("contract metadata has no schema for %s", name)
+		}
+
+		files[filepath.Join("schemas", name+".schema.json")], err = marshalAPISpec(standaloneSchema(name, schemas))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+func transactionResponse(returns map[string]interface{}) map[string]interface{} {
+	if returns == nil {
+		return map[string]interface{}{"description": "The transaction succeeded and returns nothing"}
+	}
+
+	// contractapi returns strings as they are and everything else as JSON
+	mediaType := "application/json"
+	if returns["type"] == "string" {
+		mediaType = "text/plain"
+	}
+
+	rewriteSchemaRefs(returns, "#/components/schemas/")
+	return map[string]interface{}{
+		"description": "The transaction succeeded",
+		"content":     map[string]interface{}{mediaType: map[string]interface{}{"schema": returns}},
+	}
+}
+
+func enumSchema(name string, constants []string) map[string]interface{} {
+	values := []interface{}{}
+	for i, constant := range constants {
+		values = append(values, map[string]interface{}{"const": i, "title": constant})
+	}
+	return map[string]interface{}{"title": name, "type": "integer", "oneOf": values}
+}
+
+/**
+*@dev standaloneSchema() copies a component schema into a JSON Schema document, moving the schemas it references under $defs
+*/
+
+func standaloneSchema(name string, schemas map[string]interface{}) map[string]interface{} {
+	var document map[string]interface{}
+	copySchema(schemas[name], &document)
+
+	defs := make(map[string]interface{})
+	pending := referencedSchemas(document)
+	for len(pending) > 0 {
+		ref := pending[0]
+		pending = pending[1:]
+		if defs[ref] != nil || ref == name {
+			continue
+		}
+
+		var def map[string]interface{}
+		copySchema(schemas[ref], &def)
+		defs[ref] = def
+		pending = append(pending, referencedSchemas(def)...)
+	}
+
+	rewriteDefinitionRefs(document, name)
+	for _, def := range defs {
+		rewriteDefinitionRefs(def, name)
+	}
+
+	document["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	document["$id"] = name + ".schema.json"
+	document["title"] = name
+	if len(defs) > 0 {
+		document["$defs"] = defs
+	}
+	return document
+}
+
+func copySchema(schema interface{}, copied *map[string]interface{}) {
+	schemaBytes, _ := json.Marshal(schema)
+	json.Unmarshal(schemaBytes, copied)
+}
+
+// rewriteSchemaRefs points references that name a schema directly at where it lives in the document
+func rewriteSchemaRefs(schema interface{}, prefix string) {
+	walkSchemaRefs(schema, func(ref string) string {
+		if strings.HasPrefix(ref, "#") {
+			return ref
+		}
+		return prefix + ref
+	})
+}
+
+func rewriteDefinitionRefs(schema interface{}, root string) {
+	walkSchemaRefs(schema, func(ref string) string {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		if name == root {
+			return "#"
+		}
+		return "#/$defs/" + name
+	})
+}
+
+func referencedSchemas(schema interface{}) []string {
+	refs := []string{}
+	walkSchemaRefs(schema, func(ref string) string {
+		refs = append(refs, strings.TrimPrefix(ref, "#/components/schemas/"))
+		return ref
+	})
+	return refs
+}
+
+func walkSchemaRefs(schema interface{}, rewrite func(string) string) {
+	switch schema := schema.(type) {
+	case map[string]interface{}:
+		for key, value := range schema {
+			if ref, ok := value.(string); ok && key == "$ref" {
+				schema[key] = rewrite(ref)
+				continue
+			}
+			walkSchemaRefs(value, rewrite)
+		}
+	case []interface{}:
+		for _, value := range schema {
+			walkSchemaRefs(value, rewrite)
+		}
+	}
+}
+
+func marshalAPISpec(document interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+
+	err := encoder.Encode(document)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal API spec JSON: %v", err)
+	}
+	return buffer.Bytes(), nil
+}
+
+// apiDocComment matches the first line of a doc comment in this repo's style, e.g. "*@dev AddProduct() adds a product"
+var apiDocComment = regexp.MustCompile(`^\*?\s*@dev\s+\w+\(\)\s*`)
+
+/**
+*@dev parseAPISource() reads the transactions' parameter names and doc comments, and the constants of every iota enum, from Go source
+*/
+
+func parseAPISource(dirs []string) (*apiSource, error) {
+	source := &apiSource{
+		methods:    make(map[string]map[string]apiSourceMethod),
+		enums:      make(map[string][]string),
+		enumFields: make(map[string]map[string]string),
+	}
+
+	fset := token.NewFileSet()
+	files := []*ast.File{}
+	for _, dir := range dirs {
+		packages, err := parser.ParseDir(fset, dir, func(info os.FileInfo) bool {
+			return !strings.HasSuffix(info.Name(), "_test.go")
+		}, parser.ParseComments)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse contract source in %s: %v", dir, err)
+		}
+		for _, pkg := range packages {
+			for _, file := range pkg.Files {
+				files = append(files, file)
+			}
+		}
+	}
+
+	// Struct fields are matched to enums once every enum is known
+	structs := make(map[string]*ast.StructType)
+	for _, file := range files {
+		for _, decl := range file.Decls {
+			switch decl := decl.(type) {
+			case *ast.FuncDecl:
+				receiver := methodReceiver(decl)
+				if receiver == "" || !decl.Name.IsExported() {
+					continue
+				}
+				if source.methods[receiver] == nil {
+					source.methods[receiver] = make(map[string]apiSourceMethod)
+				}
+				source.methods[receiver][decl.Name.Name] = describeMethod(fset, file, decl)
+			case *ast.GenDecl:
+				collectEnum(decl, source.enums)
+				for _, spec := range decl.Specs {
+					if typeSpec, ok := spec.(*ast.TypeSpec); ok {
+						if structType, ok := typeSpec.Type.(*ast.StructType); ok {
+							structs[typeSpec.Name.Name] = structType
+						}
+					}
+				}
+			}
+		}
+	}
+
+	for name, structType := range structs {
+		for _, field := range structType.Fields.List {
+			enum := fieldEnum(field.Type, source.enums)
+			if enum == "" || len(field.Names) == 0 {
+				continue
+			}
+			if source.enumFields[name] == nil {
+				source.enumFields[name] = make(map[string]string)
+			}
+			source.enumFields[name][jsonFieldName(field)] = enum
+		}
+	}
+
+	return source, nil
+}
+
+func methodReceiver(decl *ast.FuncDecl) string {
+	if decl.Recv == nil || len(decl.Recv.List) != 1 {
+		return ""
+	}
+	if star, ok := decl.Recv.List[0].Type.(*ast.StarExpr); ok {
+		if ident, ok := star.X.(*ast.Ident); ok {
+			return ident.Name
+		}
+	}
+	return ""
+}
+
+/**
+*@dev describeMethod() names a transaction's parameters, skipping the transaction context, and splits its doc comment into a summary and description
+*
+* Doc comments here sit one blank line above the function, so the parser does not attach them to it.
+*/
+
+func describeMethod(fset *token.FileSet, file *ast.File, decl *ast.FuncDecl) apiSourceMethod {
+	method := apiSourceMethod{Params: []string{}}
+	for i, field := range decl.Type.Params.List {
+		for _, name := range field.Names {
+			if i == 0 && name.Name == "ctx" {
+				continue
+			}
+			method.Params = append(method.Params, name.Name)
+		}
+	}
+
+	line := fset.Position(decl.Pos()).Line
+	for _, group := range file.Comments {
+		end := fset.Position(group.End()).Line
+		if end < line-2 || end >= line {
+			continue
+		}
+
+		paragraphs := []string{}
+		current := []string{}
+		for _, text := range strings.Split(group.List[0].Text, "\n") {
+			text = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(text), "/**"), "*/"))
+			text = apiDocComment.ReplaceAllString(text, "")
+			text = strings.TrimSpace(strings.TrimPrefix(text, "*"))
+			if text == "" {
+				if len(current) > 0 {
+					paragraphs = append(paragraphs, strings.Join(current, " "))
+					current = nil
+				}
+				continue
+			}
+			current = append(current, text)
+		}
+		if len(current) > 0 {
+			paragraphs = append(paragraphs, strings.Join(current, " "))
+		}
+
+		if len(paragraphs) > 0 {
+			method.Summary = strings.ToUpper(paragraphs[0][:1]) + paragraphs[0][1:]
+			method.Description = strings.Join(paragraphs[1:], "\n\n")
+		}
+	}
+
+	return method
+}
+
+/**
+*@dev collectEnum() records the constants of a block that starts a named type at iota, in order
+*/
+
+func collectEnum(decl *ast.GenDecl, enums map[string][]string) {
+	if decl.Tok != token.CONST || len(decl.Specs) == 0 {
+		return
+	}
+
+	first, ok := decl.Specs[0].(*ast.ValueSpec)
+	if !ok || first.Type == nil || len(first.Values) != 1 {
+		return
+	}
+	typeName, ok := first.Type.(*ast.Ident)
+	if !ok {
+		return
+	}
+	if value, ok := first.Values[0].(*ast.Ident); !ok || value.Name != "iota" {
+		return
+	}
+
+	constants := []string{}
+	for _, spec := range decl.Specs {
+		for _, name := range spec.(*ast.ValueSpec).Names {
+			constants = append(constants, name.Name)
+		}
+	}
+	enums[typeName.Name] = constants
+}
+
+func fieldEnum(expr ast.Expr, enums map[string][]string) string {
+	if ident, ok := expr.(*ast.Ident); ok && enums[ident.Name] != nil {
+		return ident.Name
+	}
+	return ""
+}
+
+func jsonFieldName(field *ast.Field) string {
+	if field.Tag != nil {
+		tag := reflect.StructTag(strings.Trim(field.Tag.Value, "`")).Get("json")
+		name := strings.Split(tag, ",")[0]
+		if name != "" {
+			return name
+		}
+	}
+	return field.Names[0].Name
+}
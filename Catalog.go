@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+/**
+*@dev CatalogOption() represents a configurable option of a catalog item and the values it may take
+*/
+
+type CatalogOption struct {
+	Name   string   `json:"name"`
+	Values []string `json:"values"`
+}
+
+/**
+*@dev CatalogItem() represents a catalog entry that ships in one or more variants
+*/
+
+type CatalogItem struct {
+	ID          string          `json:"id"`
+	Name        string          `json:"name"`
+	Owner       string          `json:"owner"`
+	Options     []CatalogOption `json:"options"`
+	Ingredients []Ingredient    `json:"ingredients,omitempty" metadata:",optional"`
+}
+
+/**
+*@dev ProductVariant() represents one allowed combination of a catalog item's options
+*/
+
+type ProductVariant struct {
+	ID            string            `json:"id"`
+	CatalogItemID string            `json:"catalogItemId"`
+	Attributes    map[string]string `json:"attributes"`
+}
+
+/**
+*@dev DefineCatalogItem() adds a catalog item owned by the caller's organisation with its configurable options
+*/
+
+func (c *ProductDetailsContract) DefineCatalogItem(ctx contractapi.TransactionContextInterface, catalogItemID string, name string, options []CatalogOption) error {
+	if !validCatalogID(catalogItemID) {
+		return fmt.Errorf("catalog item ID %q must be non-empty and may only contain letters, digits, dots and underscores", catalogItemID)
+	}
+
+	existingBytes, err := ctx.GetStub().GetState(fmt.Sprintf("CATALOG-%s", catalogItemID))
+	if err != nil {
+		return fmt.Errorf("failed to read catalog item from the ledger: %v", err)
+	}
+	if existingBytes != nil {
+		return fmt.Errorf("catalog item %s already exists", catalogItemID)
+	}
+
+	seen := make(map[string]bool)
+	for _, option := range options {
+		if option.Name == "" || len(option.Values) == 0 {
+			return fmt.Errorf("every option needs a name and at least one value")
+		}
+		if seen[option.Name] {
+			return fmt.Errorf("option %s is defined twice", option.Name)
+		}
+		seen[option.Name] = true
+	}
+
+	owner, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+
+	catalogItemBytes, err := json.Marshal(CatalogItem{
+		ID:      catalogItemID,
+		Name:    name,
+		Owner:   owner,
+		Options: options,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal catalog item JSON: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(fmt.Sprintf("CATALOG-%s", catalogItemID), catalogItemBytes)
+	if err != nil {
+		return fmt.Errorf("failed to put catalog item on the ledger: %v", err)
+	}
+
+	return nil
+}
+
+/**
+*@dev DefineProductVariant() adds an allowed combination of option values to a catalog item
+*/
+
+func (c *ProductDetailsContract) DefineProductVariant(ctx contractapi.TransactionContextInterface, catalogItemID string, variantID string, attributes map[string]string) error {
+	catalogItem, err := c.RetrieveCatalogItem(ctx, catalogItemID)
+	if err != nil {
+		return err
+	}
+
+	caller, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+	if caller != catalogItem.Owner {
+		return fmt.Errorf("catalog item %s is owned by %s", catalogItemID, catalogItem.Owner)
+	}
+	if !validCatalogID(variantID) {
+		return fmt.Errorf("variant ID %q must be non-empty and may only contain letters, digits, dots and underscores", variantID)
+	}
+
+	err = validateVariantAttributes(catalogItem, attributes, true)
+	if err != nil {
+		return err
+	}
+
+	variants, err := c.GetCatalogVariants(ctx, catalogItemID)
+	if err != nil {
+		return err
+	}
+	for _, variant := range variants {
+		if variant.ID == variantID {
+			return fmt.Errorf("variant %s of catalog item %s already exists", variantID, catalogItemID)
+		}
+		if variantMatches(variant, attributes) {
+			return fmt.Errorf("variant %s already has this combination of options", variant.ID)
+		}
+	}
+
+	variantBytes, err := json.Marshal(ProductVariant{
+		ID:            variantID,
+		CatalogItemID: catalogItemID,
+		Attributes:    attributes,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal product variant JSON: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(fmt.Sprintf("CATALOG-%s-VARIANT-%s", catalogItemID, variantID), variantBytes)
+	if err != nil {
+		return fmt.Errorf("failed to put product variant on the ledger: %v", err)
+	}
+
+	return nil
+}
+
+/**
+*@dev AddVariantProduct() adds a new product built as one of a catalog item's variants; only the catalog item's owner can register them
+*/
+
+func (c *ProductDetailsContract) AddVariantProduct(ctx contractapi.TransactionContextInterface, name string, description string, manufacturedDate uint64, batchNumber string, catalogItemID string, variantID string) error {
+	catalogItem, err := c.RetrieveCatalogItem(ctx, catalogItemID)
+	if err != nil {
+		return err
+	}
+
+	caller, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+	if caller != catalogItem.Owner {
+		return fmt.Errorf("catalog item %s is owned by %s", catalogItemID, catalogItem.Owner)
+	}
+
+	_, err = c.retrieveProductVariant(ctx, catalogItemID, variantID)
+	if err != nil {
+		return err
+	}
+
+	productID, err := c.addProduct(ctx, Product{
+		Name:            name,
+		Description:     description,
+		ManufactureDate: manufacturedDate,
+		BatchNumber:     batchNumber,
+		CatalogItemID:   catalogItemID,
+		VariantID:       variantID,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = ctx.GetStub().PutState(fmt.Sprintf("CATALOG-%s-PRODUCT-%020d", catalogItemID, productID), []byte(strconv.FormatUint(productID, 10)))
+	if err != nil {
+		return fmt.Errorf("failed to put catalog product index on the ledger: %v", err)
+	}
+
+	return nil
+}
+
+/**
+*@dev RetrieveCatalogItem() retrieves a catalog item
+*/
+
+func (c *ProductDetailsContract) RetrieveCatalogItem(ctx contractapi.TransactionContextInterface, catalogItemID string) (*CatalogItem, error) {
+	catalogItemBytes, err := ctx.GetStub().GetState(fmt.Sprintf("CATALOG-%s", catalogItemID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read catalog item from the ledger: %v", err)
+	}
+	if catalogItemBytes == nil {
+		return nil, fmt.Errorf("catalog item %s does not exist", catalogItemID)
+	}
+
+	catalogItem := new(CatalogItem)
+	err = json.Unmarshal(catalogItemBytes, catalogItem)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal catalog item JSON: %v", err)
+	}
+
+	return catalogItem, nil
+}
+
+/**
+*@dev GetCatalogVariants() retrieves every variant defined for a catalog item
+*/
+
+func (c *ProductDetailsContract) GetCatalogVariants(ctx contractapi.TransactionContextInterface, catalogItemID string) ([]ProductVariant, error) {
+	iterator, err := ctx.GetStub().GetStateByRange(fmt.Sprintf("CATALOG-%s-VARIANT-", catalogItemID), fmt.Sprintf("CATALOG-%s-VARIANT-~", catalogItemID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read product variants from the ledger: %v", err)
+	}
+	defer iterator.Close()
+
+	variants := []ProductVariant{}
+	for iterator.HasNext() {
+		result, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read product variant from the ledger: %v", err)
+		}
+
+		var variant ProductVariant
+		err = json.Unmarshal(result.Value, &variant)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal product variant JSON: %v", err)
+		}
+		variants = append(variants, variant)
+	}
+
+	return variants, nil
+}
+
+/**
+*@dev GetVariantProducts() retrieves the products of a catalog item whose variant has every given option value, e.g. {"firmware": "1.2"}
+*
+* Only products whose identity the caller may query are listed, and only the fields it may see of them.
+*/
+
+func (c *ProductDetailsContract) GetVariantProducts(ctx contractapi.TransactionContextInterface, catalogItemID string, attributes map[string]string) ([]*Product, error) {
+	products, err := c.variantProducts(ctx, catalogItemID, attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.authorizeListedProducts(ctx, products, "GetVariantProducts", FIELD_SET_IDENTITY), nil
+}
+
+func (c *ProductDetailsContract) variantProducts(ctx contractapi.TransactionContextInterface, catalogItemID string, attributes map[string]string) ([]*Product, error) {
+	catalogItem, err := c.RetrieveCatalogItem(ctx, catalogItemID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateVariantAttributes(catalogItem, attributes, false)
+	if err != nil {
+		return nil, err
+	}
+
+	variants, err := c.GetCatalogVariants(ctx, catalogItemID)
+	if err != nil {
+		return nil, err
+	}
+	matching := make(map[string]bool)
+	for _, variant := range variants {
+		matching[variant.ID] = variantMatches(variant, attributes)
+	}
+
+	iterator, err := ctx.GetStub().GetStateByRange(fmt.Sprintf("CATALOG-%s-PRODUCT-", catalogItemID), fmt.Sprintf("CATALOG-%s-PRODUCT-~", catalogItemID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read catalog products from the ledger: %v", err)
+	}
+	defer iterator.Close()
+
+	products := []*Product{}
+	for iterator.HasNext() {
+		result, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read catalog product from the ledger: %v", err)
+		}
+
+		productID, err := strconv.ParseUint(string(result.Value), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse catalog product ID: %v", err)
+		}
+
+		product, err := c.retrieveProductDetails(ctx, productID)
+		if err != nil {
+			return nil, err
+		}
+		if matching[product.VariantID] {
+			products = append(products, product)
+		}
+	}
+
+	return products, nil
+}
+
+/**
+*@dev validCatalogID() keeps catalog item and variant IDs free of the dash separating the parts of catalog keys, so no ID can reach into another item's index
+*/
+
+func validCatalogID(id string) bool {
+	return validTenantID(id)
+}
+
+func (c *ProductDetailsContract) retrieveProductVariant(ctx contractapi.TransactionContextInterface, catalogItemID string, variantID string) (*ProductVariant, error) {
+	variantBytes, err := ctx.GetStub().GetState(fmt.Sprintf("CATALOG-%s-VARIANT-%s", catalogItemID, variantID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read product variant from the ledger: %v", err)
+	}
+	if variantBytes == nil {
+		return nil, fmt.Errorf("variant %s of catalog item %s does not exist", variantID, catalogItemID)
+	}
+
+	variant := new(ProductVariant)
+	err = json.Unmarshal(variantBytes, variant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal product variant JSON: %v", err)
+	}
+
+	return variant, nil
+}
+
+/**
+*@dev validateVariantAttributes() checks option values against a catalog item; a complete set must name every option
+*/
+
+func validateVariantAttributes(catalogItem *CatalogItem, attributes map[string]string, complete bool) error {
+	allowed := make(map[string]map[string]bool)
+	for _, option := range catalogItem.Options {
+		allowed[option.Name] = make(map[string]bool)
+		for _, value := range option.Values {
+			allowed[option.Name][value] = true
+		}
+	}
+
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		values, ok := allowed[name]
+		if !ok {
+			return fmt.Errorf("catalog item %s has no option %s", catalogItem.ID, name)
+		}
+		if !values[attributes[name]] {
+			return fmt.Errorf("%q is not an allowed value of option %s", attributes[name], name)
+		}
+	}
+
+	if complete {
+		for _, option := range catalogItem.Options {
+			if _, ok := attributes[option.Name]; !ok {
+				return fmt.Errorf("a variant of catalog item %s must choose option %s", catalogItem.ID, option.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+func variantMatches(variant ProductVariant, attributes map[string]string) bool {
+	for name, value := range attributes {
+		if variant.Attributes[name] != value {
+			return false
+		}
+	}
+	return true
+}
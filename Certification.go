@@ -0,0 +1,507 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+/**
+*@dev CertificationStatus() represents whether a certificate still stands
+*/
+
+type CertificationStatus int
+
+const (
+	CERTIFICATION_VALID CertificationStatus = iota
+	CERTIFICATION_EXPIRED
+	CERTIFICATION_REVOKED
+	CERTIFICATION_NOT_YET_VALID
+)
+
+/**
+*@dev what a certificate can be issued to
+*/
+
+const (
+	CERTIFIED_FACILITY = "facility"
+	CERTIFIED_FARM     = "farm"
+	CERTIFIED_BATCH    = "batch"
+)
+
+/**
+*@dev Accreditation() represents the schemes a certifier organisation is accredited to certify against
+*/
+
+type Accreditation struct {
+	Certifier    string   `json:"certifier"`
+	Schemes      []string `json:"schemes"`
+	AccreditedBy string   `json:"accreditedBy"`
+	ExpiresAt    uint64   `json:"expiresAt"`
+}
+
+/**
+*@dev Certification() represents a certificate such as Organic, Fair Trade or ISO 9001 issued to a facility, farm or batch
+*
+* SubjectOrg is the organisation the facility, farm or batch belongs to. Batch numbers are only unique within an
+* organisation, so a batch certificate must name one.
+*/
+
+type Certification struct {
+	ID               string `json:"id"`
+	Scheme           string `json:"scheme"`
+	Certifier        string `json:"certifier"`
+	SubjectType      string `json:"subjectType"`
+	SubjectID        string `json:"subjectId"`
+	SubjectOrg       string `json:"subjectOrg,omitempty" metadata:",optional"`
+	Scope            string `json:"scope"`
+	ValidFrom        uint64 `json:"validFrom"`
+	ExpiresAt        uint64 `json:"expiresAt"`
+	Revoked          bool   `json:"revoked"`
+	RevokedAt        uint64 `json:"revokedAt,omitempty" metadata:",optional"`
+	RevocationReason string `json:"revocationReason,omitempty" metadata:",optional"`
+}
+
+/**
+*@dev ProductCertificationClaim() represents a product's claim to a certificate, with the certificate's status when queried
+*/
+
+type ProductCertificationClaim struct {
+	ProductID       uint64              `json:"productId"`
+	CertificationID string              `json:"certificationId"`
+	ClaimedBy       string              `json:"claimedBy"`
+	TxID            string              `json:"txId"`
+	Timestamp       uint64              `json:"timestamp"`
+	Status          CertificationStatus `json:"status"`
+	Certification   *Certification      `json:"certification,omitempty" metadata:",optional"`
+}
+
+/**
+*@dev AccreditCertifier() accredits an organisation to issue certificates for schemes; only an accreditor of an MSP trusted with the role may call it
+*/
+
+func (c *ProductDetailsContract) AccreditCertifier(ctx contractapi.TransactionContextInterface, certifier string, schemes []string, expiresAt uint64) error {
+	err := c.assertRole(ctx, ROLE_ACCREDITOR)
+	if err != nil {
+		return err
+	}
+	if certifier == "" || len(schemes) == 0 {
+		return fmt.Errorf("certifier and at least one scheme are required")
+	}
+
+	accreditedBy, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+
+	accreditationBytes, err := json.Marshal(Accreditation{
+		Certifier:    certifier,
+		Schemes:      schemes,
+		AccreditedBy: accreditedBy,
+		ExpiresAt:    expiresAt,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal accreditation JSON: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(fmt.Sprintf("ACCREDITATION-%s", certifier), accreditationBytes)
+	if err != nil {
+		return fmt.Errorf("failed to put accreditation on the ledger: %v", err)
+	}
+
+	return nil
+}
+
+/**
+*@dev IssueCertification() issues a certificate from the caller's organisation, which must hold a current accreditation for the scheme
+*
+* subjectOrg names the organisation the subject belongs to; it is required for batches and optional otherwise.
+*/
+
+func (c *ProductDetailsContract) IssueCertification(ctx contractapi.TransactionContextInterface, scheme string, subjectType string, subjectID string, subjectOrg string, scope string, validFrom uint64, expiresAt uint64) (string, error) {
+	switch subjectType {
+	case CERTIFIED_FACILITY, CERTIFIED_FARM, CERTIFIED_BATCH:
+	default:
+		return "", fmt.Errorf("unknown certification subject type %q", subjectType)
+	}
+	if subjectID == "" {
+		return "", fmt.Errorf("subject ID is required")
+	}
+	if subjectType == CERTIFIED_BATCH && subjectOrg == "" {
+		return "", fmt.Errorf("a batch certificate must name the organisation the batch belongs to")
+	}
+	if expiresAt <= validFrom {
+		return "", fmt.Errorf("certificate must expire after it becomes valid")
+	}
+
+	certifier, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return "", fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return "", fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+
+	accreditationBytes, err := ctx.GetStub().GetState(fmt.Sprintf("ACCREDITATION-%s", certifier))
+	if err != nil {
+		return "", fmt.Errorf("failed to read accreditation from the ledger: %v", err)
+	}
+	if accreditationBytes == nil {
+		return "", fmt.Errorf("%s is not an accredited certifier", certifier)
+	}
+
+	var accreditation Accreditation
+	err = json.Unmarshal(accreditationBytes, &accreditation)
+	if err != nil {
+		return "", fmt.Errorf("failed to unmarshal accreditation JSON: %v", err)
+	}
+	if uint64(timestamp.GetSeconds()) > accreditation.ExpiresAt {
+		return "", fmt.Errorf("accreditation of %s expired at %d", certifier, accreditation.ExpiresAt)
+	}
+
+	accredited := false
+	for _, accreditedScheme := range accreditation.Schemes {
+		if accreditedScheme == scheme {
+			accredited = true
+		}
+	}
+	if !accredited {
+		return "", fmt.Errorf("%s is not accredited for %s", certifier, scheme)
+	}
+
+	certification := &Certification{
+		ID:          ctx.GetStub().GetTxID(),
+		Scheme:      scheme,
+		Certifier:   certifier,
+		SubjectType: subjectType,
+		SubjectID:   subjectID,
+		SubjectOrg:  subjectOrg,
+		Scope:       scope,
+		ValidFrom:   validFrom,
+		ExpiresAt:   expiresAt,
+	}
+
+	err = c.putCertification(ctx, certification)
+	if err != nil {
+		return "", err
+	}
+
+	err = ctx.GetStub().PutState(fmt.Sprintf("CERTIFIED-%s-%s-CERTIFICATION-%s", subjectType, subjectID, certification.ID), []byte(certification.ID))
+	if err != nil {
+		return "", fmt.Errorf("failed to put certification subject index on the ledger: %v", err)
+	}
+
+	return certification.ID, nil
+}
+
+/**
+*@dev RevokeCertification() revokes a certificate; only its certifier may do so
+*/
+
+func (c *ProductDetailsContract) RevokeCertification(ctx contractapi.TransactionContextInterface, certificationID string, reason string) error {
+	certification, err := c.RetrieveCertification(ctx, certificationID)
+	if err != nil {
+		return err
+	}
+	if certification.Revoked {
+		return fmt.Errorf("certification %s has already been revoked", certificationID)
+	}
+
+	caller, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+	if caller != certification.Certifier {
+		return fmt.Errorf("only %s can revoke certification %s", certification.Certifier, certificationID)
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+
+	certification.Revoked = true
+	certification.RevokedAt = uint64(timestamp.GetSeconds())
+	certification.RevocationReason = reason
+	return c.putCertification(ctx, certification)
+}
+
+/**
+*@dev RetrieveCertification() retrieves a certificate
+*/
+
+func (c *ProductDetailsContract) RetrieveCertification(ctx contractapi.TransactionContextInterface, certificationID string) (*Certification, error) {
+	certificationBytes, err := ctx.GetStub().GetState(fmt.Sprintf("CERTIFICATION-%s", certificationID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certification from the ledger: %v", err)
+	}
+	if certificationBytes == nil {
+		return nil, fmt.Errorf("certification %s does not exist", certificationID)
+	}
+
+	certification := new(Certification)
+	err = json.Unmarshal(certificationBytes, certification)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal certification JSON: %v", err)
+	}
+
+	return certification, nil
+}
+
+/**
+*@dev GetSubjectCertifications() retrieves every certificate issued to a facility, farm or batch
+*/
+
+func (c *ProductDetailsContract) GetSubjectCertifications(ctx contractapi.TransactionContextInterface, subjectType string, subjectID string) ([]*Certification, error) {
+	iterator, err := ctx.GetStub().GetStateByRange(fmt.Sprintf("CERTIFIED-%s-%s-CERTIFICATION-", subjectType, subjectID), fmt.Sprintf("CERTIFIED-%s-%s-CERTIFICATION-~", subjectType, subjectID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read subject certifications from the ledger: %v", err)
+	}
+	defer iterator.Close()
+
+	certifications := []*Certification{}
+	for iterator.HasNext() {
+		result, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read subject certification from the ledger: %v", err)
+		}
+
+		certification, err := c.RetrieveCertification(ctx, string(result.Value))
+		if err != nil {
+			return nil, err
+		}
+		certifications = append(certifications, certification)
+	}
+
+	return certifications, nil
+}
+
+/**
+*@dev ClaimProductCertification() lets the custodian claim a certificate for a product when it covered the product's origin at manufacture
+*
+* A product originates from its registrant's batch and from the first location its registrant moved it to. A certificate
+* naming an organisation only covers products that organisation registered.
+*/
+
+func (c *ProductDetailsContract) ClaimProductCertification(ctx contractapi.TransactionContextInterface, productID uint64, certificationID string) error {
+	product, err := c.retrieveProductDetails(ctx, productID)
+	if err != nil {
+		return err
+	}
+
+	caller, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+	if product.Custodian != "" && product.Custodian != caller {
+		return fmt.Errorf("product %d is in the custody of %s", productID, product.Custodian)
+	}
+
+	certification, err := c.RetrieveCertification(ctx, certificationID)
+	if err != nil {
+		return err
+	}
+
+	status := certificationStatus(certification, product.ManufactureDate)
+	if status != CERTIFICATION_VALID {
+		return fmt.Errorf("certification %s was not valid when product %d was manufactured", certificationID, productID)
+	}
+
+	registrant, err := c.productRegistrant(ctx, productID)
+	if err != nil {
+		return err
+	}
+	if certification.SubjectOrg != "" && certification.SubjectOrg != registrant {
+		return fmt.Errorf("certification %s was issued to %s, which did not register product %d", certificationID, certification.SubjectOrg, productID)
+	}
+
+	covered := false
+	switch certification.SubjectType {
+	case CERTIFIED_BATCH:
+		// Batch certificates issued before they named an organisation cannot tell one organisation's batch from another's
+		covered = certification.SubjectOrg != "" && certification.SubjectID == product.BatchNumber
+	case CERTIFIED_FACILITY, CERTIFIED_FARM:
+		origin, err := c.productOriginLocation(ctx, productID, registrant)
+		if err != nil {
+			return err
+		}
+		covered = origin != "" && certification.SubjectID == origin
+	}
+	if !covered {
+		return fmt.Errorf("certification %s does not cover the origin of product %d", certificationID, productID)
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+
+	claimBytes, err := json.Marshal(ProductCertificationClaim{
+		ProductID:       productID,
+		CertificationID: certificationID,
+		ClaimedBy:       caller,
+		TxID:            ctx.GetStub().GetTxID(),
+		Timestamp:       uint64(timestamp.GetSeconds()),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal certification claim JSON: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(fmt.Sprintf("PRODUCT-%d-CERTIFICATION-%s", productID, certificationID), claimBytes)
+	if err != nil {
+		return fmt.Errorf("failed to put certification claim on the ledger: %v", err)
+	}
+
+	return nil
+}
+
+/**
+*@dev GetProductCertifications() retrieves a product's certification claims with each certificate's current status
+*/
+
+func (c *ProductDetailsContract) GetProductCertifications(ctx contractapi.TransactionContextInterface, productID uint64) ([]ProductCertificationClaim, error) {
+	_, _, err := c.authorizeProductQuery(ctx, productID, "GetProductCertifications", FIELD_SET_IDENTITY)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+
+	iterator, err := ctx.GetStub().GetStateByRange(fmt.Sprintf("PRODUCT-%d-CERTIFICATION-", productID), fmt.Sprintf("PRODUCT-%d-CERTIFICATION-~", productID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certification claims from the ledger: %v", err)
+	}
+	defer iterator.Close()
+
+	claims := []ProductCertificationClaim{}
+	for iterator.HasNext() {
+		result, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read certification claim from the ledger: %v", err)
+		}
+
+		var claim ProductCertificationClaim
+		err = json.Unmarshal(result.Value, &claim)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal certification claim JSON: %v", err)
+		}
+
+		claim.Certification, err = c.RetrieveCertification(ctx, claim.CertificationID)
+		if err != nil {
+			return nil, err
+		}
+		claim.Status = certificationStatus(claim.Certification, uint64(timestamp.GetSeconds()))
+		claims = append(claims, claim)
+	}
+
+	return claims, nil
+}
+
+/**
+*@dev productOriginLocation() returns where a product originates, from its latest checkpoint or from the history since
+*/
+
+func (c *ProductDetailsContract) productOriginLocation(ctx contractapi.TransactionContextInterface, productID uint64, registrant string) (string, error) {
+	checkpoint, err := c.latestHistoryCheckpoint(ctx, productID)
+	if err != nil {
+		return "", err
+	}
+	if checkpoint != nil && checkpoint.Summary.Origin != "" {
+		return checkpoint.Summary.Origin, nil
+	}
+
+	legacyHistories, err := c.retrieveLegacyProductHistory(ctx, productID)
+	if err != nil {
+		return "", err
+	}
+
+	fromSequence, custodyLeft := uint64(1), false
+	if checkpoint != nil {
+		fromSequence = checkpoint.ThroughSequence + 1
+		custodyLeft = checkpoint.Product.Custodian != registrant
+	}
+
+	events, err := c.retrieveProductEvents(ctx, productID, fromSequence)
+	if err != nil {
+		return "", err
+	}
+
+	return originLocation(registrant, legacyHistories, events, custodyLeft), nil
+}
+
+/**
+*@dev originLocation() returns the first location a product's registrant moved it to while still holding it
+*
+* Movements logged by another organisation, or after custody left the registrant, do not count, so a later holder
+* cannot choose the origin its certificates are checked against. A legacy product keeps the first location of its
+* history from before event sourcing.
+*/
+
+func originLocation(registrant string, legacyHistories []ProductHistory, events []ProductEvent, custodyLeft bool) string {
+	for _, productHistory := range effectiveHistory(legacyHistories) {
+		if productHistory.Action == HISTORY_MOVEMENT {
+			return productHistory.Location
+		}
+	}
+	if registrant == "" || custodyLeft {
+		return ""
+	}
+
+	reversed := make(map[string]bool)
+	for _, event := range events {
+		if event.Reverses != "" {
+			reversed[event.Reverses] = true
+		}
+	}
+
+	for _, event := range events {
+		if event.Reverses != "" || reversed[event.TxID] {
+			continue
+		}
+		if event.Type == HISTORY_CUSTODY_TRANSFER && event.Custodian != registrant {
+			return ""
+		}
+		if event.Type == HISTORY_MOVEMENT && event.Actor == registrant {
+			return event.Location
+		}
+	}
+
+	return ""
+}
+
+func (c *ProductDetailsContract) putCertification(ctx contractapi.TransactionContextInterface, certification *Certification) error {
+	certificationBytes, err := json.Marshal(certification)
+	if err != nil {
+		return fmt.Errorf("failed to marshal certification JSON: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(fmt.Sprintf("CERTIFICATION-%s", certification.ID), certificationBytes)
+	if err != nil {
+		return fmt.Errorf("failed to put certification on the ledger: %v", err)
+	}
+
+	return nil
+}
+
+/**
+*@dev certificationStatus() reports whether a certificate stood at a point in time; a revoked certificate no longer stands at all
+*/
+
+func certificationStatus(certification *Certification, at uint64) CertificationStatus {
+	if certification.Revoked {
+		return CERTIFICATION_REVOKED
+	}
+	if at < certification.ValidFrom {
+		return CERTIFICATION_NOT_YET_VALID
+	}
+	if at > certification.ExpiresAt {
+		return CERTIFICATION_EXPIRED
+	}
+	return CERTIFICATION_VALID
+}
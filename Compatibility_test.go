@@ -0,0 +1,652 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"Quanta-Ledger/devpeer"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// COMPAT_VOLATILE stands in for values that change on every run, such as transaction IDs and timestamps
+const COMPAT_VOLATILE = "<volatile>"
+
+// compatVolatileFields are the JSON fields replaced with COMPAT_VOLATILE before results and events are compared
+var compatVolatileFields = map[string]bool{
+	"txId":            true,
+	"transactionId":   true,
+	"timestamp":       true,
+	"firstTimestamp":  true,
+	"lastTimestamp":   true,
+	"createdAt":       true,
+	"updatedAt":       true,
+	"requestedAt":     true,
+	"respondedAt":     true,
+	"revokedAt":       true,
+	"closedAt":        true,
+	"lastServiceTxId": true,
+	"previousHash":    true,
+	"lastEntryHash":   true,
+	"root":            true,
+	"previousRoot":    true,
+}
+
+// compatRoleMSPs are the MSP IDs trusted with each role while cases are replayed, so outcomes do not depend on the environment
+var compatRoleMSPs = RoleMSPs{
+	ROLE_ADMIN:      {"Org1MSP"},
+	ROLE_ACCREDITOR: {"AccreditorMSP"},
+	ROLE_REGULATOR:  {"RegulatorMSP"},
+}
+
+/**
+*@dev compatCase() represents a query or mutation replayed against a snapshot, with the outcome recorded for it
+*
+* Cases run in order against one copy of the snapshot, so a query can check what an earlier mutation wrote.
+*/
+
+type compatCase struct {
+	Name     string           `json:"name"`
+	Identity devpeer.Identity `json:"identity"`
+	Function string           `json:"function"`
+	Args     []string         `json:"args"`
+	Submit   bool             `json:"submit,omitempty"`
+	Ignore   []string         `json:"ignore,omitempty"`
+	Result   json.RawMessage  `json:"result,omitempty"`
+	Error    string           `json:"error,omitempty"`
+	Events   []compatEvent    `json:"events,omitempty"`
+}
+
+/**
+*@dev compatEvent() represents an event a submitted case committed
+*/
+
+type compatEvent struct {
+	EventName string          `json:"eventName"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+}
+
+var (
+	compatRecord   = flag.Bool("record", false, "overwrite the recorded compatibility outcomes with the current ones")
+	compatSnapshot = flag.String("snapshot", "", "take a compatibility snapshot for this version instead of checking")
+	compatFixtures = flag.String("fixtures", "", "JSON list of transactions the snapshot is seeded with")
+)
+
+/**
+*@dev TestCompatibility() replays the recorded cases of every world state snapshot against this build of the chaincode
+*
+* Each directory under compat holds a snapshot taken with a released version (ledger.json, in the peer emulator's format)
+* and the cases run against it (cases.json). Run `go test -run TestCompatibility .` to check them, add `-record` to accept
+* the current outcomes, and `-snapshot <version> -fixtures <file>` on a release to take its snapshot.
+*/
+
+func TestCompatibility(t *testing.T) {
+	chaincode := newCompatChaincode(t)
+
+	if *compatSnapshot != "" {
+		err := takeCompatibilitySnapshot(chaincode, filepath.Join("compat", *compatSnapshot), *compatFixtures)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("took snapshot %s; add its cases and record them", *compatSnapshot)
+		return
+	}
+
+	for _, version := range compatVersions(t) {
+		t.Run(version, func(t *testing.T) {
+			mismatches, err := checkCompatibilitySnapshot(chaincode, filepath.Join("compat", version), *compatRecord)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, mismatch := range mismatches {
+				t.Error(mismatch)
+			}
+		})
+	}
+}
+
+/**
+*@dev TestCompatibilityCoversEveryTransaction() fails for each transaction no snapshot has a case for
+*/
+
+func TestCompatibilityCoversEveryTransaction(t *testing.T) {
+	peer, err := devpeer.NewPeer(newCompatChaincode(t), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadataBytes, err := peer.Evaluate(devpeer.Identity{MSPID: "compat"}, API_SPEC_SYSTEM_CONTRACT+":GetMetadata")
+	if err != nil {
+		t.Fatalf("failed to read chaincode metadata: %v", err)
+	}
+
+	var metadata chaincodeMetadata
+	err = json.Unmarshal(metadataBytes, &metadata)
+	if err != nil {
+		t.Fatalf("failed to unmarshal chaincode metadata JSON: %v", err)
+	}
+
+	covered := make(map[string]bool)
+	for _, version := range compatVersions(t) {
+		cases, err := readCompatibilityCases(filepath.Join("compat", version, "cases.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range cases {
+			covered[c.Function] = true
+		}
+	}
+
+	for contractName, contract := range metadata.Contracts {
+		if contractName == API_SPEC_SYSTEM_CONTRACT {
+			continue
+		}
+		for _, transaction := range contract.Transactions {
+			function := transaction.Name
+			if !contract.Default {
+				function = contractName + ":" + transaction.Name
+			}
+			if !covered[function] {
+				t.Errorf("no compatibility case runs %s", function)
+			}
+		}
+	}
+}
+
+func newCompatChaincode(t *testing.T) *contractapi.ContractChaincode {
+	t.Helper()
+
+	chaincode, err := newChaincode(&ProductDetailsContract{RoleMSPs: compatRoleMSPs})
+	if err != nil {
+		t.Fatalf("failed to create chaincode: %v", err)
+	}
+	return chaincode
+}
+
+// compatVersions lists the snapshot directories under compat, oldest first
+func compatVersions(t *testing.T) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir("compat")
+	if err != nil {
+		t.Fatalf("failed to read snapshot directory: %v", err)
+	}
+
+	versions := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			versions = append(versions, entry.Name())
+		}
+	}
+	if len(versions) == 0 {
+		t.Fatal("no snapshots found in compat")
+	}
+	sort.Strings(versions)
+
+	return versions
+}
+
+func readCompatibilityCases(casesFile string) ([]compatCase, error) {
+	casesBytes, err := os.ReadFile(casesFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cases: %v", err)
+	}
+
+	var cases []compatCase
+	err = json.Unmarshal(casesBytes, &cases)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal cases JSON: %v", err)
+	}
+
+	return cases, nil
+}
+
+/**
+*@dev takeCompatibilitySnapshot() seeds an empty ledger with fixture transactions and keeps it as a version's snapshot
+*/
+
+func takeCompatibilitySnapshot(chaincode *contractapi.ContractChaincode, dir string, fixturesFile string) error {
+	if fixturesFile == "" {
+		return fmt.Errorf("a snapshot needs -fixtures")
+	}
+
+	fixturesBytes, err := os.ReadFile(fixturesFile)
+	if err != nil {
+		return fmt.Errorf("failed to read fixtures: %v", err)
+	}
+
+	var fixtures []devpeer.Transaction
+	err = json.Unmarshal(fixturesBytes, &fixtures)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal fixtures JSON: %v", err)
+	}
+
+	ledgerFile := filepath.Join(dir, "ledger.json")
+	_, err = os.Stat(ledgerFile)
+	if err == nil {
+		return fmt.Errorf("snapshot %s already exists", dir)
+	}
+
+	// Seed a scratch ledger so a rejected fixture leaves no half-written snapshot behind
+	scratch, err := os.MkdirTemp("", "compat-")
+	if err != nil {
+		return fmt.Errorf("failed to create scratch directory: %v", err)
+	}
+	defer os.RemoveAll(scratch)
+
+	peer, err := devpeer.NewPeer(chaincode, filepath.Join(scratch, "ledger.json"))
+	if err != nil {
+		return err
+	}
+
+	err = peer.Seed(fixtures)
+	if err != nil {
+		return err
+	}
+
+	ledgerBytes, err := os.ReadFile(filepath.Join(scratch, "ledger.json"))
+	if err != nil {
+		return fmt.Errorf("failed to read seeded ledger: %v", err)
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot directory: %v", err)
+	}
+
+	err = os.WriteFile(ledgerFile, ledgerBytes, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot: %v", err)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "seed.json"), fixturesBytes, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot fixtures: %v", err)
+	}
+
+	return nil
+}
+
+/**
+*@dev checkCompatibilitySnapshot() runs a snapshot's cases on a scratch copy of its ledger and describes every outcome that changed
+*/
+
+func checkCompatibilitySnapshot(chaincode *contractapi.ContractChaincode, dir string, record bool) ([]string, error) {
+	casesFile := filepath.Join(dir, "cases.json")
+	cases, err := readCompatibilityCases(casesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// The peer saves every block to its state file, so it must not be handed the snapshot itself
+	ledgerBytes, err := os.ReadFile(filepath.Join(dir, "ledger.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %v", err)
+	}
+
+	scratch, err := os.MkdirTemp("", "compat-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create scratch directory: %v", err)
+	}
+	defer os.RemoveAll(scratch)
+
+	ledgerFile := filepath.Join(scratch, "ledger.json")
+	err = os.WriteFile(ledgerFile, ledgerBytes, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy snapshot: %v", err)
+	}
+
+	peer, err := devpeer.NewPeer(chaincode, ledgerFile)
+	if err != nil {
+		return nil, err
+	}
+
+	events, cancel := peer.Subscribe(peer.BlockHeight() + 1)
+	defer cancel()
+
+	replay := &compatReplay{peer: peer, events: events, payloads: make(map[string][]byte), volatileResults: make(map[string]bool)}
+	for _, c := range cases {
+		for _, arg := range c.Args {
+			for _, match := range compatReference.FindAllStringSubmatch(arg, -1) {
+				if match[2] == "" {
+					replay.volatileResults[match[1]] = true
+				}
+			}
+		}
+	}
+
+	mismatches := []string{}
+	for i, expected := range cases {
+		actual, err := replay.run(expected)
+		if err != nil {
+			return nil, fmt.Errorf("failed to run case %q: %v", expected.Name, err)
+		}
+
+		if record {
+			cases[i] = *actual
+			continue
+		}
+
+		mismatches = append(mismatches, compareCompatibilityCase(expected, *actual)...)
+	}
+
+	if record {
+		casesBytes, err := json.MarshalIndent(cases, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal cases JSON: %v", err)
+		}
+
+		err = os.WriteFile(casesFile, append(casesBytes, '\n'), 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write cases: %v", err)
+		}
+	}
+
+	return mismatches, nil
+}
+
+/**
+*@dev compatReplay() holds what the cases replayed so far against a snapshot produced, for later cases that refer to it
+*
+* An argument of the form {{case name}} stands for an earlier case's result, and {{case name/0/txId}} for the value at a
+* JSON pointer in it. Referenced values are IDs that differ on every run, so they are masked in every later outcome.
+* A reference inside a longer argument, such as a JSON document, is replaced by the value's JSON encoding instead.
+* A case whose whole result is referenced returns such an ID, so its result is masked as well.
+*/
+
+type compatReplay struct {
+	peer            *devpeer.Peer
+	events          <-chan devpeer.Event
+	payloads        map[string][]byte
+	volatileResults map[string]bool
+	referenced      []string
+}
+
+// compatReference matches a reference to an earlier case's result
+var compatReference = regexp.MustCompile(`\{\{([^/}]+)(/[^}]*)?\}\}`)
+
+/**
+*@dev run() runs one case and returns it with the outcome filled in; only a failure of the peer itself is an error
+*/
+
+func (r *compatReplay) run(c compatCase) (*compatCase, error) {
+	run := r.peer.Evaluate
+	if c.Submit {
+		run = r.peer.Submit
+	}
+
+	actual := c
+	actual.Result = nil
+	actual.Error = ""
+	actual.Events = nil
+
+	args, err := r.resolveArgs(c.Args)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := run(c.Identity, c.Function, args...)
+	if err != nil {
+		var rejection *devpeer.TransactionError
+		if !errors.As(err, &rejection) {
+			return nil, err
+		}
+		actual.Error = rejection.Message
+		for _, value := range r.referenced {
+			actual.Error = strings.ReplaceAll(actual.Error, value, COMPAT_VOLATILE)
+		}
+		return &actual, nil
+	}
+	r.payloads[c.Name] = payload
+	if r.volatileResults[c.Name] && !containsString(r.referenced, string(payload)) {
+		r.referenced = append(r.referenced, string(payload))
+	}
+
+	ignore := make(map[string]bool)
+	for _, field := range c.Ignore {
+		ignore[field] = true
+	}
+
+	actual.Result, err = normalizeCompatPayload(payload, ignore)
+	if err != nil {
+		return nil, err
+	}
+
+	// A rejected submission commits no block, so any event waiting now belongs to this case
+	for drained := false; c.Submit && !drained; {
+		select {
+		case event := <-r.events:
+			eventPayload, err := normalizeCompatPayload(event.Payload, ignore)
+			if err != nil {
+				return nil, err
+			}
+
+			// Transactions that create records name them after their transaction ID, which differs on every run
+			actual.Result = maskCompatValue(actual.Result, event.TransactionID)
+			eventPayload = maskCompatValue(eventPayload, event.TransactionID)
+			for j := range actual.Events {
+				actual.Events[j].Payload = maskCompatValue(actual.Events[j].Payload, event.TransactionID)
+			}
+
+			actual.Events = append(actual.Events, compatEvent{EventName: event.EventName, Payload: eventPayload})
+		default:
+			drained = true
+		}
+	}
+
+	for _, value := range r.referenced {
+		actual.Result = maskCompatValue(actual.Result, value)
+		for j := range actual.Events {
+			actual.Events[j].Payload = maskCompatValue(actual.Events[j].Payload, value)
+		}
+	}
+
+	return &actual, nil
+}
+
+/**
+*@dev resolveArgs() replaces the references to earlier results in the arguments with the values they refer to
+*/
+
+func (r *compatReplay) resolveArgs(args []string) ([]string, error) {
+	resolved := make([]string, len(args))
+	for i, arg := range args {
+		match := compatReference.FindStringSubmatch(arg)
+		if match != nil && match[0] == arg {
+			value, err := r.reference(match[1], match[2])
+			if err != nil {
+				return nil, fmt.Errorf("argument %s: %v", arg, err)
+			}
+			text, ok := value.(string)
+			if !ok {
+				valueBytes, _ := json.Marshal(value)
+				text = string(valueBytes)
+			}
+			resolved[i] = text
+			if !containsString(r.referenced, text) {
+				r.referenced = append(r.referenced, text)
+			}
+			continue
+		}
+
+		var failure error
+		resolved[i] = compatReference.ReplaceAllStringFunc(arg, func(reference string) string {
+			match := compatReference.FindStringSubmatch(reference)
+			value, err := r.reference(match[1], match[2])
+			if err != nil {
+				failure = fmt.Errorf("argument %s: %v", arg, err)
+				return reference
+			}
+			valueBytes, _ := json.Marshal(value)
+			return string(valueBytes)
+		})
+		if failure != nil {
+			return nil, failure
+		}
+	}
+
+	return resolved, nil
+}
+
+/**
+*@dev reference() returns the result of the named earlier case, or the value at a JSON pointer in it
+*/
+
+func (r *compatReplay) reference(name string, pointer string) (interface{}, error) {
+	payload, ok := r.payloads[name]
+	if !ok {
+		return nil, fmt.Errorf("no earlier case named %s succeeded", name)
+	}
+	if pointer == "" {
+		return string(payload), nil
+	}
+
+	var document interface{}
+	err := json.Unmarshal(payload, &document)
+	if err != nil {
+		return nil, fmt.Errorf("the result of %s is not JSON: %v", name, err)
+	}
+
+	value := document
+	for _, token := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		switch current := value.(type) {
+		case map[string]interface{}:
+			field, ok := current[token]
+			if !ok {
+				return nil, fmt.Errorf("no field %s at %s", token, pointer)
+			}
+			value = field
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(current) {
+				return nil, fmt.Errorf("no element %s at %s", token, pointer)
+			}
+			value = current[index]
+		default:
+			return nil, fmt.Errorf("nothing to index with %s at %s", token, pointer)
+		}
+	}
+	return value, nil
+}
+
+/**
+*@dev compareCompatibilityCase() describes how a case's outcome differs from the recorded one
+*/
+
+func compareCompatibilityCase(expected compatCase, actual compatCase) []string {
+	mismatches := []string{}
+
+	if expected.Error != actual.Error {
+		mismatches = append(mismatches, fmt.Sprintf("%s: expected error %q, got %q", expected.Name, expected.Error, actual.Error))
+	}
+
+	if !equalCompatJSON(expected.Result, actual.Result) {
+		mismatches = append(mismatches, fmt.Sprintf("%s: expected result %s, got %s", expected.Name, compactCompatJSON(expected.Result), actual.Result))
+	}
+
+	if len(expected.Events) != len(actual.Events) {
+		mismatches = append(mismatches, fmt.Sprintf("%s: expected %d events, got %d", expected.Name, len(expected.Events), len(actual.Events)))
+		return mismatches
+	}
+	for i := range expected.Events {
+		if expected.Events[i].EventName != actual.Events[i].EventName || !equalCompatJSON(expected.Events[i].Payload, actual.Events[i].Payload) {
+			mismatches = append(mismatches, fmt.Sprintf("%s: expected event %s %s, got %s %s", expected.Name,
+				expected.Events[i].EventName, compactCompatJSON(expected.Events[i].Payload), actual.Events[i].EventName, actual.Events[i].Payload))
+		}
+	}
+
+	return mismatches
+}
+
+/**
+*@dev normalizeCompatPayload() turns a transaction payload into JSON with its volatile fields masked; a payload that is not
+* JSON, such as a plain string result, becomes a JSON string
+*/
+
+func normalizeCompatPayload(payload []byte, ignore map[string]bool) (json.RawMessage, error) {
+	if len(payload) == 0 {
+		return nil, nil
+	}
+
+	var value interface{}
+	if json.Unmarshal(payload, &value) != nil {
+		value = string(payload)
+	}
+
+	normalized, err := json.Marshal(maskCompatFields(value, ignore))
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal normalized payload JSON: %v", err)
+	}
+
+	return normalized, nil
+}
+
+func maskCompatFields(value interface{}, ignore map[string]bool) interface{} {
+	switch value := value.(type) {
+	case string:
+		// Ledger writes and archived history entries carry the records they hold as JSON text
+		var document map[string]interface{}
+		if json.Unmarshal([]byte(value), &document) != nil {
+			return value
+		}
+		documentBytes, err := json.Marshal(maskCompatFields(document, ignore))
+		if err != nil {
+			return value
+		}
+		return string(documentBytes)
+	case map[string]interface{}:
+		for field, fieldValue := range value {
+			if compatVolatileFields[field] || ignore[field] {
+				value[field] = COMPAT_VOLATILE
+				continue
+			}
+			value[field] = maskCompatFields(fieldValue, ignore)
+		}
+	case []interface{}:
+		for i := range value {
+			value[i] = maskCompatFields(value[i], ignore)
+		}
+	}
+
+	return value
+}
+
+func maskCompatValue(value json.RawMessage, volatile string) json.RawMessage {
+	if value == nil || volatile == "" {
+		return value
+	}
+	return json.RawMessage(strings.ReplaceAll(string(value), volatile, COMPAT_VOLATILE))
+}
+
+// compactCompatJSON drops the indentation recorded outcomes are written with, so a mismatch fits on one line
+func compactCompatJSON(value json.RawMessage) string {
+	var compacted bytes.Buffer
+	if json.Compact(&compacted, value) != nil {
+		return string(value)
+	}
+	return compacted.String()
+}
+
+func equalCompatJSON(expected json.RawMessage, actual json.RawMessage) bool {
+	if len(expected) == 0 || len(actual) == 0 {
+		return len(expected) == len(actual)
+	}
+
+	var expectedValue, actualValue interface{}
+	if json.Unmarshal(expected, &expectedValue) != nil || json.Unmarshal(actual, &actualValue) != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(expectedValue, actualValue)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+/**
+*@dev ReverseHistoryEntry() appends a compensating entry for a mistaken movement and restores the location the product would have without it
+*
+* Only the product's custodian or owner can reverse its entries.
+*/
+
+func (c *ProductDetailsContract) ReverseHistoryEntry(ctx contractapi.TransactionContextInterface, productID uint64, txID string, reason string) error {
+	product, err := c.retrieveProductDetails(ctx, productID)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.authorizeProductHolder(ctx, product, "reverse history entries of")
+	if err != nil {
+		return err
+	}
+
+	histories, err := c.retrieveProductHistory(ctx, productID)
+	if err != nil {
+		return err
+	}
+
+	original, err := findReversibleEntry(histories, txID)
+	if err != nil {
+		return err
+	}
+	if original.Action != HISTORY_MOVEMENT {
+		return fmt.Errorf("history entry %s is a %s; use RevertStateChange for state changes", txID, original.Action)
+	}
+
+	location, err := c.locationWithout(ctx, productID, histories, txID)
+	if err != nil {
+		return err
+	}
+
+	return c.appendProductEvent(ctx, product, ProductEvent{
+		Type:     HISTORY_MOVEMENT_REVERSAL,
+		Location: location,
+		Reverses: txID,
+		Reason:   reason,
+	})
+}
+
+/**
+*@dev locationWithout() replays every location-changing entry of a product except the one being reversed and returns where the product ends up
+*
+* Movements and handovers to a named location both move a product. Entries already reversed are skipped, as are
+* reversals, since dropping the entry they reverse is their effect. A product migrated from the legacy history list
+* takes its location from that list, in which the entry being reversed may be.
+*/
+
+func (c *ProductDetailsContract) locationWithout(ctx contractapi.TransactionContextInterface, productID uint64, histories []ProductHistory, txID string) (string, error) {
+	legacyHistories, err := c.retrieveLegacyProductHistory(ctx, productID)
+	if err != nil {
+		return "", err
+	}
+
+	start, compactedThrough, err := c.historyStart(ctx, productID)
+	if err != nil {
+		return "", err
+	}
+
+	events, err := c.retrieveProductEvents(ctx, productID, compactedThrough+1)
+	if err != nil {
+		return "", err
+	}
+
+	reversed := map[string]bool{txID: true}
+	for _, productHistory := range histories {
+		if productHistory.Reverses != "" {
+			reversed[productHistory.Reverses] = true
+		}
+	}
+
+	location := start.Location
+	for _, productHistory := range legacyHistories {
+		if productHistory.Action == HISTORY_MOVEMENT && productHistory.Reverses == "" && !reversed[productHistory.TxID] {
+			location = productHistory.Location
+		}
+	}
+
+	for _, event := range events {
+		switch {
+		case event.Type == EVENT_PRODUCT_REGISTERED && event.Product != nil && event.Reason != LEGACY_MIGRATION_REASON:
+			location = event.Product.Location
+		case event.Type == HISTORY_MOVEMENT && !reversed[event.TxID]:
+			location = event.Location
+		case event.Type == HISTORY_CUSTODY_TRANSFER && event.Relocates:
+			location = event.Location
+		}
+	}
+
+	return location, nil
+}
+
+/**
+*@dev RevertStateChange() appends a compensating entry for a mistaken state change and restores the product's prior state
+*
+* Only the product's custodian or owner can revert its state changes. Recalls are tracked unit by unit, so a change into or
+* out of PRODUCT_RECALLED cannot be reverted here.
+*/
+
+func (c *ProductDetailsContract) RevertStateChange(ctx contractapi.TransactionContextInterface, productID uint64, txID string, reason string) error {
+	product, err := c.retrieveProductDetails(ctx, productID)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.authorizeProductHolder(ctx, product, "revert state changes of")
+	if err != nil {
+		return err
+	}
+
+	histories, err := c.retrieveProductHistory(ctx, productID)
+	if err != nil {
+		return err
+	}
+
+	original, err := findReversibleEntry(histories, txID)
+	if err != nil {
+		return err
+	}
+	if original.Action != HISTORY_STATE_CHANGE {
+		return fmt.Errorf("history entry %s is a %s; use ReverseHistoryEntry for movements", txID, original.Action)
+	}
+
+	/**
+	*@dev only the latest state change can be reverted, otherwise the restored state would skip later changes
+	*/
+
+	superseded := false
+	for _, productHistory := range effectiveHistory(histories) {
+		if superseded && productHistory.Action == HISTORY_STATE_CHANGE {
+			return fmt.Errorf("state change %s has been superseded by %s", txID, productHistory.TxID)
+		}
+		if productHistory.TxID == txID {
+			superseded = true
+		}
+	}
+	if product.State != original.State {
+		return fmt.Errorf("product %d is no longer in the state set by %s", productID, txID)
+	}
+	if original.State == PRODUCT_LEASED_OUT || original.State == PRODUCT_RETURNED {
+		return fmt.Errorf("state change %s belongs to a lease and cannot be reverted", txID)
+	}
+	if original.State == PRODUCT_RECALLED || original.PreviousState == PRODUCT_RECALLED {
+		return fmt.Errorf("state change %s belongs to a recall and cannot be reverted", txID)
+	}
+	err = validStateTransition(product.State, original.PreviousState)
+	if err != nil {
+		return err
+	}
+
+	return c.appendProductEvent(ctx, product, ProductEvent{
+		Type:     HISTORY_STATE_CHANGE_REVERSAL,
+		State:    original.PreviousState,
+		Reverses: txID,
+		Reason:   reason,
+	})
+}
+
+/**
+*@dev findReversibleEntry() finds an original history entry that has not already been reversed
+*/
+
+func findReversibleEntry(productHistories []ProductHistory, txID string) (*ProductHistory, error) {
+	if txID == "" {
+		return nil, fmt.Errorf("transaction ID of the entry to reverse is required")
+	}
+
+	var original *ProductHistory
+	for i := range productHistories {
+		if productHistories[i].Reverses == txID {
+			return nil, fmt.Errorf("history entry %s has already been reversed", txID)
+		}
+		if productHistories[i].TxID == txID {
+			original = &productHistories[i]
+		}
+	}
+
+	if original == nil {
+		return nil, fmt.Errorf("history entry %s does not exist", txID)
+	}
+	if original.Reverses != "" {
+		return nil, fmt.Errorf("history entry %s is itself a reversal and cannot be reversed", txID)
+	}
+
+	return original, nil
+}
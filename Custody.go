@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+/**
+*@dev FindingSeverity() represents how serious a chain-of-custody finding is
+*/
+
+type FindingSeverity int
+
+const (
+	SEVERITY_INFO FindingSeverity = iota
+	SEVERITY_LOW
+	SEVERITY_MEDIUM
+	SEVERITY_HIGH
+)
+
+/**
+*@dev chain-of-custody finding codes
+*/
+
+const (
+	FINDING_MOVED_AFTER_SALE              = "MOVED_AFTER_SALE"
+	FINDING_MOVED_WITHOUT_HANDOVER        = "MOVED_WITHOUT_HANDOVER"
+	FINDING_STATE_CHANGED_WITHOUT_CUSTODY = "STATE_CHANGED_WITHOUT_CUSTODY"
+	FINDING_MISSING_INTERMEDIATE_FACILITY = "MISSING_INTERMEDIATE_FACILITY"
+	FINDING_TIME_ORDER_ANOMALY            = "TIME_ORDER_ANOMALY"
+	FINDING_UNKNOWN_CUSTODY               = "UNKNOWN_CUSTODY"
+)
+
+/**
+*@dev CustodyFinding() represents one gap or contradiction found in a product's records
+*/
+
+type CustodyFinding struct {
+	Severity  FindingSeverity `json:"severity"`
+	Code      string          `json:"code"`
+	TxID      string          `json:"txId,omitempty" metadata:",optional"`
+	Timestamp uint64          `json:"timestamp"`
+	Detail    string          `json:"detail"`
+}
+
+/**
+*@dev CustodyReport() represents the findings of a chain-of-custody validation
+*/
+
+type CustodyReport struct {
+	ProductID uint64           `json:"productId"`
+	Findings  []CustodyFinding `json:"findings"`
+}
+
+/**
+*@dev TransferCustody() hands a product from its current custodian to another organisation at a location, which becomes the product's location
+*
+* A product registered before custody was tracked is held by its registrant until its first handover. One registered
+* before registrants were recorded has neither, and an admin must assign its custodian with AssignLegacyCustody first.
+*/
+
+func (c *ProductDetailsContract) TransferCustody(ctx contractapi.TransactionContextInterface, productID uint64, toOrg string, location string) error {
+	product, err := c.retrieveProductDetails(ctx, productID)
+	if err != nil {
+		return err
+	}
+
+	caller, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+
+	holder := product.Custodian
+	if holder == "" {
+		holder, err = c.productRegistrant(ctx, productID)
+		if err != nil {
+			return err
+		}
+	}
+	if holder == "" {
+		return fmt.Errorf("product %d has no recorded custodian or registrant; an admin must assign its custody first", productID)
+	}
+	if holder != caller {
+		return fmt.Errorf("product %d is in the custody of %s", productID, holder)
+	}
+	if toOrg == "" || toOrg == holder {
+		return fmt.Errorf("custody must be transferred to another organisation")
+	}
+
+	return c.appendProductEvent(ctx, product, ProductEvent{
+		Type:      HISTORY_CUSTODY_TRANSFER,
+		Custodian: toOrg,
+		Location:  location,
+		Relocates: location != "",
+	})
+}
+
+/**
+*@dev AssignLegacyCustody() lets an admin name the custodian of a product recorded with neither a custodian nor a registrant
+*/
+
+func (c *ProductDetailsContract) AssignLegacyCustody(ctx contractapi.TransactionContextInterface, productID uint64, custodian string, reason string) error {
+	err := c.assertRole(ctx, ROLE_ADMIN)
+	if err != nil {
+		return err
+	}
+	if custodian == "" || reason == "" {
+		return fmt.Errorf("custodian and reason are required")
+	}
+
+	product, err := c.retrieveProductDetails(ctx, productID)
+	if err != nil {
+		return err
+	}
+
+	registrant, err := c.productRegistrant(ctx, productID)
+	if err != nil {
+		return err
+	}
+	if product.Custodian != "" || registrant != "" {
+		return fmt.Errorf("product %d already has a recorded custodian or registrant", productID)
+	}
+
+	return c.appendProductEvent(ctx, product, ProductEvent{
+		Type:      HISTORY_CUSTODY_TRANSFER,
+		Custodian: custodian,
+		Reason:    reason,
+	})
+}
+
+/**
+*@dev authorizeProductHolder() lets only a product's custodian or owner act on it and returns the caller
+*
+* Products registered before registrants and custodians were recorded have neither, so nobody can act on them this way.
+*/
+
+func (c *ProductDetailsContract) authorizeProductHolder(ctx contractapi.TransactionContextInterface, product *Product, action string) (string, error) {
+	caller, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return "", fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+
+	owner, err := c.productOwner(ctx, product)
+	if err != nil {
+		return "", err
+	}
+	if owner == "" && product.Custodian == "" {
+		return "", fmt.Errorf("product %d has no recorded custodian or owner to %s it", product.ID, action)
+	}
+	if caller != owner && caller != product.Custodian {
+		return "", fmt.Errorf("only the custodian or owner of product %d can %s it", product.ID, action)
+	}
+
+	return caller, nil
+}
+
+/**
+*@dev ValidateChainOfCustody() scans a product's history, custody transfers and state changes for gaps and contradictions
+*/
+
+func (c *ProductDetailsContract) ValidateChainOfCustody(ctx contractapi.TransactionContextInterface, productID uint64) (*CustodyReport, error) {
+	_, _, err := c.authorizeProductQuery(ctx, productID, "ValidateChainOfCustody", FIELD_SET_HISTORY)
+	if err != nil {
+		return nil, err
+	}
+
+	legacyHistories, err := c.retrieveLegacyProductHistory(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	start, compactedThrough, err := c.historyStart(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := c.retrieveProductEvents(ctx, productID, compactedThrough+1)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &CustodyReport{ProductID: productID, Findings: []CustodyFinding{}}
+	addFinding := func(severity FindingSeverity, code string, txID string, timestamp uint64, detail string, args ...interface{}) {
+		report.Findings = append(report.Findings, CustodyFinding{
+			Severity:  severity,
+			Code:      code,
+			TxID:      txID,
+			Timestamp: timestamp,
+			Detail:    fmt.Sprintf(detail, args...),
+		})
+	}
+
+	/**
+	*@dev entries logged before event sourcing carry no actor, so only ordering and sale checks apply
+	*/
+
+	var lastTimestamp uint64
+	for _, productHistory := range effectiveHistory(legacyHistories) {
+		if productHistory.Timestamp < lastTimestamp {
+			addFinding(SEVERITY_MEDIUM, FINDING_TIME_ORDER_ANOMALY, productHistory.TxID, productHistory.Timestamp, "entry at %d recorded after an entry at %d", productHistory.Timestamp, lastTimestamp)
+		} else {
+			lastTimestamp = productHistory.Timestamp
+		}
+		if productHistory.Action == HISTORY_MOVEMENT && productHistory.State == PRODUCT_SOLD {
+			addFinding(SEVERITY_HIGH, FINDING_MOVED_AFTER_SALE, productHistory.TxID, productHistory.Timestamp, "moved to %s after being sold", productHistory.Location)
+		}
+	}
+
+	reversed := make(map[string]bool)
+	for _, event := range events {
+		if event.Reverses != "" {
+			reversed[event.Reverses] = true
+		}
+	}
+
+	product := start
+	for _, event := range events {
+		previous := product
+		err = applyProductEvent(&product, event)
+		if err != nil {
+			return nil, err
+		}
+
+		// A reversed entry and its compensation cancel out and are not judged
+		if event.Reverses != "" || (reversed[event.TxID] && event.Type != EVENT_PRODUCT_REGISTERED) {
+			continue
+		}
+
+		if event.Timestamp < lastTimestamp {
+			addFinding(SEVERITY_MEDIUM, FINDING_TIME_ORDER_ANOMALY, event.TxID, event.Timestamp, "event %d at %d recorded after an event at %d", event.Sequence, event.Timestamp, lastTimestamp)
+		} else {
+			lastTimestamp = event.Timestamp
+		}
+
+		switch event.Type {
+		case EVENT_PRODUCT_REGISTERED:
+			if product.Custodian == "" {
+				addFinding(SEVERITY_INFO, FINDING_UNKNOWN_CUSTODY, event.TxID, event.Timestamp, "product was registered before custody was tracked")
+			}
+		case HISTORY_MOVEMENT:
+			if previous.State == PRODUCT_SOLD || previous.State == CONSUMPTION {
+				addFinding(SEVERITY_HIGH, FINDING_MOVED_AFTER_SALE, event.TxID, event.Timestamp, "moved from %q to %q after being sold", previous.Location, event.Location)
+			}
+			if previous.Custodian != "" && event.Actor != previous.Custodian {
+				addFinding(SEVERITY_HIGH, FINDING_MOVED_WITHOUT_HANDOVER, event.TxID, event.Timestamp, "%s moved the product from %q to %q while %s had custody", event.Actor, previous.Location, event.Location, previous.Custodian)
+			}
+		case HISTORY_STATE_CHANGE:
+			if previous.Custodian != "" && event.Actor != previous.Custodian {
+				addFinding(SEVERITY_MEDIUM, FINDING_STATE_CHANGED_WITHOUT_CUSTODY, event.TxID, event.Timestamp, "%s changed the state from %d to %d while %s had custody", event.Actor, previous.State, event.State, previous.Custodian)
+			}
+		case HISTORY_CUSTODY_TRANSFER:
+			if event.Location != "" && previous.Location != "" && event.Location != previous.Location {
+				addFinding(SEVERITY_MEDIUM, FINDING_MISSING_INTERMEDIATE_FACILITY, event.TxID, event.Timestamp, "handed to %s at %q but last recorded at %q", event.Custodian, event.Location, previous.Location)
+			}
+		}
+	}
+
+	return report, nil
+}
@@ -0,0 +1,677 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+/**
+*@dev AgreementStatus() represents where a data-sharing agreement stands between its two orgs
+*/
+
+type AgreementStatus int
+
+const (
+	AGREEMENT_PROPOSED AgreementStatus = iota
+	AGREEMENT_ACTIVE
+	AGREEMENT_TERMINATED
+)
+
+/**
+*@dev field sets an agreement can share; a product's ID is always visible
+*
+* identity: name, description, manufacture date, batch, catalog item, variant, tag and certifications
+* status: state, version and return verification
+* location: location, custodian and recall progress
+* composition: input products, ingredients and allergens
+* history: product history, events, checkpoints, disputes and chain of custody
+* telemetry: telemetry batches
+* service: service records
+*/
+
+const (
+	FIELD_SET_IDENTITY    = "identity"
+	FIELD_SET_STATUS      = "status"
+	FIELD_SET_LOCATION    = "location"
+	FIELD_SET_COMPOSITION = "composition"
+	FIELD_SET_HISTORY     = "history"
+	FIELD_SET_TELEMETRY   = "telemetry"
+	FIELD_SET_SERVICE     = "service"
+)
+
+var fieldSets = []string{
+	FIELD_SET_IDENTITY,
+	FIELD_SET_STATUS,
+	FIELD_SET_LOCATION,
+	FIELD_SET_COMPOSITION,
+	FIELD_SET_HISTORY,
+	FIELD_SET_TELEMETRY,
+	FIELD_SET_SERVICE,
+}
+
+// fieldSetFields names the JSON fields of a product each field set holds
+var fieldSetFields = map[string][]string{
+	FIELD_SET_IDENTITY:    {"name", "description", "manufactureDate", "batchNumber", "catalogItemId", "variantId", "tag"},
+	FIELD_SET_STATUS:      {"state", "version", "returnVerification"},
+	FIELD_SET_LOCATION:    {"location", "custodian"},
+	FIELD_SET_COMPOSITION: {"inputProductIds", "ingredients", "allergens"},
+}
+
+/**
+*@dev DataSharingAgreement() represents what product data an owner org lets a partner org query, and for how long
+*
+* A product is in scope if its batch is one of Batches or its catalog item is one of Categories. Agreements are kept
+* outside any tenant's namespace, so a partner in another tenant can use them with ReadSharedProduct.
+*/
+
+type DataSharingAgreement struct {
+	ID           string          `json:"id"`
+	Owner        string          `json:"owner"`
+	Partner      string          `json:"partner"`
+	Batches      []string        `json:"batches"`
+	Categories   []string        `json:"categories"`
+	FieldSets    []string        `json:"fieldSets"`
+	ValidFrom    uint64          `json:"validFrom"`
+	ValidUntil   uint64          `json:"validUntil"`
+	Status       AgreementStatus `json:"status"`
+	TerminatedBy string          `json:"terminatedBy,omitempty" metadata:",optional"`
+	TxID         string          `json:"txId"`
+	Timestamp    uint64          `json:"timestamp"`
+}
+
+/**
+*@dev PRODUCT_ACCESS_LIFETIME is how many seconds a logged access lets its accessor run the query it names
+*/
+
+const PRODUCT_ACCESS_LIFETIME = 3600
+
+/**
+*@dev ProductAccess() represents a logged query: a partner's under data-sharing agreements, with the agreements that allowed it, or a regulated query with its purpose
+*/
+
+type ProductAccess struct {
+	ProductID   uint64   `json:"productId"`
+	Accessor    string   `json:"accessor"`
+	Transaction string   `json:"transaction"`
+	Purpose     string   `json:"purpose,omitempty" metadata:",optional"`
+	Agreements  []string `json:"agreements"`
+	FieldSets   []string `json:"fieldSets"`
+	TxID        string   `json:"txId"`
+	Timestamp   uint64   `json:"timestamp"`
+}
+
+/**
+*@dev ProposeDataSharingAgreement() offers a partner org access to the caller's product data; the partner must accept it before it applies
+*/
+
+func (c *ProductDetailsContract) ProposeDataSharingAgreement(ctx contractapi.TransactionContextInterface, agreementID string, partner string, batches []string, categories []string, sharedFieldSets []string, validFrom uint64, validUntil uint64) error {
+	if agreementID == "" {
+		return fmt.Errorf("agreement ID is required")
+	}
+
+	owner, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+	if partner == "" || partner == owner {
+		return fmt.Errorf("partner must be another organisation")
+	}
+	if len(batches) == 0 && len(categories) == 0 {
+		return fmt.Errorf("an agreement must cover at least one batch or category")
+	}
+	if len(sharedFieldSets) == 0 {
+		return fmt.Errorf("an agreement must share at least one field set")
+	}
+	for _, fieldSet := range sharedFieldSets {
+		if !containsString(fieldSets, fieldSet) {
+			return fmt.Errorf("unknown field set %s", fieldSet)
+		}
+	}
+	if validUntil <= validFrom {
+		return fmt.Errorf("agreement must end after it starts")
+	}
+
+	existing, err := c.lookupAgreement(ctx, agreementID)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("agreement %s already exists", agreementID)
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+
+	err = c.putAgreement(ctx, &DataSharingAgreement{
+		ID:         agreementID,
+		Owner:      owner,
+		Partner:    partner,
+		Batches:    batches,
+		Categories: categories,
+		FieldSets:  sharedFieldSets,
+		ValidFrom:  validFrom,
+		ValidUntil: validUntil,
+		Status:     AGREEMENT_PROPOSED,
+		TxID:       ctx.GetStub().GetTxID(),
+		Timestamp:  uint64(timestamp.Seconds),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = sharedStub(ctx).PutState(fmt.Sprintf("PARTNER-%s-AGREEMENT-%s", partner, agreementID), []byte(agreementID))
+	if err != nil {
+		return fmt.Errorf("failed to put partner agreement index on the ledger: %v", err)
+	}
+
+	return nil
+}
+
+/**
+*@dev AcceptDataSharingAgreement() lets the partner named in a proposed agreement put it into effect
+*/
+
+func (c *ProductDetailsContract) AcceptDataSharingAgreement(ctx contractapi.TransactionContextInterface, agreementID string) error {
+	agreement, err := c.GetDataSharingAgreement(ctx, agreementID)
+	if err != nil {
+		return err
+	}
+
+	caller, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+	if caller != agreement.Partner {
+		return fmt.Errorf("only %s can accept agreement %s", agreement.Partner, agreementID)
+	}
+	if agreement.Status != AGREEMENT_PROPOSED {
+		return fmt.Errorf("agreement %s is not awaiting acceptance", agreementID)
+	}
+
+	return c.updateAgreementStatus(ctx, agreement, AGREEMENT_ACTIVE)
+}
+
+/**
+*@dev TerminateDataSharingAgreement() ends an agreement early; either org can terminate it
+*/
+
+func (c *ProductDetailsContract) TerminateDataSharingAgreement(ctx contractapi.TransactionContextInterface, agreementID string) error {
+	agreement, err := c.GetDataSharingAgreement(ctx, agreementID)
+	if err != nil {
+		return err
+	}
+	if agreement.Status == AGREEMENT_TERMINATED {
+		return fmt.Errorf("agreement %s is already terminated", agreementID)
+	}
+
+	agreement.TerminatedBy, err = ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+
+	return c.updateAgreementStatus(ctx, agreement, AGREEMENT_TERMINATED)
+}
+
+/**
+*@dev GetDataSharingAgreement() retrieves an agreement; only its two orgs can read it
+*/
+
+func (c *ProductDetailsContract) GetDataSharingAgreement(ctx contractapi.TransactionContextInterface, agreementID string) (*DataSharingAgreement, error) {
+	agreement, err := c.retrieveAgreement(ctx, agreementID)
+	if err != nil {
+		return nil, err
+	}
+
+	caller, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+	if caller != agreement.Owner && caller != agreement.Partner {
+		return nil, fmt.Errorf("agreement %s is between %s and %s", agreementID, agreement.Owner, agreement.Partner)
+	}
+
+	return agreement, nil
+}
+
+/**
+*@dev LogProductAccess() logs a query the caller is about to run on a product, which the query needs unless the caller is the product's owner or custodian
+*
+* Queries are evaluated, so nothing they write is committed; submit this first instead. transaction names the query,
+* and purpose is required for the regulated ones. The logged access lets the caller run that query on the product for
+* PRODUCT_ACCESS_LIFETIME seconds, seeing no more than the field sets shared when it was logged, and is published in a
+* ProductAccessed event.
+*/
+
+func (c *ProductDetailsContract) LogProductAccess(ctx contractapi.TransactionContextInterface, productID uint64, transaction string, purpose string) (*ProductAccess, error) {
+	return c.logProductAccess(ctx, productID, transaction, purpose)
+}
+
+/**
+*@dev authorizeProductQuery() lets the product's owner and custodian query it freely, and anyone else only under an agreement and with the access logged
+*
+* For a partner it returns the field sets both its agreements and its logged access share; required names the field
+* set the query needs, or "" if any will do. A nil list means the caller sees everything.
+*/
+
+func (c *ProductDetailsContract) authorizeProductQuery(ctx contractapi.TransactionContextInterface, productID uint64, transaction string, required string) (*Product, []string, error) {
+	product, access, restricted, err := c.productQueryAccess(ctx, productID, transaction, required, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !restricted {
+		return product, nil, nil
+	}
+
+	err = c.assertProductAccessLogged(ctx, access, required)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return product, access.FieldSets, nil
+}
+
+/**
+*@dev authorizeListedProducts() keeps the products a listing query may show the caller, each filtered to the fields it may see
+*
+* Products the caller may not query are left out rather than failing the listing.
+*/
+
+func (c *ProductDetailsContract) authorizeListedProducts(ctx contractapi.TransactionContextInterface, products []*Product, transaction string, required string) []*Product {
+	listed := []*Product{}
+	for _, product := range products {
+		_, sharedFieldSets, err := c.authorizeProductQuery(ctx, product.ID, transaction, required)
+		if err != nil {
+			continue
+		}
+		if sharedFieldSets != nil {
+			product = filterProductFields(product, sharedFieldSets)
+		}
+		listed = append(listed, product)
+	}
+	return listed
+}
+
+/**
+*@dev productQueryAccess() works out what the caller may see of a product and describes the access for the log
+*
+* restricted is false when the caller sees everything: as the product's owner or custodian, or, when regulators is set,
+* as a regulator in an MSP trusted with the role. Anyone else is restricted to the field sets of their active agreements
+* covering the product.
+*/
+
+func (c *ProductDetailsContract) productQueryAccess(ctx contractapi.TransactionContextInterface, productID uint64, transaction string, required string, regulators bool) (*Product, *ProductAccess, bool, error) {
+	product, err := c.retrieveProductDetails(ctx, productID)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	caller, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+	now := uint64(timestamp.Seconds)
+
+	access := &ProductAccess{
+		ProductID:   productID,
+		Accessor:    caller,
+		Transaction: transaction,
+		Agreements:  []string{},
+		FieldSets:   []string{},
+		TxID:        ctx.GetStub().GetTxID(),
+		Timestamp:   now,
+	}
+
+	owner, err := c.productOwner(ctx, product)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	// Products registered before registrants and custodians were recorded have no owner to share them, so they stay open
+	fullAccess := owner == "" || caller == owner || caller == product.Custodian
+	if !fullAccess && regulators {
+		fullAccess = c.hasRole(ctx, ROLE_REGULATOR)
+	}
+	if fullAccess {
+		access.FieldSets = append(access.FieldSets, fieldSets...)
+		return product, access, false, nil
+	}
+
+	agreementIDs, err := partnerAgreementIDs(ctx, caller)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	shared := make(map[string]bool)
+	for _, agreementID := range agreementIDs {
+		agreement, err := c.retrieveAgreement(ctx, agreementID)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if agreement.Partner != caller || agreement.Owner != owner || agreement.Status != AGREEMENT_ACTIVE || now < agreement.ValidFrom || now >= agreement.ValidUntil {
+			continue
+		}
+		if !containsString(agreement.Batches, product.BatchNumber) && (product.CatalogItemID == "" || !containsString(agreement.Categories, product.CatalogItemID)) {
+			continue
+		}
+		if required != "" && !containsString(agreement.FieldSets, required) {
+			continue
+		}
+
+		access.Agreements = append(access.Agreements, agreement.ID)
+		for _, fieldSet := range agreement.FieldSets {
+			shared[fieldSet] = true
+		}
+	}
+
+	if len(access.Agreements) == 0 {
+		if required != "" {
+			return nil, nil, false, fmt.Errorf("no data-sharing agreement with %s shares the %s of product %d with %s", owner, required, productID, caller)
+		}
+		return nil, nil, false, fmt.Errorf("no data-sharing agreement with %s covers product %d for %s", owner, productID, caller)
+	}
+
+	for _, fieldSet := range fieldSets {
+		if shared[fieldSet] {
+			access.FieldSets = append(access.FieldSets, fieldSet)
+		}
+	}
+
+	return product, access, true, nil
+}
+
+/**
+*@dev hasFullProductAccess() reports whether the caller may see every field of a product without an agreement
+*/
+
+func (c *ProductDetailsContract) hasFullProductAccess(ctx contractapi.TransactionContextInterface, productID uint64) bool {
+	_, _, restricted, err := c.productQueryAccess(ctx, productID, "", "", false)
+	return err == nil && !restricted
+}
+
+/**
+*@dev productOwner() returns the org that registered a product; products registered before event sourcing have no recorded registrant, so their custodian stands in
+*/
+
+func (c *ProductDetailsContract) productOwner(ctx contractapi.TransactionContextInterface, product *Product) (string, error) {
+	owner, err := c.productRegistrant(ctx, product.ID)
+	if err != nil {
+		return "", err
+	}
+	if owner == "" {
+		return product.Custodian, nil
+	}
+
+	return owner, nil
+}
+
+/**
+*@dev logProductAccess() logs the caller's access to a product for a query and keeps it where the query can find it
+*/
+
+func (c *ProductDetailsContract) logProductAccess(ctx contractapi.TransactionContextInterface, productID uint64, transaction string, purpose string) (*ProductAccess, error) {
+	if transaction == "" {
+		return nil, fmt.Errorf("the query to be run is required")
+	}
+
+	_, access, _, err := c.productQueryAccess(ctx, productID, transaction, "", purpose != "")
+	if err != nil {
+		return nil, err
+	}
+	access.Purpose = purpose
+
+	accessBytes, err := json.Marshal(access)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal product access JSON: %v", err)
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+
+	// Keying the log by the full transaction time keeps accesses logged within the same second in order
+	err = ctx.GetStub().PutState(fmt.Sprintf("PRODUCT-%d-ACCESS-%010d%09d-%s", productID, timestamp.Seconds, timestamp.Nanos, access.TxID), accessBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to put product access on the ledger: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(productAccessPassKey(productID, access.Accessor, transaction), accessBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to put product access on the ledger: %v", err)
+	}
+
+	err = ctx.GetStub().SetEvent("ProductAccessed", accessBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set product access event: %v", err)
+	}
+
+	return access, nil
+}
+
+/**
+*@dev assertProductAccessLogged() checks that the caller logged an access for a query that has not expired, and narrows the access to the field sets it logged
+*/
+
+func (c *ProductDetailsContract) assertProductAccessLogged(ctx contractapi.TransactionContextInterface, access *ProductAccess, required string) error {
+	loggedBytes, err := ctx.GetStub().GetState(productAccessPassKey(access.ProductID, access.Accessor, access.Transaction))
+	if err != nil {
+		return fmt.Errorf("failed to read product access from the ledger: %v", err)
+	}
+	if loggedBytes == nil {
+		return fmt.Errorf("%s has not logged access to product %d for %s; submit LogProductAccess first", access.Accessor, access.ProductID, access.Transaction)
+	}
+
+	var logged ProductAccess
+	err = json.Unmarshal(loggedBytes, &logged)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal product access JSON: %v", err)
+	}
+	if access.Timestamp >= logged.Timestamp+PRODUCT_ACCESS_LIFETIME {
+		return fmt.Errorf("the access %s logged to product %d for %s has expired; submit LogProductAccess again", access.Accessor, access.ProductID, access.Transaction)
+	}
+	if logged.Purpose != access.Purpose {
+		return fmt.Errorf("%s logged access to product %d for %s with purpose %q, not %q", access.Accessor, access.ProductID, access.Transaction, logged.Purpose, access.Purpose)
+	}
+
+	narrowed := []string{}
+	for _, fieldSet := range access.FieldSets {
+		if containsString(logged.FieldSets, fieldSet) {
+			narrowed = append(narrowed, fieldSet)
+		}
+	}
+	if required != "" && !containsString(narrowed, required) {
+		return fmt.Errorf("the access %s logged to product %d for %s does not cover its %s; submit LogProductAccess again", access.Accessor, access.ProductID, access.Transaction, required)
+	}
+	access.FieldSets = narrowed
+
+	return nil
+}
+
+// A logged access is also kept outside the access log's key range, under a key the query can look up
+func productAccessPassKey(productID uint64, accessor string, transaction string) string {
+	return fmt.Sprintf("PRODUCT-%d-ACCESSPASS-%s-%s", productID, accessor, transaction)
+}
+
+/**
+*@dev filterProductFields() returns a copy of a product holding only its ID and the fields in the given field sets
+*/
+
+func filterProductFields(product *Product, sharedFieldSets []string) *Product {
+	filtered := &Product{ID: product.ID}
+	for _, fieldSet := range sharedFieldSets {
+		switch fieldSet {
+		case FIELD_SET_IDENTITY:
+			filtered.Name = product.Name
+			filtered.Description = product.Description
+			filtered.ManufactureDate = product.ManufactureDate
+			filtered.BatchNumber = product.BatchNumber
+			filtered.CatalogItemID = product.CatalogItemID
+			filtered.VariantID = product.VariantID
+			filtered.Tag = product.Tag
+		case FIELD_SET_STATUS:
+			filtered.State = product.State
+			filtered.Version = product.Version
+			filtered.ReturnVerification = product.ReturnVerification
+		case FIELD_SET_LOCATION:
+			filtered.Location = product.Location
+			filtered.Custodian = product.Custodian
+		case FIELD_SET_COMPOSITION:
+			filtered.InputProductIDs = product.InputProductIDs
+			filtered.Ingredients = product.Ingredients
+			filtered.Allergens = product.Allergens
+		}
+	}
+
+	filtered.withheld = []string{}
+	for _, fieldSet := range fieldSets {
+		if !containsString(sharedFieldSets, fieldSet) {
+			filtered.withheld = append(filtered.withheld, fieldSetFields[fieldSet]...)
+		}
+	}
+	return filtered
+}
+
+/**
+*@dev MarshalJSON() leaves out the fields a filtered product withholds, so a partner cannot mistake a withheld state for PRODUCT_REGISTERED
+*/
+
+func (p Product) MarshalJSON() ([]byte, error) {
+	type product Product
+	productBytes, err := json.Marshal(product(p))
+	if err != nil || len(p.withheld) == 0 {
+		return productBytes, err
+	}
+
+	fields := make(map[string]json.RawMessage)
+	err = json.Unmarshal(productBytes, &fields)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range p.withheld {
+		delete(fields, field)
+	}
+	return json.Marshal(fields)
+}
+
+func (c *ProductDetailsContract) updateAgreementStatus(ctx contractapi.TransactionContextInterface, agreement *DataSharingAgreement, status AgreementStatus) error {
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+
+	agreement.Status = status
+	agreement.TxID = ctx.GetStub().GetTxID()
+	agreement.Timestamp = uint64(timestamp.Seconds)
+	return c.putAgreement(ctx, agreement)
+}
+
+func (c *ProductDetailsContract) retrieveAgreement(ctx contractapi.TransactionContextInterface, agreementID string) (*DataSharingAgreement, error) {
+	agreement, err := c.lookupAgreement(ctx, agreementID)
+	if err != nil {
+		return nil, err
+	}
+	if agreement == nil {
+		return nil, fmt.Errorf("agreement %s does not exist", agreementID)
+	}
+
+	return agreement, nil
+}
+
+/**
+*@dev lookupAgreement() reads an agreement, or returns nil if there is none
+*
+* Agreements proposed from within a tenant before they were kept outside tenant namespaces are still found there.
+*/
+
+func (c *ProductDetailsContract) lookupAgreement(ctx contractapi.TransactionContextInterface, agreementID string) (*DataSharingAgreement, error) {
+	for _, stub := range agreementStubs(ctx) {
+		agreementBytes, err := stub.GetState(fmt.Sprintf("AGREEMENT-%s", agreementID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read agreement from the ledger: %v", err)
+		}
+		if agreementBytes == nil {
+			continue
+		}
+
+		agreement := new(DataSharingAgreement)
+		err = json.Unmarshal(agreementBytes, agreement)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal agreement JSON: %v", err)
+		}
+		return agreement, nil
+	}
+
+	return nil, nil
+}
+
+/**
+*@dev partnerAgreementIDs() lists the agreements naming an org as partner
+*/
+
+func partnerAgreementIDs(ctx contractapi.TransactionContextInterface, partner string) ([]string, error) {
+	agreementIDs := []string{}
+	for _, stub := range agreementStubs(ctx) {
+		iterator, err := stub.GetStateByRange(fmt.Sprintf("PARTNER-%s-AGREEMENT-", partner), fmt.Sprintf("PARTNER-%s-AGREEMENT-~", partner))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read partner agreements from the ledger: %v", err)
+		}
+
+		for iterator.HasNext() {
+			result, err := iterator.Next()
+			if err != nil {
+				iterator.Close()
+				return nil, fmt.Errorf("failed to read partner agreement from the ledger: %v", err)
+			}
+			if !containsString(agreementIDs, string(result.Value)) {
+				agreementIDs = append(agreementIDs, string(result.Value))
+			}
+		}
+		iterator.Close()
+	}
+
+	return agreementIDs, nil
+}
+
+/**
+*@dev agreementStubs() returns the stub agreements are kept in, followed by the tenant's own stub when the transaction works in a tenant
+*/
+
+func agreementStubs(ctx contractapi.TransactionContextInterface) []shim.ChaincodeStubInterface {
+	stub := sharedStub(ctx)
+	if ctx.GetStub() == stub {
+		return []shim.ChaincodeStubInterface{stub}
+	}
+	return []shim.ChaincodeStubInterface{stub, ctx.GetStub()}
+}
+
+func (c *ProductDetailsContract) putAgreement(ctx contractapi.TransactionContextInterface, agreement *DataSharingAgreement) error {
+	agreementBytes, err := json.Marshal(agreement)
+	if err != nil {
+		return fmt.Errorf("failed to marshal agreement JSON: %v", err)
+	}
+
+	err = sharedStub(ctx).PutState(fmt.Sprintf("AGREEMENT-%s", agreement.ID), agreementBytes)
+	if err != nil {
+		return fmt.Errorf("failed to put agreement on the ledger: %v", err)
+	}
+
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
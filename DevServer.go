@@ -0,0 +1,89 @@
+//go:build devserver
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+
+	"Quanta-Ledger/devpeer"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+func init() {
+	devCommands["devserver"] = runDevServer
+}
+
+/**
+*@dev runDevServer() hosts the chaincode in-process behind a local peer emulator so client apps can be developed without a Fabric network
+*
+* It is only built with the devserver tag, which keeps the emulator and its servers out of the chaincode deployed to peers.
+* Run it with `go run -tags devserver . devserver -state ledger.json -fixtures fixtures.json`.
+*/
+
+func runDevServer(chaincode *contractapi.ContractChaincode, args []string) error {
+	flags := flag.NewFlagSet("devserver", flag.ExitOnError)
+	addr := flags.String("addr", "localhost:7080", "address to serve the peer emulator's HTTP API on")
+	gatewayAddr := flags.String("gateway-addr", "localhost:7051", "address to serve the Fabric Gateway gRPC service on; empty disables it")
+	stateFile := flags.String("state", "devpeer-ledger.json", "file the world state is persisted to; empty keeps it in memory")
+	fixturesFile := flags.String("fixtures", "", "JSON list of transactions submitted when the ledger is empty")
+	reset := flags.Bool("reset", false, "empty the persisted ledger before serving")
+	flags.Parse(args)
+
+	peer, err := devpeer.NewPeer(chaincode, *stateFile)
+	if err != nil {
+		return err
+	}
+
+	if *reset {
+		err = peer.Reset()
+		if err != nil {
+			return err
+		}
+	}
+
+	if *fixturesFile != "" && peer.BlockHeight() == 0 {
+		fixturesBytes, err := os.ReadFile(*fixturesFile)
+		if err != nil {
+			return fmt.Errorf("failed to read fixtures: %v", err)
+		}
+
+		var fixtures []devpeer.Transaction
+		err = json.Unmarshal(fixturesBytes, &fixtures)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal fixtures JSON: %v", err)
+		}
+
+		err = peer.Seed(fixtures)
+		if err != nil {
+			return err
+		}
+		log.Printf("seeded %d fixture transactions", len(fixtures))
+	}
+
+	served := make(chan error, 2)
+	if *gatewayAddr != "" {
+		listener, err := net.Listen("tcp", *gatewayAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen for gateway connections: %v", err)
+		}
+
+		log.Printf("gateway listening on %s", *gatewayAddr)
+		go func() {
+			served <- devpeer.NewGatewayServer(peer).Serve(listener)
+		}()
+	}
+
+	log.Printf("peer emulator listening on %s at block height %d", *addr, peer.BlockHeight())
+	go func() {
+		served <- http.ListenAndServe(*addr, devpeer.NewServer(peer))
+	}()
+
+	return <-served
+}
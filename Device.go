@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+/**
+*@dev Device() represents an IoT tracker whose signed readings are accepted as telemetry
+*/
+
+type Device struct {
+	ID                string   `json:"id"`
+	OwnerOrg          string   `json:"ownerOrg"`
+	PublicKey         string   `json:"publicKey"`
+	ProductIDs        []uint64 `json:"productIds"`
+	ShipmentID        string   `json:"shipmentId,omitempty" metadata:",optional"`
+	CalibrationExpiry uint64   `json:"calibrationExpiry"`
+	Revoked           bool     `json:"revoked"`
+	RevokedAt         uint64   `json:"revokedAt,omitempty" metadata:",optional"`
+	RevocationReason  string   `json:"revocationReason,omitempty" metadata:",optional"`
+}
+
+/**
+*@dev RegisterDevice() registers a tracker with its PEM public key and calibration expiry for the caller's organisation
+*/
+
+func (c *ProductDetailsContract) RegisterDevice(ctx contractapi.TransactionContextInterface, deviceID string, publicKey string, calibrationExpiry uint64) error {
+	if !validDeviceID(deviceID) {
+		return fmt.Errorf("device ID %q must be non-empty and may only contain letters, digits, dots and underscores", deviceID)
+	}
+
+	existingBytes, err := ctx.GetStub().GetState(fmt.Sprintf("DEVICE-%s", deviceID))
+	if err != nil {
+		return fmt.Errorf("failed to read device from the ledger: %v", err)
+	}
+	if existingBytes != nil {
+		return fmt.Errorf("device %s already exists", deviceID)
+	}
+
+	_, err = parsePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+
+	owner, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+
+	return c.putDevice(ctx, &Device{
+		ID:                deviceID,
+		OwnerOrg:          owner,
+		PublicKey:         publicKey,
+		ProductIDs:        []uint64{},
+		CalibrationExpiry: calibrationExpiry,
+	})
+}
+
+/**
+*@dev BindDevice() binds a device to a product, or to the products travelling in a shipment, replacing its earlier binding
+*
+* The caller must own the device and be the custodian or owner of every product it is bound to.
+*/
+
+func (c *ProductDetailsContract) BindDevice(ctx contractapi.TransactionContextInterface, deviceID string, productIDs []uint64, shipmentID string) error {
+	device, err := c.retrieveOwnedDevice(ctx, deviceID)
+	if err != nil {
+		return err
+	}
+	if device.Revoked {
+		return fmt.Errorf("device %s has been revoked", deviceID)
+	}
+	if len(productIDs) == 0 {
+		return fmt.Errorf("a device must be bound to at least one product")
+	}
+
+	for _, productID := range productIDs {
+		product, err := c.retrieveProductDetails(ctx, productID)
+		if err != nil {
+			return err
+		}
+
+		_, err = c.authorizeProductHolder(ctx, product, "bind a device to")
+		if err != nil {
+			return err
+		}
+	}
+
+	device.ProductIDs = productIDs
+	device.ShipmentID = shipmentID
+	return c.putDevice(ctx, device)
+}
+
+/**
+*@dev UpdateDeviceCalibration() records a new calibration expiry after a device is recalibrated
+*/
+
+func (c *ProductDetailsContract) UpdateDeviceCalibration(ctx contractapi.TransactionContextInterface, deviceID string, calibrationExpiry uint64) error {
+	device, err := c.retrieveOwnedDevice(ctx, deviceID)
+	if err != nil {
+		return err
+	}
+	if device.Revoked {
+		return fmt.Errorf("device %s has been revoked", deviceID)
+	}
+
+	device.CalibrationExpiry = calibrationExpiry
+	return c.putDevice(ctx, device)
+}
+
+/**
+*@dev RevokeDevice() stops a device's readings from being accepted
+*/
+
+func (c *ProductDetailsContract) RevokeDevice(ctx contractapi.TransactionContextInterface, deviceID string, reason string) error {
+	device, err := c.retrieveOwnedDevice(ctx, deviceID)
+	if err != nil {
+		return err
+	}
+	if device.Revoked {
+		return fmt.Errorf("device %s has already been revoked", deviceID)
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+
+	device.Revoked = true
+	device.RevokedAt = uint64(timestamp.GetSeconds())
+	device.RevocationReason = reason
+	return c.putDevice(ctx, device)
+}
+
+/**
+*@dev RetrieveDevice() retrieves a device
+*/
+
+func (c *ProductDetailsContract) RetrieveDevice(ctx contractapi.TransactionContextInterface, deviceID string) (*Device, error) {
+	deviceBytes, err := ctx.GetStub().GetState(fmt.Sprintf("DEVICE-%s", deviceID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read device from the ledger: %v", err)
+	}
+	if deviceBytes == nil {
+		return nil, fmt.Errorf("device %s does not exist", deviceID)
+	}
+
+	device := new(Device)
+	err = json.Unmarshal(deviceBytes, device)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal device JSON: %v", err)
+	}
+
+	return device, nil
+}
+
+/**
+*@dev retrieveOwnedDevice() retrieves a device the caller's organisation owns
+*/
+
+func (c *ProductDetailsContract) retrieveOwnedDevice(ctx contractapi.TransactionContextInterface, deviceID string) (*Device, error) {
+	device, err := c.RetrieveDevice(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	caller, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+	if caller != device.OwnerOrg {
+		return nil, fmt.Errorf("device %s is owned by %s", deviceID, device.OwnerOrg)
+	}
+
+	return device, nil
+}
+
+func (c *ProductDetailsContract) putDevice(ctx contractapi.TransactionContextInterface, device *Device) error {
+	deviceBytes, err := json.Marshal(device)
+	if err != nil {
+		return fmt.Errorf("failed to marshal device JSON: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(fmt.Sprintf("DEVICE-%s", device.ID), deviceBytes)
+	if err != nil {
+		return fmt.Errorf("failed to put device on the ledger: %v", err)
+	}
+
+	return nil
+}
+
+/**
+*@dev verifyDeviceReading() checks that a reading for a product was signed by a valid device bound to it and calibrated when submitted
+*
+* Calibration is checked at the transaction's timestamp, since a device can sign any timestamp it likes.
+*/
+
+func verifyDeviceReading(device *Device, productID uint64, reading TelemetryReading, submittedAt uint64) error {
+	if device.Revoked {
+		return fmt.Errorf("device %s has been revoked", device.ID)
+	}
+	if submittedAt > device.CalibrationExpiry {
+		return fmt.Errorf("device %s calibration expired at %d, before the reading was submitted at %d", device.ID, device.CalibrationExpiry, submittedAt)
+	}
+
+	bound := false
+	for _, boundID := range device.ProductIDs {
+		if boundID == productID {
+			bound = true
+		}
+	}
+	if !bound {
+		return fmt.Errorf("device %s is not bound to product %d", device.ID, productID)
+	}
+
+	err := verifySignature(device.PublicKey, ReadingSigningPayload(reading), reading.Signature)
+	if err != nil {
+		return fmt.Errorf("reading from device %s at %d: %v", device.ID, reading.Timestamp, err)
+	}
+
+	return nil
+}
+
+/**
+*@dev validDeviceID() keeps device IDs free of the dash that separates the parts of device and reading sequence keys
+*/
+
+func validDeviceID(deviceID string) bool {
+	return validTenantID(deviceID)
+}
+
+/**
+*@dev ReadingSigningPayload() returns the bytes a device signs for a reading: deviceId|sequence|timestamp|kind|value|latitude|longitude
+*/
+
+func ReadingSigningPayload(reading TelemetryReading) []byte {
+	return []byte(reading.DeviceID + "|" +
+		strconv.FormatUint(reading.Sequence, 10) + "|" +
+		strconv.FormatUint(reading.Timestamp, 10) + "|" +
+		reading.Kind + "|" +
+		strconv.FormatFloat(reading.Value, 'f', -1, 64) + "|" +
+		strconv.FormatFloat(reading.Latitude, 'f', -1, 64) + "|" +
+		strconv.FormatFloat(reading.Longitude, 'f', -1, 64))
+}
+
+/**
+*@dev verifySignature() checks a base64 signature over a message against a PEM public key
+*
+* ECDSA keys verify the SHA-256 digest of the message; Ed25519 keys verify the message itself.
+*/
+
+func verifySignature(publicKey string, message []byte, signature string) error {
+	key, err := parsePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+
+	signatureBytes, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("signature is not base64: %v", err)
+	}
+
+	verified := false
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(message)
+		verified = ecdsa.VerifyASN1(key, digest[:], signatureBytes)
+	case ed25519.PublicKey:
+		verified = ed25519.Verify(key, message, signatureBytes)
+	}
+	if !verified {
+		return fmt.Errorf("invalid signature")
+	}
+
+	return nil
+}
+
+func parsePublicKey(publicKey string) (interface{}, error) {
+	block, _ := pem.Decode([]byte(publicKey))
+	if block == nil {
+		return nil, fmt.Errorf("public key is not PEM encoded")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %v", err)
+	}
+
+	switch key.(type) {
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("public key must be ECDSA or Ed25519")
+	}
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+/**
+*@dev DisputeStatus() represents the stage a dispute has reached
+*/
+
+type DisputeStatus int
+
+const (
+	DISPUTE_OPEN DisputeStatus = iota
+	DISPUTE_UNDER_ARBITRATION
+	DISPUTE_RESOLVED
+	DISPUTE_WITHDRAWN
+)
+
+/**
+*@dev dispute claim kinds and follow-up action types
+*/
+
+const (
+	DISPUTE_CLAIM        = "Claim"
+	DISPUTE_COUNTERCLAIM = "Counterclaim"
+
+	DISPUTE_ACTION_STATE_CHANGE  = "StateChange"
+	DISPUTE_ACTION_ESCROW_REFUND = "EscrowRefund"
+)
+
+/**
+*@dev DisputeClaim() represents a claim or counterclaim with the hashes of its off-chain evidence
+*/
+
+type DisputeClaim struct {
+	Kind           string   `json:"kind"`
+	By             string   `json:"by"`
+	Statement      string   `json:"statement"`
+	EvidenceHashes []string `json:"evidenceHashes"`
+	TxID           string   `json:"txId"`
+	Timestamp      uint64   `json:"timestamp"`
+}
+
+/**
+*@dev DisputeAction() represents a follow-up action a resolution triggers
+*
+* State changes are applied by the resolving transaction; escrow refunds are settled off this chaincode
+* and stay pending for the escrow holder to act on the DisputeResolved event.
+*/
+
+type DisputeAction struct {
+	Type        string       `json:"type"`
+	ProductID   uint64       `json:"productId,omitempty" metadata:",optional"`
+	State       ProductState `json:"state,omitempty" metadata:",optional"`
+	EscrowID    string       `json:"escrowId,omitempty" metadata:",optional"`
+	Amount      string       `json:"amount,omitempty" metadata:",optional"`
+	Beneficiary string       `json:"beneficiary,omitempty" metadata:",optional"`
+	Applied     bool         `json:"applied"`
+}
+
+/**
+*@dev DisputeResolution() represents the outcome of a dispute
+*/
+
+type DisputeResolution struct {
+	Decision   string          `json:"decision"`
+	ResolvedBy string          `json:"resolvedBy"`
+	Binding    bool            `json:"binding"`
+	Actions    []DisputeAction `json:"actions"`
+	TxID       string          `json:"txId"`
+	Timestamp  uint64          `json:"timestamp"`
+}
+
+/**
+*@dev DisputeAuditEntry() represents one transition of a dispute's state machine
+*/
+
+type DisputeAuditEntry struct {
+	Action     string        `json:"action"`
+	Actor      string        `json:"actor"`
+	FromStatus DisputeStatus `json:"fromStatus"`
+	ToStatus   DisputeStatus `json:"toStatus"`
+	TxID       string        `json:"txId"`
+	Timestamp  uint64        `json:"timestamp"`
+}
+
+/**
+*@dev Dispute() represents a disagreement between two organisations about products, a shipment or a discrepancy
+*/
+
+type Dispute struct {
+	ID            string              `json:"id"`
+	Category      string              `json:"category"`
+	ProductIDs    []uint64            `json:"productIds"`
+	ShipmentID    string              `json:"shipmentId,omitempty" metadata:",optional"`
+	DiscrepancyID string              `json:"discrepancyId,omitempty" metadata:",optional"`
+	Claimant      string              `json:"claimant"`
+	Respondent    string              `json:"respondent"`
+	Arbitrator    string              `json:"arbitrator,omitempty" metadata:",optional"`
+	NominatedBy   string              `json:"nominatedBy,omitempty" metadata:",optional"`
+	Status        DisputeStatus       `json:"status"`
+	Claims        []DisputeClaim      `json:"claims"`
+	Resolution    *DisputeResolution  `json:"resolution,omitempty" metadata:",optional"`
+	Audit         []DisputeAuditEntry `json:"audit"`
+}
+
+/**
+*@dev OpenDispute() opens a dispute against another organisation with the claimant's first claim
+*
+* Every disputed product must be in the custody of one of the parties, or owned by one if it has no custodian.
+*/
+
+func (c *ProductDetailsContract) OpenDispute(ctx contractapi.TransactionContextInterface, respondent string, category string, productIDs []uint64, shipmentID string, discrepancyID string, statement string, evidenceHashes []string) (string, error) {
+	if len(productIDs) == 0 && shipmentID == "" && discrepancyID == "" {
+		return "", fmt.Errorf("a dispute must concern at least one product, shipment or discrepancy")
+	}
+	if category == "" || statement == "" {
+		return "", fmt.Errorf("category and statement are required")
+	}
+
+	claimant, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return "", fmt.Errorf("failed to read claimant identity: %v", err)
+	}
+	if respondent == "" || respondent == claimant {
+		return "", fmt.Errorf("respondent must be another organisation")
+	}
+
+	disputed := make(map[uint64]bool)
+	for _, productID := range productIDs {
+		if disputed[productID] {
+			return "", fmt.Errorf("product %d is listed more than once", productID)
+		}
+		disputed[productID] = true
+
+		holder, err := c.disputedProductHolder(ctx, productID)
+		if err != nil {
+			return "", err
+		}
+		if holder != claimant && holder != respondent {
+			return "", fmt.Errorf("product %d is held by neither %s nor %s", productID, claimant, respondent)
+		}
+	}
+
+	dispute := &Dispute{
+		ID:            ctx.GetStub().GetTxID(),
+		Category:      category,
+		ProductIDs:    productIDs,
+		ShipmentID:    shipmentID,
+		DiscrepancyID: discrepancyID,
+		Claimant:      claimant,
+		Respondent:    respondent,
+		Status:        DISPUTE_OPEN,
+		Claims:        []DisputeClaim{},
+		Audit:         []DisputeAuditEntry{},
+	}
+	if dispute.ProductIDs == nil {
+		dispute.ProductIDs = []uint64{}
+	}
+
+	claim, err := newDisputeClaim(ctx, DISPUTE_CLAIM, claimant, statement, evidenceHashes)
+	if err != nil {
+		return "", err
+	}
+	dispute.Claims = append(dispute.Claims, *claim)
+
+	for _, productID := range productIDs {
+		err = ctx.GetStub().PutState(fmt.Sprintf("PRODUCT-%d-DISPUTE-%s", productID, dispute.ID), []byte(dispute.ID))
+		if err != nil {
+			return "", fmt.Errorf("failed to put product dispute link on the ledger: %v", err)
+		}
+	}
+
+	err = c.recordDisputeTransition(ctx, dispute, "Opened", DISPUTE_OPEN)
+	if err != nil {
+		return "", err
+	}
+
+	return dispute.ID, nil
+}
+
+/**
+*@dev AddDisputeClaim() adds a claim from the claimant or a counterclaim from the respondent
+*/
+
+func (c *ProductDetailsContract) AddDisputeClaim(ctx contractapi.TransactionContextInterface, disputeID string, statement string, evidenceHashes []string) error {
+	dispute, err := c.retrieveDispute(ctx, disputeID)
+	if err != nil {
+		return err
+	}
+	if dispute.Status != DISPUTE_OPEN && dispute.Status != DISPUTE_UNDER_ARBITRATION {
+		return fmt.Errorf("dispute %s is closed", disputeID)
+	}
+	if statement == "" {
+		return fmt.Errorf("statement is required")
+	}
+
+	caller, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+
+	kind := DISPUTE_CLAIM
+	switch caller {
+	case dispute.Claimant:
+	case dispute.Respondent:
+		kind = DISPUTE_COUNTERCLAIM
+	default:
+		return fmt.Errorf("only the parties to dispute %s can add claims", disputeID)
+	}
+
+	claim, err := newDisputeClaim(ctx, kind, caller, statement, evidenceHashes)
+	if err != nil {
+		return err
+	}
+	dispute.Claims = append(dispute.Claims, *claim)
+
+	return c.recordDisputeTransition(ctx, dispute, kind+"Added", dispute.Status)
+}
+
+/**
+*@dev EscalateDispute() nominates an arbitrator organisation for an open dispute and escalates it once both parties name the same one
+*
+* The first nomination waits for the other party; a different nomination from the other party replaces it and waits in turn.
+*/
+
+func (c *ProductDetailsContract) EscalateDispute(ctx contractapi.TransactionContextInterface, disputeID string, arbitrator string) error {
+	dispute, err := c.retrieveDispute(ctx, disputeID)
+	if err != nil {
+		return err
+	}
+	if dispute.Status != DISPUTE_OPEN {
+		return fmt.Errorf("only open disputes can be escalated")
+	}
+
+	caller, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+	if caller != dispute.Claimant && caller != dispute.Respondent {
+		return fmt.Errorf("only the parties to dispute %s can escalate it", disputeID)
+	}
+	if arbitrator == "" || arbitrator == dispute.Claimant || arbitrator == dispute.Respondent {
+		return fmt.Errorf("arbitrator must be an organisation other than the parties")
+	}
+
+	if dispute.Arbitrator == arbitrator && dispute.NominatedBy != "" && dispute.NominatedBy != caller {
+		dispute.NominatedBy = ""
+		return c.recordDisputeTransition(ctx, dispute, "Escalated", DISPUTE_UNDER_ARBITRATION)
+	}
+
+	dispute.Arbitrator = arbitrator
+	dispute.NominatedBy = caller
+	return c.recordDisputeTransition(ctx, dispute, "ArbitratorNominated", DISPUTE_OPEN)
+}
+
+/**
+*@dev ResolveDispute() resolves a dispute and applies its follow-up actions
+*
+* Under arbitration only an identity from the arbitrator organisation holding the arbitrator role can resolve,
+* and the resolution is binding. An open dispute can only be resolved by the respondent conceding; a concession
+* only changes the state of disputed products the respondent holds and only refunds the claimant.
+* Each product can take at most one state change per resolution.
+*/
+
+func (c *ProductDetailsContract) ResolveDispute(ctx contractapi.TransactionContextInterface, disputeID string, decision string, actions []DisputeAction) error {
+	dispute, err := c.retrieveDispute(ctx, disputeID)
+	if err != nil {
+		return err
+	}
+	if decision == "" {
+		return fmt.Errorf("decision is required")
+	}
+
+	caller, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+
+	binding := false
+	conceding := false
+	switch dispute.Status {
+	case DISPUTE_UNDER_ARBITRATION:
+		if caller != dispute.Arbitrator {
+			return fmt.Errorf("only arbitrator %s can resolve dispute %s", dispute.Arbitrator, disputeID)
+		}
+		err = ctx.GetClientIdentity().AssertAttributeValue("role", "arbitrator")
+		if err != nil {
+			return fmt.Errorf("submitter does not hold the arbitrator role: %v", err)
+		}
+		binding = true
+	case DISPUTE_OPEN:
+		if caller != dispute.Respondent {
+			return fmt.Errorf("an open dispute can only be resolved by the respondent conceding")
+		}
+		conceding = true
+	default:
+		return fmt.Errorf("dispute %s is closed", disputeID)
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+
+	resolution := &DisputeResolution{
+		Decision:   decision,
+		ResolvedBy: caller,
+		Binding:    binding,
+		Actions:    []DisputeAction{},
+		TxID:       ctx.GetStub().GetTxID(),
+		Timestamp:  uint64(timestamp.GetSeconds()),
+	}
+
+	changed := make(map[uint64]bool)
+	for _, action := range actions {
+		action.Applied = false
+		switch action.Type {
+		case DISPUTE_ACTION_STATE_CHANGE:
+			if !disputeCoversProduct(dispute, action.ProductID) {
+				return fmt.Errorf("product %d is not part of dispute %s", action.ProductID, disputeID)
+			}
+			if changed[action.ProductID] {
+				return fmt.Errorf("product %d has more than one state change", action.ProductID)
+			}
+			changed[action.ProductID] = true
+			if conceding {
+				holder, err := c.disputedProductHolder(ctx, action.ProductID)
+				if err != nil {
+					return err
+				}
+				if holder != dispute.Respondent {
+					return fmt.Errorf("a concession can only change the state of products %s holds, and %s holds product %d", dispute.Respondent, holder, action.ProductID)
+				}
+			}
+			err = c.applyDisputeStateChange(ctx, dispute, action)
+			if err != nil {
+				return err
+			}
+			action.Applied = true
+		case DISPUTE_ACTION_ESCROW_REFUND:
+			if action.EscrowID == "" || action.Beneficiary == "" {
+				return fmt.Errorf("escrow refunds need an escrow ID and a beneficiary")
+			}
+			if conceding && action.Beneficiary != dispute.Claimant {
+				return fmt.Errorf("a concession can only refund the claimant %s", dispute.Claimant)
+			}
+		default:
+			return fmt.Errorf("unknown dispute action %s", action.Type)
+		}
+		resolution.Actions = append(resolution.Actions, action)
+	}
+
+	dispute.Resolution = resolution
+	return c.recordDisputeTransition(ctx, dispute, "Resolved", DISPUTE_RESOLVED)
+}
+
+/**
+*@dev WithdrawDispute() lets the claimant drop a dispute that has not been resolved
+*/
+
+func (c *ProductDetailsContract) WithdrawDispute(ctx contractapi.TransactionContextInterface, disputeID string) error {
+	dispute, err := c.retrieveDispute(ctx, disputeID)
+	if err != nil {
+		return err
+	}
+	if dispute.Status != DISPUTE_OPEN && dispute.Status != DISPUTE_UNDER_ARBITRATION {
+		return fmt.Errorf("dispute %s is closed", disputeID)
+	}
+
+	caller, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+	if caller != dispute.Claimant {
+		return fmt.Errorf("only the claimant can withdraw dispute %s", disputeID)
+	}
+
+	return c.recordDisputeTransition(ctx, dispute, "Withdrawn", DISPUTE_WITHDRAWN)
+}
+
+/**
+*@dev RetrieveDispute() retrieves a dispute for its claimant, its respondent or its arbitrator
+*/
+
+func (c *ProductDetailsContract) RetrieveDispute(ctx contractapi.TransactionContextInterface, disputeID string) (*Dispute, error) {
+	dispute, err := c.retrieveDispute(ctx, disputeID)
+	if err != nil {
+		return nil, err
+	}
+
+	caller, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+	if caller != dispute.Claimant && caller != dispute.Respondent && (dispute.Arbitrator == "" || caller != dispute.Arbitrator) {
+		return nil, fmt.Errorf("only the parties to dispute %s and its arbitrator can read it", disputeID)
+	}
+
+	return dispute, nil
+}
+
+func (c *ProductDetailsContract) retrieveDispute(ctx contractapi.TransactionContextInterface, disputeID string) (*Dispute, error) {
+	disputeBytes, err := ctx.GetStub().GetState(fmt.Sprintf("DISPUTE-%s", disputeID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dispute from the ledger: %v", err)
+	}
+	if disputeBytes == nil {
+		return nil, fmt.Errorf("dispute %s does not exist", disputeID)
+	}
+
+	dispute := new(Dispute)
+	err = json.Unmarshal(disputeBytes, dispute)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal dispute JSON: %v", err)
+	}
+
+	return dispute, nil
+}
+
+/**
+*@dev GetProductDisputes() retrieves every dispute raised about a product
+*/
+
+func (c *ProductDetailsContract) GetProductDisputes(ctx contractapi.TransactionContextInterface, productID uint64) ([]*Dispute, error) {
+	_, _, err := c.authorizeProductQuery(ctx, productID, "GetProductDisputes", FIELD_SET_HISTORY)
+	if err != nil {
+		return nil, err
+	}
+
+	iterator, err := ctx.GetStub().GetStateByRange(fmt.Sprintf("PRODUCT-%d-DISPUTE-", productID), fmt.Sprintf("PRODUCT-%d-DISPUTE-~", productID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read product disputes from the ledger: %v", err)
+	}
+	defer iterator.Close()
+
+	disputes := []*Dispute{}
+	for iterator.HasNext() {
+		result, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read product dispute from the ledger: %v", err)
+		}
+
+		dispute, err := c.retrieveDispute(ctx, string(result.Value))
+		if err != nil {
+			return nil, err
+		}
+		disputes = append(disputes, dispute)
+	}
+
+	return disputes, nil
+}
+
+/**
+*@dev disputedProductHolder() returns the organisation holding a product for a dispute: its custodian, or its owner if it has none
+*/
+
+func (c *ProductDetailsContract) disputedProductHolder(ctx contractapi.TransactionContextInterface, productID uint64) (string, error) {
+	product, err := c.retrieveProductDetails(ctx, productID)
+	if err != nil {
+		return "", err
+	}
+	if product.Custodian != "" {
+		return product.Custodian, nil
+	}
+
+	return c.productOwner(ctx, product)
+}
+
+/**
+*@dev applyDisputeStateChange() moves a disputed product to the state a resolution orders
+*/
+
+func (c *ProductDetailsContract) applyDisputeStateChange(ctx contractapi.TransactionContextInterface, dispute *Dispute, action DisputeAction) error {
+	product, err := c.retrieveProductDetails(ctx, action.ProductID)
+	if err != nil {
+		return err
+	}
+	err = validStateTransition(product.State, action.State)
+	if err != nil {
+		return err
+	}
+
+	return c.appendProductEvent(ctx, product, ProductEvent{
+		Type:   HISTORY_STATE_CHANGE,
+		State:  action.State,
+		Reason: fmt.Sprintf("resolution of dispute %s", dispute.ID),
+	})
+}
+
+/**
+*@dev recordDisputeTransition() appends an audit entry, stores the dispute and emits an event named after the transition
+*/
+
+func (c *ProductDetailsContract) recordDisputeTransition(ctx contractapi.TransactionContextInterface, dispute *Dispute, action string, toStatus DisputeStatus) error {
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+
+	actor, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+
+	dispute.Audit = append(dispute.Audit, DisputeAuditEntry{
+		Action:     action,
+		Actor:      actor,
+		FromStatus: dispute.Status,
+		ToStatus:   toStatus,
+		TxID:       ctx.GetStub().GetTxID(),
+		Timestamp:  uint64(timestamp.GetSeconds()),
+	})
+	dispute.Status = toStatus
+
+	disputeBytes, err := json.Marshal(dispute)
+	if err != nil {
+		return fmt.Errorf("failed to marshal dispute JSON: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(fmt.Sprintf("DISPUTE-%s", dispute.ID), disputeBytes)
+	if err != nil {
+		return fmt.Errorf("failed to put dispute on the ledger: %v", err)
+	}
+
+	err = ctx.GetStub().SetEvent("Dispute"+action, disputeBytes)
+	if err != nil {
+		return fmt.Errorf("failed to set dispute event: %v", err)
+	}
+
+	return nil
+}
+
+func newDisputeClaim(ctx contractapi.TransactionContextInterface, kind string, by string, statement string, evidenceHashes []string) (*DisputeClaim, error) {
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+	if evidenceHashes == nil {
+		evidenceHashes = []string{}
+	}
+
+	return &DisputeClaim{
+		Kind:           kind,
+		By:             by,
+		Statement:      statement,
+		EvidenceHashes: evidenceHashes,
+		TxID:           ctx.GetStub().GetTxID(),
+		Timestamp:      uint64(timestamp.GetSeconds()),
+	}, nil
+}
+
+func disputeCoversProduct(dispute *Dispute, productID uint64) bool {
+	for _, disputedID := range dispute.ProductIDs {
+		if disputedID == productID {
+			return true
+		}
+	}
+	return false
+}
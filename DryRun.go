@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+/**
+*@dev ProposedWrite() represents a key a transaction would write, with its value before and after
+*
+* Redacted is set when the key holds data of a product the caller cannot query in full, and both values are left out.
+*/
+
+type ProposedWrite struct {
+	Key      string `json:"key"`
+	Before   string `json:"before,omitempty" metadata:",optional"`
+	After    string `json:"after,omitempty" metadata:",optional"`
+	Deleted  bool   `json:"deleted"`
+	Redacted bool   `json:"redacted,omitempty" metadata:",optional"`
+}
+
+/**
+*@dev ProposedEvent() represents an event a transaction would emit
+*
+* Redacted is set when the payload names a product the caller cannot query in full, and the payload is left out.
+*/
+
+type ProposedEvent struct {
+	Name     string `json:"name"`
+	Payload  string `json:"payload"`
+	Redacted bool   `json:"redacted,omitempty" metadata:",optional"`
+}
+
+/**
+*@dev DryRunResult() represents everything a transaction would change if it were submitted
+*/
+
+type DryRunResult struct {
+	Function string          `json:"function"`
+	Result   string          `json:"result,omitempty" metadata:",optional"`
+	Writes   []ProposedWrite `json:"writes"`
+	Events   []ProposedEvent `json:"events"`
+}
+
+/**
+*@dev dryRunStub() wraps the peer stub and records writes and events instead of passing them on
+*
+* Reads still go to the peer stub, so, as on a real submit, a transaction does not see its own writes.
+*/
+
+type dryRunStub struct {
+	shim.ChaincodeStubInterface
+	writes map[string]*ProposedWrite
+	order  []string
+	events []ProposedEvent
+}
+
+func (s *dryRunStub) record(key string, value []byte, deleted bool) error {
+	write, ok := s.writes[key]
+	if !ok {
+		before, err := s.ChaincodeStubInterface.GetState(key)
+		if err != nil {
+			return err
+		}
+		write = &ProposedWrite{Key: key, Before: string(before)}
+		s.writes[key] = write
+		s.order = append(s.order, key)
+	}
+	write.After = string(value)
+	write.Deleted = deleted
+	return nil
+}
+
+func (s *dryRunStub) PutState(key string, value []byte) error {
+	return s.record(key, value, false)
+}
+
+func (s *dryRunStub) DelState(key string) error {
+	return s.record(key, nil, true)
+}
+
+// Fabric keeps only the last event a transaction sets
+func (s *dryRunStub) SetEvent(name string, payload []byte) error {
+	s.events = []ProposedEvent{{Name: name, Payload: string(payload)}}
+	return nil
+}
+
+/**
+*@dev dryRunContext() hands the recording stub to the transaction in place of the peer stub
+*/
+
+type dryRunContext struct {
+	contractapi.TransactionContextInterface
+	stub *dryRunStub
+}
+
+func (d *dryRunContext) GetStub() shim.ChaincodeStubInterface {
+	return d.stub
+}
+
+func (d *dryRunContext) GetTenant() *Tenant {
+	return tenantOf(d.TransactionContextInterface)
+}
+
+/**
+*@dev DryRun() runs a transaction against the current world state without committing and returns the writes and events it would make
+*
+* Writes and events belonging to an existing product are only shown to callers who can query the product in full, so
+* a dry run reveals no more than a query would. Products the transaction itself registers are shown.
+*/
+
+func (c *ProductDetailsContract) DryRun(ctx contractapi.TransactionContextInterface, function string, args []string) (*DryRunResult, error) {
+	if function == "DryRun" {
+		return nil, fmt.Errorf("DryRun cannot dry-run itself")
+	}
+
+	stub := &dryRunStub{
+		ChaincodeStubInterface: ctx.GetStub(),
+		writes:                 make(map[string]*ProposedWrite),
+	}
+
+	resultJSON, err := c.callTransaction(&dryRunContext{TransactionContextInterface: ctx, stub: stub}, function, args)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &DryRunResult{
+		Function: function,
+		Result:   resultJSON,
+		Writes:   []ProposedWrite{},
+		Events:   []ProposedEvent{},
+	}
+
+	visibility := &dryRunVisibility{contract: c, ctx: ctx, namespaces: []string{""}, visible: make(map[string]bool)}
+	for _, key := range stub.order {
+		write := *stub.writes[key]
+
+		tenantID, productIDs := writeProducts(write)
+		if !visibility.productsVisible([]string{tenantID}, productIDs) {
+			write.Before, write.After, write.Redacted = "", "", true
+		}
+		if len(productIDs) > 0 && !containsString(visibility.namespaces, tenantID) {
+			visibility.namespaces = append(visibility.namespaces, tenantID)
+		}
+
+		result.Writes = append(result.Writes, write)
+	}
+
+	for _, event := range stub.events {
+		if !visibility.productsVisible(visibility.namespaces, payloadProducts(event.Payload)) {
+			event.Payload, event.Redacted = "", true
+		}
+		result.Events = append(result.Events, event)
+	}
+
+	return result, nil
+}
+
+// productKeyPattern finds the product a key belongs to: its own PRODUCT-<id> keys and the indexes naming it, e.g. CATALOG-<item>-PRODUCT-<id>
+var productKeyPattern = regexp.MustCompile(`(?:^|-)(?:PRODUCT|UNIT)-0*(\d+)(?:-|$)`)
+
+// maintenanceDuePattern matches maintenanceDueKey, which names the product after the due date
+var maintenanceDuePattern = regexp.MustCompile(`^MAINTENANCE-DUE-\d+-0*(\d+)$`)
+
+/**
+*@dev writeProducts() returns the tenant whose namespace a write is in, or "" for the caller's own, and the products it belongs to
+*
+* The products are the one the key names or, for other records such as leases and disputes, those their values name.
+* Tenant IDs contain no "-", so the TENANT-<id>- prefix of a key written into another tenant's namespace ends at the first one.
+*/
+
+func writeProducts(write ProposedWrite) (string, []uint64) {
+	tenantID, key := "", write.Key
+	if strings.HasPrefix(key, TENANT_KEY_PREFIX) {
+		rest := strings.TrimPrefix(key, TENANT_KEY_PREFIX)
+		separator := strings.Index(rest, "-")
+		if separator < 0 {
+			return "", nil
+		}
+		tenantID, key = rest[:separator], rest[separator+1:]
+	}
+
+	match := maintenanceDuePattern.FindStringSubmatch(key)
+	if match == nil {
+		match = productKeyPattern.FindStringSubmatch(key)
+	}
+	if match != nil {
+		productID, err := strconv.ParseUint(match[1], 10, 64)
+		if err == nil {
+			return tenantID, []uint64{productID}
+		}
+	}
+
+	return tenantID, append(payloadProducts(write.Before), payloadProducts(write.After)...)
+}
+
+/**
+*@dev payloadProducts() returns the products a JSON record or event names in its productId or productIds field
+*/
+
+func payloadProducts(payload string) []uint64 {
+	var record struct {
+		ProductID  *uint64  `json:"productId"`
+		ProductIDs []uint64 `json:"productIds"`
+	}
+	err := json.Unmarshal([]byte(payload), &record)
+	if err != nil {
+		return nil
+	}
+
+	productIDs := record.ProductIDs
+	if record.ProductID != nil {
+		productIDs = append(productIDs, *record.ProductID)
+	}
+	return productIDs
+}
+
+/**
+*@dev dryRunVisibility() decides, and remembers, which products' data a dry run may show the caller
+*
+* namespaces lists the tenant namespaces the transaction wrote product data in, "" being the caller's own; events do
+* not say which namespace they come from, so a product an event names is checked in each of them.
+*/
+
+type dryRunVisibility struct {
+	contract   *ProductDetailsContract
+	ctx        contractapi.TransactionContextInterface
+	namespaces []string
+	visible    map[string]bool
+}
+
+/**
+*@dev productVisible() reports whether the caller can query a product in full, or the product does not exist before the transaction
+*/
+
+func (v *dryRunVisibility) productVisible(tenantID string, productID uint64) bool {
+	cacheKey := fmt.Sprintf("%s/%d", tenantID, productID)
+	visible, ok := v.visible[cacheKey]
+	if ok {
+		return visible
+	}
+
+	visible = false
+	ctx := v.ctx
+	if tenantID != "" {
+		tenant, err := retrieveTenant(v.ctx, tenantID)
+		if err == nil && tenant != nil {
+			ctx = scopeToTenant(v.ctx, tenant, true)
+		} else {
+			ctx = nil
+		}
+	}
+	if ctx != nil {
+		snapshotBytes, err := ctx.GetStub().GetState(fmt.Sprintf("PRODUCT-%d", productID))
+		visible = err == nil && (snapshotBytes == nil || v.contract.hasFullProductAccess(ctx, productID))
+	}
+
+	v.visible[cacheKey] = visible
+	return visible
+}
+
+/**
+*@dev productsVisible() reports whether the caller may see each of the products in each of the tenant namespaces
+*/
+
+func (v *dryRunVisibility) productsVisible(tenantIDs []string, productIDs []uint64) bool {
+	for _, productID := range productIDs {
+		for _, tenantID := range tenantIDs {
+			if !v.productVisible(tenantID, productID) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+/**
+*@dev callTransaction() runs a transaction by name with JSON-encoded arguments in the given context and returns its result as JSON, or "" if it has none
+*/
+
+func (c *ProductDetailsContract) callTransaction(ctx contractapi.TransactionContextInterface, function string, args []string) (string, error) {
+	method := reflect.ValueOf(c).MethodByName(function)
+	if !method.IsValid() {
+		return "", fmt.Errorf("transaction %s does not exist", function)
+	}
+
+	methodType := method.Type()
+	contextType := reflect.TypeOf((*contractapi.TransactionContextInterface)(nil)).Elem()
+	errorType := reflect.TypeOf((*error)(nil)).Elem()
+	if methodType.NumIn() == 0 || methodType.In(0) != contextType || methodType.NumOut() == 0 || methodType.Out(methodType.NumOut()-1) != errorType {
+		return "", fmt.Errorf("%s is not a transaction", function)
+	}
+	if methodType.NumIn()-1 != len(args) {
+		return "", fmt.Errorf("transaction %s expects %d arguments, got %d", function, methodType.NumIn()-1, len(args))
+	}
+
+	in := []reflect.Value{reflect.ValueOf(ctx)}
+	for i, arg := range args {
+		paramType := methodType.In(i + 1)
+		param := reflect.New(paramType)
+		if paramType.Kind() == reflect.String {
+			param.Elem().SetString(arg)
+		} else {
+			err := json.Unmarshal([]byte(arg), param.Interface())
+			if err != nil {
+				return "", fmt.Errorf("failed to convert argument %d of %s: %v", i+1, function, err)
+			}
+		}
+		in = append(in, param.Elem())
+	}
+
+	out := method.Call(in)
+	if err, _ := out[len(out)-1].Interface().(error); err != nil {
+		return "", err
+	}
+	if len(out) != 2 {
+		return "", nil
+	}
+
+	resultBytes, err := json.Marshal(out[0].Interface())
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal %s result JSON: %v", function, err)
+	}
+
+	return string(resultBytes), nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+/**
+*@dev privileged roles
+*
+* A role attribute can be written into a certificate by any organisation's CA, so a role is only honoured for
+* identities of the MSPs configured for it.
+*/
+
+const (
+	ROLE_ADMIN      = "admin"
+	ROLE_ACCREDITOR = "accreditor"
+	ROLE_REGULATOR  = "regulator"
+)
+
+// roleMSPVariables name the environment variables listing, comma-separated, the MSP IDs trusted with each role
+var roleMSPVariables = map[string]string{
+	ROLE_ADMIN:      "ADMIN_MSP_IDS",
+	ROLE_ACCREDITOR: "ACCREDITOR_MSP_IDS",
+	ROLE_REGULATOR:  "REGULATOR_MSP_IDS",
+}
+
+/**
+*@dev RoleMSPs() maps each privileged role to the MSP IDs trusted to hold it; every endorsing peer must be given the same map
+*/
+
+type RoleMSPs map[string][]string
+
+/**
+*@dev RoleMSPsFromEnv() reads the MSP IDs trusted with each role from the environment; an unset variable trusts nobody
+*/
+
+func RoleMSPsFromEnv() RoleMSPs {
+	roleMSPs := RoleMSPs{}
+	for role, variable := range roleMSPVariables {
+		for _, mspID := range strings.Split(os.Getenv(variable), ",") {
+			if mspID = strings.TrimSpace(mspID); mspID != "" {
+				roleMSPs[role] = append(roleMSPs[role], mspID)
+			}
+		}
+	}
+	return roleMSPs
+}
+
+/**
+*@dev assertRole() checks that the submitter holds a role attribute and belongs to an MSP trusted with that role
+*/
+
+func (c *ProductDetailsContract) assertRole(ctx contractapi.TransactionContextInterface, role string) error {
+	if !c.hasRole(ctx, role) {
+		return fmt.Errorf("submitter does not hold the %s role in an MSP trusted with it", role)
+	}
+	return nil
+}
+
+/**
+*@dev hasRole() reports whether the submitter holds a role attribute and belongs to an MSP trusted with that role
+*/
+
+func (c *ProductDetailsContract) hasRole(ctx contractapi.TransactionContextInterface, role string) bool {
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil || !containsString(c.RoleMSPs[role], mspID) {
+		return false
+	}
+	return ctx.GetClientIdentity().AssertAttributeValue("role", role) == nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+
+	"Quanta-Ledger/historyarchive"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+/**
+*@dev HistoryChainReport() represents the result of checking that each of a product's events carries the hash of the event before it
+*
+* CheckedFrom is the first event checked; earlier events were compacted into a checkpoint.
+* ChainedFrom is the first event carrying a previous hash; events written before chaining carry none.
+*/
+
+type HistoryChainReport struct {
+	ProductID   uint64                      `json:"productId"`
+	CheckedFrom uint64                      `json:"checkedFrom"`
+	EventCount  uint64                      `json:"eventCount"`
+	ChainedFrom uint64                      `json:"chainedFrom"`
+	Intact      bool                        `json:"intact"`
+	Breaks      []historyarchive.ChainBreak `json:"breaks"`
+}
+
+/**
+*@dev VerifyHistoryChain() recomputes the hash chain over a product's stored events and reports every break
+*/
+
+func (c *ProductDetailsContract) VerifyHistoryChain(ctx contractapi.TransactionContextInterface, productID uint64) (*HistoryChainReport, error) {
+	_, err := c.retrieveProductSnapshot(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoint, err := c.latestHistoryCheckpoint(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	verifier := historyarchive.NewChainVerifier("", 0)
+	if checkpoint != nil {
+		verifier = historyarchive.NewChainVerifier(checkpoint.LastEntryHash, checkpoint.ThroughSequence)
+	}
+	report := &HistoryChainReport{ProductID: productID, CheckedFrom: verifier.Sequence + 1}
+
+	iterator, err := ctx.GetStub().GetStateByRange(productEventKey(productID, report.CheckedFrom), fmt.Sprintf("PRODUCT-%d-EVENT-~", productID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read product events from the ledger: %v", err)
+	}
+	defer iterator.Close()
+
+	for iterator.HasNext() {
+		result, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read product event from the ledger: %v", err)
+		}
+
+		var sequence uint64
+		_, err = fmt.Sscanf(result.Key, fmt.Sprintf("PRODUCT-%d-EVENT-%%d", productID), &sequence)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse product event key %s: %v", result.Key, err)
+		}
+
+		verifier.Add(historyarchive.Entry{Sequence: sequence, Entry: string(result.Value)})
+		report.EventCount++
+	}
+
+	report.ChainedFrom = verifier.ChainedFrom
+	report.Intact = verifier.Intact()
+	report.Breaks = verifier.Breaks
+	return report, nil
+}
+
+/**
+*@dev previousEventHash() returns the hash of the stored event a new event follows, or "" for a product's first event
+*/
+
+func (c *ProductDetailsContract) previousEventHash(ctx contractapi.TransactionContextInterface, product *Product) (string, error) {
+	if product.eventHash != "" || product.Version == 0 {
+		return product.eventHash, nil
+	}
+
+	eventBytes, err := ctx.GetStub().GetState(productEventKey(product.ID, product.Version))
+	if err != nil {
+		return "", fmt.Errorf("failed to read product event from the ledger: %v", err)
+	}
+	if eventBytes != nil {
+		return historyarchive.EntryHash(string(eventBytes)), nil
+	}
+
+	// The previous event has been compacted into a checkpoint
+	checkpoint, err := c.latestHistoryCheckpoint(ctx, product.ID)
+	if err != nil {
+		return "", err
+	}
+	if checkpoint == nil || checkpoint.ThroughSequence != product.Version {
+		return "", fmt.Errorf("event %d of product %d is missing", product.Version, product.ID)
+	}
+
+	return checkpoint.LastEntryHash, nil
+}
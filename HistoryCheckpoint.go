@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"Quanta-Ledger/historyarchive"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+/**
+*@dev HistorySummary() represents what remains on the ledger of the history entries rolled into a checkpoint
+*/
+
+type HistorySummary struct {
+	EntryCount     uint64            `json:"entryCount"`
+	FirstTimestamp uint64            `json:"firstTimestamp"`
+	LastTimestamp  uint64            `json:"lastTimestamp"`
+	Actions        map[string]uint64 `json:"actions"`
+	Origin         string            `json:"origin,omitempty" metadata:",optional"`
+}
+
+/**
+*@dev HistoryCheckpoint() represents older history entries of a product compacted into a summary and a hash chain root
+*
+* The entries themselves are archived off-chain. Each checkpoint's chain starts from the previous checkpoint's root.
+*/
+
+type HistoryCheckpoint struct {
+	ProductID       uint64         `json:"productId"`
+	ThroughSequence uint64         `json:"throughSequence"`
+	PreviousRoot    string         `json:"previousRoot"`
+	Root            string         `json:"root"`
+	LastEntryHash   string         `json:"lastEntryHash"`
+	Summary         HistorySummary `json:"summary"`
+	Product         Product        `json:"product"`
+	Registrant      string         `json:"registrant,omitempty" metadata:",optional"`
+	CompactedBy     string         `json:"compactedBy"`
+	TxID            string         `json:"txId"`
+	Timestamp       uint64         `json:"timestamp"`
+}
+
+/**
+*@dev ExportProductHistory() returns the history entries a compaction through the given sequence would remove, exactly as stored, for archiving
+*/
+
+func (c *ProductDetailsContract) ExportProductHistory(ctx contractapi.TransactionContextInterface, productID uint64, throughSequence uint64) ([]historyarchive.Entry, error) {
+	_, _, err := c.authorizeProductQuery(ctx, productID, "ExportProductHistory", FIELD_SET_HISTORY)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, _, _, err := c.compactableHistory(ctx, productID, throughSequence)
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+/**
+*@dev CompactProductHistory() rolls a product's history entries up to a sequence number into a checkpoint and removes them from the ledger
+*
+* Only an admin of an MSP trusted with the role, in the organisation that holds or owns the product, can compact.
+* Archive the entries from ExportProductHistory first; they cannot be read back afterwards.
+*/
+
+func (c *ProductDetailsContract) CompactProductHistory(ctx contractapi.TransactionContextInterface, productID uint64, throughSequence uint64) (*HistoryCheckpoint, error) {
+	err := c.assertRole(ctx, ROLE_ADMIN)
+	if err != nil {
+		return nil, err
+	}
+
+	product, err := c.retrieveProductDetails(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	compactedBy, err := c.authorizeProductHolder(ctx, product, "compact the history of")
+	if err != nil {
+		return nil, err
+	}
+
+	entries, events, previous, err := c.compactableHistory(ctx, productID, throughSequence)
+	if err != nil {
+		return nil, err
+	}
+
+	legacyHistories, err := c.retrieveLegacyProductHistory(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoint := &HistoryCheckpoint{
+		ProductID:       productID,
+		ThroughSequence: throughSequence,
+		Summary: HistorySummary{
+			EntryCount: uint64(len(entries)),
+			Actions:    make(map[string]uint64),
+		},
+		CompactedBy: compactedBy,
+		TxID:        ctx.GetStub().GetTxID(),
+	}
+
+	start := Product{}
+	if previous != nil {
+		checkpoint.PreviousRoot = previous.Root
+		checkpoint.Summary.Origin = previous.Summary.Origin
+		checkpoint.Registrant = previous.Registrant
+		start = previous.Product
+	} else if events[0].Reason != LEGACY_MIGRATION_REASON {
+		checkpoint.Registrant = events[0].Actor
+	}
+	checkpoint.Root = historyarchive.ComputeRoot(checkpoint.PreviousRoot, entries)
+	checkpoint.LastEntryHash = historyarchive.EntryHash(entries[len(entries)-1].Entry)
+
+	if checkpoint.Summary.Origin == "" {
+		custodyLeft := previous != nil && previous.Product.Custodian != checkpoint.Registrant
+		checkpoint.Summary.Origin = originLocation(checkpoint.Registrant, legacyHistories, events, custodyLeft)
+	}
+
+	checkpoint.Product = start
+	for _, event := range events {
+		err = applyProductEvent(&checkpoint.Product, event)
+		if err != nil {
+			return nil, err
+		}
+
+		checkpoint.Summary.Actions[event.Type]++
+		if checkpoint.Summary.FirstTimestamp == 0 {
+			checkpoint.Summary.FirstTimestamp = event.Timestamp
+		}
+		checkpoint.Summary.LastTimestamp = event.Timestamp
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+	checkpoint.Timestamp = uint64(timestamp.GetSeconds())
+
+	// Reads start from the snapshot, so it must not predate the removed events
+	productBytes, err := json.Marshal(product)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal product JSON: %v", err)
+	}
+	err = ctx.GetStub().PutState(fmt.Sprintf("PRODUCT-%d", productID), productBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to put product snapshot on the ledger: %v", err)
+	}
+
+	for _, entry := range entries {
+		key := productEventKey(productID, entry.Sequence)
+		if entry.Sequence == 0 {
+			key = fmt.Sprintf("PRODUCT-%d-HISTORY", productID)
+		}
+
+		err = ctx.GetStub().DelState(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete compacted history entry from the ledger: %v", err)
+		}
+	}
+
+	checkpointBytes, err := json.Marshal(checkpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal history checkpoint JSON: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(historyCheckpointKey(productID, throughSequence), checkpointBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to put history checkpoint on the ledger: %v", err)
+	}
+
+	return checkpoint, nil
+}
+
+/**
+*@dev GetHistoryCheckpoints() retrieves a product's history checkpoints, oldest first
+*/
+
+func (c *ProductDetailsContract) GetHistoryCheckpoints(ctx contractapi.TransactionContextInterface, productID uint64) ([]HistoryCheckpoint, error) {
+	_, _, err := c.authorizeProductQuery(ctx, productID, "GetHistoryCheckpoints", FIELD_SET_HISTORY)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.historyCheckpoints(ctx, productID)
+}
+
+func (c *ProductDetailsContract) historyCheckpoints(ctx contractapi.TransactionContextInterface, productID uint64) ([]HistoryCheckpoint, error) {
+	iterator, err := ctx.GetStub().GetStateByRange(fmt.Sprintf("PRODUCT-%d-CHECKPOINT-", productID), fmt.Sprintf("PRODUCT-%d-CHECKPOINT-~", productID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history checkpoints from the ledger: %v", err)
+	}
+	defer iterator.Close()
+
+	checkpoints := []HistoryCheckpoint{}
+	for iterator.HasNext() {
+		result, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read history checkpoint from the ledger: %v", err)
+		}
+
+		var checkpoint HistoryCheckpoint
+		err = json.Unmarshal(result.Value, &checkpoint)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal history checkpoint JSON: %v", err)
+		}
+		checkpoints = append(checkpoints, checkpoint)
+	}
+
+	return checkpoints, nil
+}
+
+/**
+*@dev VerifyArchivedHistoryEntry() checks that an archived entry was rolled into one of the product's checkpoints at the position its proof claims
+*/
+
+func (c *ProductDetailsContract) VerifyArchivedHistoryEntry(ctx contractapi.TransactionContextInterface, proof historyarchive.Proof) (bool, error) {
+	checkpoints, err := c.historyCheckpoints(ctx, proof.ProductID)
+	if err != nil {
+		return false, err
+	}
+
+	for _, checkpoint := range checkpoints {
+		if checkpoint.Root != proof.Root {
+			continue
+		}
+		if uint64(len(proof.Following)) > checkpoint.ThroughSequence || checkpoint.ThroughSequence-uint64(len(proof.Following)) != proof.Sequence {
+			return false, nil
+		}
+		return historyarchive.VerifyProof(proof), nil
+	}
+
+	return false, fmt.Errorf("product %d has no history checkpoint with root %s", proof.ProductID, proof.Root)
+}
+
+/**
+*@dev compactableHistory() reads the stored entries after the latest checkpoint up to a sequence number, with their decoded events
+*/
+
+func (c *ProductDetailsContract) compactableHistory(ctx contractapi.TransactionContextInterface, productID uint64, throughSequence uint64) ([]historyarchive.Entry, []ProductEvent, *HistoryCheckpoint, error) {
+	product, err := c.retrieveProductDetails(ctx, productID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	previous, err := c.latestHistoryCheckpoint(ctx, productID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	fromSequence := uint64(1)
+	if previous != nil {
+		fromSequence = previous.ThroughSequence + 1
+	}
+	if throughSequence < fromSequence || throughSequence > product.Version {
+		return nil, nil, nil, fmt.Errorf("product %d can only be compacted through a sequence from %d to %d", productID, fromSequence, product.Version)
+	}
+
+	entries := []historyarchive.Entry{}
+	if previous == nil {
+		legacyBytes, err := ctx.GetStub().GetState(fmt.Sprintf("PRODUCT-%d-HISTORY", productID))
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to read product history from the ledger: %v", err)
+		}
+		if legacyBytes != nil {
+			entries = append(entries, historyarchive.Entry{Sequence: 0, Entry: string(legacyBytes)})
+		}
+	}
+
+	iterator, err := ctx.GetStub().GetStateByRange(productEventKey(productID, fromSequence), productEventKey(productID, throughSequence+1))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to read product events from the ledger: %v", err)
+	}
+	defer iterator.Close()
+
+	events := []ProductEvent{}
+	for iterator.HasNext() {
+		result, err := iterator.Next()
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to read product event from the ledger: %v", err)
+		}
+
+		var event ProductEvent
+		err = json.Unmarshal(result.Value, &event)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to unmarshal product event JSON: %v", err)
+		}
+		if event.Sequence != fromSequence+uint64(len(events)) {
+			return nil, nil, nil, fmt.Errorf("event %d of product %d is missing", fromSequence+uint64(len(events)), productID)
+		}
+
+		events = append(events, event)
+		entries = append(entries, historyarchive.Entry{Sequence: event.Sequence, Entry: string(result.Value)})
+	}
+	if uint64(len(events)) != throughSequence-fromSequence+1 {
+		return nil, nil, nil, fmt.Errorf("events %d to %d of product %d are incomplete", fromSequence, throughSequence, productID)
+	}
+
+	return entries, events, previous, nil
+}
+
+/**
+*@dev latestHistoryCheckpoint() retrieves a product's most recent history checkpoint, or nil if its history was never compacted
+*/
+
+func (c *ProductDetailsContract) latestHistoryCheckpoint(ctx contractapi.TransactionContextInterface, productID uint64) (*HistoryCheckpoint, error) {
+	checkpoints, err := c.historyCheckpoints(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+	if len(checkpoints) == 0 {
+		return nil, nil
+	}
+
+	return &checkpoints[len(checkpoints)-1], nil
+}
+
+/**
+*@dev historyStart() returns the product as of its latest checkpoint, from which the remaining events are replayed
+*/
+
+func (c *ProductDetailsContract) historyStart(ctx contractapi.TransactionContextInterface, productID uint64) (Product, uint64, error) {
+	checkpoint, err := c.latestHistoryCheckpoint(ctx, productID)
+	if err != nil {
+		return Product{}, 0, err
+	}
+	if checkpoint == nil {
+		return Product{}, 0, nil
+	}
+
+	return checkpoint.Product, checkpoint.ThroughSequence, nil
+}
+
+func historyCheckpointKey(productID uint64, throughSequence uint64) string {
+	return fmt.Sprintf("PRODUCT-%d-CHECKPOINT-%020d", productID, throughSequence)
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+/**
+*@dev Ingredient() represents an ingredient and the allergens it contains
+*/
+
+type Ingredient struct {
+	Name      string   `json:"name"`
+	Allergens []string `json:"allergens"`
+}
+
+/**
+*@dev BatchIngredients() represents the ingredients declared for a production batch
+*/
+
+type BatchIngredients struct {
+	BatchNumber string       `json:"batchNumber"`
+	DeclaredBy  string       `json:"declaredBy"`
+	Ingredients []Ingredient `json:"ingredients"`
+}
+
+/**
+*@dev SetCatalogIngredients() declares the ingredients of a catalog item for its products registered from now on
+*/
+
+func (c *ProductDetailsContract) SetCatalogIngredients(ctx contractapi.TransactionContextInterface, catalogItemID string, ingredients []Ingredient) error {
+	catalogItem, err := c.RetrieveCatalogItem(ctx, catalogItemID)
+	if err != nil {
+		return err
+	}
+
+	caller, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+	if caller != catalogItem.Owner {
+		return fmt.Errorf("catalog item %s is owned by %s", catalogItemID, catalogItem.Owner)
+	}
+
+	catalogItem.Ingredients, err = normalizeIngredients(ingredients)
+	if err != nil {
+		return err
+	}
+
+	catalogItemBytes, err := json.Marshal(catalogItem)
+	if err != nil {
+		return fmt.Errorf("failed to marshal catalog item JSON: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(fmt.Sprintf("CATALOG-%s", catalogItemID), catalogItemBytes)
+	if err != nil {
+		return fmt.Errorf("failed to put catalog item on the ledger: %v", err)
+	}
+
+	return nil
+}
+
+/**
+*@dev DeclareBatchIngredients() declares the ingredients of one of the caller's production batches before its products are registered
+*
+* Batch numbers are only unique within an organisation, so a declaration applies to the products the declaring
+* organisation registers. Ingredients are resolved when a product is registered, so a declaration cannot be changed once made.
+*/
+
+func (c *ProductDetailsContract) DeclareBatchIngredients(ctx contractapi.TransactionContextInterface, batchNumber string, ingredients []Ingredient) error {
+	if batchNumber == "" {
+		return fmt.Errorf("batch number is required")
+	}
+
+	declaredBy, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+
+	existing, err := c.retrieveBatchIngredients(ctx, declaredBy, batchNumber)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("ingredients of batch %s were already declared by %s", batchNumber, existing.DeclaredBy)
+	}
+
+	normalized, err := normalizeIngredients(ingredients)
+	if err != nil {
+		return err
+	}
+
+	batchBytes, err := json.Marshal(BatchIngredients{
+		BatchNumber: batchNumber,
+		DeclaredBy:  declaredBy,
+		Ingredients: normalized,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal batch ingredients JSON: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(batchIngredientsKey(declaredBy, batchNumber), batchBytes)
+	if err != nil {
+		return fmt.Errorf("failed to put batch ingredients on the ledger: %v", err)
+	}
+
+	return nil
+}
+
+/**
+*@dev TransformProducts() registers a product blended or transformed from input products; it carries every ingredient and allergen of its inputs
+*
+* The caller must be the custodian or owner of every input.
+*/
+
+func (c *ProductDetailsContract) TransformProducts(ctx contractapi.TransactionContextInterface, inputProductIDs []uint64, name string, description string, manufacturedDate uint64, batchNumber string, addedIngredients []Ingredient) error {
+	if len(inputProductIDs) == 0 {
+		return fmt.Errorf("a transformation needs at least one input product")
+	}
+
+	ingredients, err := normalizeIngredients(addedIngredients)
+	if err != nil {
+		return err
+	}
+
+	for _, inputProductID := range inputProductIDs {
+		input, err := c.retrieveProductDetails(ctx, inputProductID)
+		if err != nil {
+			return err
+		}
+		if input.State == PRODUCT_RECALLED {
+			return fmt.Errorf("input product %d has been recalled", inputProductID)
+		}
+
+		_, err = c.authorizeProductHolder(ctx, input, "transform")
+		if err != nil {
+			return err
+		}
+
+		// An input without declared ingredients is itself the ingredient
+		if len(input.Ingredients) == 0 {
+			ingredients = mergeIngredients(ingredients, []Ingredient{{Name: input.Name, Allergens: input.Allergens}})
+		} else {
+			ingredients = mergeIngredients(ingredients, input.Ingredients)
+		}
+	}
+
+	_, err = c.addProduct(ctx, Product{
+		Name:            name,
+		Description:     description,
+		ManufactureDate: manufacturedDate,
+		BatchNumber:     batchNumber,
+		InputProductIDs: inputProductIDs,
+		Ingredients:     ingredients,
+	})
+	return err
+}
+
+/**
+*@dev GetProductsWithAllergen() retrieves every product containing an allergen, directly or through its inputs
+*
+* Only products whose composition the caller may query are listed, and only the fields it may see of them.
+*/
+
+func (c *ProductDetailsContract) GetProductsWithAllergen(ctx contractapi.TransactionContextInterface, allergen string) ([]*Product, error) {
+	allergen = normalizeAllergen(allergen)
+	iterator, err := ctx.GetStub().GetStateByRange(fmt.Sprintf("ALLERGEN-%s-PRODUCT-", allergen), fmt.Sprintf("ALLERGEN-%s-PRODUCT-~", allergen))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read allergen index from the ledger: %v", err)
+	}
+	defer iterator.Close()
+
+	products := []*Product{}
+	for iterator.HasNext() {
+		result, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read allergen index from the ledger: %v", err)
+		}
+
+		productID, err := strconv.ParseUint(string(result.Value), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse allergen product ID: %v", err)
+		}
+
+		product, err := c.retrieveProductDetails(ctx, productID)
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, product)
+	}
+
+	return c.authorizeListedProducts(ctx, products, "GetProductsWithAllergen", FIELD_SET_COMPOSITION), nil
+}
+
+/**
+*@dev resolveProductIngredients() adds the ingredients of a new product's catalog item and batch to its own and derives its allergens
+*
+* Only a batch declaration made by the registering organisation applies.
+*/
+
+func (c *ProductDetailsContract) resolveProductIngredients(ctx contractapi.TransactionContextInterface, product *Product) error {
+	ingredients := product.Ingredients
+
+	if product.CatalogItemID != "" {
+		catalogItem, err := c.RetrieveCatalogItem(ctx, product.CatalogItemID)
+		if err != nil {
+			return err
+		}
+		ingredients = mergeIngredients(ingredients, catalogItem.Ingredients)
+	}
+
+	if product.BatchNumber != "" {
+		registrant, err := ctx.GetClientIdentity().GetMSPID()
+		if err != nil {
+			return fmt.Errorf("failed to read submitter identity: %v", err)
+		}
+
+		batch, err := c.retrieveBatchIngredients(ctx, registrant, product.BatchNumber)
+		if err != nil {
+			return err
+		}
+		if batch != nil {
+			ingredients = mergeIngredients(ingredients, batch.Ingredients)
+		}
+	}
+
+	allergens := []string{}
+	seen := make(map[string]bool)
+	for _, ingredient := range ingredients {
+		for _, allergen := range ingredient.Allergens {
+			if !seen[allergen] {
+				seen[allergen] = true
+				allergens = append(allergens, allergen)
+			}
+		}
+	}
+	sort.Strings(allergens)
+
+	product.Ingredients = ingredients
+	product.Allergens = allergens
+	return nil
+}
+
+/**
+*@dev retrieveBatchIngredients() retrieves the ingredients an organisation declared for one of its batches, or nil if it declared none
+*
+* Declarations made before they were scoped to an organisation are stored under the batch number alone and still
+* apply to the organisation that made them.
+*/
+
+func (c *ProductDetailsContract) retrieveBatchIngredients(ctx contractapi.TransactionContextInterface, mspID string, batchNumber string) (*BatchIngredients, error) {
+	for _, batchKey := range []string{batchIngredientsKey(mspID, batchNumber), fmt.Sprintf("BATCH-%s-INGREDIENTS", batchNumber)} {
+		batchBytes, err := ctx.GetStub().GetState(batchKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read batch ingredients from the ledger: %v", err)
+		}
+		if batchBytes == nil {
+			continue
+		}
+
+		batch := new(BatchIngredients)
+		err = json.Unmarshal(batchBytes, batch)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal batch ingredients JSON: %v", err)
+		}
+		if batch.DeclaredBy == mspID {
+			return batch, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func batchIngredientsKey(mspID string, batchNumber string) string {
+	return fmt.Sprintf("ORG-%s-BATCH-%s-INGREDIENTS", mspID, batchNumber)
+}
+
+/**
+*@dev normalizeIngredients() checks declared ingredients and normalises their allergen names
+*/
+
+func normalizeIngredients(ingredients []Ingredient) ([]Ingredient, error) {
+	normalized := []Ingredient{}
+	for _, ingredient := range ingredients {
+		if ingredient.Name == "" {
+			return nil, fmt.Errorf("every ingredient needs a name")
+		}
+
+		allergens := []string{}
+		for _, allergen := range ingredient.Allergens {
+			allergen = normalizeAllergen(allergen)
+			if allergen == "" {
+				return nil, fmt.Errorf("ingredient %s has an empty allergen", ingredient.Name)
+			}
+			allergens = append(allergens, allergen)
+		}
+		normalized = mergeIngredients(normalized, []Ingredient{{Name: ingredient.Name, Allergens: allergens}})
+	}
+
+	return normalized, nil
+}
+
+/**
+*@dev mergeIngredients() adds ingredients to a list, joining the allergens of ingredients with the same name
+*/
+
+func mergeIngredients(ingredients []Ingredient, additions []Ingredient) []Ingredient {
+	merged := append([]Ingredient{}, ingredients...)
+	for _, addition := range additions {
+		index := -1
+		for i, ingredient := range merged {
+			if ingredient.Name == addition.Name {
+				index = i
+			}
+		}
+		if index == -1 {
+			merged = append(merged, Ingredient{Name: addition.Name, Allergens: []string{}})
+			index = len(merged) - 1
+		}
+
+		allergens := append([]string{}, merged[index].Allergens...)
+		for _, allergen := range addition.Allergens {
+			present := false
+			for _, existing := range allergens {
+				if existing == allergen {
+					present = true
+				}
+			}
+			if !present {
+				allergens = append(allergens, allergen)
+			}
+		}
+		sort.Strings(allergens)
+		merged[index].Allergens = allergens
+	}
+
+	return merged
+}
+
+func normalizeAllergen(allergen string) string {
+	return strings.ToLower(strings.TrimSpace(allergen))
+}
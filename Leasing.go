@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+/**
+*@dev LeaseStatus() represents whether a leased product is still out with the lessee
+*/
+
+type LeaseStatus int
+
+const (
+	LEASE_ACTIVE LeaseStatus = iota
+	LEASE_RETURNED
+)
+
+/**
+*@dev ReturnCondition() represents the condition a product was found in when its lease ended
+*/
+
+type ReturnCondition int
+
+const (
+	CONDITION_GOOD ReturnCondition = iota
+	CONDITION_WORN
+	CONDITION_DAMAGED
+	CONDITION_UNUSABLE
+)
+
+/**
+*@dev ReturnInspection() represents the lessor's assessment of a product handed back at the end of a lease
+*/
+
+type ReturnInspection struct {
+	Inspector             string          `json:"inspector"`
+	Condition             ReturnCondition `json:"condition"`
+	MeetsReturnConditions bool            `json:"meetsReturnConditions"`
+	Notes                 string          `json:"notes"`
+	TxID                  string          `json:"txId"`
+	Timestamp             uint64          `json:"timestamp"`
+}
+
+/**
+*@dev Lease() represents a contract leasing a product to another organisation for a term
+*/
+
+type Lease struct {
+	ID               string            `json:"id"`
+	ProductID        uint64            `json:"productId"`
+	Lessor           string            `json:"lessor"`
+	Lessee           string            `json:"lessee"`
+	StartDate        uint64            `json:"startDate"`
+	EndDate          uint64            `json:"endDate"`
+	Rate             string            `json:"rate"`
+	ReturnConditions string            `json:"returnConditions"`
+	Status           LeaseStatus       `json:"status"`
+	Inspection       *ReturnInspection `json:"inspection,omitempty" metadata:",optional"`
+}
+
+/**
+*@dev LesseeLeases() represents a lessee's leases that are still out, with those past their end date listed separately
+*/
+
+type LesseeLeases struct {
+	Lessee  string   `json:"lessee"`
+	Active  []*Lease `json:"active"`
+	Overdue []*Lease `json:"overdue"`
+}
+
+/**
+*@dev LeaseProduct() leases a product the caller holds or owns to another organisation, which becomes its custodian, and moves it to PRODUCT_LEASED_OUT
+*/
+
+func (c *ProductDetailsContract) LeaseProduct(ctx contractapi.TransactionContextInterface, productID uint64, lessee string, startDate uint64, endDate uint64, rate string, returnConditions string) (string, error) {
+	product, err := c.retrieveProductDetails(ctx, productID)
+	if err != nil {
+		return "", err
+	}
+
+	lessor, err := c.authorizeProductHolder(ctx, product, "lease")
+	if err != nil {
+		return "", err
+	}
+	if lessee == "" || lessee == lessor {
+		return "", fmt.Errorf("lessee must be another organisation")
+	}
+	if endDate <= startDate {
+		return "", fmt.Errorf("lease must end after it starts")
+	}
+
+	switch product.State {
+	case PRODUCT_LEASED_OUT, PRODUCT_SOLD, PRODUCT_RECALLED, CONSUMPTION:
+		return "", fmt.Errorf("product %d cannot be leased from state %d", productID, product.State)
+	}
+	if !validLifecycleTransition(product.State, PRODUCT_LEASED_OUT) {
+		return "", fmt.Errorf("invalid state transition")
+	}
+
+	lease := &Lease{
+		ID:               ctx.GetStub().GetTxID(),
+		ProductID:        productID,
+		Lessor:           lessor,
+		Lessee:           lessee,
+		StartDate:        startDate,
+		EndDate:          endDate,
+		Rate:             rate,
+		ReturnConditions: returnConditions,
+		Status:           LEASE_ACTIVE,
+	}
+
+	err = c.putLease(ctx, lease)
+	if err != nil {
+		return "", err
+	}
+
+	err = ctx.GetStub().PutState(fmt.Sprintf("LESSEE-%s-LEASE-%s", lessee, lease.ID), []byte(lease.ID))
+	if err != nil {
+		return "", fmt.Errorf("failed to put lessee lease index on the ledger: %v", err)
+	}
+
+	err = c.appendProductEvent(ctx, product, ProductEvent{
+		Type:   HISTORY_STATE_CHANGE,
+		State:  PRODUCT_LEASED_OUT,
+		Reason: fmt.Sprintf("leased to %s under lease %s", lessee, lease.ID),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	err = c.appendProductEvent(ctx, product, ProductEvent{
+		Type:      HISTORY_CUSTODY_TRANSFER,
+		Custodian: lessee,
+		Reason:    fmt.Sprintf("handed to the lessee under lease %s", lease.ID),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return lease.ID, nil
+}
+
+/**
+*@dev ReturnLeasedProduct() records the lessor's return inspection, closes the lease, hands custody back to the lessor and moves the product to PRODUCT_RETURNED
+*/
+
+func (c *ProductDetailsContract) ReturnLeasedProduct(ctx contractapi.TransactionContextInterface, leaseID string, condition int, meetsReturnConditions bool, notes string) error {
+	lease, err := c.RetrieveLease(ctx, leaseID)
+	if err != nil {
+		return err
+	}
+	if lease.Status != LEASE_ACTIVE {
+		return fmt.Errorf("lease %s has already ended", leaseID)
+	}
+
+	inspector, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+	if inspector != lease.Lessor {
+		return fmt.Errorf("only the lessor can inspect the return of lease %s", leaseID)
+	}
+
+	returnCondition := ReturnCondition(condition)
+	if returnCondition < CONDITION_GOOD || returnCondition > CONDITION_UNUSABLE {
+		return fmt.Errorf("unknown return condition %d", condition)
+	}
+
+	product, err := c.retrieveProductDetails(ctx, lease.ProductID)
+	if err != nil {
+		return err
+	}
+	if product.State != PRODUCT_LEASED_OUT && product.State != PRODUCT_RECALLED {
+		return fmt.Errorf("product %d is not leased out", lease.ProductID)
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+
+	lease.Status = LEASE_RETURNED
+	lease.Inspection = &ReturnInspection{
+		Inspector:             inspector,
+		Condition:             returnCondition,
+		MeetsReturnConditions: meetsReturnConditions,
+		Notes:                 notes,
+		TxID:                  ctx.GetStub().GetTxID(),
+		Timestamp:             uint64(timestamp.GetSeconds()),
+	}
+
+	err = c.putLease(ctx, lease)
+	if err != nil {
+		return err
+	}
+
+	// Leases made before lessees took custody left the product with the lessor
+	if product.Custodian != lease.Lessor {
+		err = c.appendProductEvent(ctx, product, ProductEvent{
+			Type:      HISTORY_CUSTODY_TRANSFER,
+			Custodian: lease.Lessor,
+			Reason:    fmt.Sprintf("returned to the lessor under lease %s", lease.ID),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// A product recalled while out on lease stays recalled once it comes back
+	if product.State == PRODUCT_RECALLED {
+		return nil
+	}
+
+	return c.appendProductEvent(ctx, product, ProductEvent{
+		Type:   HISTORY_STATE_CHANGE,
+		State:  PRODUCT_RETURNED,
+		Reason: fmt.Sprintf("returned under lease %s", lease.ID),
+	})
+}
+
+/**
+*@dev RetrieveLease() retrieves a lease
+*/
+
+func (c *ProductDetailsContract) RetrieveLease(ctx contractapi.TransactionContextInterface, leaseID string) (*Lease, error) {
+	leaseBytes, err := ctx.GetStub().GetState(fmt.Sprintf("LEASE-%s", leaseID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lease from the ledger: %v", err)
+	}
+	if leaseBytes == nil {
+		return nil, fmt.Errorf("lease %s does not exist", leaseID)
+	}
+
+	lease := new(Lease)
+	err = json.Unmarshal(leaseBytes, lease)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal lease JSON: %v", err)
+	}
+
+	return lease, nil
+}
+
+/**
+*@dev GetLesseeLeases() lists a lessee's active leases and those past their end date at asOf
+*/
+
+func (c *ProductDetailsContract) GetLesseeLeases(ctx contractapi.TransactionContextInterface, lessee string, asOf uint64) (*LesseeLeases, error) {
+	iterator, err := ctx.GetStub().GetStateByRange(fmt.Sprintf("LESSEE-%s-LEASE-", lessee), fmt.Sprintf("LESSEE-%s-LEASE-~", lessee))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lessee leases from the ledger: %v", err)
+	}
+	defer iterator.Close()
+
+	leases := &LesseeLeases{Lessee: lessee, Active: []*Lease{}, Overdue: []*Lease{}}
+	for iterator.HasNext() {
+		result, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read lessee lease from the ledger: %v", err)
+		}
+
+		lease, err := c.RetrieveLease(ctx, string(result.Value))
+		if err != nil {
+			return nil, err
+		}
+		if lease.Status != LEASE_ACTIVE {
+			continue
+		}
+
+		leases.Active = append(leases.Active, lease)
+		if lease.EndDate < asOf {
+			leases.Overdue = append(leases.Overdue, lease)
+		}
+	}
+
+	return leases, nil
+}
+
+func (c *ProductDetailsContract) putLease(ctx contractapi.TransactionContextInterface, lease *Lease) error {
+	leaseBytes, err := json.Marshal(lease)
+	if err != nil {
+		return fmt.Errorf("failed to marshal lease JSON: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(fmt.Sprintf("LEASE-%s", lease.ID), leaseBytes)
+	if err != nil {
+		return fmt.Errorf("failed to put lease on the ledger: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+/**
+*@dev ServiceRecord() represents one maintenance visit to a durable product
+*
+* Records are kept against the product rather than its owner, so they pass to each new custodian.
+*/
+
+type ServiceRecord struct {
+	ProductID     uint64   `json:"productId"`
+	TxID          string   `json:"txId"`
+	Timestamp     uint64   `json:"timestamp"`
+	Technician    string   `json:"technician"`
+	WorkPerformed string   `json:"workPerformed"`
+	AuthorizedBy  string   `json:"authorizedBy,omitempty" metadata:",optional"`
+	PartsReplaced []uint64 `json:"partsReplaced"`
+	NextDueDate   uint64   `json:"nextDueDate"`
+}
+
+/**
+*@dev ServiceAuthorization() represents a technician organisation a product's custodian or owner lets record service on it
+*
+* It lapses when the organisation that gave it no longer holds the product.
+*/
+
+type ServiceAuthorization struct {
+	ProductID    uint64 `json:"productId"`
+	Technician   string `json:"technician"`
+	AuthorizedBy string `json:"authorizedBy"`
+	TxID         string `json:"txId"`
+	Timestamp    uint64 `json:"timestamp"`
+}
+
+/**
+*@dev MaintenanceSchedule() represents when a product is next due for service
+*/
+
+type MaintenanceSchedule struct {
+	ProductID       uint64 `json:"productId"`
+	NextDueDate     uint64 `json:"nextDueDate"`
+	LastServiceTxID string `json:"lastServiceTxId"`
+	Custodian       string `json:"custodian,omitempty" metadata:",optional"`
+}
+
+/**
+*@dev RecordService() records maintenance performed on a product by the caller's organisation; a nextDueDate of 0 means no further service is scheduled
+*
+* Only the product's custodian or owner, or a technician organisation one of them has authorised with AuthorizeServiceTechnician,
+* can record service, so nobody else can move or clear its schedule. Replaced parts must be held by the technician.
+*/
+
+func (c *ProductDetailsContract) RecordService(ctx contractapi.TransactionContextInterface, productID uint64, workPerformed string, partsReplaced []uint64, nextDueDate uint64) error {
+	product, err := c.retrieveProductDetails(ctx, productID)
+	if err != nil {
+		return err
+	}
+
+	technician, authorizedBy, err := c.authorizeServiceTechnician(ctx, product)
+	if err != nil {
+		return err
+	}
+	if workPerformed == "" {
+		return fmt.Errorf("work performed is required")
+	}
+
+	for _, partID := range partsReplaced {
+		if partID == productID {
+			return fmt.Errorf("product %d cannot be a replacement part of itself", productID)
+		}
+		part, err := c.retrieveProductDetails(ctx, partID)
+		if err != nil {
+			return err
+		}
+		_, err = c.authorizeProductHolder(ctx, part, "replace parts with")
+		if err != nil {
+			return err
+		}
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+
+	record := ServiceRecord{
+		ProductID:     productID,
+		TxID:          ctx.GetStub().GetTxID(),
+		Timestamp:     uint64(timestamp.GetSeconds()),
+		Technician:    technician,
+		AuthorizedBy:  authorizedBy,
+		WorkPerformed: workPerformed,
+		PartsReplaced: partsReplaced,
+		NextDueDate:   nextDueDate,
+	}
+
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal service record JSON: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(fmt.Sprintf("PRODUCT-%d-SERVICE-%s", productID, record.TxID), recordBytes)
+	if err != nil {
+		return fmt.Errorf("failed to put service record on the ledger: %v", err)
+	}
+
+	return c.rescheduleMaintenance(ctx, record)
+}
+
+/**
+*@dev AuthorizeServiceTechnician() lets a technician organisation record service on a product the caller is the custodian or owner of
+*/
+
+func (c *ProductDetailsContract) AuthorizeServiceTechnician(ctx contractapi.TransactionContextInterface, productID uint64, technician string) error {
+	product, err := c.retrieveProductDetails(ctx, productID)
+	if err != nil {
+		return err
+	}
+
+	holder, err := c.authorizeProductHolder(ctx, product, "authorise a technician for")
+	if err != nil {
+		return err
+	}
+	if technician == "" {
+		return fmt.Errorf("technician is required")
+	}
+	if technician == holder {
+		return fmt.Errorf("%s can already record service on product %d", technician, productID)
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+
+	authorizationBytes, err := json.Marshal(ServiceAuthorization{
+		ProductID:    productID,
+		Technician:   technician,
+		AuthorizedBy: holder,
+		TxID:         ctx.GetStub().GetTxID(),
+		Timestamp:    uint64(timestamp.GetSeconds()),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal service authorization JSON: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(serviceAuthorizationKey(productID, technician), authorizationBytes)
+	if err != nil {
+		return fmt.Errorf("failed to put service authorization on the ledger: %v", err)
+	}
+
+	return nil
+}
+
+/**
+*@dev RevokeServiceTechnician() withdraws a technician organisation's authorisation to record service on a product
+*/
+
+func (c *ProductDetailsContract) RevokeServiceTechnician(ctx contractapi.TransactionContextInterface, productID uint64, technician string) error {
+	product, err := c.retrieveProductDetails(ctx, productID)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.authorizeProductHolder(ctx, product, "revoke a technician for")
+	if err != nil {
+		return err
+	}
+
+	authorizationBytes, err := ctx.GetStub().GetState(serviceAuthorizationKey(productID, technician))
+	if err != nil {
+		return fmt.Errorf("failed to read service authorization from the ledger: %v", err)
+	}
+	if authorizationBytes == nil {
+		return fmt.Errorf("%s is not authorised to record service on product %d", technician, productID)
+	}
+
+	err = ctx.GetStub().DelState(serviceAuthorizationKey(productID, technician))
+	if err != nil {
+		return fmt.Errorf("failed to delete service authorization from the ledger: %v", err)
+	}
+
+	return nil
+}
+
+/**
+*@dev authorizeServiceTechnician() returns the caller if it may record service on a product, with the holder that authorised it if it does not hold the product itself
+*/
+
+func (c *ProductDetailsContract) authorizeServiceTechnician(ctx contractapi.TransactionContextInterface, product *Product) (string, string, error) {
+	caller, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+
+	owner, err := c.productOwner(ctx, product)
+	if err != nil {
+		return "", "", err
+	}
+	if owner == "" && product.Custodian == "" {
+		return "", "", fmt.Errorf("product %d has no recorded custodian or owner to record service on it", product.ID)
+	}
+	if caller == owner || caller == product.Custodian {
+		return caller, "", nil
+	}
+
+	authorizationBytes, err := ctx.GetStub().GetState(serviceAuthorizationKey(product.ID, caller))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read service authorization from the ledger: %v", err)
+	}
+	if authorizationBytes != nil {
+		var authorization ServiceAuthorization
+		err = json.Unmarshal(authorizationBytes, &authorization)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to unmarshal service authorization JSON: %v", err)
+		}
+
+		// An authorisation given by an earlier holder has lapsed
+		if authorization.AuthorizedBy == owner || authorization.AuthorizedBy == product.Custodian {
+			return caller, authorization.AuthorizedBy, nil
+		}
+	}
+
+	return "", "", fmt.Errorf("only the custodian or owner of product %d, or a technician one of them has authorised, can record service on it", product.ID)
+}
+
+/**
+*@dev GetServiceHistory() retrieves every service record of a product, oldest first
+*/
+
+func (c *ProductDetailsContract) GetServiceHistory(ctx contractapi.TransactionContextInterface, productID uint64) ([]ServiceRecord, error) {
+	_, _, err := c.authorizeProductQuery(ctx, productID, "GetServiceHistory", FIELD_SET_SERVICE)
+	if err != nil {
+		return nil, err
+	}
+
+	iterator, err := ctx.GetStub().GetStateByRange(fmt.Sprintf("PRODUCT-%d-SERVICE-", productID), fmt.Sprintf("PRODUCT-%d-SERVICE-~", productID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service history from the ledger: %v", err)
+	}
+	defer iterator.Close()
+
+	records := []ServiceRecord{}
+	for iterator.HasNext() {
+		result, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read service record from the ledger: %v", err)
+		}
+
+		var record ServiceRecord
+		err = json.Unmarshal(result.Value, &record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal service record JSON: %v", err)
+		}
+		records = append(records, record)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Timestamp < records[j].Timestamp
+	})
+
+	return records, nil
+}
+
+/**
+*@dev GetOverdueMaintenance() lists products whose next service was due before asOf, optionally only those in a custodian's hands
+*
+* Only products whose service records the caller may query are listed, and their custodian only if it may see their location.
+*/
+
+func (c *ProductDetailsContract) GetOverdueMaintenance(ctx contractapi.TransactionContextInterface, asOf uint64, custodian string) ([]MaintenanceSchedule, error) {
+	iterator, err := ctx.GetStub().GetStateByRange("MAINTENANCE-DUE-", maintenanceDueKey(asOf, 0))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read maintenance schedule from the ledger: %v", err)
+	}
+	defer iterator.Close()
+
+	schedules := []MaintenanceSchedule{}
+	for iterator.HasNext() {
+		result, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read maintenance schedule from the ledger: %v", err)
+		}
+
+		var schedule MaintenanceSchedule
+		err = json.Unmarshal(result.Value, &schedule)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal maintenance schedule JSON: %v", err)
+		}
+
+		// Products whose service records are not shared with the caller are left out rather than failing the listing
+		product, sharedFieldSets, err := c.authorizeProductQuery(ctx, schedule.ProductID, "GetOverdueMaintenance", FIELD_SET_SERVICE)
+		if err != nil {
+			continue
+		}
+		if sharedFieldSets != nil && !containsString(sharedFieldSets, FIELD_SET_LOCATION) {
+			product.Custodian = ""
+		}
+		if custodian != "" && product.Custodian != custodian {
+			continue
+		}
+
+		schedule.Custodian = product.Custodian
+		schedules = append(schedules, schedule)
+	}
+
+	return schedules, nil
+}
+
+/**
+*@dev rescheduleMaintenance() replaces a product's entry in the due-date index with the one set by its latest service
+*/
+
+func (c *ProductDetailsContract) rescheduleMaintenance(ctx contractapi.TransactionContextInterface, record ServiceRecord) error {
+	scheduleKey := fmt.Sprintf("PRODUCT-%d-MAINTENANCE", record.ProductID)
+	scheduleBytes, err := ctx.GetStub().GetState(scheduleKey)
+	if err != nil {
+		return fmt.Errorf("failed to read maintenance schedule from the ledger: %v", err)
+	}
+
+	if scheduleBytes != nil {
+		var previous MaintenanceSchedule
+		err = json.Unmarshal(scheduleBytes, &previous)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal maintenance schedule JSON: %v", err)
+		}
+
+		err = ctx.GetStub().DelState(maintenanceDueKey(previous.NextDueDate, previous.ProductID))
+		if err != nil {
+			return fmt.Errorf("failed to delete maintenance schedule from the ledger: %v", err)
+		}
+	}
+
+	if record.NextDueDate == 0 {
+		err = ctx.GetStub().DelState(scheduleKey)
+		if err != nil {
+			return fmt.Errorf("failed to delete maintenance schedule from the ledger: %v", err)
+		}
+		return nil
+	}
+
+	schedule := MaintenanceSchedule{
+		ProductID:       record.ProductID,
+		NextDueDate:     record.NextDueDate,
+		LastServiceTxID: record.TxID,
+	}
+
+	scheduleBytes, err = json.Marshal(schedule)
+	if err != nil {
+		return fmt.Errorf("failed to marshal maintenance schedule JSON: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(scheduleKey, scheduleBytes)
+	if err != nil {
+		return fmt.Errorf("failed to put maintenance schedule on the ledger: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(maintenanceDueKey(schedule.NextDueDate, schedule.ProductID), scheduleBytes)
+	if err != nil {
+		return fmt.Errorf("failed to put maintenance schedule on the ledger: %v", err)
+	}
+
+	return nil
+}
+
+func serviceAuthorizationKey(productID uint64, technician string) string {
+	return fmt.Sprintf("PRODUCT-%d-TECHNICIAN-%s", productID, technician)
+}
+
+func maintenanceDueKey(dueDate uint64, productID uint64) string {
+	return fmt.Sprintf("MAINTENANCE-DUE-%020d-%020d", dueDate, productID)
+}
@@ -6,10 +6,12 @@ import (
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
 
 	"encoding/json"
+	"strconv"
 )
 
 type ProductDetailsContract struct {
 	contractapi.Contract
+	RoleMSPs RoleMSPs
 }
 
 /**
@@ -18,11 +20,26 @@ type ProductDetailsContract struct {
 
 type Product struct {
 	ID              uint64 `json:"id"`
-	Name            string `json:"name"`
-	Description     string `json:"description"`
-	ManufactureDate uint64 `json:"manufactureDate"`
-	BatchNumber     string `json:"batchNumber"`
-	State ProductState `json:"state"`
+	Name            string `json:"name" metadata:",optional"`
+	Description     string `json:"description" metadata:",optional"`
+	ManufactureDate uint64 `json:"manufactureDate" metadata:",optional"`
+	BatchNumber     string `json:"batchNumber" metadata:",optional"`
+	State ProductState `json:"state" metadata:",optional"`
+	Location        string `json:"location,omitempty" metadata:",optional"`
+	Custodian       string `json:"custodian,omitempty" metadata:",optional"`
+	Version         uint64 `json:"version" metadata:",optional"`
+	ReturnVerification *ReturnVerification `json:"returnVerification,omitempty" metadata:",optional"`
+	Tag             *ProductTag `json:"tag,omitempty" metadata:",optional"`
+	CatalogItemID   string `json:"catalogItemId,omitempty" metadata:",optional"`
+	VariantID       string `json:"variantId,omitempty" metadata:",optional"`
+	InputProductIDs []uint64 `json:"inputProductIds,omitempty" metadata:",optional"`
+	Ingredients     []Ingredient `json:"ingredients,omitempty" metadata:",optional"`
+	Allergens       []string `json:"allergens,omitempty" metadata:",optional"`
+
+	// eventHash carries the hash of the event last appended in this transaction, which the ledger cannot read back yet
+	eventHash string
+	// withheld names the JSON fields a copy filtered for a partner leaves out, so they do not read as zero values
+	withheld []string
 }
 
 /**
@@ -34,8 +51,26 @@ type ProductHistory struct {
 	Action    string        `json:"action"`
 	Location  string        `json:"location"`
 	State     ProductState `json:"state"`
+	PreviousState ProductState `json:"previousState"`
+	TxID      string        `json:"txId,omitempty" metadata:",optional"`
+	Reverses  string        `json:"reverses,omitempty" metadata:",optional"`
+	Reason    string        `json:"reason,omitempty" metadata:",optional"`
+	Custodian string        `json:"custodian,omitempty" metadata:",optional"`
+	PhysicallyProven bool   `json:"physicallyProven,omitempty" metadata:",optional"`
 }
 
+/**
+*@dev history actions recorded in ProductHistory
+*/
+
+const (
+	HISTORY_MOVEMENT              = "Movement"
+	HISTORY_STATE_CHANGE          = "StateChange"
+	HISTORY_MOVEMENT_REVERSAL     = "MovementReversal"
+	HISTORY_STATE_CHANGE_REVERSAL = "StateChangeReversal"
+	HISTORY_CUSTODY_TRANSFER      = "CustodyTransfer"
+)
+
 /**
 *@dev ProductState() represents the state of a product
 */
@@ -53,6 +88,8 @@ const (
 	PENDING
 	VALIDATING
 	PUBLISHING
+	PRODUCT_LEASED_OUT
+	PRODUCT_RETURNED
 )
 
 /**
@@ -69,45 +106,113 @@ func (c *ProductDetailsContract) Init(ctx contractapi.TransactionContextInterfac
 */
 
 func (c *ProductDetailsContract) AddProduct(ctx contractapi.TransactionContextInterface, name string, description string, manufacturedDate uint64, batchNumber string) error {
-	nextProductID, err := c.generateNextProductID(ctx)
-	if err != nil {
-		return err
-	}
-
-	product := Product{
-		ID:              nextProductID,
+	_, err := c.addProduct(ctx, Product{
 		Name:            name,
 		Description:     description,
 		ManufactureDate: manufacturedDate,
 		BatchNumber:     batchNumber,
+	})
+	return err
+}
+
+/**
+*@dev addProduct() registers a new product from its details, assigning its ID and making the caller its custodian
+*/
+
+func (c *ProductDetailsContract) addProduct(ctx contractapi.TransactionContextInterface, product Product) (uint64, error) {
+	nextProductID, err := c.generateNextProductID(ctx)
+	if err != nil {
+		return 0, err
 	}
 
-	err = ctx.GetStub().PutState(fmt.Sprintf("PRODUCT-%d", nextProductID), []byte(product));
+	custodian, err := ctx.GetClientIdentity().GetMSPID()
 	if err != nil {
-		return fmt.Errorf("failed to put product on the ledger: %v", err)
+		return 0, fmt.Errorf("failed to read submitter identity: %v", err)
 	}
 
-	return nil
+	product.ID = nextProductID
+	product.Custodian = custodian
 
+	err = c.resolveProductIngredients(ctx, &product)
+	if err != nil {
+		return 0, err
+	}
+
+	err = c.appendProductEvent(ctx, new(Product), ProductEvent{
+		Type:    EVENT_PRODUCT_REGISTERED,
+		Product: &product,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, allergen := range product.Allergens {
+		err = ctx.GetStub().PutState(fmt.Sprintf("ALLERGEN-%s-PRODUCT-%020d", allergen, product.ID), []byte(strconv.FormatUint(product.ID, 10)))
+		if err != nil {
+			return 0, fmt.Errorf("failed to put allergen index on the ledger: %v", err)
+		}
+	}
+
+	err = indexOrgProduct(ctx, custodian, product.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	if product.BatchNumber != "" {
+		err = c.indexBatchProduct(ctx, custodian, product.BatchNumber, product.ID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return nextProductID, nil
 }
 
 /**
-*@dev RetrieveProductDetails() retrieves the details of a product
+*@dev RetrieveProductDetails() retrieves the details of a product; a partner querying under a data-sharing agreement only sees the fields it shares
 */
 
 func (c *ProductDetailsContract) RetrieveProductDetails(ctx contractapi.TransactionContextInterface, productID uint64) (*Product, error) {
-	productBytes, err := ctx.GetStub().GetState(fmt.Sprintf("PRODUCT-%d", productID))
+	product, sharedFieldSets, err := c.authorizeProductQuery(ctx, productID, "RetrieveProductDetails", "")
 	if err != nil {
-		return nil, fmt.Errorf("failed to read product from the ledger: %v", err)
+		return nil, err
 	}
-	if productBytes == nil {
-		return nil, fmt.Errorf("product with ID %d does not exist", productID)
+	if sharedFieldSets != nil {
+		return filterProductFields(product, sharedFieldSets), nil
 	}
 
-	product := new(Product)
-	err = json.Unmarshal(productBytes, product)
+	return product, nil
+}
+
+/**
+*@dev retrieveProductDetails() projects a product from its latest snapshot and the events recorded since
+*/
+
+func (c *ProductDetailsContract) retrieveProductDetails(ctx contractapi.TransactionContextInterface, productID uint64) (*Product, error) {
+	product, err := c.retrieveProductSnapshot(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Products registered before event sourcing only have their location in the legacy history
+	if product.Version == 0 {
+		legacyHistories, err := c.retrieveLegacyProductHistory(ctx, productID)
+		if err != nil {
+			return nil, err
+		}
+		product.Location = currentLocation(legacyHistories)
+	}
+
+	events, err := c.retrieveProductEvents(ctx, productID, product.Version+1)
 	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal product JSON: %v", err)
+		return nil, err
+	}
+
+	for _, event := range events {
+		err = applyProductEvent(product, event)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return product, nil
@@ -118,89 +223,237 @@ func (c *ProductDetailsContract) RetrieveProductDetails(ctx contractapi.Transact
 */
 
 func (c *ProductDetailsContract) UpdateProductState(ctx contractapi.TransactionContextInterface, productID uint64, currentState ProductState) error {
-	product, err := c.RetrieveProductDetails(ctx, productID)
+	product, err := c.retrieveProductDetails(ctx, productID)
+	if err != nil {
+		return err
+	}
+
+	err = validStateTransition(product.State, currentState)
 	if err != nil {
 		return err
 	}
 
-	/**
-	*@dev check for valid state transitions
-    */
+	return c.appendProductEvent(ctx, product, ProductEvent{
+		Type:  HISTORY_STATE_CHANGE,
+		State: currentState,
+	})
+}
 
-	if product.State == PRODUCT_REGISTERED && currentState != PRODUCT_TRANSIT {
-		return fmt.Errorf("invalid state transition")
+/**
+*@dev LogProductMovement logs the movement of a product
+*
+* A tagged product can only be moved with LogTaggedProductMovement, so every movement in its history is physically proven.
+*/
+
+func (c *ProductDetailsContract) LogProductMovement(ctx contractapi.TransactionContextInterface, productID uint64, newLocation string) error {
+	product, err := c.retrieveProductDetails(ctx, productID)
+	if err != nil {
+		return err
+	}
+	if product.Tag != nil {
+		return fmt.Errorf("product %d has a registered tag, so its movements must be logged with LogTaggedProductMovement", productID)
 	}
 
-	product.State = currentState
-	productBytes, err := json.Marshal(product)
+	return c.appendProductEvent(ctx, product, ProductEvent{
+		Type:     HISTORY_MOVEMENT,
+		Location: newLocation,
+	})
+}
+
+/**
+*@dev GetProductHistory() retrieves the history of a product, hiding reversed entries and their compensations unless includeReversed is set
+*/
+
+func (c *ProductDetailsContract) GetProductHistory(ctx contractapi.TransactionContextInterface, productID uint64, includeReversed bool) ([]ProductHistory, error) {
+	_, _, err := c.authorizeProductQuery(ctx, productID, "GetProductHistory", FIELD_SET_HISTORY)
 	if err != nil {
-		return fmt.Errorf("failed to marshal product JSON: %v", err)
+		return nil, err
 	}
 
-	err = ctx.GetStub().PutState(fmt.Sprintf("PRODUCT-%d", productID), productBytes)
+	return c.productHistory(ctx, productID, includeReversed)
+}
+
+/**
+*@dev productHistory() reads a product's history, hiding reversed entries and their compensations unless includeReversed is set
+*/
+
+func (c *ProductDetailsContract) productHistory(ctx contractapi.TransactionContextInterface, productID uint64, includeReversed bool) ([]ProductHistory, error) {
+	histories, err := c.retrieveProductHistory(ctx, productID)
 	if err != nil {
-		return fmt.Errorf("failed to put updated product state on the ledger: %v", err)
+		return nil, err
 	}
 
+	if includeReversed {
+		return histories, nil
+	}
+
+	return effectiveHistory(histories), nil
+}
+
+/**
+*@dev validStateTransition() checks whether a state change, a dispute resolution or a reversion may move a product from one state to another
+*
+* The new state must be one of the states from PRODUCT_REGISTERED to PRODUCT_RETURNED.
+* Leases and recalls own their states: only LeaseProduct and ReturnLeasedProduct move a product into or out of a lease,
+* and only a recall moves it into PRODUCT_RECALLED, which it is tracked in unit by unit and does not leave.
+*/
+
+func validStateTransition(from ProductState, to ProductState) error {
+	if to < PRODUCT_REGISTERED || to > PRODUCT_RETURNED {
+		return fmt.Errorf("unknown product state %d", to)
+	}
+	if from == PRODUCT_LEASED_OUT || to == PRODUCT_LEASED_OUT || to == PRODUCT_RETURNED {
+		return fmt.Errorf("leased products change state through LeaseProduct and ReturnLeasedProduct")
+	}
+	if from == PRODUCT_RECALLED || to == PRODUCT_RECALLED {
+		return fmt.Errorf("recalled products change state only through recalls")
+	}
+	if !validLifecycleTransition(from, to) {
+		return fmt.Errorf("invalid state transition")
+	}
 	return nil
 }
 
 /**
-*@dev LogProductMovement logs the movement of a product
+*@dev validLifecycleTransition() checks the order a product moves through its lifecycle in, whichever transaction moves it
 */
 
-func (c *ProductDetailsContract) LogProductMovement(ctx contractapi.TransactionContextInterface, productID uint64, newLocation string) error {
-	product, err := c.RetrieveProductDetails(ctx, productID)
+func validLifecycleTransition(from ProductState, to ProductState) bool {
+	if from == PRODUCT_REGISTERED && to != PRODUCT_TRANSIT {
+		return false
+	}
+	return true
+}
+
+/**
+*@dev retrieveProductHistory() reads the history of a product since its latest checkpoint, including entries logged before event sourcing
+*/
+
+func (c *ProductDetailsContract) retrieveProductHistory(ctx contractapi.TransactionContextInterface, productID uint64) ([]ProductHistory, error) {
+	productHistories, err := c.retrieveLegacyProductHistory(ctx, productID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	productHistory := ProductHistory{
-		Timestamp: uint64(ctx.GetStub().GetTxTimestamp().GetSeconds()),
-		Action:    "Movement",
-		Location:  newLocation,
-		State:     product.State,
+	start, compactedThrough, err := c.historyStart(ctx, productID)
+	if err != nil {
+		return nil, err
 	}
 
-	timestamp, _ := ctx.GetStub().GetTxTimestamp() // Error handling is not required here
-    productHistory.Timestamp = uint64(timestamp.GetSeconds())
+	events, err := c.retrieveProductEvents(ctx, productID, compactedThrough+1)
+	if err != nil {
+		return nil, err
+	}
 
-	historyKey := fmt.Sprintf("PRODUCT-%d-HISTORY", productID)
-	existingHistoryBytes, err := ctx.GetStub().GetState(historyKey)
+	projected, err := projectProductHistory(start, events)
 	if err != nil {
-		return fmt.Errorf("failed to read product history from the ledger: %v", err)
+		return nil, err
 	}
 
-	var productHistories []ProductHistory
-	if existingHistoryBytes != nil {
-		err = json.Unmarshal(existingHistoryBytes, &productHistories)
-		if err != nil {
-			return fmt.Errorf("failed to unmarshal product history JSON: %v", err);
+	return append(productHistories, projected...), nil
 }
 
-		// Unmarshal existing product histories
-		err = json.Unmarshal(existingHistoryBytes, &productHistories)
+/**
+*@dev retrieveLegacyProductHistory() reads the history list LogProductMovement kept before event sourcing
+*/
+
+func (c *ProductDetailsContract) retrieveLegacyProductHistory(ctx contractapi.TransactionContextInterface, productID uint64) ([]ProductHistory, error) {
+	historyBytes, err := ctx.GetStub().GetState(fmt.Sprintf("PRODUCT-%d-HISTORY", productID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read product history from the ledger: %v", err)
+	}
+
+	productHistories := []ProductHistory{}
+	if historyBytes != nil {
+		err = json.Unmarshal(historyBytes, &productHistories)
 		if err != nil {
-			return fmt.Errorf("failed to unmarshal product history JSON: %v", err)
+			return nil, fmt.Errorf("failed to unmarshal product history JSON: %v", err)
+		}
+	}
+
+	return productHistories, nil
+}
+
+/**
+*@dev effectiveHistory() drops reversed entries together with the entries that reversed them
+*/
+
+func effectiveHistory(productHistories []ProductHistory) []ProductHistory {
+	reversed := make(map[string]bool)
+	for _, productHistory := range productHistories {
+		if productHistory.Reverses != "" {
+			reversed[productHistory.Reverses] = true
+		}
+	}
+
+	effective := []ProductHistory{}
+	for _, productHistory := range productHistories {
+		if productHistory.Reverses != "" || (productHistory.TxID != "" && reversed[productHistory.TxID]) {
+			continue
 		}
+		effective = append(effective, productHistory)
 	}
 
-	// Append the new product history
-	productHistories = append(productHistories, productHistory)
+	return effective
+}
 
-	// Marshal the updated product history
-	updatedHistoryBytes, err := json.Marshal(productHistories)
-	if err != nil {
-		return fmt.Errorf("failed to marshal updated product history JSON: %v", err)
+/**
+*@dev currentLocation() returns the location of the last movement in a product's effective history
+*/
+
+func currentLocation(productHistories []ProductHistory) string {
+	location := ""
+	for _, productHistory := range effectiveHistory(productHistories) {
+		if productHistory.Action == HISTORY_MOVEMENT {
+			location = productHistory.Location
+		}
 	}
+	return location
+}
+
+/**
+*@dev GetLastProductID() returns the ID of the product registered last, or 0 if there is none
+*
+* IDs are issued in sequence and never reused, so every ID up to this one belongs to a product, whether or not the caller
+* may read it, and no higher ID does.
+*/
 
-	// Store the updated history on the ledger
-	err = ctx.GetStub().PutState(historyKey, updatedHistoryBytes)
+func (c *ProductDetailsContract) GetLastProductID(ctx contractapi.TransactionContextInterface) (uint64, error) {
+	return c.lastProductID(ctx)
+}
+
+func (c *ProductDetailsContract) lastProductID(ctx contractapi.TransactionContextInterface) (uint64, error) {
+	counterBytes, err := ctx.GetStub().GetState("PRODUCT-COUNTER")
 	if err != nil {
-		return fmt.Errorf("failed to put updated product history on the ledger: %v", err)
+		return 0, fmt.Errorf("failed to read product counter from the ledger: %v", err)
 	}
 
-	return nil
+	var lastProductID uint64
+	if counterBytes != nil {
+		lastProductID, err = strconv.ParseUint(string(counterBytes), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse product counter: %v", err)
+		}
+	}
+
+	return lastProductID, nil
 }
 
+/**
+*@dev generateNextProductID() increments and returns the product ID counter
+*/
+
+func (c *ProductDetailsContract) generateNextProductID(ctx contractapi.TransactionContextInterface) (uint64, error) {
+	lastProductID, err := c.lastProductID(ctx)
+	if err != nil {
+		return 0, err
+	}
 
+	nextProductID := lastProductID + 1
+	err = ctx.GetStub().PutState("PRODUCT-COUNTER", []byte(strconv.FormatUint(nextProductID, 10)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to put product counter on the ledger: %v", err)
+	}
+
+	return nextProductID, nil
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"Quanta-Ledger/historyarchive"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+/**
+*@dev ProductEvent() represents one entry in a product's append-only event stream
+*
+* The product record stored under PRODUCT-%d is only a snapshot; the events are the source of truth.
+*/
+
+type ProductEvent struct {
+	ProductID          uint64              `json:"productId"`
+	Sequence           uint64              `json:"sequence"`
+	Type               string              `json:"type"`
+	TxID               string              `json:"txId"`
+	Timestamp          uint64              `json:"timestamp"`
+	Actor              string              `json:"actor"`
+	Product            *Product            `json:"product,omitempty" metadata:",optional"`
+	State              ProductState        `json:"state"`
+	Location           string              `json:"location,omitempty" metadata:",optional"`
+	Reverses           string              `json:"reverses,omitempty" metadata:",optional"`
+	Reason             string              `json:"reason,omitempty" metadata:",optional"`
+	Custodian          string              `json:"custodian,omitempty" metadata:",optional"`
+	ReturnVerification *ReturnVerification `json:"returnVerification,omitempty" metadata:",optional"`
+	TagCounter         uint64              `json:"tagCounter,omitempty" metadata:",optional"`
+	PhysicallyProven   bool                `json:"physicallyProven,omitempty" metadata:",optional"`
+	Relocates          bool                `json:"relocates,omitempty" metadata:",optional"`
+	PreviousHash       string              `json:"previousHash,omitempty" metadata:",optional"`
+}
+
+/**
+*@dev event types that do not appear in ProductHistory; the rest share the HISTORY_* actions
+*/
+
+const (
+	EVENT_PRODUCT_REGISTERED = "Registered"
+	EVENT_RETURN_VERIFIED    = "ReturnVerified"
+)
+
+/**
+*@dev PRODUCT_SNAPSHOT_INTERVAL is how many events may accumulate before the product snapshot is rewritten
+*/
+
+const PRODUCT_SNAPSHOT_INTERVAL = 10
+
+/**
+*@dev LEGACY_MIGRATION_REASON marks the registration event that opens the stream of a product stored before event sourcing
+*/
+
+const LEGACY_MIGRATION_REASON = "migrated from pre-event record"
+
+/**
+*@dev ProductConsistencyReport() represents the result of rebuilding a product from its events and comparing it with the snapshot
+*/
+
+type ProductConsistencyReport struct {
+	ProductID       uint64   `json:"productId"`
+	SnapshotVersion uint64   `json:"snapshotVersion"`
+	EventCount      uint64   `json:"eventCount"`
+	Consistent      bool     `json:"consistent"`
+	Differences     []string `json:"differences"`
+}
+
+/**
+*@dev GetProductEvents() retrieves a product's event stream since its latest history checkpoint
+*/
+
+func (c *ProductDetailsContract) GetProductEvents(ctx contractapi.TransactionContextInterface, productID uint64) ([]ProductEvent, error) {
+	_, _, err := c.authorizeProductQuery(ctx, productID, "GetProductEvents", FIELD_SET_HISTORY)
+	if err != nil {
+		return nil, err
+	}
+
+	_, compactedThrough, err := c.historyStart(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.retrieveProductEvents(ctx, productID, compactedThrough+1)
+}
+
+/**
+*@dev CheckProductConsistency() rebuilds a product from its events and compares the result with the stored snapshot
+*/
+
+func (c *ProductDetailsContract) CheckProductConsistency(ctx contractapi.TransactionContextInterface, productID uint64) (*ProductConsistencyReport, error) {
+	_, _, err := c.authorizeProductQuery(ctx, productID, "CheckProductConsistency", FIELD_SET_HISTORY)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot, err := c.retrieveProductSnapshot(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	start, compactedThrough, err := c.historyStart(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := c.retrieveProductEvents(ctx, productID, compactedThrough+1)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ProductConsistencyReport{
+		ProductID:       productID,
+		SnapshotVersion: snapshot.Version,
+		EventCount:      uint64(len(events)),
+		Differences:     []string{},
+	}
+
+	// Products registered before event sourcing have no events until their next change
+	if len(events) == 0 && snapshot.Version == 0 {
+		report.Consistent = true
+		return report, nil
+	}
+
+	// Compacted events are replayed from the product recorded in their checkpoint
+	rebuilt := &start
+	for i, event := range events {
+		if event.Sequence != compactedThrough+uint64(i+1) {
+			report.Differences = append(report.Differences, fmt.Sprintf("event sequence gap: expected %d, found %d", compactedThrough+uint64(i+1), event.Sequence))
+			break
+		}
+		if event.Sequence > snapshot.Version {
+			break
+		}
+		err = applyProductEvent(rebuilt, event)
+		if err != nil {
+			report.Differences = append(report.Differences, err.Error())
+			break
+		}
+	}
+
+	if rebuilt.Version != snapshot.Version {
+		report.Differences = append(report.Differences, fmt.Sprintf("snapshot is at version %d but events only rebuild to version %d", snapshot.Version, rebuilt.Version))
+	}
+
+	differences, err := diffProducts(snapshot, rebuilt)
+	if err != nil {
+		return nil, err
+	}
+	report.Differences = append(report.Differences, differences...)
+	report.Consistent = len(report.Differences) == 0
+
+	return report, nil
+}
+
+/**
+*@dev retrieveProductSnapshot() reads the stored product snapshot without replaying later events
+*/
+
+func (c *ProductDetailsContract) retrieveProductSnapshot(ctx contractapi.TransactionContextInterface, productID uint64) (*Product, error) {
+	productBytes, err := ctx.GetStub().GetState(fmt.Sprintf("PRODUCT-%d", productID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read product from the ledger: %v", err)
+	}
+	if productBytes == nil {
+		return nil, fmt.Errorf("product with ID %d does not exist", productID)
+	}
+
+	product := new(Product)
+	err = json.Unmarshal(productBytes, product)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal product JSON: %v", err)
+	}
+
+	return product, nil
+}
+
+/**
+*@dev retrieveProductEvents() reads a product's events starting at the given sequence number
+*/
+
+func (c *ProductDetailsContract) retrieveProductEvents(ctx contractapi.TransactionContextInterface, productID uint64, fromSequence uint64) ([]ProductEvent, error) {
+	iterator, err := ctx.GetStub().GetStateByRange(productEventKey(productID, fromSequence), fmt.Sprintf("PRODUCT-%d-EVENT-~", productID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read product events from the ledger: %v", err)
+	}
+	defer iterator.Close()
+
+	events := []ProductEvent{}
+	for iterator.HasNext() {
+		result, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read product event from the ledger: %v", err)
+		}
+
+		var event ProductEvent
+		err = json.Unmarshal(result.Value, &event)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal product event JSON: %v", err)
+		}
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+/**
+*@dev appendProductEvent() stamps an event, applies it to the product in memory, stores it and rewrites the snapshot when one is due
+*
+* Fabric does not let a transaction read its own writes, so callers appending several events must pass the same product.
+*/
+
+func (c *ProductDetailsContract) appendProductEvent(ctx contractapi.TransactionContextInterface, product *Product, event ProductEvent) error {
+	if product.Version == 0 && event.Type != EVENT_PRODUCT_REGISTERED {
+		err := c.migrateLegacyProduct(ctx, product)
+		if err != nil {
+			return err
+		}
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+
+	actor, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+
+	previousHash, err := c.previousEventHash(ctx, product)
+	if err != nil {
+		return err
+	}
+
+	event.Sequence = product.Version + 1
+	event.PreviousHash = previousHash
+	event.TxID = ctx.GetStub().GetTxID()
+	event.Timestamp = uint64(timestamp.GetSeconds())
+	event.Actor = actor
+	if event.Product != nil {
+		event.ProductID = event.Product.ID
+	} else {
+		event.ProductID = product.ID
+	}
+
+	err = applyProductEvent(product, event)
+	if err != nil {
+		return err
+	}
+
+	if product.State == PRODUCT_RECALLED && (event.Type == HISTORY_MOVEMENT || event.Type == HISTORY_CUSTODY_TRANSFER) {
+		err = c.trackRecalledProduct(ctx, product, event)
+		if err != nil {
+			return err
+		}
+	}
+
+	eventBytes, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal product event JSON: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(productEventKey(event.ProductID, event.Sequence), eventBytes)
+	if err != nil {
+		return fmt.Errorf("failed to put product event on the ledger: %v", err)
+	}
+	product.eventHash = historyarchive.EntryHash(string(eventBytes))
+
+	if event.Sequence == 1 || event.Sequence%PRODUCT_SNAPSHOT_INTERVAL == 0 {
+		productBytes, err := json.Marshal(product)
+		if err != nil {
+			return fmt.Errorf("failed to marshal product JSON: %v", err)
+		}
+
+		err = ctx.GetStub().PutState(fmt.Sprintf("PRODUCT-%d", product.ID), productBytes)
+		if err != nil {
+			return fmt.Errorf("failed to put product snapshot on the ledger: %v", err)
+		}
+	}
+
+	return nil
+}
+
+/**
+*@dev migrateLegacyProduct() opens the event stream of a product stored before event sourcing with a registration event of its current record
+*/
+
+func (c *ProductDetailsContract) migrateLegacyProduct(ctx contractapi.TransactionContextInterface, product *Product) error {
+	legacyHistories, err := c.retrieveLegacyProductHistory(ctx, product.ID)
+	if err != nil {
+		return err
+	}
+
+	registered := *product
+	registered.Location = currentLocation(legacyHistories)
+
+	return c.appendProductEvent(ctx, product, ProductEvent{
+		Type:    EVENT_PRODUCT_REGISTERED,
+		Product: &registered,
+		Reason:  LEGACY_MIGRATION_REASON,
+	})
+}
+
+/**
+*@dev applyProductEvent() folds one event into a product
+*/
+
+func applyProductEvent(product *Product, event ProductEvent) error {
+	if event.Sequence != product.Version+1 {
+		return fmt.Errorf("event %d of product %d applied out of order after version %d", event.Sequence, event.ProductID, product.Version)
+	}
+
+	switch event.Type {
+	case EVENT_PRODUCT_REGISTERED:
+		if event.Product == nil {
+			return fmt.Errorf("registration event %d of product %d has no product", event.Sequence, event.ProductID)
+		}
+		*product = *event.Product
+	case HISTORY_STATE_CHANGE, HISTORY_STATE_CHANGE_REVERSAL:
+		product.State = event.State
+	case HISTORY_MOVEMENT, HISTORY_MOVEMENT_REVERSAL:
+		product.Location = event.Location
+		if event.PhysicallyProven {
+			if product.Tag == nil {
+				return fmt.Errorf("event %d of product %d is tag-proven but the product has no tag", event.Sequence, event.ProductID)
+			}
+			tag := *product.Tag
+			tag.Counter = event.TagCounter
+			product.Tag = &tag
+		}
+	case HISTORY_CUSTODY_TRANSFER:
+		product.Custodian = event.Custodian
+		// Transfers recorded before handovers moved the product keep the location they were replayed with
+		if event.Relocates {
+			product.Location = event.Location
+		}
+	case EVENT_RETURN_VERIFIED:
+		product.ReturnVerification = event.ReturnVerification
+	default:
+		return fmt.Errorf("unknown event type %s in event %d of product %d", event.Type, event.Sequence, event.ProductID)
+	}
+
+	product.Version = event.Sequence
+	return nil
+}
+
+/**
+*@dev projectProductHistory() turns movement and state change events into history entries
+*/
+
+func projectProductHistory(start Product, events []ProductEvent) ([]ProductHistory, error) {
+	product := start
+	productHistories := []ProductHistory{}
+	for _, event := range events {
+		previousState := product.State
+		err := applyProductEvent(&product, event)
+		if err != nil {
+			return nil, err
+		}
+
+		switch event.Type {
+		case HISTORY_MOVEMENT, HISTORY_STATE_CHANGE, HISTORY_MOVEMENT_REVERSAL, HISTORY_STATE_CHANGE_REVERSAL, HISTORY_CUSTODY_TRANSFER:
+			location := product.Location
+			if event.Type == HISTORY_CUSTODY_TRANSFER && event.Location != "" {
+				location = event.Location
+			}
+			productHistories = append(productHistories, ProductHistory{
+				Timestamp:        event.Timestamp,
+				Action:           event.Type,
+				Location:         location,
+				State:            product.State,
+				PreviousState:    previousState,
+				TxID:             event.TxID,
+				Reverses:         event.Reverses,
+				Reason:           event.Reason,
+				Custodian:        product.Custodian,
+				PhysicallyProven: event.PhysicallyProven,
+			})
+		}
+	}
+
+	return productHistories, nil
+}
+
+/**
+*@dev diffProducts() lists the fields that differ between a snapshot and a rebuilt product
+*/
+
+func diffProducts(snapshot *Product, rebuilt *Product) ([]string, error) {
+	snapshotFields, err := productFields(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	rebuiltFields, err := productFields(rebuilt)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for name := range snapshotFields {
+		names = append(names, name)
+	}
+	for name := range rebuiltFields {
+		if _, ok := snapshotFields[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	differences := []string{}
+	for _, name := range names {
+		if string(snapshotFields[name]) != string(rebuiltFields[name]) {
+			differences = append(differences, fmt.Sprintf("%s: snapshot %s, events %s", name, snapshotFields[name], rebuiltFields[name]))
+		}
+	}
+
+	return differences, nil
+}
+
+func productFields(product *Product) (map[string]json.RawMessage, error) {
+	productBytes, err := json.Marshal(product)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal product JSON: %v", err)
+	}
+
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(productBytes, &fields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal product JSON: %v", err)
+	}
+
+	return fields, nil
+}
+
+func productEventKey(productID uint64, sequence uint64) string {
+	return fmt.Sprintf("PRODUCT-%d-EVENT-%020d", productID, sequence)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+/**
+*@dev TAG_CHALLENGE_LIFETIME is how many seconds a tag challenge can be answered for after it is issued
+*/
+
+const TAG_CHALLENGE_LIFETIME = 300
+
+/**
+*@dev ProductTag() represents the secure NFC tag attached to a product and the last counter it proved a check-in with
+*/
+
+type ProductTag struct {
+	ID        string `json:"id"`
+	PublicKey string `json:"publicKey"`
+	Counter   uint64 `json:"counter"`
+}
+
+/**
+*@dev TagChallenge() represents a one-time challenge the ledger issued to an organisation for a tag to sign
+*/
+
+type TagChallenge struct {
+	TagID     string `json:"tagId"`
+	ProductID uint64 `json:"productId"`
+	Challenge string `json:"challenge"`
+	IssuedTo  string `json:"issuedTo"`
+	ExpiresAt uint64 `json:"expiresAt"`
+}
+
+/**
+*@dev AddTaggedProduct() adds a new product with the PEM public key of the secure NFC tag attached to it
+*
+* A tag ID can only be registered once, so a cloned tag cannot be attached to a second product.
+*/
+
+func (c *ProductDetailsContract) AddTaggedProduct(ctx contractapi.TransactionContextInterface, name string, description string, manufacturedDate uint64, batchNumber string, tagID string, tagPublicKey string) error {
+	if tagID == "" {
+		return fmt.Errorf("tag ID is required")
+	}
+
+	_, err := parsePublicKey(tagPublicKey)
+	if err != nil {
+		return err
+	}
+
+	taggedBytes, err := ctx.GetStub().GetState(tagProductKey(tagID))
+	if err != nil {
+		return fmt.Errorf("failed to read tag index from the ledger: %v", err)
+	}
+	if taggedBytes != nil {
+		return fmt.Errorf("tag %s is already registered for product %s", tagID, taggedBytes)
+	}
+
+	productID, err := c.addProduct(ctx, Product{
+		Name:            name,
+		Description:     description,
+		ManufactureDate: manufacturedDate,
+		BatchNumber:     batchNumber,
+		Tag: &ProductTag{
+			ID:        tagID,
+			PublicKey: tagPublicKey,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = ctx.GetStub().PutState(tagProductKey(tagID), []byte(strconv.FormatUint(productID, 10)))
+	if err != nil {
+		return fmt.Errorf("failed to put tag index on the ledger: %v", err)
+	}
+
+	return nil
+}
+
+// The index has its own prefix, so no tag ID can reach a TAG-<id>-CHALLENGE- key
+func tagProductKey(tagID string) string {
+	return fmt.Sprintf("TAGID-%s", tagID)
+}
+
+/**
+*@dev IssueTagChallenge() issues the caller's organisation a one-time challenge for the tag of a product to sign when read
+*
+* Each organisation holds at most one challenge per tag, so a new one replaces its earlier one.
+*/
+
+func (c *ProductDetailsContract) IssueTagChallenge(ctx contractapi.TransactionContextInterface, productID uint64) (*TagChallenge, error) {
+	product, err := c.retrieveProductDetails(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+	if product.Tag == nil {
+		return nil, fmt.Errorf("product %d has no registered tag", productID)
+	}
+
+	caller, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+
+	// The transaction ID is unique and unknown before the transaction is proposed, so the challenge cannot be answered in advance
+	digest := sha256.Sum256([]byte(ctx.GetStub().GetTxID()))
+	challenge := &TagChallenge{
+		TagID:     product.Tag.ID,
+		ProductID: productID,
+		Challenge: hex.EncodeToString(digest[:]),
+		IssuedTo:  caller,
+		ExpiresAt: uint64(timestamp.GetSeconds()) + TAG_CHALLENGE_LIFETIME,
+	}
+
+	challengeBytes, err := json.Marshal(challenge)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal tag challenge JSON: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(fmt.Sprintf("TAG-%s-CHALLENGE-%s", challenge.TagID, caller), challengeBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to put tag challenge on the ledger: %v", err)
+	}
+
+	return challenge, nil
+}
+
+/**
+*@dev LogTaggedProductMovement() logs the movement of a product with a one-time tag response proving it was physically present
+*
+* The tag must sign the challenge last issued to the caller's organisation with IssueTagChallenge, together with the new
+* location, so a response cannot be replayed or moved to another location.
+*/
+
+func (c *ProductDetailsContract) LogTaggedProductMovement(ctx contractapi.TransactionContextInterface, productID uint64, newLocation string, tagID string, counter uint64, signature string) error {
+	product, err := c.retrieveProductDetails(ctx, productID)
+	if err != nil {
+		return err
+	}
+
+	if product.Tag == nil {
+		return fmt.Errorf("product %d has no registered tag", productID)
+	}
+	if tagID != product.Tag.ID {
+		return fmt.Errorf("tag %s is not the tag registered for product %d", tagID, productID)
+	}
+
+	challenge, err := c.consumeTagChallenge(ctx, tagID, productID)
+	if err != nil {
+		return err
+	}
+
+	// The tag increments its counter on every read, so a counter already seen is a replayed response
+	if counter <= product.Tag.Counter {
+		return fmt.Errorf("tag counter %d is not greater than the last accepted counter %d", counter, product.Tag.Counter)
+	}
+
+	err = verifySignature(product.Tag.PublicKey, TagResponseSigningPayload(tagID, counter, challenge.Challenge, newLocation), signature)
+	if err != nil {
+		return fmt.Errorf("tag response for product %d: %v", productID, err)
+	}
+
+	return c.appendProductEvent(ctx, product, ProductEvent{
+		Type:             HISTORY_MOVEMENT,
+		Location:         newLocation,
+		TagCounter:       counter,
+		PhysicallyProven: true,
+	})
+}
+
+/**
+*@dev consumeTagChallenge() retrieves and deletes the unexpired challenge issued to the caller's organisation for a tag
+*/
+
+func (c *ProductDetailsContract) consumeTagChallenge(ctx contractapi.TransactionContextInterface, tagID string, productID uint64) (*TagChallenge, error) {
+	caller, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+
+	challengeKey := fmt.Sprintf("TAG-%s-CHALLENGE-%s", tagID, caller)
+	challengeBytes, err := ctx.GetStub().GetState(challengeKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tag challenge from the ledger: %v", err)
+	}
+	if challengeBytes == nil {
+		return nil, fmt.Errorf("no challenge has been issued to %s for tag %s", caller, tagID)
+	}
+
+	challenge := new(TagChallenge)
+	err = json.Unmarshal(challengeBytes, challenge)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tag challenge JSON: %v", err)
+	}
+	if challenge.ProductID != productID {
+		return nil, fmt.Errorf("the challenge for tag %s was issued for product %d", tagID, challenge.ProductID)
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+	if uint64(timestamp.GetSeconds()) > challenge.ExpiresAt {
+		return nil, fmt.Errorf("the challenge for tag %s expired at %d", tagID, challenge.ExpiresAt)
+	}
+
+	err = ctx.GetStub().DelState(challengeKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete tag challenge from the ledger: %v", err)
+	}
+
+	return challenge, nil
+}
+
+/**
+*@dev TagResponseSigningPayload() returns the bytes a tag signs for a read: tagId|counter|challenge|location
+*/
+
+func TagResponseSigningPayload(tagID string, counter uint64, challenge string, location string) []byte {
+	return []byte(tagID + "|" + strconv.FormatUint(counter, 10) + "|" + challenge + "|" + location)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+/**
+*@dev RecallStatus() represents whether a recall is still being worked
+*/
+
+type RecallStatus int
+
+const (
+	RECALL_OPEN RecallStatus = iota
+	RECALL_CLOSED
+)
+
+/**
+*@dev Recall() represents a recall and the products it moved to PRODUCT_RECALLED
+*/
+
+type Recall struct {
+	ID                   string            `json:"id"`
+	Reason               string            `json:"reason"`
+	Initiator            string            `json:"initiator"`
+	BatchNumber          string            `json:"batchNumber,omitempty" metadata:",optional"`
+	CatalogItemID        string            `json:"catalogItemId,omitempty" metadata:",optional"`
+	Attributes           map[string]string `json:"attributes,omitempty" metadata:",optional"`
+	ProductIDs           []uint64          `json:"productIds"`
+	Timestamp            uint64            `json:"timestamp"`
+	Status               RecallStatus      `json:"status"`
+	Override             *RecallOverride   `json:"override,omitempty" metadata:",optional"`
+	ClosedAt             uint64            `json:"closedAt,omitempty" metadata:",optional"`
+	ClosingEffectiveness float64           `json:"closingEffectiveness,omitempty" metadata:",optional"`
+}
+
+/**
+*@dev RecallBatch() recalls every product the caller registered under a batch number
+*
+* Products are found through the batch index written when they are registered. Batch numbers are only unique per
+* organisation. Products registered before the index existed are only found once IndexProducts has covered them.
+* Those registered before registrants were recorded are only recalled by an admin, or by their custodian.
+*/
+
+func (c *ProductDetailsContract) RecallBatch(ctx contractapi.TransactionContextInterface, batchNumber string, reason string) (string, error) {
+	if batchNumber == "" {
+		return "", fmt.Errorf("batch number is required")
+	}
+
+	initiator, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return "", fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+
+	// Products registered before registrants were recorded are indexed without one, and only an admin or their custodian can recall them
+	admin := c.hasRole(ctx, ROLE_ADMIN)
+	unattributedPrefix := batchProductPrefix("", batchNumber)
+
+	products := []*Product{}
+	for _, prefix := range []string{batchProductPrefix(initiator, batchNumber), unattributedPrefix} {
+		iterator, err := ctx.GetStub().GetStateByRange(prefix, prefix+"~")
+		if err != nil {
+			return "", fmt.Errorf("failed to read batch index from the ledger: %v", err)
+		}
+
+		for iterator.HasNext() {
+			result, err := iterator.Next()
+			if err != nil {
+				iterator.Close()
+				return "", fmt.Errorf("failed to read batch index from the ledger: %v", err)
+			}
+
+			productID, err := strconv.ParseUint(string(result.Value), 10, 64)
+			if err != nil {
+				iterator.Close()
+				return "", fmt.Errorf("failed to parse batch product ID: %v", err)
+			}
+
+			product, err := c.retrieveProductDetails(ctx, productID)
+			if err != nil {
+				iterator.Close()
+				return "", err
+			}
+			if prefix == unattributedPrefix && !admin && product.Custodian != initiator {
+				continue
+			}
+			products = append(products, product)
+		}
+		iterator.Close()
+	}
+
+	recall := &Recall{
+		ID:          ctx.GetStub().GetTxID(),
+		Reason:      reason,
+		Initiator:   initiator,
+		BatchNumber: batchNumber,
+	}
+
+	err = c.recallProducts(ctx, recall, products)
+	if err != nil {
+		return "", err
+	}
+
+	return recall.ID, nil
+}
+
+/**
+*@dev IndexProducts() adds the products with IDs from fromProductID to toProductID to the batch and organisation indexes; only an admin may call it
+*
+* Products are indexed when registered, so this only needs running once, in pages, over those registered before.
+*/
+
+func (c *ProductDetailsContract) IndexProducts(ctx contractapi.TransactionContextInterface, fromProductID uint64, toProductID uint64) (uint64, error) {
+	err := c.assertRole(ctx, ROLE_ADMIN)
+	if err != nil {
+		return 0, err
+	}
+	if fromProductID == 0 || toProductID < fromProductID {
+		return 0, fmt.Errorf("invalid product ID range %d to %d", fromProductID, toProductID)
+	}
+
+	var indexed uint64
+	for productID := fromProductID; productID <= toProductID; productID++ {
+		product, err := c.retrieveProductDetails(ctx, productID)
+		if err != nil {
+			return 0, err
+		}
+
+		registrant, err := c.productRegistrant(ctx, productID)
+		if err != nil {
+			return 0, err
+		}
+
+		if registrant != "" {
+			err = indexOrgProduct(ctx, registrant, productID)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if product.BatchNumber != "" {
+			err = c.indexBatchProduct(ctx, registrant, product.BatchNumber, productID)
+			if err != nil {
+				return 0, err
+			}
+		}
+		indexed++
+	}
+
+	return indexed, nil
+}
+
+/**
+*@dev RecallVariant() recalls every product of a catalog item whose variant has the given option values
+*/
+
+func (c *ProductDetailsContract) RecallVariant(ctx contractapi.TransactionContextInterface, catalogItemID string, attributes map[string]string, reason string) (string, error) {
+	catalogItem, err := c.RetrieveCatalogItem(ctx, catalogItemID)
+	if err != nil {
+		return "", err
+	}
+
+	initiator, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return "", fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+	if initiator != catalogItem.Owner {
+		return "", fmt.Errorf("only %s can recall products of catalog item %s", catalogItem.Owner, catalogItemID)
+	}
+
+	products, err := c.variantProducts(ctx, catalogItemID, attributes)
+	if err != nil {
+		return "", err
+	}
+
+	recall := &Recall{
+		ID:            ctx.GetStub().GetTxID(),
+		Reason:        reason,
+		Initiator:     initiator,
+		CatalogItemID: catalogItemID,
+		Attributes:    attributes,
+	}
+
+	err = c.recallProducts(ctx, recall, products)
+	if err != nil {
+		return "", err
+	}
+
+	return recall.ID, nil
+}
+
+/**
+*@dev RetrieveRecall() retrieves a recall
+*/
+
+func (c *ProductDetailsContract) RetrieveRecall(ctx contractapi.TransactionContextInterface, recallID string) (*Recall, error) {
+	recallBytes, err := ctx.GetStub().GetState(fmt.Sprintf("RECALL-%s", recallID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recall from the ledger: %v", err)
+	}
+	if recallBytes == nil {
+		return nil, fmt.Errorf("recall %s does not exist", recallID)
+	}
+
+	recall := new(Recall)
+	err = json.Unmarshal(recallBytes, recall)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal recall JSON: %v", err)
+	}
+
+	return recall, nil
+}
+
+/**
+*@dev recallProducts() moves products to PRODUCT_RECALLED, opens their progress records, stores the recall and emits a RecallIssued event
+*
+* A recall applies whatever state a product is in; products already recalled are left out.
+*/
+
+func (c *ProductDetailsContract) recallProducts(ctx contractapi.TransactionContextInterface, recall *Recall, products []*Product) error {
+	if len(products) == 0 {
+		return fmt.Errorf("no products match the recall")
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+	recall.Timestamp = uint64(timestamp.GetSeconds())
+
+	recall.ProductIDs = []uint64{}
+	for _, product := range products {
+		if product.State == PRODUCT_RECALLED {
+			continue
+		}
+
+		err = c.appendProductEvent(ctx, product, ProductEvent{
+			Type:   HISTORY_STATE_CHANGE,
+			State:  PRODUCT_RECALLED,
+			Reason: fmt.Sprintf("recall %s: %s", recall.ID, recall.Reason),
+		})
+		if err != nil {
+			return err
+		}
+		recall.ProductIDs = append(recall.ProductIDs, product.ID)
+
+		err = c.openRecallUnit(ctx, recall, product)
+		if err != nil {
+			return err
+		}
+	}
+
+	// A recall with no units could never reach the effectiveness needed to close
+	if len(recall.ProductIDs) == 0 {
+		return fmt.Errorf("every product matching the recall has already been recalled")
+	}
+
+	recallBytes, err := c.putRecall(ctx, recall)
+	if err != nil {
+		return err
+	}
+
+	err = ctx.GetStub().SetEvent("RecallIssued", recallBytes)
+	if err != nil {
+		return fmt.Errorf("failed to set recall event: %v", err)
+	}
+
+	return nil
+}
+
+func (c *ProductDetailsContract) putRecall(ctx contractapi.TransactionContextInterface, recall *Recall) ([]byte, error) {
+	recallBytes, err := json.Marshal(recall)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal recall JSON: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(fmt.Sprintf("RECALL-%s", recall.ID), recallBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to put recall on the ledger: %v", err)
+	}
+
+	return recallBytes, nil
+}
+
+/**
+*@dev indexBatchProduct() links a product to its registrant's batch; products with no recorded registrant go under ""
+*/
+
+func (c *ProductDetailsContract) indexBatchProduct(ctx contractapi.TransactionContextInterface, registrant string, batchNumber string, productID uint64) error {
+	err := ctx.GetStub().PutState(fmt.Sprintf("%s%020d", batchProductPrefix(registrant, batchNumber), productID), []byte(strconv.FormatUint(productID, 10)))
+	if err != nil {
+		return fmt.Errorf("failed to put batch index on the ledger: %v", err)
+	}
+
+	return nil
+}
+
+func batchProductPrefix(registrant string, batchNumber string) string {
+	return fmt.Sprintf("ORG-%s-BATCH-%s-PRODUCT-", registrant, batchNumber)
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+/**
+*@dev RecallDisposition() represents what has become of one recalled unit
+*/
+
+type RecallDisposition int
+
+const (
+	RECALL_UNIT_IN_MARKET RecallDisposition = iota
+	RECALL_UNIT_RETURNED
+	RECALL_UNIT_DESTROYED
+	RECALL_UNIT_UNTRACEABLE
+)
+
+/**
+*@dev RECALL_CLOSE_THRESHOLD is the share of units that must be returned or destroyed before a recall closes without an override
+*/
+
+const RECALL_CLOSE_THRESHOLD = 0.95
+
+/**
+*@dev RecallUnit() represents the progress record of one product in a recall
+*/
+
+type RecallUnit struct {
+	RecallID     string            `json:"recallId"`
+	ProductID    uint64            `json:"productId"`
+	Disposition  RecallDisposition `json:"disposition"`
+	Holder       string            `json:"holder"`
+	LastLocation string            `json:"lastLocation"`
+	Note         string            `json:"note,omitempty" metadata:",optional"`
+	TxID         string            `json:"txId"`
+	UpdatedAt    uint64            `json:"updatedAt"`
+}
+
+/**
+*@dev RecallOverride() represents a regulator's approval to close a recall below the effectiveness threshold
+*/
+
+type RecallOverride struct {
+	ApprovedBy string `json:"approvedBy"`
+	Reason     string `json:"reason"`
+	TxID       string `json:"txId"`
+	Timestamp  uint64 `json:"timestamp"`
+}
+
+/**
+*@dev RecallProgress() represents how many recalled units are in each disposition
+*/
+
+type RecallProgress struct {
+	Holder        string  `json:"holder,omitempty" metadata:",optional"`
+	Total         int     `json:"total"`
+	Returned      int     `json:"returned"`
+	Destroyed     int     `json:"destroyed"`
+	InMarket      int     `json:"inMarket"`
+	Untraceable   int     `json:"untraceable"`
+	Effectiveness float64 `json:"effectiveness"`
+}
+
+/**
+*@dev RecallEffectivenessReport() represents a recall's progress overall and per downstream holder
+*/
+
+type RecallEffectivenessReport struct {
+	RecallID string           `json:"recallId"`
+	Status   RecallStatus     `json:"status"`
+	Overall  RecallProgress   `json:"overall"`
+	ByHolder []RecallProgress `json:"byHolder"`
+}
+
+/**
+*@dev RecordRecallDisposition() records that a recalled unit was returned, destroyed or cannot be traced
+*
+* The unit's current holder reports returns and destruction; only the initiator can declare a unit untraceable.
+*/
+
+func (c *ProductDetailsContract) RecordRecallDisposition(ctx contractapi.TransactionContextInterface, recallID string, productID uint64, disposition int, note string) error {
+	recall, err := c.RetrieveRecall(ctx, recallID)
+	if err != nil {
+		return err
+	}
+	if recall.Status != RECALL_OPEN {
+		return fmt.Errorf("recall %s is closed", recallID)
+	}
+
+	unit, err := c.retrieveRecallUnit(ctx, recallID, productID)
+	if err != nil {
+		return err
+	}
+
+	caller, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+
+	newDisposition := RecallDisposition(disposition)
+	switch newDisposition {
+	case RECALL_UNIT_RETURNED, RECALL_UNIT_DESTROYED:
+		if caller != unit.Holder && caller != recall.Initiator {
+			return fmt.Errorf("only the holder %s or the initiator %s can report on product %d", unit.Holder, recall.Initiator, productID)
+		}
+	case RECALL_UNIT_UNTRACEABLE:
+		if caller != recall.Initiator {
+			return fmt.Errorf("only %s can declare product %d untraceable", recall.Initiator, productID)
+		}
+	default:
+		return fmt.Errorf("unknown recall disposition %d", disposition)
+	}
+	if unit.Disposition == RECALL_UNIT_DESTROYED {
+		return fmt.Errorf("product %d has already been destroyed", productID)
+	}
+
+	unit.Disposition = newDisposition
+	unit.Note = note
+	return c.putRecallUnit(ctx, unit)
+}
+
+/**
+*@dev GetRecallUnits() retrieves the progress record of every unit in a recall
+*
+* Only units whose product's location the caller may query are listed, since a unit names its holder and last location.
+*/
+
+func (c *ProductDetailsContract) GetRecallUnits(ctx contractapi.TransactionContextInterface, recallID string) ([]RecallUnit, error) {
+	units, err := c.recallUnits(ctx, recallID)
+	if err != nil {
+		return nil, err
+	}
+
+	visible := []RecallUnit{}
+	for _, unit := range units {
+		_, _, err := c.authorizeProductQuery(ctx, unit.ProductID, "GetRecallUnits", FIELD_SET_LOCATION)
+		if err != nil {
+			continue
+		}
+		visible = append(visible, unit)
+	}
+
+	return visible, nil
+}
+
+func (c *ProductDetailsContract) recallUnits(ctx contractapi.TransactionContextInterface, recallID string) ([]RecallUnit, error) {
+	iterator, err := ctx.GetStub().GetStateByRange(fmt.Sprintf("RECALL-%s-UNIT-", recallID), fmt.Sprintf("RECALL-%s-UNIT-~", recallID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recall units from the ledger: %v", err)
+	}
+	defer iterator.Close()
+
+	units := []RecallUnit{}
+	for iterator.HasNext() {
+		result, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read recall unit from the ledger: %v", err)
+		}
+
+		var unit RecallUnit
+		err = json.Unmarshal(result.Value, &unit)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal recall unit JSON: %v", err)
+		}
+		units = append(units, unit)
+	}
+
+	return units, nil
+}
+
+/**
+*@dev GetRecallEffectiveness() reports how many recalled units have been recovered, overall and per holder
+*/
+
+func (c *ProductDetailsContract) GetRecallEffectiveness(ctx contractapi.TransactionContextInterface, recallID string) (*RecallEffectivenessReport, error) {
+	recall, err := c.RetrieveRecall(ctx, recallID)
+	if err != nil {
+		return nil, err
+	}
+
+	units, err := c.recallUnits(ctx, recallID)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RecallEffectivenessReport{RecallID: recallID, Status: recall.Status, ByHolder: []RecallProgress{}}
+	byHolder := make(map[string]*RecallProgress)
+	holders := []string{}
+	for _, unit := range units {
+		progress, ok := byHolder[unit.Holder]
+		if !ok {
+			progress = &RecallProgress{Holder: unit.Holder}
+			byHolder[unit.Holder] = progress
+			holders = append(holders, unit.Holder)
+		}
+		countRecallUnit(&report.Overall, unit)
+		countRecallUnit(progress, unit)
+	}
+
+	sort.Strings(holders)
+	for _, holder := range holders {
+		report.ByHolder = append(report.ByHolder, *byHolder[holder])
+	}
+
+	return report, nil
+}
+
+/**
+*@dev ApproveRecallOverride() lets a regulator of an MSP trusted with the role allow a recall to close below the effectiveness threshold
+*/
+
+func (c *ProductDetailsContract) ApproveRecallOverride(ctx contractapi.TransactionContextInterface, recallID string, reason string) error {
+	err := c.assertRole(ctx, ROLE_REGULATOR)
+	if err != nil {
+		return err
+	}
+
+	recall, err := c.RetrieveRecall(ctx, recallID)
+	if err != nil {
+		return err
+	}
+	if recall.Status != RECALL_OPEN {
+		return fmt.Errorf("recall %s is closed", recallID)
+	}
+
+	approvedBy, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+
+	recall.Override = &RecallOverride{
+		ApprovedBy: approvedBy,
+		Reason:     reason,
+		TxID:       ctx.GetStub().GetTxID(),
+		Timestamp:  uint64(timestamp.GetSeconds()),
+	}
+
+	_, err = c.putRecall(ctx, recall)
+	return err
+}
+
+/**
+*@dev CloseRecall() closes a recall once RECALL_CLOSE_THRESHOLD of its units are recovered, or with an approved override
+*/
+
+func (c *ProductDetailsContract) CloseRecall(ctx contractapi.TransactionContextInterface, recallID string) error {
+	recall, err := c.RetrieveRecall(ctx, recallID)
+	if err != nil {
+		return err
+	}
+	if recall.Status != RECALL_OPEN {
+		return fmt.Errorf("recall %s is already closed", recallID)
+	}
+
+	caller, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+	if caller != recall.Initiator {
+		return fmt.Errorf("only %s can close recall %s", recall.Initiator, recallID)
+	}
+
+	report, err := c.GetRecallEffectiveness(ctx, recallID)
+	if err != nil {
+		return err
+	}
+	// Recalls opened before empty recalls were refused can have no units, and so nothing left to recover
+	if report.Overall.Total > 0 && report.Overall.Effectiveness < RECALL_CLOSE_THRESHOLD && recall.Override == nil {
+		return fmt.Errorf("recall %s is %.1f%% effective, below the %.1f%% needed to close without an override", recallID, report.Overall.Effectiveness*100, RECALL_CLOSE_THRESHOLD*100)
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+
+	recall.Status = RECALL_CLOSED
+	recall.ClosedAt = uint64(timestamp.GetSeconds())
+	recall.ClosingEffectiveness = report.Overall.Effectiveness
+
+	recallBytes, err := c.putRecall(ctx, recall)
+	if err != nil {
+		return err
+	}
+
+	err = ctx.GetStub().SetEvent("RecallClosed", recallBytes)
+	if err != nil {
+		return fmt.Errorf("failed to set recall event: %v", err)
+	}
+
+	return nil
+}
+
+/**
+*@dev openRecallUnit() starts the progress record of a product entering a recall and links the product to it
+*/
+
+func (c *ProductDetailsContract) openRecallUnit(ctx contractapi.TransactionContextInterface, recall *Recall, product *Product) error {
+	err := ctx.GetStub().PutState(fmt.Sprintf("PRODUCT-%d-RECALL", product.ID), []byte(recall.ID))
+	if err != nil {
+		return fmt.Errorf("failed to put product recall link on the ledger: %v", err)
+	}
+
+	return c.putRecallUnit(ctx, &RecallUnit{
+		RecallID:     recall.ID,
+		ProductID:    product.ID,
+		Disposition:  RECALL_UNIT_IN_MARKET,
+		Holder:       product.Custodian,
+		LastLocation: product.Location,
+	})
+}
+
+/**
+*@dev trackRecalledProduct() updates a recalled product's progress record after it moves or changes hands
+*
+* A unit handed back to the recall's initiator counts as returned.
+*/
+
+func (c *ProductDetailsContract) trackRecalledProduct(ctx contractapi.TransactionContextInterface, product *Product, event ProductEvent) error {
+	recallIDBytes, err := ctx.GetStub().GetState(fmt.Sprintf("PRODUCT-%d-RECALL", product.ID))
+	if err != nil {
+		return fmt.Errorf("failed to read product recall link from the ledger: %v", err)
+	}
+
+	// Products set to PRODUCT_RECALLED by hand belong to no recall
+	if recallIDBytes == nil {
+		return nil
+	}
+
+	recall, err := c.RetrieveRecall(ctx, string(recallIDBytes))
+	if err != nil {
+		return err
+	}
+	if recall.Status != RECALL_OPEN {
+		return nil
+	}
+
+	unit, err := c.retrieveRecallUnit(ctx, recall.ID, product.ID)
+	if err != nil {
+		return err
+	}
+
+	unit.Holder = product.Custodian
+	unit.LastLocation = product.Location
+	if event.Type == HISTORY_CUSTODY_TRANSFER && event.Location != "" {
+		unit.LastLocation = event.Location
+	}
+	if event.Type == HISTORY_CUSTODY_TRANSFER && product.Custodian == recall.Initiator && unit.Disposition != RECALL_UNIT_DESTROYED {
+		unit.Disposition = RECALL_UNIT_RETURNED
+	}
+
+	return c.putRecallUnit(ctx, unit)
+}
+
+/**
+*@dev productRegistrant() returns the organisation that registered a product, or "" for products registered before event sourcing
+*/
+
+func (c *ProductDetailsContract) productRegistrant(ctx contractapi.TransactionContextInterface, productID uint64) (string, error) {
+	eventBytes, err := ctx.GetStub().GetState(productEventKey(productID, 1))
+	if err != nil {
+		return "", fmt.Errorf("failed to read product event from the ledger: %v", err)
+	}
+	if eventBytes == nil {
+		// A compacted registration leaves its registrant on the checkpoint
+		checkpoint, err := c.latestHistoryCheckpoint(ctx, productID)
+		if err != nil || checkpoint == nil {
+			return "", err
+		}
+		return checkpoint.Registrant, nil
+	}
+
+	var event ProductEvent
+	err = json.Unmarshal(eventBytes, &event)
+	if err != nil {
+		return "", fmt.Errorf("failed to unmarshal product event JSON: %v", err)
+	}
+
+	// A migration event records whoever first changed a legacy product, not who registered it
+	if event.Reason == LEGACY_MIGRATION_REASON {
+		return "", nil
+	}
+
+	return event.Actor, nil
+}
+
+func (c *ProductDetailsContract) retrieveRecallUnit(ctx contractapi.TransactionContextInterface, recallID string, productID uint64) (*RecallUnit, error) {
+	unitBytes, err := ctx.GetStub().GetState(recallUnitKey(recallID, productID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recall unit from the ledger: %v", err)
+	}
+	if unitBytes == nil {
+		return nil, fmt.Errorf("product %d is not part of recall %s", productID, recallID)
+	}
+
+	unit := new(RecallUnit)
+	err = json.Unmarshal(unitBytes, unit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal recall unit JSON: %v", err)
+	}
+
+	return unit, nil
+}
+
+func (c *ProductDetailsContract) putRecallUnit(ctx contractapi.TransactionContextInterface, unit *RecallUnit) error {
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+
+	unit.TxID = ctx.GetStub().GetTxID()
+	unit.UpdatedAt = uint64(timestamp.GetSeconds())
+
+	unitBytes, err := json.Marshal(unit)
+	if err != nil {
+		return fmt.Errorf("failed to marshal recall unit JSON: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(recallUnitKey(unit.RecallID, unit.ProductID), unitBytes)
+	if err != nil {
+		return fmt.Errorf("failed to put recall unit on the ledger: %v", err)
+	}
+
+	return nil
+}
+
+func countRecallUnit(progress *RecallProgress, unit RecallUnit) {
+	progress.Total++
+	switch unit.Disposition {
+	case RECALL_UNIT_RETURNED:
+		progress.Returned++
+	case RECALL_UNIT_DESTROYED:
+		progress.Destroyed++
+	case RECALL_UNIT_UNTRACEABLE:
+		progress.Untraceable++
+	default:
+		progress.InMarket++
+	}
+	progress.Effectiveness = float64(progress.Returned+progress.Destroyed) / float64(progress.Total)
+}
+
+func recallUnitKey(recallID string, productID uint64) string {
+	return fmt.Sprintf("RECALL-%s-UNIT-%020d", recallID, productID)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+/**
+*@dev RegulatedRetrieveProductDetails() retrieves a product like RetrieveProductDetails and logs the lookup with its purpose
+*
+* Submit LogProductAccess for it with the same purpose first, which logs the lookup; everyone must, the product's
+* owner included. Regulators may look up any product this way.
+*/
+
+func (c *ProductDetailsContract) RegulatedRetrieveProductDetails(ctx contractapi.TransactionContextInterface, productID uint64, purpose string) (*Product, error) {
+	product, sharedFieldSets, err := c.authorizeRegulatedQuery(ctx, productID, "RegulatedRetrieveProductDetails", "", purpose)
+	if err != nil {
+		return nil, err
+	}
+	if sharedFieldSets != nil {
+		return filterProductFields(product, sharedFieldSets), nil
+	}
+
+	return product, nil
+}
+
+/**
+*@dev RegulatedGetProductHistory() retrieves a product's history like GetProductHistory and logs the lookup with its purpose
+*/
+
+func (c *ProductDetailsContract) RegulatedGetProductHistory(ctx contractapi.TransactionContextInterface, productID uint64, includeReversed bool, purpose string) ([]ProductHistory, error) {
+	_, _, err := c.authorizeRegulatedQuery(ctx, productID, "RegulatedGetProductHistory", FIELD_SET_HISTORY, purpose)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.productHistory(ctx, productID, includeReversed)
+}
+
+/**
+*@dev GetProductAccessLog() lists the logged lookups of a product, oldest first; only the product's owner and regulators of a trusted MSP can read it
+*/
+
+func (c *ProductDetailsContract) GetProductAccessLog(ctx contractapi.TransactionContextInterface, productID uint64) ([]ProductAccess, error) {
+	product, err := c.retrieveProductDetails(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	caller, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+
+	owner, err := c.productOwner(ctx, product)
+	if err != nil {
+		return nil, err
+	}
+	if caller != owner && !c.hasRole(ctx, ROLE_REGULATOR) {
+		return nil, fmt.Errorf("only %s or a regulator in an MSP trusted with the role can read the access log of product %d", owner, productID)
+	}
+
+	iterator, err := ctx.GetStub().GetStateByRange(fmt.Sprintf("PRODUCT-%d-ACCESS-", productID), fmt.Sprintf("PRODUCT-%d-ACCESS-~", productID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read product access log from the ledger: %v", err)
+	}
+	defer iterator.Close()
+
+	accesses := []ProductAccess{}
+	for iterator.HasNext() {
+		result, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read product access from the ledger: %v", err)
+		}
+
+		var access ProductAccess
+		err = json.Unmarshal(result.Value, &access)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal product access JSON: %v", err)
+		}
+		accesses = append(accesses, access)
+	}
+
+	// Entries logged before the log was keyed by time are keyed by transaction ID alone, so their order on the ledger is arbitrary
+	sort.SliceStable(accesses, func(i, j int) bool {
+		return accesses[i].Timestamp < accesses[j].Timestamp
+	})
+
+	return accesses, nil
+}
+
+/**
+*@dev authorizeRegulatedQuery() applies the same access rules as authorizeProductQuery, letting regulators through as well, and always needs the lookup logged with its purpose
+*/
+
+func (c *ProductDetailsContract) authorizeRegulatedQuery(ctx contractapi.TransactionContextInterface, productID uint64, transaction string, required string, purpose string) (*Product, []string, error) {
+	if purpose == "" {
+		return nil, nil, fmt.Errorf("a purpose code is required")
+	}
+
+	product, access, restricted, err := c.productQueryAccess(ctx, productID, transaction, required, true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	access.Purpose = purpose
+	err = c.assertProductAccessLogged(ctx, access, required)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !restricted {
+		return product, nil, nil
+	}
+	return product, access.FieldSets, nil
+}
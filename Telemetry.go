@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+/**
+*@dev telemetry reading kinds
+*/
+
+const (
+	TELEMETRY_TEMPERATURE = "temperature"
+	TELEMETRY_HUMIDITY    = "humidity"
+	TELEMETRY_POSITION    = "position"
+)
+
+/**
+*@dev TelemetryReading() represents one sensor reading from a tracker attached to a product
+*
+* Sequence is a counter the device increases with every measurement it publishes, which stops a signed reading being replayed.
+*/
+
+type TelemetryReading struct {
+	DeviceID  string  `json:"deviceId"`
+	Sequence  uint64  `json:"sequence"`
+	Timestamp uint64  `json:"timestamp"`
+	Kind      string  `json:"kind"`
+	Value     float64 `json:"value"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Signature string  `json:"signature"`
+}
+
+/**
+*@dev TelemetryBatch() represents the readings for a product submitted in one transaction
+*/
+
+type TelemetryBatch struct {
+	ProductID uint64             `json:"productId"`
+	TxID      string             `json:"txId"`
+	Submitter string             `json:"submitter"`
+	Timestamp uint64             `json:"timestamp"`
+	Readings  []TelemetryReading `json:"readings"`
+}
+
+/**
+*@dev RecordTelemetry() records a batch of tracker readings against a product, each signed by a registered device bound to it
+*/
+
+func (c *ProductDetailsContract) RecordTelemetry(ctx contractapi.TransactionContextInterface, productID uint64, readings []TelemetryReading) error {
+	if len(readings) == 0 {
+		return fmt.Errorf("at least one reading is required")
+	}
+
+	_, err := c.retrieveProductDetails(ctx, productID)
+	if err != nil {
+		return err
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+
+	devices := make(map[string]*Device)
+	sequences := make(map[string]uint64)
+	sequenceKeys := []string{}
+	for i, reading := range readings {
+		if reading.DeviceID == "" {
+			return fmt.Errorf("reading %d has no device ID", i)
+		}
+		switch reading.Kind {
+		case TELEMETRY_TEMPERATURE, TELEMETRY_HUMIDITY, TELEMETRY_POSITION:
+		default:
+			return fmt.Errorf("reading %d has unknown kind %q", i, reading.Kind)
+		}
+
+		device, ok := devices[reading.DeviceID]
+		if !ok {
+			device, err = c.RetrieveDevice(ctx, reading.DeviceID)
+			if err != nil {
+				return fmt.Errorf("reading %d: %v", i, err)
+			}
+			devices[reading.DeviceID] = device
+		}
+
+		err = verifyDeviceReading(device, productID, reading, uint64(timestamp.GetSeconds()))
+		if err != nil {
+			return fmt.Errorf("reading %d: %v", i, err)
+		}
+
+		sequenceKey := readingSequenceKey(reading.DeviceID, productID, reading.Kind)
+		lastSequence, ok := sequences[sequenceKey]
+		if !ok {
+			lastSequence, err = c.retrieveReadingSequence(ctx, sequenceKey)
+			if err != nil {
+				return err
+			}
+			sequenceKeys = append(sequenceKeys, sequenceKey)
+		}
+		if reading.Sequence <= lastSequence {
+			return fmt.Errorf("reading %d: device %s already recorded a %s reading for product %d at sequence %d", i, reading.DeviceID, reading.Kind, productID, lastSequence)
+		}
+		sequences[sequenceKey] = reading.Sequence
+	}
+
+	for _, sequenceKey := range sequenceKeys {
+		err = ctx.GetStub().PutState(sequenceKey, []byte(strconv.FormatUint(sequences[sequenceKey], 10)))
+		if err != nil {
+			return fmt.Errorf("failed to put reading sequence on the ledger: %v", err)
+		}
+	}
+
+	submitter, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+
+	batch := TelemetryBatch{
+		ProductID: productID,
+		TxID:      ctx.GetStub().GetTxID(),
+		Submitter: submitter,
+		Timestamp: uint64(timestamp.GetSeconds()),
+		Readings:  readings,
+	}
+
+	batchBytes, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("failed to marshal telemetry batch JSON: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(fmt.Sprintf("PRODUCT-%d-TELEMETRY-%s", productID, batch.TxID), batchBytes)
+	if err != nil {
+		return fmt.Errorf("failed to put telemetry batch on the ledger: %v", err)
+	}
+
+	return nil
+}
+
+/**
+*@dev GetProductTelemetry() retrieves every telemetry batch recorded against a product
+*/
+
+func (c *ProductDetailsContract) GetProductTelemetry(ctx contractapi.TransactionContextInterface, productID uint64) ([]TelemetryBatch, error) {
+	_, _, err := c.authorizeProductQuery(ctx, productID, "GetProductTelemetry", FIELD_SET_TELEMETRY)
+	if err != nil {
+		return nil, err
+	}
+
+	iterator, err := ctx.GetStub().GetStateByRange(fmt.Sprintf("PRODUCT-%d-TELEMETRY-", productID), fmt.Sprintf("PRODUCT-%d-TELEMETRY-~", productID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read product telemetry from the ledger: %v", err)
+	}
+	defer iterator.Close()
+
+	batches := []TelemetryBatch{}
+	for iterator.HasNext() {
+		result, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read telemetry batch from the ledger: %v", err)
+		}
+
+		var batch TelemetryBatch
+		err = json.Unmarshal(result.Value, &batch)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal telemetry batch JSON: %v", err)
+		}
+		batches = append(batches, batch)
+	}
+
+	return batches, nil
+}
+
+/**
+*@dev retrieveReadingSequence() returns the last sequence recorded for a device's readings of one kind for a product
+*
+* Sequences are kept per product and kind because a tracker on a shipment publishes the same signed measurement for
+* every product in it, and one measurement carries a reading of each kind.
+*/
+
+func (c *ProductDetailsContract) retrieveReadingSequence(ctx contractapi.TransactionContextInterface, sequenceKey string) (uint64, error) {
+	sequenceBytes, err := ctx.GetStub().GetState(sequenceKey)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read reading sequence from the ledger: %v", err)
+	}
+	if sequenceBytes == nil {
+		return 0, nil
+	}
+
+	sequence, err := strconv.ParseUint(string(sequenceBytes), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse reading sequence: %v", err)
+	}
+
+	return sequence, nil
+}
+
+func readingSequenceKey(deviceID string, productID uint64, kind string) string {
+	return fmt.Sprintf("READINGSEQ-%s-%d-%s", deviceID, productID, kind)
+}
@@ -0,0 +1,663 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+)
+
+/**
+*@dev TENANT_KEY_PREFIX starts every tenant's registry entry and every key in its namespace
+*/
+
+const TENANT_KEY_PREFIX = "TENANT-"
+
+/**
+*@dev Tenant() represents a brand owner hosted on the channel, with its own namespace of keys
+*
+* The owner org registers the tenant and decides which other orgs may work in its namespace. TxID and Timestamp
+* record the last change to the tenant.
+*/
+
+type Tenant struct {
+	ID        string   `json:"id"`
+	Owner     string   `json:"owner"`
+	Members   []string `json:"members"`
+	TxID      string   `json:"txId"`
+	Timestamp uint64   `json:"timestamp"`
+}
+
+/**
+*@dev ProductGrant() represents read access a tenant has given another tenant to one of its products
+*/
+
+type ProductGrant struct {
+	ProductID uint64 `json:"productId"`
+	Tenant    string `json:"tenant"`
+	Grantee   string `json:"grantee"`
+	GrantedBy string `json:"grantedBy"`
+	TxID      string `json:"txId"`
+	Timestamp uint64 `json:"timestamp"`
+}
+
+/**
+*@dev tenantStub() wraps a stub and keeps every key inside one tenant's namespace
+*
+* Keys already starting with TENANT- pass through unchanged: the tenant registry is shared by all tenants, and a stub
+* scoped to another tenant can be layered on top of this one.
+*/
+
+type tenantStub struct {
+	shim.ChaincodeStubInterface
+	prefix   string
+	readOnly bool
+}
+
+func newTenantStub(stub shim.ChaincodeStubInterface, tenantID string, readOnly bool) *tenantStub {
+	return &tenantStub{ChaincodeStubInterface: stub, prefix: TENANT_KEY_PREFIX + tenantID + "-", readOnly: readOnly}
+}
+
+func (s *tenantStub) key(key string) string {
+	if strings.HasPrefix(key, TENANT_KEY_PREFIX) {
+		return key
+	}
+	return s.prefix + key
+}
+
+func (s *tenantStub) GetState(key string) ([]byte, error) {
+	return s.ChaincodeStubInterface.GetState(s.key(key))
+}
+
+func (s *tenantStub) PutState(key string, value []byte) error {
+	if s.readOnly {
+		return fmt.Errorf("shared products are read-only")
+	}
+	return s.ChaincodeStubInterface.PutState(s.key(key), value)
+}
+
+func (s *tenantStub) DelState(key string) error {
+	if s.readOnly {
+		return fmt.Errorf("shared products are read-only")
+	}
+	return s.ChaincodeStubInterface.DelState(s.key(key))
+}
+
+func (s *tenantStub) GetStateByRange(startKey string, endKey string) (shim.StateQueryIteratorInterface, error) {
+	iterator, err := s.ChaincodeStubInterface.GetStateByRange(s.key(startKey), s.key(endKey))
+	if err != nil {
+		return nil, err
+	}
+	return &tenantIterator{StateQueryIteratorInterface: iterator, prefix: s.prefix}, nil
+}
+
+/**
+*@dev tenantIterator() strips the tenant prefix from the keys of a range scan, so callers can parse them as usual
+*/
+
+type tenantIterator struct {
+	shim.StateQueryIteratorInterface
+	prefix string
+}
+
+func (i *tenantIterator) Next() (*queryresult.KV, error) {
+	result, err := i.StateQueryIteratorInterface.Next()
+	if err != nil {
+		return nil, err
+	}
+	return &queryresult.KV{Namespace: result.Namespace, Key: strings.TrimPrefix(result.Key, i.prefix), Value: result.Value}, nil
+}
+
+/**
+*@dev TenantContext() is the transaction context of the product contract; a caller whose org is a registered tenant works in that tenant's namespace
+*/
+
+type TenantContext struct {
+	contractapi.TransactionContext
+	tenant *Tenant
+}
+
+func (c *TenantContext) GetStub() shim.ChaincodeStubInterface {
+	if c.tenant == nil {
+		return c.TransactionContext.GetStub()
+	}
+	return newTenantStub(c.TransactionContext.GetStub(), c.tenant.ID, false)
+}
+
+func (c *TenantContext) GetTenant() *Tenant {
+	return c.tenant
+}
+
+/**
+*@dev tenantScopedContext() hands a transaction a stub scoped to a tenant chosen explicitly, in place of the caller's own
+*/
+
+type tenantScopedContext struct {
+	contractapi.TransactionContextInterface
+	tenant *Tenant
+	stub   *tenantStub
+}
+
+func (t *tenantScopedContext) GetStub() shim.ChaincodeStubInterface {
+	return t.stub
+}
+
+func (t *tenantScopedContext) GetTenant() *Tenant {
+	return t.tenant
+}
+
+func scopeToTenant(ctx contractapi.TransactionContextInterface, tenant *Tenant, readOnly bool) *tenantScopedContext {
+	return &tenantScopedContext{
+		TransactionContextInterface: ctx,
+		tenant:                      tenant,
+		stub:                        newTenantStub(ctx.GetStub(), tenant.ID, readOnly),
+	}
+}
+
+/**
+*@dev sharedStub() returns the transaction's stub outside any tenant's namespace, for records two tenants must both reach
+*/
+
+func sharedStub(ctx contractapi.TransactionContextInterface) shim.ChaincodeStubInterface {
+	stub := ctx.GetStub()
+	for {
+		scoped, ok := stub.(*tenantStub)
+		if !ok {
+			return stub
+		}
+		stub = scoped.ChaincodeStubInterface
+	}
+}
+
+/**
+*@dev tenantOf() returns the tenant a transaction works for, or nil in the shared namespace
+*/
+
+func tenantOf(ctx contractapi.TransactionContextInterface) *Tenant {
+	if scoped, ok := ctx.(interface{ GetTenant() *Tenant }); ok {
+		return scoped.GetTenant()
+	}
+	return nil
+}
+
+func (c *ProductDetailsContract) GetTransactionContextHandler() contractapi.SettableTransactionContextInterface {
+	return new(TenantContext)
+}
+
+func (c *ProductDetailsContract) GetBeforeTransaction() interface{} {
+	return c.resolveCallerTenant
+}
+
+/**
+*@dev resolveCallerTenant() runs before every transaction and scopes it to the tenant registered under, and owned by, the caller's org
+*
+* Before brand tenants had to carry their owner's prefix, an org could register a tenant named after another org. The
+* org it is named after is refused every transaction but RegisterTenant, which reclaims the tenant.
+*/
+
+func (c *ProductDetailsContract) resolveCallerTenant(ctx contractapi.TransactionContextInterface) error {
+	tenantCtx, ok := ctx.(*TenantContext)
+	if !ok || ctx.GetClientIdentity() == nil {
+		return nil
+	}
+
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+
+	tenant, err := retrieveTenant(ctx, mspID)
+	if err != nil || tenant == nil {
+		return err
+	}
+
+	if tenant.Owner != mspID {
+		function, _ := ctx.GetStub().GetFunctionAndParameters()
+		if function[strings.LastIndex(function, ":")+1:] == "RegisterTenant" {
+			return nil
+		}
+		return fmt.Errorf("tenant %s is owned by %s rather than the organisation it is named after; register it to reclaim it", mspID, tenant.Owner)
+	}
+
+	tenantCtx.tenant = tenant
+	return nil
+}
+
+/**
+*@dev RegisterTenant() registers a tenant owned by the caller's org
+*
+* A tenant named after the caller's MSP ID becomes the org's default namespace. The org must not have registered
+* products in the shared namespace, since they would no longer be visible to it. Other tenants, e.g. one for each
+* brand an org hosts, are named "<MSP ID>.<brand>", are registered by an admin of an MSP trusted with the role and
+* are reached with AsTenant.
+*/
+
+func (c *ProductDetailsContract) RegisterTenant(ctx contractapi.TransactionContextInterface, tenantID string, members []string) error {
+	owner, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+
+	if !validTenantID(tenantID) {
+		return fmt.Errorf("tenant ID %q may only contain letters, digits, dots and underscores", tenantID)
+	}
+	if tenantID != owner {
+		if !strings.HasPrefix(tenantID, owner+".") {
+			return fmt.Errorf("tenant %s must be named after %s, or be one of its brands named %s.<brand>", tenantID, owner, owner)
+		}
+		err = c.assertRole(ctx, ROLE_ADMIN)
+		if err != nil {
+			return err
+		}
+	}
+
+	existing, err := retrieveTenant(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	// A tenant named after the caller's org but owned by another is reclaimed, along with its namespace
+	if existing != nil && (tenantID != owner || existing.Owner == owner) {
+		return fmt.Errorf("tenant %s already exists", tenantID)
+	}
+
+	if tenantID == owner {
+		iterator, err := ctx.GetStub().GetStateByRange(orgProductPrefix(owner), orgProductPrefix(owner)+"~")
+		if err != nil {
+			return fmt.Errorf("failed to read organisation products from the ledger: %v", err)
+		}
+		registered := iterator.HasNext()
+		iterator.Close()
+
+		if registered {
+			return fmt.Errorf("%s has registered products in the shared namespace, which it could no longer see as a tenant", owner)
+		}
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+
+	return putTenant(ctx, &Tenant{
+		ID:        tenantID,
+		Owner:     owner,
+		Members:   members,
+		TxID:      ctx.GetStub().GetTxID(),
+		Timestamp: uint64(timestamp.Seconds),
+	})
+}
+
+/**
+*@dev UpdateTenantMembers() replaces the orgs, besides the owner, that may work in a tenant's namespace
+*/
+
+func (c *ProductDetailsContract) UpdateTenantMembers(ctx contractapi.TransactionContextInterface, tenantID string, members []string) error {
+	tenant, err := c.GetTenant(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+
+	caller, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+	if caller != tenant.Owner {
+		return fmt.Errorf("only %s can change the members of tenant %s", tenant.Owner, tenantID)
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+
+	tenant.Members = members
+	tenant.TxID = ctx.GetStub().GetTxID()
+	tenant.Timestamp = uint64(timestamp.Seconds)
+	return putTenant(ctx, tenant)
+}
+
+/**
+*@dev GetTenant() retrieves a tenant from the registry
+*/
+
+func (c *ProductDetailsContract) GetTenant(ctx contractapi.TransactionContextInterface, tenantID string) (*Tenant, error) {
+	tenant, err := retrieveTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	if tenant == nil {
+		return nil, fmt.Errorf("tenant %s does not exist", tenantID)
+	}
+
+	return tenant, nil
+}
+
+/**
+*@dev AsTenant() runs a transaction in the namespace of the given tenant, which the caller's org must own or be a member of
+*
+* Arguments are JSON-encoded as for DryRun, and the transaction's result is returned unchanged.
+*/
+
+func (c *ProductDetailsContract) AsTenant(ctx contractapi.TransactionContextInterface, tenantID string, function string, args []string) (string, error) {
+	if function == "AsTenant" {
+		return "", fmt.Errorf("AsTenant cannot call itself")
+	}
+
+	tenant, err := c.GetTenant(ctx, tenantID)
+	if err != nil {
+		return "", err
+	}
+
+	caller, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return "", fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+	if !tenant.hasMember(caller) {
+		return "", fmt.Errorf("%s is not a member of tenant %s", caller, tenantID)
+	}
+
+	return c.callTransaction(scopeToTenant(ctx, tenant, false), function, args)
+}
+
+/**
+*@dev GrantProductAccess() lets another tenant read one of the current tenant's products; only the tenant's owner can share
+*/
+
+func (c *ProductDetailsContract) GrantProductAccess(ctx contractapi.TransactionContextInterface, productID uint64, grantee string) error {
+	tenant, err := c.assertTenantOwner(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.retrieveProductSnapshot(ctx, productID)
+	if err != nil {
+		return err
+	}
+
+	if grantee == tenant.ID {
+		return fmt.Errorf("tenant %s can already read its own products", grantee)
+	}
+	_, err = c.GetTenant(ctx, grantee)
+	if err != nil {
+		return err
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+
+	grantBytes, err := json.Marshal(ProductGrant{
+		ProductID: productID,
+		Tenant:    tenant.ID,
+		Grantee:   grantee,
+		GrantedBy: tenant.Owner,
+		TxID:      ctx.GetStub().GetTxID(),
+		Timestamp: uint64(timestamp.Seconds),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal product grant JSON: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(productGrantKey(productID, grantee), grantBytes)
+	if err != nil {
+		return fmt.Errorf("failed to put product grant on the ledger: %v", err)
+	}
+
+	return nil
+}
+
+/**
+*@dev RevokeProductAccess() withdraws another tenant's read access to a product
+*/
+
+func (c *ProductDetailsContract) RevokeProductAccess(ctx contractapi.TransactionContextInterface, productID uint64, grantee string) error {
+	_, err := c.assertTenantOwner(ctx)
+	if err != nil {
+		return err
+	}
+
+	grantBytes, err := ctx.GetStub().GetState(productGrantKey(productID, grantee))
+	if err != nil {
+		return fmt.Errorf("failed to read product grant from the ledger: %v", err)
+	}
+	if grantBytes == nil {
+		return fmt.Errorf("tenant %s has no access to product %d", grantee, productID)
+	}
+
+	err = ctx.GetStub().DelState(productGrantKey(productID, grantee))
+	if err != nil {
+		return fmt.Errorf("failed to delete product grant from the ledger: %v", err)
+	}
+
+	return nil
+}
+
+/**
+*@dev GetProductGrants() lists the tenants the current tenant has shared a product with
+*/
+
+func (c *ProductDetailsContract) GetProductGrants(ctx contractapi.TransactionContextInterface, productID uint64) ([]ProductGrant, error) {
+	iterator, err := ctx.GetStub().GetStateByRange(fmt.Sprintf("PRODUCT-%d-GRANT-", productID), fmt.Sprintf("PRODUCT-%d-GRANT-~", productID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read product grants from the ledger: %v", err)
+	}
+	defer iterator.Close()
+
+	grants := []ProductGrant{}
+	for iterator.HasNext() {
+		result, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read product grant from the ledger: %v", err)
+		}
+
+		var grant ProductGrant
+		err = json.Unmarshal(result.Value, &grant)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal product grant JSON: %v", err)
+		}
+		grants = append(grants, grant)
+	}
+
+	return grants, nil
+}
+
+/**
+*@dev ReadSharedProduct() retrieves a product another tenant has shared with the current tenant, or the fields of it an agreement shares with the caller
+*/
+
+func (c *ProductDetailsContract) ReadSharedProduct(ctx contractapi.TransactionContextInterface, ownerTenant string, productID uint64) (*Product, error) {
+	sharedCtx, sharedFieldSets, err := c.sharedProductContext(ctx, ownerTenant, productID, "ReadSharedProduct", "")
+	if err != nil {
+		return nil, err
+	}
+
+	product, err := c.retrieveProductDetails(sharedCtx, productID)
+	if err != nil {
+		return nil, err
+	}
+	if sharedFieldSets != nil {
+		return filterProductFields(product, sharedFieldSets), nil
+	}
+
+	return product, nil
+}
+
+/**
+*@dev ReadSharedProductHistory() retrieves the history of a product another tenant has shared with the current tenant, or whose history an agreement shares with the caller
+*/
+
+func (c *ProductDetailsContract) ReadSharedProductHistory(ctx contractapi.TransactionContextInterface, ownerTenant string, productID uint64, includeReversed bool) ([]ProductHistory, error) {
+	sharedCtx, _, err := c.sharedProductContext(ctx, ownerTenant, productID, "ReadSharedProductHistory", FIELD_SET_HISTORY)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.productHistory(sharedCtx, productID, includeReversed)
+}
+
+/**
+*@dev LogSharedProductAccess() logs a read the caller is about to make of a product in another tenant, as LogProductAccess does within one
+*
+* The access is logged in the owner tenant's namespace, where its owner reads the access log. A grant to the caller's
+* tenant needs no logged access.
+*/
+
+func (c *ProductDetailsContract) LogSharedProductAccess(ctx contractapi.TransactionContextInterface, ownerTenant string, productID uint64, transaction string) (*ProductAccess, error) {
+	owner, err := c.GetTenant(ctx, ownerTenant)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.logProductAccess(scopeToTenant(ctx, owner, false), productID, transaction, "")
+}
+
+/**
+*@dev sharedProductContext() returns a read-only context in the owner tenant's namespace, and what the caller may see of the product there
+*
+* A grant to the caller's tenant shows the whole product. Otherwise the caller's agreements with the product's owner
+* decide, as they do within one namespace, and the caller must have logged the read with LogSharedProductAccess;
+* required names the field set the read needs. A nil list means the caller sees everything.
+*/
+
+func (c *ProductDetailsContract) sharedProductContext(ctx contractapi.TransactionContextInterface, ownerTenant string, productID uint64, transaction string, required string) (contractapi.TransactionContextInterface, []string, error) {
+	owner, err := c.GetTenant(ctx, ownerTenant)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ownerCtx := scopeToTenant(ctx, owner, true)
+	if reader := tenantOf(ctx); reader != nil {
+		grantBytes, err := ownerCtx.GetStub().GetState(productGrantKey(productID, reader.ID))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read product grant from the ledger: %v", err)
+		}
+		if grantBytes != nil {
+			return ownerCtx, nil, nil
+		}
+	}
+
+	_, access, restricted, err := c.productQueryAccess(ownerCtx, productID, transaction, required, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !restricted {
+		return ownerCtx, nil, nil
+	}
+
+	err = c.assertProductAccessLogged(ownerCtx, access, required)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ownerCtx, access.FieldSets, nil
+}
+
+/**
+*@dev assertTenantOwner() returns the current tenant if the caller's org owns it
+*/
+
+func (c *ProductDetailsContract) assertTenantOwner(ctx contractapi.TransactionContextInterface) (*Tenant, error) {
+	tenant := tenantOf(ctx)
+	if tenant == nil {
+		return nil, fmt.Errorf("products can only be shared from within a tenant")
+	}
+
+	caller, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+	if caller != tenant.Owner {
+		return nil, fmt.Errorf("only %s can share the products of tenant %s", tenant.Owner, tenant.ID)
+	}
+
+	return tenant, nil
+}
+
+func (t *Tenant) hasMember(mspID string) bool {
+	if mspID == t.Owner {
+		return true
+	}
+	for _, member := range t.Members {
+		if member == mspID {
+			return true
+		}
+	}
+	return false
+}
+
+func retrieveTenant(ctx contractapi.TransactionContextInterface, tenantID string) (*Tenant, error) {
+	tenantBytes, err := ctx.GetStub().GetState(tenantKey(tenantID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenant from the ledger: %v", err)
+	}
+	if tenantBytes == nil {
+		return nil, nil
+	}
+
+	tenant := new(Tenant)
+	err = json.Unmarshal(tenantBytes, tenant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tenant JSON: %v", err)
+	}
+
+	return tenant, nil
+}
+
+func putTenant(ctx contractapi.TransactionContextInterface, tenant *Tenant) error {
+	tenantBytes, err := json.Marshal(tenant)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tenant JSON: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(tenantKey(tenant.ID), tenantBytes)
+	if err != nil {
+		return fmt.Errorf("failed to put tenant on the ledger: %v", err)
+	}
+
+	return nil
+}
+
+/**
+*@dev validTenantID() keeps tenant IDs free of the dash separating a tenant's prefix from its keys
+*/
+
+func validTenantID(tenantID string) bool {
+	if tenantID == "" {
+		return false
+	}
+	for _, r := range tenantID {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+/**
+*@dev indexOrgProduct() records that an org registered a product, so it can tell whether it has products in a namespace
+*/
+
+func indexOrgProduct(ctx contractapi.TransactionContextInterface, registrant string, productID uint64) error {
+	err := ctx.GetStub().PutState(fmt.Sprintf("%s%020d", orgProductPrefix(registrant), productID), []byte(fmt.Sprint(productID)))
+	if err != nil {
+		return fmt.Errorf("failed to put organisation product index on the ledger: %v", err)
+	}
+
+	return nil
+}
+
+func orgProductPrefix(registrant string) string {
+	return fmt.Sprintf("ORG-%s-PRODUCT-", registrant)
+}
+
+func tenantKey(tenantID string) string {
+	return TENANT_KEY_PREFIX + tenantID
+}
+
+func productGrantKey(productID uint64, grantee string) string {
+	return fmt.Sprintf("PRODUCT-%d-GRANT-%s", productID, grantee)
+}
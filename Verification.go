@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+/**
+*@dev VerificationStatus() represents the outcome of a saleable return verification
+*/
+
+type VerificationStatus int
+
+const (
+	VERIFICATION_PENDING VerificationStatus = iota
+	VERIFICATION_VERIFIED
+	VERIFICATION_NOT_VERIFIED
+)
+
+/**
+*@dev VerificationRequest() represents a wholesaler's request to verify a returned product's identifier
+*/
+
+type VerificationRequest struct {
+	ID           string             `json:"id"`
+	ProductID    uint64             `json:"productId"`
+	GTIN         string             `json:"gtin"`
+	SerialNumber string             `json:"serialNumber"`
+	LotNumber    string             `json:"lotNumber"`
+	ExpiryDate   string             `json:"expiryDate"`
+	Requester    string             `json:"requester"`
+	RequestedAt  uint64             `json:"requestedAt"`
+	Status       VerificationStatus `json:"status"`
+	Responder    string             `json:"responder,omitempty" metadata:",optional"`
+	RespondedAt  uint64             `json:"respondedAt,omitempty" metadata:",optional"`
+}
+
+/**
+*@dev ReturnVerification() represents the latest verification result recorded on a product
+*/
+
+type ReturnVerification struct {
+	RequestID   string             `json:"requestId"`
+	Status      VerificationStatus `json:"status"`
+	Responder   string             `json:"responder"`
+	RespondedAt uint64             `json:"respondedAt"`
+}
+
+/**
+*@dev RequestReturnVerification() records a verification request for a returned product and notifies the manufacturer's responder
+*/
+
+func (c *ProductDetailsContract) RequestReturnVerification(ctx contractapi.TransactionContextInterface, productID uint64, gtin string, serialNumber string, lotNumber string, expiryDate string) (string, error) {
+	if gtin == "" || serialNumber == "" || lotNumber == "" || expiryDate == "" {
+		return "", fmt.Errorf("gtin, serial number, lot number and expiry date are required")
+	}
+
+	product, err := c.retrieveProductDetails(ctx, productID)
+	if err != nil {
+		return "", err
+	}
+	if lotNumber != product.BatchNumber {
+		return "", fmt.Errorf("lot %s does not match the batch %s of product %d", lotNumber, product.BatchNumber, productID)
+	}
+
+	requester, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return "", fmt.Errorf("failed to read requester identity: %v", err)
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return "", fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+
+	request := VerificationRequest{
+		ID:           ctx.GetStub().GetTxID(),
+		ProductID:    productID,
+		GTIN:         gtin,
+		SerialNumber: serialNumber,
+		LotNumber:    lotNumber,
+		ExpiryDate:   expiryDate,
+		Requester:    requester,
+		RequestedAt:  uint64(timestamp.GetSeconds()),
+		Status:       VERIFICATION_PENDING,
+	}
+
+	requestBytes, err := json.Marshal(request)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal verification request JSON: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(fmt.Sprintf("VERIFICATION-%s", request.ID), requestBytes)
+	if err != nil {
+		return "", fmt.Errorf("failed to put verification request on the ledger: %v", err)
+	}
+
+	err = ctx.GetStub().SetEvent("VerificationRequested", requestBytes)
+	if err != nil {
+		return "", fmt.Errorf("failed to set verification request event: %v", err)
+	}
+
+	return request.ID, nil
+}
+
+/**
+*@dev RetrieveVerificationRequest() retrieves a verification request
+*/
+
+func (c *ProductDetailsContract) RetrieveVerificationRequest(ctx contractapi.TransactionContextInterface, requestID string) (*VerificationRequest, error) {
+	requestBytes, err := ctx.GetStub().GetState(fmt.Sprintf("VERIFICATION-%s", requestID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read verification request from the ledger: %v", err)
+	}
+	if requestBytes == nil {
+		return nil, fmt.Errorf("verification request %s does not exist", requestID)
+	}
+
+	request := new(VerificationRequest)
+	err = json.Unmarshal(requestBytes, request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal verification request JSON: %v", err)
+	}
+
+	return request, nil
+}
+
+/**
+*@dev RespondToVerification() records the manufacturer's answer to a verification request on the request and the product
+*
+* Only the organisation that registered the product can answer for it.
+*/
+
+func (c *ProductDetailsContract) RespondToVerification(ctx contractapi.TransactionContextInterface, requestID string, verified bool) error {
+	request, err := c.RetrieveVerificationRequest(ctx, requestID)
+	if err != nil {
+		return err
+	}
+	if request.Status != VERIFICATION_PENDING {
+		return fmt.Errorf("verification request %s has already been answered", requestID)
+	}
+
+	responder, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read responder identity: %v", err)
+	}
+	if responder == request.Requester {
+		return fmt.Errorf("verification request %s cannot be answered by the requesting organisation", requestID)
+	}
+
+	registrant, err := c.productRegistrant(ctx, request.ProductID)
+	if err != nil {
+		return err
+	}
+	if registrant == "" {
+		return fmt.Errorf("product %d has no recorded registrant to answer verification request %s", request.ProductID, requestID)
+	}
+	if responder != registrant {
+		return fmt.Errorf("verification request %s can only be answered by %s, which registered product %d", requestID, registrant, request.ProductID)
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+
+	request.Status = VERIFICATION_NOT_VERIFIED
+	if verified {
+		request.Status = VERIFICATION_VERIFIED
+	}
+	request.Responder = responder
+	request.RespondedAt = uint64(timestamp.GetSeconds())
+
+	requestBytes, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to marshal verification request JSON: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(fmt.Sprintf("VERIFICATION-%s", request.ID), requestBytes)
+	if err != nil {
+		return fmt.Errorf("failed to put verification response on the ledger: %v", err)
+	}
+
+	product, err := c.retrieveProductDetails(ctx, request.ProductID)
+	if err != nil {
+		return err
+	}
+
+	err = c.appendProductEvent(ctx, product, ProductEvent{
+		Type: EVENT_RETURN_VERIFIED,
+		ReturnVerification: &ReturnVerification{
+			RequestID:   request.ID,
+			Status:      request.Status,
+			Responder:   request.Responder,
+			RespondedAt: request.RespondedAt,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = ctx.GetStub().SetEvent("VerificationResponded", requestBytes)
+	if err != nil {
+		return fmt.Errorf("failed to set verification response event: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"Quanta-Ledger/devpeer"
+	"Quanta-Ledger/gatewayclient"
+	"Quanta-Ledger/reconcile"
+)
+
+const usage = `usage:
+  erp-reconcile compare LEDGER -export FILE -out REPORT [-states FILE] [-scan]
+  erp-reconcile propose -report REPORT -out PROPOSALS [-states FILE]
+  erp-reconcile apply LEDGER -proposals PROPOSALS
+
+LEDGER is either a peer's gateway:
+  -gateway HOST:PORT -msp MSP -cert FILE -key FILE [-tls-cert FILE] [-channel NAME] [-chaincode NAME]
+or the peer emulator:
+  -peer URL -msp MSP [-role ROLE]`
+
+func main() {
+	if len(os.Args) < 2 {
+		log.Fatal(usage)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "compare":
+		err = runCompare(os.Args[2:])
+	case "propose":
+		err = runPropose(os.Args[2:])
+	case "apply":
+		err = runApply(os.Args[2:])
+	default:
+		err = fmt.Errorf("unknown command %s\n%s", os.Args[1], usage)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+/**
+*@dev runCompare() reconciles an ERP export with the ledger as the ERP's organisation and writes the differences to a report
+*/
+
+func runCompare(args []string) error {
+	flags := flag.NewFlagSet("compare", flag.ExitOnError)
+	ledger := addLedgerFlags(flags, "MSP ID of the organisation the ERP belongs to")
+	export := flags.String("export", "", "ERP export to reconcile, as .csv or .json")
+	states := flags.String("states", "", "JSON file mapping ERP state terms to ProductState names")
+	scan := flags.Bool("scan", false, "read every product on the ledger to find those missing from the ERP")
+	out := flags.String("out", "", "report file to write")
+	flags.Parse(args)
+
+	if *export == "" || *out == "" {
+		return fmt.Errorf("an ERP export and a report file are required")
+	}
+
+	aliases, err := readStateAliases(*states)
+	if err != nil {
+		return err
+	}
+	records, err := reconcile.ReadExport(*export)
+	if err != nil {
+		return err
+	}
+
+	client, closeClient, err := ledger.connect()
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+
+	reconciler := newReconciler(client, *ledger.mspID, aliases)
+	reconciler.Scan = *scan
+
+	report, err := reconciler.Compare(records)
+	if err != nil {
+		return err
+	}
+
+	err = reconcile.WriteReport(*out, report)
+	if err != nil {
+		return err
+	}
+
+	counts := report.Counts()
+	categories := make([]string, 0, len(counts))
+	for category := range counts {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	log.Printf("reconciled %d ERP records with %d ledger products: %d matched, %d differences", report.ERPRecords, report.LedgerProducts, report.Matched, len(report.Differences))
+	for _, category := range categories {
+		log.Printf("  %s: %d", category, counts[category])
+	}
+	return nil
+}
+
+func runPropose(args []string) error {
+	flags := flag.NewFlagSet("propose", flag.ExitOnError)
+	reportFile := flags.String("report", "", "report file written by compare")
+	states := flags.String("states", "", "JSON file mapping ERP state terms to ProductState names")
+	out := flags.String("out", "", "proposals file to write")
+	flags.Parse(args)
+
+	if *reportFile == "" || *out == "" {
+		return fmt.Errorf("a report file and a proposals file are required")
+	}
+
+	aliases, err := readStateAliases(*states)
+	if err != nil {
+		return err
+	}
+	report, err := reconcile.ReadReport(*reportFile)
+	if err != nil {
+		return err
+	}
+
+	proposals, err := reconcile.Propose(report, aliases)
+	if err != nil {
+		return err
+	}
+
+	err = reconcile.WriteProposals(*out, proposals)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("proposed %d corrections for %d differences; the rest need handling by hand", len(proposals), len(report.Differences))
+	return nil
+}
+
+/**
+*@dev runApply() asks the operator to confirm each pending proposal before submitting it, saving every decision as it is made
+*
+* Declined, stale and failed proposals stay in the file with their status, and quitting leaves the remaining ones pending.
+*/
+
+func runApply(args []string) error {
+	flags := flag.NewFlagSet("apply", flag.ExitOnError)
+	ledger := addLedgerFlags(flags, "MSP ID to submit as")
+	proposalsFile := flags.String("proposals", "", "proposals file written by propose")
+	flags.Parse(args)
+
+	if *proposalsFile == "" {
+		return fmt.Errorf("a proposals file is required")
+	}
+
+	proposals, err := reconcile.ReadProposals(*proposalsFile)
+	if err != nil {
+		return err
+	}
+
+	client, closeClient, err := ledger.connect()
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+
+	reconciler := newReconciler(client, *ledger.mspID, nil)
+
+	input := bufio.NewReader(os.Stdin)
+	quit := false
+	confirm := func(proposal reconcile.Proposal) (bool, error) {
+		fmt.Printf("product %d: %s\n  %s(%s)\napply? [y/N/q] ", proposal.ProductID, proposal.Reason, proposal.Function, strings.Join(proposal.Args, ", "))
+		answer, err := input.ReadString('\n')
+		if err != nil && answer == "" {
+			quit = true
+			return false, nil
+		}
+
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			return true, nil
+		case "q", "quit":
+			quit = true
+		}
+		return false, nil
+	}
+
+	for i := range proposals {
+		proposal := &proposals[i]
+		if proposal.Status != reconcile.PROPOSAL_PENDING {
+			continue
+		}
+
+		err = reconciler.ApplyProposal(proposal, confirm)
+		if err != nil {
+			return err
+		}
+		if quit {
+			proposal.Status = reconcile.PROPOSAL_PENDING
+			break
+		}
+		if proposal.Result != "" {
+			log.Printf("product %d: %s: %s", proposal.ProductID, proposal.Status, proposal.Result)
+		} else {
+			log.Printf("product %d: %s", proposal.ProductID, proposal.Status)
+		}
+
+		err = reconcile.WriteProposals(*proposalsFile, proposals)
+		if err != nil {
+			return err
+		}
+	}
+
+	counts := make(map[string]int)
+	for _, proposal := range proposals {
+		counts[proposal.Status]++
+	}
+	log.Printf("%d applied, %d declined, %d stale, %d failed, %d pending", counts[reconcile.PROPOSAL_APPLIED], counts[reconcile.PROPOSAL_DECLINED], counts[reconcile.PROPOSAL_STALE], counts[reconcile.PROPOSAL_FAILED], counts[reconcile.PROPOSAL_PENDING])
+	return nil
+}
+
+/**
+*@dev ledgerFlags() are the flags saying how to reach the ledger: through a peer's gateway when -gateway is set, or else the peer emulator
+*/
+
+type ledgerFlags struct {
+	gateway   *string
+	tlsCert   *string
+	cert      *string
+	key       *string
+	channel   *string
+	chaincode *string
+	peer      *string
+	mspID     *string
+	role      *string
+}
+
+func addLedgerFlags(flags *flag.FlagSet, mspUsage string) *ledgerFlags {
+	return &ledgerFlags{
+		gateway:   flags.String("gateway", "", "host:port of a peer's gateway endpoint; the peer emulator is used when empty"),
+		tlsCert:   flags.String("tls-cert", "", "CA certificate the gateway's TLS certificate is checked against; the connection is not encrypted when empty"),
+		cert:      flags.String("cert", "", "certificate of the identity to connect to the gateway as"),
+		key:       flags.String("key", "", "private key of the identity to connect to the gateway as"),
+		channel:   flags.String("channel", "mychannel", "channel the chaincode is deployed on"),
+		chaincode: flags.String("chaincode", "quanta-ledger", "name the chaincode is deployed under"),
+		peer:      flags.String("peer", "http://localhost:7080", "URL of the peer emulator"),
+		mspID:     flags.String("msp", "Org1MSP", mspUsage),
+		role:      flags.String("role", "", "role attribute of the identity on the peer emulator; a gateway identity's certificate carries its attributes"),
+	}
+}
+
+/**
+*@dev connect() returns a client for the ledger the flags name and a function that closes it
+*/
+
+func (l *ledgerFlags) connect() (reconcile.ContractClient, func(), error) {
+	if *l.gateway == "" {
+		identity := devpeer.Identity{MSPID: *l.mspID}
+		if *l.role != "" {
+			identity.Attributes = map[string]string{"role": *l.role}
+		}
+		return devpeer.NewClient(*l.peer, identity), func() {}, nil
+	}
+
+	if *l.cert == "" || *l.key == "" {
+		return nil, nil, fmt.Errorf("connecting to a gateway needs the identity's -cert and -key")
+	}
+	identity, err := gatewayclient.ReadIdentity(*l.mspID, *l.cert, *l.key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	contract, err := gatewayclient.Dial(*l.gateway, *l.tlsCert, identity, *l.channel, *l.chaincode)
+	if err != nil {
+		return nil, nil, err
+	}
+	return contract, func() { contract.Close() }, nil
+}
+
+func newReconciler(client reconcile.ContractClient, custodian string, aliases map[string]string) *reconcile.Reconciler {
+	return &reconcile.Reconciler{
+		Ledger:       client,
+		Custodian:    custodian,
+		StateAliases: aliases,
+		IsRejection: func(err error) bool {
+			var rejection *devpeer.TransactionError
+			var gatewayRejection *gatewayclient.TransactionError
+			return errors.As(err, &rejection) || errors.As(err, &gatewayRejection)
+		},
+	}
+}
+
+func readStateAliases(path string) (map[string]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	aliasesBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state aliases: %v", err)
+	}
+
+	aliases := make(map[string]string)
+	err = json.Unmarshal(aliasesBytes, &aliases)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal state aliases JSON: %v", err)
+	}
+
+	return aliases, nil
+}
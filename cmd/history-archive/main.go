@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"Quanta-Ledger/devpeer"
+	"Quanta-Ledger/historyarchive"
+)
+
+/**
+*@dev checkpoint() is the part of the chaincode's HistoryCheckpoint the archiver checks
+*/
+
+type checkpoint struct {
+	ThroughSequence uint64 `json:"throughSequence"`
+	Root            string `json:"root"`
+	LastEntryHash   string `json:"lastEntryHash"`
+}
+
+const usage = `usage:
+  history-archive archive -peer URL -product ID -through SEQ -out FILE [-compact]
+  history-archive verify -archive FILE
+  history-archive prove -archive FILE -sequence SEQ
+  history-archive verify-chain -peer URL -product ID [-archives FILE,...]`
+
+func main() {
+	if len(os.Args) < 2 {
+		log.Fatal(usage)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "archive":
+		err = runArchive(os.Args[2:])
+	case "verify":
+		err = runVerify(os.Args[2:])
+	case "prove":
+		err = runProve(os.Args[2:])
+	case "verify-chain":
+		err = runVerifyChain(os.Args[2:])
+	default:
+		err = fmt.Errorf("unknown command %s\n%s", os.Args[1], usage)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+/**
+*@dev runArchive() exports the entries a compaction would remove to an archive file, then optionally submits the compaction
+*
+* The archive is written before anything is compacted, and the checkpoint's root is checked against it afterwards.
+*/
+
+func runArchive(args []string) error {
+	flags := flag.NewFlagSet("archive", flag.ExitOnError)
+	peer := flags.String("peer", "http://localhost:7080", "URL of the peer emulator")
+	mspID := flags.String("msp", "Org1MSP", "MSP ID to submit as")
+	role := flags.String("role", "admin", "role attribute of the submitting identity")
+	productID := flags.Uint64("product", 0, "product whose history is archived")
+	through := flags.Uint64("through", 0, "last event sequence to archive")
+	out := flags.String("out", "", "archive file to write")
+	compact := flags.Bool("compact", false, "compact the archived entries on the ledger once the archive is written")
+	flags.Parse(args)
+
+	if *out == "" {
+		return fmt.Errorf("an archive file is required")
+	}
+
+	client := devpeer.NewClient(*peer, devpeer.Identity{MSPID: *mspID, Attributes: map[string]string{"role": *role}})
+	productArg := strconv.FormatUint(*productID, 10)
+
+	checkpointsBytes, err := client.EvaluateTransaction("GetHistoryCheckpoints", productArg)
+	if err != nil {
+		return err
+	}
+	var checkpoints []checkpoint
+	err = json.Unmarshal(checkpointsBytes, &checkpoints)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal history checkpoints JSON: %v", err)
+	}
+
+	entriesBytes, err := client.EvaluateTransaction("ExportProductHistory", productArg, strconv.FormatUint(*through, 10))
+	if err != nil {
+		return err
+	}
+	archive := &historyarchive.Archive{ProductID: *productID, ThroughSequence: *through}
+	err = json.Unmarshal(entriesBytes, &archive.Entries)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal history entries JSON: %v", err)
+	}
+
+	if len(checkpoints) > 0 {
+		archive.PreviousRoot = checkpoints[len(checkpoints)-1].Root
+	}
+	archive.Root = historyarchive.ComputeRoot(archive.PreviousRoot, archive.Entries)
+
+	err = historyarchive.WriteArchive(*out, archive)
+	if err != nil {
+		return err
+	}
+	log.Printf("archived %d entries of product %d with root %s", len(archive.Entries), *productID, archive.Root)
+
+	if !*compact {
+		return nil
+	}
+
+	checkpointBytes, err := client.SubmitTransaction("CompactProductHistory", productArg, strconv.FormatUint(*through, 10))
+	if err != nil {
+		return err
+	}
+	var compacted checkpoint
+	err = json.Unmarshal(checkpointBytes, &compacted)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal history checkpoint JSON: %v", err)
+	}
+	if compacted.Root != archive.Root {
+		return fmt.Errorf("checkpoint root %s does not match archive root %s", compacted.Root, archive.Root)
+	}
+
+	log.Printf("compacted product %d through event %d", *productID, compacted.ThroughSequence)
+	return nil
+}
+
+func runVerify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	archiveFile := flags.String("archive", "", "archive file to verify")
+	flags.Parse(args)
+
+	archive, err := historyarchive.ReadArchive(*archiveFile)
+	if err != nil {
+		return err
+	}
+
+	err = archive.Verify()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("archive of product %d verifies to root %s", archive.ProductID, archive.Root)
+	return nil
+}
+
+/**
+*@dev runProve() prints the proof for one archived entry; submit it to VerifyArchivedHistoryEntry to check it against the ledger
+*/
+
+func runProve(args []string) error {
+	flags := flag.NewFlagSet("prove", flag.ExitOnError)
+	archiveFile := flags.String("archive", "", "archive file holding the entry")
+	sequence := flags.Uint64("sequence", 0, "sequence of the entry to prove; 0 is the pre-event history list")
+	flags.Parse(args)
+
+	archive, err := historyarchive.ReadArchive(*archiveFile)
+	if err != nil {
+		return err
+	}
+
+	proof, err := archive.Prove(*sequence)
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(os.Stdout).Encode(proof)
+}
+
+/**
+*@dev runVerifyChain() checks the hash chain of a product's events independently of the chaincode
+*
+* Without archives the chain is checked from the latest checkpoint. With every archive of the product, oldest first,
+* it is checked from the product's first event and each archive's root is matched against its checkpoint.
+*/
+
+func runVerifyChain(args []string) error {
+	flags := flag.NewFlagSet("verify-chain", flag.ExitOnError)
+	peer := flags.String("peer", "http://localhost:7080", "URL of the peer emulator")
+	mspID := flags.String("msp", "Org1MSP", "MSP ID to evaluate as")
+	productID := flags.Uint64("product", 0, "product whose history is checked")
+	archiveFiles := flags.String("archives", "", "comma-separated archive files of the product, oldest first")
+	flags.Parse(args)
+
+	client := devpeer.NewClient(*peer, devpeer.Identity{MSPID: *mspID})
+	productArg := strconv.FormatUint(*productID, 10)
+
+	checkpointsBytes, err := client.EvaluateTransaction("GetHistoryCheckpoints", productArg)
+	if err != nil {
+		return err
+	}
+	var checkpoints []checkpoint
+	err = json.Unmarshal(checkpointsBytes, &checkpoints)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal history checkpoints JSON: %v", err)
+	}
+
+	verifier := historyarchive.NewChainVerifier("", 0)
+	if *archiveFiles == "" && len(checkpoints) > 0 {
+		latest := checkpoints[len(checkpoints)-1]
+		verifier = historyarchive.NewChainVerifier(latest.LastEntryHash, latest.ThroughSequence)
+	}
+
+	if *archiveFiles != "" {
+		paths := strings.Split(*archiveFiles, ",")
+		if len(paths) != len(checkpoints) {
+			return fmt.Errorf("product %d has %d checkpoints but %d archives were given", *productID, len(checkpoints), len(paths))
+		}
+
+		for i, path := range paths {
+			archive, err := historyarchive.ReadArchive(path)
+			if err != nil {
+				return err
+			}
+			err = archive.Verify()
+			if err != nil {
+				return err
+			}
+			if archive.Root != checkpoints[i].Root {
+				return fmt.Errorf("archive %s has root %s but checkpoint %d has root %s", path, archive.Root, i+1, checkpoints[i].Root)
+			}
+
+			for _, entry := range archive.Entries {
+				verifier.Add(entry)
+			}
+		}
+	}
+
+	productBytes, err := client.EvaluateTransaction("RetrieveProductDetails", productArg)
+	if err != nil {
+		return err
+	}
+	var product struct {
+		Version uint64 `json:"version"`
+	}
+	err = json.Unmarshal(productBytes, &product)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal product JSON: %v", err)
+	}
+
+	if product.Version > verifier.Sequence {
+		entriesBytes, err := client.EvaluateTransaction("ExportProductHistory", productArg, strconv.FormatUint(product.Version, 10))
+		if err != nil {
+			return err
+		}
+		var entries []historyarchive.Entry
+		err = json.Unmarshal(entriesBytes, &entries)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal history entries JSON: %v", err)
+		}
+
+		for _, entry := range entries {
+			verifier.Add(entry)
+		}
+	}
+
+	if verifier.Sequence != product.Version {
+		verifier.Breaks = append(verifier.Breaks, historyarchive.ChainBreak{Sequence: verifier.Sequence, Detail: fmt.Sprintf("chain ends at event %d but the product is at version %d", verifier.Sequence, product.Version)})
+	}
+
+	for _, chainBreak := range verifier.Breaks {
+		log.Printf("event %d: %s", chainBreak.Sequence, chainBreak.Detail)
+	}
+	if !verifier.Intact() {
+		return fmt.Errorf("history chain of product %d is broken in %d places", *productID, len(verifier.Breaks))
+	}
+
+	log.Printf("history chain of product %d is intact through event %d", *productID, verifier.Sequence)
+	return nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"Quanta-Ledger/devpeer"
+	"Quanta-Ledger/historyarchive"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+/**
+*@dev ledgerContract() stands in for the chaincode's history transactions, serving one product's checkpoints and stored entries
+*/
+
+type ledgerContract struct {
+	contractapi.Contract
+	checkpoints []checkpoint
+	entries     []historyarchive.Entry
+	version     uint64
+	// compactedRoot, when set, is the root CompactProductHistory reports instead of the one it computes
+	compactedRoot string
+}
+
+func (c *ledgerContract) GetHistoryCheckpoints(ctx contractapi.TransactionContextInterface, productID uint64) (string, error) {
+	return marshal(c.checkpoints)
+}
+
+// ExportProductHistory returns the stored entries after the latest checkpoint through a sequence, as the chaincode does
+func (c *ledgerContract) ExportProductHistory(ctx contractapi.TransactionContextInterface, productID uint64, through uint64) (string, error) {
+	return marshal(c.uncompacted(through))
+}
+
+func (c *ledgerContract) RetrieveProductDetails(ctx contractapi.TransactionContextInterface, productID uint64) (string, error) {
+	return marshal(map[string]uint64{"id": productID, "version": c.version})
+}
+
+func (c *ledgerContract) CompactProductHistory(ctx contractapi.TransactionContextInterface, productID uint64, through uint64) (string, error) {
+	compacted := c.uncompacted(through)
+	root := historyarchive.ComputeRoot(c.latestRoot(), compacted)
+	if c.compactedRoot != "" {
+		root = c.compactedRoot
+	}
+	return marshal(checkpoint{ThroughSequence: through, Root: root, LastEntryHash: historyarchive.EntryHash(compacted[len(compacted)-1].Entry)})
+}
+
+func (c *ledgerContract) uncompacted(through uint64) []historyarchive.Entry {
+	entries := []historyarchive.Entry{}
+	for _, entry := range c.entries {
+		if entry.Sequence <= through {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func (c *ledgerContract) latestRoot() string {
+	if len(c.checkpoints) == 0 {
+		return ""
+	}
+	return c.checkpoints[len(c.checkpoints)-1].Root
+}
+
+func marshal(value interface{}) (string, error) {
+	valueBytes, err := json.Marshal(value)
+	return string(valueBytes), err
+}
+
+/**
+*@dev chainedEvents() builds a product's legacy history list and stored events with sequences 1 to count, each event
+* carrying the hash of the one before
+*/
+
+func chainedEvents(count uint64) []historyarchive.Entry {
+	entries := []historyarchive.Entry{{Sequence: 0, Entry: `[{"timestamp":1700000000,"action":"MOVEMENT","location":"Lagos depot"}]`}}
+	previousHash := ""
+	for sequence := uint64(1); sequence <= count; sequence++ {
+		entry := historyarchive.Entry{Sequence: sequence, Entry: fmt.Sprintf(`{"sequence":%d,"previousHash":%q,"type":"MOVEMENT","location":"Hub %d"}`, sequence, previousHash, sequence)}
+		entries = append(entries, entry)
+		previousHash = historyarchive.EntryHash(entry.Entry)
+	}
+	return entries
+}
+
+/**
+*@dev compactedLedger() is a product with six events whose history through event 3 was archived and compacted
+*/
+
+func compactedLedger() (*ledgerContract, *historyarchive.Archive) {
+	entries := chainedEvents(6)
+	archive := &historyarchive.Archive{ProductID: 1, ThroughSequence: 3, Entries: entries[:4]}
+	archive.Root = historyarchive.ComputeRoot("", archive.Entries)
+
+	ledger := &ledgerContract{
+		checkpoints: []checkpoint{{ThroughSequence: 3, Root: archive.Root, LastEntryHash: historyarchive.EntryHash(entries[3].Entry)}},
+		entries:     entries[4:],
+		version:     6,
+	}
+	return ledger, archive
+}
+
+func serveLedger(t *testing.T, ledger *ledgerContract) string {
+	t.Helper()
+
+	chaincode, err := contractapi.NewChaincode(ledger)
+	if err != nil {
+		t.Fatalf("failed to create chaincode: %v", err)
+	}
+	peer, err := devpeer.NewPeer(chaincode, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(devpeer.NewServer(peer))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func writeArchive(t *testing.T, archive *historyarchive.Archive) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "archive.json")
+	err := historyarchive.WriteArchive(path, archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func expectError(t *testing.T, err error, expected string) {
+	t.Helper()
+
+	if expected == "" {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	if err == nil || !strings.Contains(err.Error(), expected) {
+		t.Fatalf("expected an error containing %q, got %v", expected, err)
+	}
+}
+
+func TestVerifyChain(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(ledger *ledgerContract, archive *historyarchive.Archive)
+		archives int
+		err      string
+	}{
+		{name: "intact from the latest checkpoint", modify: func(ledger *ledgerContract, archive *historyarchive.Archive) {}},
+		{name: "intact from the first event", modify: func(ledger *ledgerContract, archive *historyarchive.Archive) {}, archives: 1},
+		{name: "tampered event", modify: func(ledger *ledgerContract, archive *historyarchive.Archive) {
+			ledger.entries[1].Entry = strings.Replace(ledger.entries[1].Entry, "Hub 5", "Hub 9", 1)
+		}, err: "broken in 1 places"},
+		{name: "dropped event", modify: func(ledger *ledgerContract, archive *historyarchive.Archive) {
+			ledger.entries = append(ledger.entries[:1], ledger.entries[2:]...)
+		}, err: "broken in 1 places"},
+		{name: "reordered events", modify: func(ledger *ledgerContract, archive *historyarchive.Archive) {
+			ledger.entries[1], ledger.entries[2] = ledger.entries[2], ledger.entries[1]
+		}, err: "broken in 3 places"},
+		{name: "events missing at the end", modify: func(ledger *ledgerContract, archive *historyarchive.Archive) {
+			ledger.version = 7
+		}, err: "broken in 1 places"},
+		{name: "event tampered after the checkpoint", modify: func(ledger *ledgerContract, archive *historyarchive.Archive) {
+			ledger.checkpoints[0].LastEntryHash = historyarchive.EntryHash("another entry")
+		}, err: "broken in 1 places"},
+		{name: "tampered archive", modify: func(ledger *ledgerContract, archive *historyarchive.Archive) {
+			archive.Entries[2].Entry = strings.Replace(archive.Entries[2].Entry, "Hub 2", "Hub 9", 1)
+		}, archives: 1, err: "hashes to"},
+		{name: "archive rehashed after tampering", modify: func(ledger *ledgerContract, archive *historyarchive.Archive) {
+			archive.Entries[2].Entry = strings.Replace(archive.Entries[2].Entry, "Hub 2", "Hub 9", 1)
+			archive.Root = historyarchive.ComputeRoot("", archive.Entries)
+		}, archives: 1, err: "but checkpoint 1 has root"},
+		{name: "archive missing", modify: func(ledger *ledgerContract, archive *historyarchive.Archive) {}, archives: 2, err: "has 1 checkpoints but 2 archives"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ledger, archive := compactedLedger()
+			test.modify(ledger, archive)
+
+			args := []string{"-peer", serveLedger(t, ledger), "-product", "1"}
+			if test.archives > 0 {
+				paths := []string{}
+				for i := 0; i < test.archives; i++ {
+					paths = append(paths, writeArchive(t, archive))
+				}
+				args = append(args, "-archives", strings.Join(paths, ","))
+			}
+
+			expectError(t, runVerifyChain(args), test.err)
+		})
+	}
+}
+
+func TestVerifyArchive(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(archive *historyarchive.Archive)
+		err    string
+	}{
+		{name: "intact", modify: func(archive *historyarchive.Archive) {}},
+		{name: "tampered entry", modify: func(archive *historyarchive.Archive) {
+			archive.Entries[1].Entry = strings.Replace(archive.Entries[1].Entry, "Hub 1", "Hub 9", 1)
+		}, err: "hashes to"},
+		{name: "dropped entry", modify: func(archive *historyarchive.Archive) {
+			archive.Entries = archive.Entries[:3]
+		}, err: "hashes to"},
+		{name: "reordered entries", modify: func(archive *historyarchive.Archive) {
+			archive.Entries[1], archive.Entries[2] = archive.Entries[2], archive.Entries[1]
+		}, err: "hashes to"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, archive := compactedLedger()
+			test.modify(archive)
+
+			expectError(t, runVerify([]string{"-archive", writeArchive(t, archive)}), test.err)
+		})
+	}
+}
+
+func TestArchiveChecksCompactedRoot(t *testing.T) {
+	tests := []struct {
+		name          string
+		compactedRoot string
+		err           string
+	}{
+		{name: "matching root"},
+		{name: "root of other entries", compactedRoot: historyarchive.ComputeRoot("", chainedEvents(2)), err: "does not match archive root"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ledger, archive := compactedLedger()
+			ledger.compactedRoot = test.compactedRoot
+
+			out := filepath.Join(t.TempDir(), "archive.json")
+			err := runArchive([]string{"-peer", serveLedger(t, ledger), "-product", "1", "-through", "5", "-out", out, "-compact"})
+			expectError(t, err, test.err)
+
+			written, err := historyarchive.ReadArchive(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if written.PreviousRoot != archive.Root || len(written.Entries) != 2 {
+				t.Fatalf("expected events 4 and 5 archived after the checkpoint's root, got %+v", written)
+			}
+			err = written.Verify()
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	"Quanta-Ledger/devpeer"
+	"Quanta-Ledger/mqttbridge"
+)
+
+/**
+*@dev logSubmitter() stands in for a gateway connection and only logs the transactions it is given
+*/
+
+type logSubmitter struct{}
+
+func (logSubmitter) SubmitTransaction(name string, args ...string) ([]byte, error) {
+	log.Printf("submit %s %q", name, args)
+	return nil, nil
+}
+
+func main() {
+	broker := flag.String("broker", "tcp://localhost:1883", "MQTT broker URL")
+	clientID := flag.String("client-id", "quanta-mqtt-bridge", "MQTT client ID")
+	topics := flag.String("topics", "trackers/+/telemetry", "comma-separated topic filters to subscribe to")
+	registryFile := flag.String("registry", "devices.json", "JSON file binding device IDs to product IDs")
+	batchSize := flag.Int("batch", 50, "readings per product that trigger an immediate submit")
+	flushInterval := flag.Duration("flush", 30*time.Second, "interval between submits of queued readings")
+	retries := flag.Int("retries", 3, "retries per transaction before readings are re-queued")
+	embedded := flag.String("embedded-broker", "", "start an in-process broker on this address and bridge from it")
+	devPeer := flag.String("dev-peer", "", "submit to a local peer emulator at this URL instead of logging")
+	mspID := flag.String("msp", "Org1MSP", "MSP ID the bridge submits as on the peer emulator")
+	deadLetterFile := flag.String("dead-letter", "", "append readings the ledger rejects to this file as JSON lines")
+	flag.Parse()
+
+	if *embedded != "" {
+		server, err := mqttbridge.StartEmbeddedBroker(*embedded)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer server.Close()
+		*broker = "tcp://" + *embedded
+	}
+
+	registry, err := mqttbridge.LoadRegistry(*registryFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var submitter mqttbridge.Submitter = logSubmitter{}
+	if *devPeer != "" {
+		submitter = devpeer.NewClient(*devPeer, devpeer.Identity{MSPID: *mspID})
+	}
+
+	var deadLetter func(uint64, mqttbridge.Reading, error)
+	if *deadLetterFile != "" {
+		file, err := os.OpenFile(*deadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			log.Fatalf("failed to open dead letter file: %v", err)
+		}
+		defer file.Close()
+		deadLetter = writeDeadLetter(json.NewEncoder(file))
+	}
+
+	bridge := mqttbridge.NewBridge(mqttbridge.Config{
+		BrokerURL:     *broker,
+		ClientID:      *clientID,
+		Topics:        strings.Split(*topics, ","),
+		BatchSize:     *batchSize,
+		FlushInterval: *flushInterval,
+		MaxRetries:    *retries,
+		IsRejection: func(err error) bool {
+			var rejection *devpeer.TransactionError
+			return errors.As(err, &rejection)
+		},
+		DeadLetter: deadLetter,
+	}, registry, submitter)
+
+	client, err := bridge.Subscribe()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Disconnect(250)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	log.Printf("bridging %s from %s", *topics, *broker)
+	bridge.Run(ctx)
+}
+
+/**
+*@dev writeDeadLetter() records each rejected reading with the product it was for and the ledger's reason
+*/
+
+func writeDeadLetter(encoder *json.Encoder) func(uint64, mqttbridge.Reading, error) {
+	var mu sync.Mutex
+	return func(productID uint64, reading mqttbridge.Reading, rejection error) {
+		mu.Lock()
+		defer mu.Unlock()
+		err := encoder.Encode(struct {
+			ProductID uint64             `json:"productId"`
+			Reading   mqttbridge.Reading `json:"reading"`
+			Error     string             `json:"error"`
+		}{productID, reading, rejection.Error()})
+		if err != nil {
+			log.Printf("failed to write dead letter: %v", err)
+		}
+	}
+}
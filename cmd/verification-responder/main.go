@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"Quanta-Ledger/devpeer"
+	"Quanta-Ledger/verification"
+)
+
+func main() {
+	addr := flag.String("addr", ":8090", "address to serve verification requests on")
+	stubFile := flag.String("stub", "", "JSON file of identifiers the local stub lookup treats as issued")
+	devPeer := flag.String("dev-peer", "", "record results on a local peer emulator at this URL")
+	mspID := flag.String("msp", "Org1MSP", "MSP ID the responder submits as on the peer emulator")
+	routesFile := flag.String("routes", "", "JSON object mapping GTIN company prefixes to the URLs of other manufacturers' responders")
+	flag.Parse()
+
+	var identifiers []verification.Identifier
+	if *stubFile != "" {
+		stubBytes, err := os.ReadFile(*stubFile)
+		if err != nil {
+			log.Fatalf("failed to read stub identifiers: %v", err)
+		}
+		err = json.Unmarshal(stubBytes, &identifiers)
+		if err != nil {
+			log.Fatalf("failed to unmarshal stub identifiers JSON: %v", err)
+		}
+	}
+
+	// Without a gateway connection the responder answers but does not record results
+	var client verification.ContractClient
+	if *devPeer != "" {
+		client = devpeer.NewClient(*devPeer, devpeer.Identity{MSPID: *mspID})
+	}
+	responder := verification.NewResponder(verification.NewStubLookup(identifiers...), client)
+
+	// GTINs no route claims are answered locally
+	router := verification.NewRouter()
+	router.Register("", responder)
+
+	routes := map[string]string{}
+	if *routesFile != "" {
+		routesBytes, err := os.ReadFile(*routesFile)
+		if err != nil {
+			log.Fatalf("failed to read routes: %v", err)
+		}
+		err = json.Unmarshal(routesBytes, &routes)
+		if err != nil {
+			log.Fatalf("failed to unmarshal routes JSON: %v", err)
+		}
+	}
+	for prefix, url := range routes {
+		router.Register(prefix, &verification.RemoteResponder{URL: url})
+	}
+
+	log.Printf("verification responder listening on %s with %d stub identifiers and %d remote routes", *addr, len(identifiers), len(routes))
+	log.Fatal(http.ListenAndServe(*addr, router))
+}
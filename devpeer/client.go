@@ -0,0 +1,130 @@
+package devpeer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+/**
+*@dev Client() submits and evaluates transactions against a dev server as one identity
+*
+* It has the same SubmitTransaction and EvaluateTransaction methods as a gateway contract, so it can stand in for one.
+*/
+
+type Client struct {
+	URL        string
+	Identity   Identity
+	HTTPClient *http.Client
+}
+
+func NewClient(url string, identity Identity) *Client {
+	return &Client{URL: strings.TrimSuffix(url, "/"), Identity: identity, HTTPClient: http.DefaultClient}
+}
+
+func (c *Client) SubmitTransaction(name string, args ...string) ([]byte, error) {
+	return c.post("/submit", name, Transaction{Identity: c.Identity, Function: name, Args: args})
+}
+
+func (c *Client) EvaluateTransaction(name string, args ...string) ([]byte, error) {
+	return c.post("/evaluate", name, Transaction{Identity: c.Identity, Function: name, Args: args})
+}
+
+/**
+*@dev Events() streams committed events from a block onwards until the context is cancelled
+*/
+
+func (c *Client) Events(ctx context.Context, startBlock uint64) (<-chan Event, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/events?startBlock=%d", c.URL, startBlock), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create events request: %v", err)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to dev peer: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		message, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("failed to subscribe to events: %s", strings.TrimSpace(string(message)))
+	}
+
+	events := make(chan Event)
+	go func() {
+		defer resp.Body.Close()
+		defer close(events)
+
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+
+			var event Event
+			if json.Unmarshal([]byte(data), &event) != nil {
+				continue
+			}
+
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+/**
+*@dev Reset() empties the dev server's ledger
+*/
+
+func (c *Client) Reset() error {
+	_, err := c.post("/reset", "reset", nil)
+	return err
+}
+
+/**
+*@dev Seed() submits fixture transactions to the dev server
+*/
+
+func (c *Client) Seed(fixtures []Transaction) error {
+	_, err := c.post("/seed", "seed", fixtures)
+	return err
+}
+
+func (c *Client) post(path string, function string, body interface{}) ([]byte, error) {
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request JSON: %v", err)
+	}
+
+	resp, err := c.HTTPClient.Post(c.URL+path, "application/json", bytes.NewReader(bodyBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to dev peer: %v", err)
+	}
+	defer resp.Body.Close()
+
+	result, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dev peer response: %v", err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return result, nil
+	case http.StatusUnprocessableEntity:
+		return nil, &TransactionError{Function: function, Message: strings.TrimSpace(string(result))}
+	default:
+		return nil, fmt.Errorf("dev peer returned %s: %s", resp.Status, strings.TrimSpace(string(result)))
+	}
+}
@@ -0,0 +1,327 @@
+package devpeer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/gateway"
+	"github.com/hyperledger/fabric-protos-go/orderer"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/**
+*@dev Gateway() serves a peer over the Fabric Gateway gRPC service, so apps can connect to it with the Fabric Gateway client SDKs
+*
+* The peer is the only endorser and signs nothing, and proposal and transaction signatures are not checked. A submitted
+* transaction is committed by the time Submit returns, so CommitStatus answers at once.
+*/
+
+type Gateway struct {
+	gateway.UnimplementedGatewayServer
+	peer     *Peer
+	mu       sync.Mutex
+	prepared map[string][]byte
+}
+
+func NewGateway(peer *Peer) *Gateway {
+	return &Gateway{peer: peer, prepared: make(map[string][]byte)}
+}
+
+/**
+*@dev NewGatewayServer() returns a gRPC server with the peer's gateway registered, ready to Serve a listener
+*/
+
+func NewGatewayServer(peer *Peer) *grpc.Server {
+	server := grpc.NewServer()
+	gateway.RegisterGatewayServer(server, NewGateway(peer))
+	return server
+}
+
+func (g *Gateway) Endorse(ctx context.Context, req *gateway.EndorseRequest) (*gateway.EndorseResponse, error) {
+	proposal, err := parseProposal(req.GetProposedTransaction())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	payload, event, err := g.peer.endorse(proposal.creator, proposal.txID, proposal.transient, proposal.args)
+	if err != nil {
+		return nil, transactionStatus(codes.Aborted, "failed to endorse transaction, see attached details for more info", err)
+	}
+
+	envelope, err := proposal.preparedTransaction(payload, event)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	g.mu.Lock()
+	g.prepared[proposal.txID] = envelope.Payload
+	g.mu.Unlock()
+
+	return &gateway.EndorseResponse{PreparedTransaction: envelope}, nil
+}
+
+func (g *Gateway) Submit(ctx context.Context, req *gateway.SubmitRequest) (*gateway.SubmitResponse, error) {
+	g.mu.Lock()
+	prepared, ok := g.prepared[req.GetTransactionId()]
+	delete(g.prepared, req.GetTransactionId())
+	g.mu.Unlock()
+
+	if !ok {
+		return nil, status.Errorf(codes.FailedPrecondition, "transaction %s has not been endorsed", req.GetTransactionId())
+	}
+	if !bytes.Equal(req.GetPreparedTransaction().GetPayload(), prepared) {
+		return nil, status.Errorf(codes.InvalidArgument, "transaction %s does not match the one endorsed", req.GetTransactionId())
+	}
+
+	_, err := g.peer.commitEndorsed(req.GetTransactionId())
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	return &gateway.SubmitResponse{}, nil
+}
+
+func (g *Gateway) CommitStatus(ctx context.Context, signed *gateway.SignedCommitStatusRequest) (*gateway.CommitStatusResponse, error) {
+	var req gateway.CommitStatusRequest
+	err := proto.Unmarshal(signed.GetRequest(), &req)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "failed to unmarshal commit status request: %v", err)
+	}
+
+	committed, ok := g.peer.commitStatus(req.GetTransactionId())
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "transaction %s has not been submitted", req.GetTransactionId())
+	}
+
+	return &gateway.CommitStatusResponse{Result: committed.Code, BlockNumber: committed.BlockNumber}, nil
+}
+
+func (g *Gateway) Evaluate(ctx context.Context, req *gateway.EvaluateRequest) (*gateway.EvaluateResponse, error) {
+	proposal, err := parseProposal(req.GetProposedTransaction())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	payload, err := g.peer.evaluate(proposal.creator, proposal.txID, proposal.transient, proposal.args)
+	if err != nil {
+		return nil, transactionStatus(codes.Unknown, "evaluate call to endorser returned error", err)
+	}
+
+	return &gateway.EvaluateResponse{Result: &pb.Response{Status: shim.OK, Payload: payload}}, nil
+}
+
+/**
+*@dev ChaincodeEvents() streams committed events from the requested start position, or from the next block when none is given
+*/
+
+func (g *Gateway) ChaincodeEvents(signed *gateway.SignedChaincodeEventsRequest, stream gateway.Gateway_ChaincodeEventsServer) error {
+	var req gateway.ChaincodeEventsRequest
+	err := proto.Unmarshal(signed.GetRequest(), &req)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "failed to unmarshal chaincode events request: %v", err)
+	}
+
+	startBlock := g.peer.BlockHeight() + 1
+	switch position := req.GetStartPosition().GetType().(type) {
+	case *orderer.SeekPosition_Oldest:
+		startBlock = 0
+	case *orderer.SeekPosition_Newest:
+		startBlock = g.peer.BlockHeight()
+	case *orderer.SeekPosition_Specified:
+		startBlock = position.Specified.GetNumber()
+	}
+
+	events, cancel := g.peer.Subscribe(startBlock)
+	defer cancel()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		case event, ok := <-events:
+			if !ok {
+				return status.Error(codes.Unavailable, "event stream fell too far behind the peer")
+			}
+
+			// Each block holds one transaction, so only the start block can hold the transaction to resume after
+			if event.BlockNumber == startBlock && event.TransactionID == req.GetAfterTransactionId() {
+				continue
+			}
+
+			err = stream.Send(&gateway.ChaincodeEventsResponse{
+				BlockNumber: event.BlockNumber,
+				Events: []*pb.ChaincodeEvent{{
+					ChaincodeId: req.GetChaincodeId(),
+					TxId:        event.TransactionID,
+					EventName:   event.EventName,
+					Payload:     event.Payload,
+				}},
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+/**
+*@dev transactionStatus() reports a transaction the chaincode rejected with the gateway's error details, and other failures as unavailable
+*/
+
+func transactionStatus(code codes.Code, message string, err error) error {
+	var transactionErr *TransactionError
+	if !errors.As(err, &transactionErr) {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+
+	rejected, detailErr := status.New(code, message).WithDetails(&gateway.ErrorDetail{Address: "devpeer", Message: transactionErr.Message})
+	if detailErr != nil {
+		return status.Error(code, fmt.Sprintf("%s: %s", message, transactionErr.Message))
+	}
+	return rejected.Err()
+}
+
+// proposal is the part of a signed proposal the peer needs to run it and build its prepared transaction
+type proposal struct {
+	header      *common.Header
+	txID        string
+	creator     []byte
+	chaincodeID *pb.ChaincodeID
+	input       *pb.ChaincodeInput
+	args        [][]byte
+	transient   map[string][]byte
+}
+
+func parseProposal(signed *pb.SignedProposal) (*proposal, error) {
+	var unsigned pb.Proposal
+	err := proto.Unmarshal(signed.GetProposalBytes(), &unsigned)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal proposal: %v", err)
+	}
+
+	var header common.Header
+	err = proto.Unmarshal(unsigned.GetHeader(), &header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal proposal header: %v", err)
+	}
+
+	var channelHeader common.ChannelHeader
+	err = proto.Unmarshal(header.GetChannelHeader(), &channelHeader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal channel header: %v", err)
+	}
+
+	var signatureHeader common.SignatureHeader
+	err = proto.Unmarshal(header.GetSignatureHeader(), &signatureHeader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal signature header: %v", err)
+	}
+
+	var payload pb.ChaincodeProposalPayload
+	err = proto.Unmarshal(unsigned.GetPayload(), &payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal proposal payload: %v", err)
+	}
+
+	var invocation pb.ChaincodeInvocationSpec
+	err = proto.Unmarshal(payload.GetInput(), &invocation)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal chaincode invocation: %v", err)
+	}
+
+	if channelHeader.GetTxId() == "" {
+		return nil, fmt.Errorf("proposal has no transaction ID")
+	}
+
+	return &proposal{
+		header:      &header,
+		txID:        channelHeader.GetTxId(),
+		creator:     signatureHeader.GetCreator(),
+		chaincodeID: invocation.GetChaincodeSpec().GetChaincodeId(),
+		input:       invocation.GetChaincodeSpec().GetInput(),
+		args:        invocation.GetChaincodeSpec().GetInput().GetArgs(),
+		transient:   payload.GetTransientMap(),
+	}, nil
+}
+
+/**
+*@dev preparedTransaction() builds the unsigned transaction envelope a peer returns from endorsement, carrying the result and event
+*
+* The transient data is left out, as a peer leaves it out of the transaction it orders.
+*/
+
+func (p *proposal) preparedTransaction(result []byte, event *pb.ChaincodeEvent) (*common.Envelope, error) {
+	action := &pb.ChaincodeAction{
+		Response:    &pb.Response{Status: shim.OK, Payload: result},
+		ChaincodeId: p.chaincodeID,
+	}
+	if event != nil {
+		eventBytes, err := proto.Marshal(&pb.ChaincodeEvent{
+			ChaincodeId: p.chaincodeID.GetName(),
+			TxId:        event.TxId,
+			EventName:   event.EventName,
+			Payload:     event.Payload,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal chaincode event: %v", err)
+		}
+		action.Events = eventBytes
+	}
+
+	actionBytes, err := proto.Marshal(action)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal chaincode action: %v", err)
+	}
+
+	invocationBytes, err := proto.Marshal(&pb.ChaincodeInvocationSpec{ChaincodeSpec: &pb.ChaincodeSpec{ChaincodeId: p.chaincodeID, Input: p.input}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal chaincode invocation: %v", err)
+	}
+
+	proposalPayloadBytes, err := proto.Marshal(&pb.ChaincodeProposalPayload{Input: invocationBytes})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal proposal payload: %v", err)
+	}
+
+	proposalHash := sha256.New()
+	proposalHash.Write(p.header.GetChannelHeader())
+	proposalHash.Write(p.header.GetSignatureHeader())
+	proposalHash.Write(proposalPayloadBytes)
+
+	responsePayloadBytes, err := proto.Marshal(&pb.ProposalResponsePayload{ProposalHash: proposalHash.Sum(nil), Extension: actionBytes})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal proposal response payload: %v", err)
+	}
+
+	actionPayloadBytes, err := proto.Marshal(&pb.ChaincodeActionPayload{
+		ChaincodeProposalPayload: proposalPayloadBytes,
+		Action:                   &pb.ChaincodeEndorsedAction{ProposalResponsePayload: responsePayloadBytes},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal chaincode action payload: %v", err)
+	}
+
+	transactionBytes, err := proto.Marshal(&pb.Transaction{
+		Actions: []*pb.TransactionAction{{Header: p.header.GetSignatureHeader(), Payload: actionPayloadBytes}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal transaction: %v", err)
+	}
+
+	payloadBytes, err := proto.Marshal(&common.Payload{Header: p.header, Data: transactionBytes})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal transaction payload: %v", err)
+	}
+
+	return &common.Envelope{Payload: payloadBytes}, nil
+}
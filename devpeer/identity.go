@@ -0,0 +1,120 @@
+package devpeer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-protos-go/msp"
+)
+
+/**
+*@dev Identity() represents the client a transaction is submitted as: its organisation and the certificate attributes it carries, e.g. {"role": "regulator"}
+*/
+
+type Identity struct {
+	MSPID      string            `json:"mspId"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// attributeOID is the certificate extension Fabric CA writes enrollment attributes to
+var attributeOID = asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}
+
+/**
+*@dev creators() caches one self-signed certificate per identity so a client keeps the same ID across transactions
+*/
+
+type creators struct {
+	mu    sync.Mutex
+	cache map[string][]byte
+}
+
+func (c *creators) creator(identity Identity) ([]byte, error) {
+	if identity.MSPID == "" {
+		return nil, fmt.Errorf("identity needs an MSP ID")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := identity.key()
+	if creator, ok := c.cache[key]; ok {
+		return creator, nil
+	}
+
+	certificate, err := selfSignedCertificate(identity)
+	if err != nil {
+		return nil, err
+	}
+
+	creator, err := proto.Marshal(&msp.SerializedIdentity{Mspid: identity.MSPID, IdBytes: certificate})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal serialized identity: %v", err)
+	}
+
+	if c.cache == nil {
+		c.cache = make(map[string][]byte)
+	}
+	c.cache[key] = creator
+	return creator, nil
+}
+
+func (identity Identity) key() string {
+	names := make([]string, 0, len(identity.Attributes))
+	for name := range identity.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := []string{identity.MSPID}
+	for _, name := range names {
+		parts = append(parts, name+"="+identity.Attributes[name])
+	}
+	return strings.Join(parts, "|")
+}
+
+func selfSignedCertificate(identity Identity) ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate identity key: %v", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate certificate serial: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "devpeer-user", Organization: []string{identity.MSPID}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+	}
+
+	if len(identity.Attributes) > 0 {
+		attributes, err := json.Marshal(map[string]map[string]string{"attrs": identity.Attributes})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal identity attributes: %v", err)
+		}
+		template.ExtraExtensions = []pkix.Extension{{Id: attributeOID, Value: attributes}}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create identity certificate: %v", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
@@ -0,0 +1,519 @@
+package devpeer
+
+import (
+	"container/list"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+/**
+*@dev Event() represents a chaincode event committed with a submitted transaction
+*/
+
+type Event struct {
+	BlockNumber   uint64 `json:"blockNumber"`
+	TransactionID string `json:"transactionId"`
+	EventName     string `json:"eventName"`
+	Payload       []byte `json:"payload"`
+}
+
+/**
+*@dev Transaction() represents a transaction proposal as clients send it to the peer; seed fixtures are lists of them
+*/
+
+type Transaction struct {
+	Identity Identity `json:"identity"`
+	Function string   `json:"function"`
+	Args     []string `json:"args"`
+}
+
+/**
+*@dev TransactionError() represents a transaction the chaincode rejected, as opposed to a failure of the peer itself
+*/
+
+type TransactionError struct {
+	Function string
+	Message  string
+}
+
+func (e *TransactionError) Error() string {
+	return fmt.Sprintf("transaction %s failed: %s", e.Function, e.Message)
+}
+
+/**
+*@dev Peer() hosts a chaincode in-process and stands in for a single-peer channel
+*
+* Every submitted transaction is committed in its own block. As on a real peer, a transaction reads the committed world
+* state rather than its own writes, and is invalidated if a key or range it read changes between endorsement and commit.
+*/
+
+type Peer struct {
+	mu          sync.Mutex
+	chaincode   shim.Chaincode
+	stub        *shimtest.MockStub
+	creators    *creators
+	stateFile   string
+	blockHeight uint64
+	versions    map[string]uint64
+	events      []Event
+	subscribers map[chan Event]bool
+	endorsed    map[string]*simulation
+	statuses    map[string]CommitStatus
+}
+
+/**
+*@dev CommitStatus() represents how a transaction endorsed through the gateway was committed and in which block
+*/
+
+type CommitStatus struct {
+	Code        pb.TxValidationCode
+	BlockNumber uint64
+}
+
+// ledgerFile is the JSON the peer persists its world state to
+type ledgerFile struct {
+	State       map[string][]byte `json:"state"`
+	BlockHeight uint64            `json:"blockHeight"`
+	Versions    map[string]uint64 `json:"versions"`
+	Events      []Event           `json:"events"`
+	Creators    map[string][]byte `json:"creators"`
+}
+
+/**
+*@dev NewPeer() creates a peer for a chaincode; with a state file the ledger is loaded from it and saved to it after every block
+*/
+
+func NewPeer(chaincode shim.Chaincode, stateFile string) (*Peer, error) {
+	peer := &Peer{
+		chaincode:   chaincode,
+		creators:    &creators{},
+		stateFile:   stateFile,
+		versions:    make(map[string]uint64),
+		subscribers: make(map[chan Event]bool),
+		endorsed:    make(map[string]*simulation),
+		statuses:    make(map[string]CommitStatus),
+	}
+	peer.stub = newStub(chaincode)
+
+	if stateFile == "" {
+		return peer, nil
+	}
+
+	ledgerBytes, err := os.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return peer, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %v", err)
+	}
+
+	var ledger ledgerFile
+	err = json.Unmarshal(ledgerBytes, &ledger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal state file JSON: %v", err)
+	}
+
+	restoreState(peer.stub, ledger.State)
+	peer.blockHeight = ledger.BlockHeight
+	if ledger.Versions != nil {
+		peer.versions = ledger.Versions
+	}
+	peer.events = ledger.Events
+	peer.creators.cache = ledger.Creators
+	return peer, nil
+}
+
+/**
+*@dev Evaluate() runs a transaction as a query; its writes are discarded and nothing is committed
+*/
+
+func (p *Peer) Evaluate(identity Identity, function string, args ...string) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	creator, err := p.creators.creator(identity)
+	if err != nil {
+		return nil, err
+	}
+
+	txID, err := newTransactionID()
+	if err != nil {
+		return nil, err
+	}
+
+	_, payload, err := p.simulate(creator, txID, nil, invocationArgs(function, args))
+	return payload, err
+}
+
+/**
+*@dev Submit() runs a transaction and commits its writes and event in a new block; a rejected transaction leaves the ledger untouched
+*/
+
+func (p *Peer) Submit(identity Identity, function string, args ...string) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.submit(identity, function, args)
+}
+
+func (p *Peer) submit(identity Identity, function string, args []string) ([]byte, error) {
+	creator, err := p.creators.creator(identity)
+	if err != nil {
+		return nil, err
+	}
+
+	txID, err := newTransactionID()
+	if err != nil {
+		return nil, err
+	}
+
+	simulated, payload, err := p.simulate(creator, txID, nil, invocationArgs(function, args))
+	if err != nil {
+		return nil, err
+	}
+
+	// Nothing else commits while the lock is held, so the transaction's reads are still current
+	_, err = p.commit(simulated)
+	if err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
+
+/**
+*@dev simulate() runs one transaction against the committed world state and returns its simulation and payload
+*/
+
+func (p *Peer) simulate(creator []byte, txID string, transient map[string][]byte, args [][]byte) (*simulation, []byte, error) {
+	if len(args) == 0 {
+		return nil, nil, fmt.Errorf("transaction has no function name")
+	}
+
+	simulated := newSimulation(p.stub, p.versions, txID, args)
+	p.stub.Creator = creator
+	p.stub.TransientMap = transient
+	p.stub.MockTransactionStart(txID)
+	response := p.chaincode.Invoke(simulated)
+	p.stub.MockTransactionEnd(txID)
+
+	if response.Status != shim.OK {
+		return nil, nil, &TransactionError{Function: string(args[0]), Message: response.Message}
+	}
+
+	return simulated, response.Payload, nil
+}
+
+/**
+*@dev commit() validates a simulated transaction and commits it in a new block, applying its writes and event only if it is valid
+*/
+
+func (p *Peer) commit(simulated *simulation) (CommitStatus, error) {
+	code := simulated.validate()
+
+	p.blockHeight++
+	status := CommitStatus{Code: code, BlockNumber: p.blockHeight}
+	if code != pb.TxValidationCode_VALID {
+		return status, p.save()
+	}
+
+	p.stub.MockTransactionStart(simulated.txID)
+	for key, value := range simulated.writes {
+		if len(value) == 0 {
+			p.stub.DelState(key)
+		} else {
+			p.stub.PutState(key, value)
+		}
+		p.versions[key] = p.blockHeight
+	}
+	p.stub.MockTransactionEnd(simulated.txID)
+
+	if simulated.event != nil {
+		committed := Event{
+			BlockNumber:   p.blockHeight,
+			TransactionID: simulated.event.TxId,
+			EventName:     simulated.event.EventName,
+			Payload:       simulated.event.Payload,
+		}
+		p.events = append(p.events, committed)
+		for subscriber := range p.subscribers {
+			select {
+			case subscriber <- committed:
+			default:
+				// A subscriber that cannot keep up is dropped rather than blocking the peer
+				close(subscriber)
+				delete(p.subscribers, subscriber)
+			}
+		}
+	}
+
+	return status, p.save()
+}
+
+/**
+*@dev endorse() simulates a proposal from the gateway and holds its simulation until the transaction is submitted
+*/
+
+func (p *Peer) endorse(creator []byte, txID string, transient map[string][]byte, args [][]byte) ([]byte, *pb.ChaincodeEvent, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, committed := p.statuses[txID]; committed {
+		return nil, nil, fmt.Errorf("transaction %s has already been committed", txID)
+	}
+
+	simulated, payload, err := p.simulate(creator, txID, transient, args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.endorsed[txID] = simulated
+	return payload, simulated.event, nil
+}
+
+/**
+*@dev evaluate() simulates a proposal from the gateway without committing it
+*/
+
+func (p *Peer) evaluate(creator []byte, txID string, transient map[string][]byte, args [][]byte) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, payload, err := p.simulate(creator, txID, transient, args)
+	return payload, err
+}
+
+/**
+*@dev commitEndorsed() commits a transaction endorsed through the gateway; it may be invalidated by blocks committed since its endorsement
+*/
+
+func (p *Peer) commitEndorsed(txID string) (CommitStatus, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	simulated, ok := p.endorsed[txID]
+	if !ok {
+		return CommitStatus{}, fmt.Errorf("transaction %s has not been endorsed", txID)
+	}
+	delete(p.endorsed, txID)
+
+	status, err := p.commit(simulated)
+	if err != nil {
+		return CommitStatus{}, err
+	}
+
+	p.statuses[txID] = status
+	return status, nil
+}
+
+/**
+*@dev commitStatus() returns how a transaction submitted through the gateway was committed
+*/
+
+func (p *Peer) commitStatus(txID string) (CommitStatus, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	status, ok := p.statuses[txID]
+	return status, ok
+}
+
+/**
+*@dev Seed() submits fixture transactions in order and stops at the first one rejected
+*/
+
+func (p *Peer) Seed(fixtures []Transaction) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, fixture := range fixtures {
+		_, err := p.submit(fixture.Identity, fixture.Function, fixture.Args)
+		if err != nil {
+			return fmt.Errorf("failed to seed fixture %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+/**
+*@dev Reset() empties the ledger, including its blocks and events
+*/
+
+func (p *Peer) Reset() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.stub = newStub(p.chaincode)
+	p.blockHeight = 0
+	p.versions = make(map[string]uint64)
+	p.events = nil
+	p.endorsed = make(map[string]*simulation)
+	p.statuses = make(map[string]CommitStatus)
+	return p.save()
+}
+
+/**
+*@dev BlockHeight() returns the number of blocks committed
+*/
+
+func (p *Peer) BlockHeight() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.blockHeight
+}
+
+/**
+*@dev Subscribe() returns the events committed from a block onwards, followed by events as they are committed
+*
+* The channel is closed when the subscriber is cancelled or falls too far behind.
+*/
+
+func (p *Peer) Subscribe(startBlock uint64) (<-chan Event, func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	replay := []Event{}
+	for _, event := range p.events {
+		if event.BlockNumber >= startBlock {
+			replay = append(replay, event)
+		}
+	}
+
+	subscriber := make(chan Event, len(replay)+100)
+	for _, event := range replay {
+		subscriber <- event
+	}
+	p.subscribers[subscriber] = true
+
+	cancel := func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		if p.subscribers[subscriber] {
+			close(subscriber)
+			delete(p.subscribers, subscriber)
+		}
+	}
+
+	return subscriber, cancel
+}
+
+/**
+*@dev save() writes the ledger to the state file, replacing it only once the new file is complete
+*/
+
+func (p *Peer) save() error {
+	if p.stateFile == "" {
+		return nil
+	}
+
+	ledgerBytes, err := json.Marshal(ledgerFile{
+		State:       p.stub.State,
+		BlockHeight: p.blockHeight,
+		Versions:    p.versions,
+		Events:      p.events,
+		Creators:    p.creators.cache,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal state file JSON: %v", err)
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(p.stateFile), filepath.Base(p.stateFile)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create state file: %v", err)
+	}
+	defer os.Remove(temp.Name())
+
+	_, err = temp.Write(ledgerBytes)
+	if err == nil {
+		err = temp.Close()
+	} else {
+		temp.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+
+	err = os.Rename(temp.Name(), p.stateFile)
+	if err != nil {
+		return fmt.Errorf("failed to replace state file: %v", err)
+	}
+
+	return nil
+}
+
+func newStub(chaincode shim.Chaincode) *shimtest.MockStub {
+	return shimtest.NewMockStub("devpeer", chaincode)
+}
+
+func invocationArgs(function string, args []string) [][]byte {
+	invocation := [][]byte{[]byte(function)}
+	for _, arg := range args {
+		invocation = append(invocation, []byte(arg))
+	}
+	return invocation
+}
+
+func newTransactionID() (string, error) {
+	random := make([]byte, 32)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate transaction ID: %v", err)
+	}
+	return hex.EncodeToString(random), nil
+}
+
+func copyState(state map[string][]byte) map[string][]byte {
+	snapshot := make(map[string][]byte, len(state))
+	for key, value := range state {
+		snapshot[key] = value
+	}
+	return snapshot
+}
+
+/**
+*@dev restoreState() replaces the stub's world state, rebuilding the sorted key list its range queries walk
+*/
+
+func restoreState(stub *shimtest.MockStub, state map[string][]byte) {
+	keys := make([]string, 0, len(state))
+	for key := range state {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	stub.State = copyState(state)
+	stub.Keys = list.New()
+	for _, key := range keys {
+		stub.Keys.PushBack(key)
+	}
+}
+
+/**
+*@dev LocalClient() submits and evaluates transactions on an in-process peer as one identity, in the same way Client does over HTTP
+*/
+
+type LocalClient struct {
+	Peer     *Peer
+	Identity Identity
+}
+
+func (c *LocalClient) SubmitTransaction(name string, args ...string) ([]byte, error) {
+	return c.Peer.Submit(c.Identity, name, args...)
+}
+
+func (c *LocalClient) EvaluateTransaction(name string, args ...string) ([]byte, error) {
+	return c.Peer.Evaluate(c.Identity, name, args...)
+}
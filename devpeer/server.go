@@ -0,0 +1,161 @@
+package devpeer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+/**
+*@dev Server() exposes a peer over HTTP
+*
+* POST /evaluate and POST /submit take a Transaction and answer with the raw transaction result.
+* GET /events?startBlock=N streams committed events as server-sent events.
+* POST /reset empties the ledger and POST /seed submits a JSON list of Transactions.
+*/
+
+type Server struct {
+	peer *Peer
+	mux  *http.ServeMux
+}
+
+func NewServer(peer *Peer) *Server {
+	server := &Server{peer: peer, mux: http.NewServeMux()}
+	server.mux.HandleFunc("/evaluate", server.serveTransaction(peer.Evaluate))
+	server.mux.HandleFunc("/submit", server.serveTransaction(peer.Submit))
+	server.mux.HandleFunc("/events", server.serveEvents)
+	server.mux.HandleFunc("/reset", server.serveReset)
+	server.mux.HandleFunc("/seed", server.serveSeed)
+	return server
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mux.ServeHTTP(w, req)
+}
+
+func (s *Server) serveTransaction(run func(Identity, string, ...string) ([]byte, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var transaction Transaction
+		err := json.NewDecoder(req.Body).Decode(&transaction)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to decode transaction: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		result, err := run(transaction.Identity, transaction.Function, transaction.Args...)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Block-Height", strconv.FormatUint(s.peer.BlockHeight(), 10))
+		w.Write(result)
+	}
+}
+
+func (s *Server) serveEvents(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var startBlock uint64
+	if param := req.URL.Query().Get("startBlock"); param != "" {
+		var err error
+		startBlock, err = strconv.ParseUint(param, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to parse start block: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	events, cancel := s.peer.Subscribe(startBlock)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+
+			eventBytes, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.BlockNumber, event.EventName, eventBytes)
+			flusher.Flush()
+		}
+	}
+}
+
+func (s *Server) serveReset(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := s.peer.Reset()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) serveSeed(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var fixtures []Transaction
+	err := json.NewDecoder(req.Body).Decode(&fixtures)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode fixtures: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	err = s.peer.Seed(fixtures)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/**
+*@dev writeError() answers 422 for a transaction the chaincode rejected and 500 for a failure of the peer
+*/
+
+func writeError(w http.ResponseWriter, err error) {
+	var transactionErr *TransactionError
+	if errors.As(err, &transactionErr) {
+		http.Error(w, transactionErr.Message, http.StatusUnprocessableEntity)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
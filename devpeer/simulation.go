@@ -0,0 +1,165 @@
+package devpeer
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+/**
+*@dev simulation() is the stub a transaction runs against, standing in for a peer's transaction simulator
+*
+* Reads see the committed world state and never the transaction's own writes, which are buffered until it commits.
+* The version of every key read, and of every key in each range read, is recorded so the commit can be invalidated
+* when another transaction has changed them since.
+*/
+
+type simulation struct {
+	*shimtest.MockStub
+	txID     string
+	args     [][]byte
+	versions map[string]uint64
+	reads    map[string]uint64
+	ranges   []rangeRead
+	writes   map[string][]byte
+	event    *pb.ChaincodeEvent
+}
+
+// rangeRead is a range query and the versions of the keys it covered when the transaction ran
+type rangeRead struct {
+	startKey string
+	endKey   string
+	keys     map[string]uint64
+}
+
+func newSimulation(stub *shimtest.MockStub, versions map[string]uint64, txID string, args [][]byte) *simulation {
+	return &simulation{
+		MockStub: stub,
+		txID:     txID,
+		args:     args,
+		versions: versions,
+		reads:    make(map[string]uint64),
+		writes:   make(map[string][]byte),
+	}
+}
+
+func (s *simulation) GetArgs() [][]byte {
+	return s.args
+}
+
+func (s *simulation) GetStringArgs() []string {
+	args := make([]string, 0, len(s.args))
+	for _, arg := range s.args {
+		args = append(args, string(arg))
+	}
+	return args
+}
+
+func (s *simulation) GetFunctionAndParameters() (string, []string) {
+	args := s.GetStringArgs()
+	if len(args) == 0 {
+		return "", []string{}
+	}
+	return args[0], args[1:]
+}
+
+func (s *simulation) GetState(key string) ([]byte, error) {
+	if _, read := s.reads[key]; !read {
+		s.reads[key] = s.versions[key]
+	}
+	return s.MockStub.State[key], nil
+}
+
+func (s *simulation) PutState(key string, value []byte) error {
+	if key == "" {
+		return fmt.Errorf("key must not be an empty string")
+	}
+	s.writes[key] = append([]byte{}, value...)
+	return nil
+}
+
+func (s *simulation) DelState(key string) error {
+	if key == "" {
+		return fmt.Errorf("key must not be an empty string")
+	}
+	s.writes[key] = nil
+	return nil
+}
+
+func (s *simulation) GetStateByRange(startKey string, endKey string) (shim.StateQueryIteratorInterface, error) {
+	iterator, err := s.MockStub.GetStateByRange(startKey, endKey)
+	if err != nil {
+		return nil, err
+	}
+	s.ranges = append(s.ranges, rangeRead{startKey: startKey, endKey: endKey, keys: s.rangeVersions(startKey, endKey)})
+	return iterator, nil
+}
+
+func (s *simulation) GetStateByPartialCompositeKey(objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	iterator, err := s.MockStub.GetStateByPartialCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	startKey, _ := shim.CreateCompositeKey(objectType, attributes)
+	endKey := startKey + string(utf8.MaxRune)
+	s.ranges = append(s.ranges, rangeRead{startKey: startKey, endKey: endKey, keys: s.rangeVersions(startKey, endKey)})
+	return iterator, nil
+}
+
+// Fabric keeps only the last event a transaction sets
+func (s *simulation) SetEvent(name string, payload []byte) error {
+	if name == "" {
+		return fmt.Errorf("event name can not be empty string")
+	}
+	s.event = &pb.ChaincodeEvent{TxId: s.txID, EventName: name, Payload: payload}
+	return nil
+}
+
+/**
+*@dev rangeVersions() returns the committed version of every key from startKey up to, but not including, endKey
+*/
+
+func (s *simulation) rangeVersions(startKey string, endKey string) map[string]uint64 {
+	keys := make(map[string]uint64)
+	for element := s.MockStub.Keys.Front(); element != nil; element = element.Next() {
+		key := element.Value.(string)
+		if strings.Compare(key, startKey) < 0 {
+			continue
+		}
+		if endKey != "" && strings.Compare(key, endKey) >= 0 {
+			break
+		}
+		keys[key] = s.versions[key]
+	}
+	return keys
+}
+
+/**
+*@dev validate() checks the transaction's reads against the world state it is about to commit to, as a peer's MVCC validation does
+*/
+
+func (s *simulation) validate() pb.TxValidationCode {
+	for key, version := range s.reads {
+		if s.versions[key] != version {
+			return pb.TxValidationCode_MVCC_READ_CONFLICT
+		}
+	}
+
+	for _, read := range s.ranges {
+		current := s.rangeVersions(read.startKey, read.endKey)
+		if len(current) != len(read.keys) {
+			return pb.TxValidationCode_PHANTOM_READ_CONFLICT
+		}
+		for key, version := range read.keys {
+			if currentVersion, ok := current[key]; !ok || currentVersion != version {
+				return pb.TxValidationCode_PHANTOM_READ_CONFLICT
+			}
+		}
+	}
+
+	return pb.TxValidationCode_VALID
+}
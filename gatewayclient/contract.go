@@ -0,0 +1,303 @@
+package gatewayclient
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/gateway"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// DEFAULT_TIMEOUT bounds each call to the gateway, a submission's endorsement, ordering and commit included
+const DEFAULT_TIMEOUT = 30 * time.Second
+
+/**
+*@dev TransactionError() represents a transaction the chaincode rejected, or that failed validation, as opposed to a failure to reach the gateway
+*/
+
+type TransactionError struct {
+	Function string
+	Message  string
+}
+
+func (e *TransactionError) Error() string {
+	return fmt.Sprintf("transaction %s failed: %s", e.Function, e.Message)
+}
+
+/**
+*@dev Contract() submits and evaluates transactions on one chaincode through a peer's Fabric Gateway service, as one identity
+*
+* It has the same SubmitTransaction and EvaluateTransaction methods as a gateway SDK contract. Submitting waits until the
+* transaction has committed, and a transaction that commits as invalid is returned as a TransactionError.
+*/
+
+type Contract struct {
+	Channel   string
+	Chaincode string
+	Timeout   time.Duration
+	identity  *Identity
+	conn      *grpc.ClientConn
+	client    gateway.GatewayClient
+}
+
+/**
+*@dev Dial() connects to a peer's gateway endpoint, over TLS trusting the CA certificate in tlsRootCertFile, or without TLS if it is empty
+*/
+
+func Dial(endpoint string, tlsRootCertFile string, identity *Identity, channel string, chaincode string) (*Contract, error) {
+	transport := insecure.NewCredentials()
+	if tlsRootCertFile != "" {
+		rootCert, err := os.ReadFile(tlsRootCertFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read TLS root certificate: %v", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(rootCert) {
+			return nil, fmt.Errorf("TLS root certificate %s holds no PEM certificates", tlsRootCertFile)
+		}
+		transport = credentials.NewClientTLSFromCert(pool, "")
+	}
+
+	conn, err := grpc.Dial(endpoint, grpc.WithTransportCredentials(transport))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to gateway %s: %v", endpoint, err)
+	}
+
+	return &Contract{
+		Channel:   channel,
+		Chaincode: chaincode,
+		Timeout:   DEFAULT_TIMEOUT,
+		identity:  identity,
+		conn:      conn,
+		client:    gateway.NewGatewayClient(conn),
+	}, nil
+}
+
+func (c *Contract) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Contract) EvaluateTransaction(name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+
+	txID, signed, err := c.proposal(name, args)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.Evaluate(ctx, &gateway.EvaluateRequest{TransactionId: txID, ChannelId: c.Channel, ProposedTransaction: signed})
+	if err != nil {
+		return nil, gatewayError(name, "evaluate", err)
+	}
+
+	return response.GetResult().GetPayload(), nil
+}
+
+/**
+*@dev SubmitTransaction() has the transaction endorsed, signs and submits it for ordering, and waits for it to commit
+*/
+
+func (c *Contract) SubmitTransaction(name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+
+	txID, signed, err := c.proposal(name, args)
+	if err != nil {
+		return nil, err
+	}
+
+	endorsed, err := c.client.Endorse(ctx, &gateway.EndorseRequest{TransactionId: txID, ChannelId: c.Channel, ProposedTransaction: signed})
+	if err != nil {
+		return nil, gatewayError(name, "endorse", err)
+	}
+
+	prepared := endorsed.GetPreparedTransaction()
+	result, err := preparedResult(prepared)
+	if err != nil {
+		return nil, err
+	}
+
+	prepared.Signature, err = c.identity.sign(prepared.GetPayload())
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = c.client.Submit(ctx, &gateway.SubmitRequest{TransactionId: txID, ChannelId: c.Channel, PreparedTransaction: prepared})
+	if err != nil {
+		return nil, gatewayError(name, "submit", err)
+	}
+
+	creator, err := c.identity.creator()
+	if err != nil {
+		return nil, err
+	}
+	statusRequest, err := proto.Marshal(&gateway.CommitStatusRequest{TransactionId: txID, ChannelId: c.Channel, Identity: creator})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal commit status request: %v", err)
+	}
+	statusSignature, err := c.identity.sign(statusRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	committed, err := c.client.CommitStatus(ctx, &gateway.SignedCommitStatusRequest{Request: statusRequest, Signature: statusSignature})
+	if err != nil {
+		return nil, gatewayError(name, "read the commit status of", err)
+	}
+	if committed.GetResult() != pb.TxValidationCode_VALID {
+		return nil, &TransactionError{Function: name, Message: fmt.Sprintf("transaction %s committed as invalid with code %s", txID, committed.GetResult())}
+	}
+
+	return result, nil
+}
+
+/**
+*@dev proposal() builds and signs a proposal to run a transaction, returning it with its transaction ID
+*/
+
+func (c *Contract) proposal(name string, args []string) (string, *pb.SignedProposal, error) {
+	creator, err := c.identity.creator()
+	if err != nil {
+		return "", nil, err
+	}
+
+	nonce := make([]byte, 24)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	// Peers check the transaction ID is the hash of the nonce and creator
+	txIDHash := sha256.Sum256(append(append([]byte{}, nonce...), creator...))
+	txID := hex.EncodeToString(txIDHash[:])
+
+	chaincodeID := &pb.ChaincodeID{Name: c.Chaincode}
+	extension, err := proto.Marshal(&pb.ChaincodeHeaderExtension{ChaincodeId: chaincodeID})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to marshal chaincode header extension: %v", err)
+	}
+
+	channelHeader, err := proto.Marshal(&common.ChannelHeader{
+		Type:      int32(common.HeaderType_ENDORSER_TRANSACTION),
+		ChannelId: c.Channel,
+		TxId:      txID,
+		Timestamp: timestamppb.Now(),
+		Extension: extension,
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to marshal channel header: %v", err)
+	}
+
+	signatureHeader, err := proto.Marshal(&common.SignatureHeader{Creator: creator, Nonce: nonce})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to marshal signature header: %v", err)
+	}
+
+	header, err := proto.Marshal(&common.Header{ChannelHeader: channelHeader, SignatureHeader: signatureHeader})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to marshal proposal header: %v", err)
+	}
+
+	input := &pb.ChaincodeInput{Args: [][]byte{[]byte(name)}}
+	for _, arg := range args {
+		input.Args = append(input.Args, []byte(arg))
+	}
+	invocation, err := proto.Marshal(&pb.ChaincodeInvocationSpec{ChaincodeSpec: &pb.ChaincodeSpec{Type: pb.ChaincodeSpec_GOLANG, ChaincodeId: chaincodeID, Input: input}})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to marshal chaincode invocation: %v", err)
+	}
+
+	payload, err := proto.Marshal(&pb.ChaincodeProposalPayload{Input: invocation})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to marshal proposal payload: %v", err)
+	}
+
+	proposalBytes, err := proto.Marshal(&pb.Proposal{Header: header, Payload: payload})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to marshal proposal: %v", err)
+	}
+
+	signature, err := c.identity.sign(proposalBytes)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return txID, &pb.SignedProposal{ProposalBytes: proposalBytes, Signature: signature}, nil
+}
+
+/**
+*@dev preparedResult() reads the chaincode's result out of an endorsed transaction envelope
+*/
+
+func preparedResult(envelope *common.Envelope) ([]byte, error) {
+	var payload common.Payload
+	err := proto.Unmarshal(envelope.GetPayload(), &payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal transaction payload: %v", err)
+	}
+
+	var transaction pb.Transaction
+	err = proto.Unmarshal(payload.GetData(), &transaction)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal transaction: %v", err)
+	}
+	if len(transaction.GetActions()) == 0 {
+		return nil, fmt.Errorf("endorsed transaction has no actions")
+	}
+
+	var actionPayload pb.ChaincodeActionPayload
+	err = proto.Unmarshal(transaction.GetActions()[0].GetPayload(), &actionPayload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal chaincode action payload: %v", err)
+	}
+
+	var responsePayload pb.ProposalResponsePayload
+	err = proto.Unmarshal(actionPayload.GetAction().GetProposalResponsePayload(), &responsePayload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal proposal response payload: %v", err)
+	}
+
+	var action pb.ChaincodeAction
+	err = proto.Unmarshal(responsePayload.GetExtension(), &action)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal chaincode action: %v", err)
+	}
+
+	return action.GetResponse().GetPayload(), nil
+}
+
+/**
+*@dev gatewayError() turns a failed gateway call into a TransactionError when the endorsers reported why, and a plain error otherwise
+*
+* The gateway attaches an ErrorDetail for each endorser or orderer that answered; its absence means none of them were reached.
+*/
+
+func gatewayError(function string, call string, err error) error {
+	messages := []string{}
+	for _, detail := range status.Convert(err).Details() {
+		if errorDetail, ok := detail.(*gateway.ErrorDetail); ok {
+			messages = append(messages, errorDetail.GetMessage())
+		}
+	}
+
+	if len(messages) == 0 {
+		return fmt.Errorf("failed to %s transaction %s: %v", call, function, err)
+	}
+	return &TransactionError{Function: function, Message: strings.Join(messages, "; ")}
+}
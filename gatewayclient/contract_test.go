@@ -0,0 +1,197 @@
+package gatewayclient
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"Quanta-Ledger/devpeer"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// counterContract is a chaincode small enough to check the client's round trips with
+type counterContract struct {
+	contractapi.Contract
+}
+
+func (c *counterContract) Increment(ctx contractapi.TransactionContextInterface) (int, error) {
+	count, err := c.Count(ctx)
+	if err != nil {
+		return 0, err
+	}
+	count++
+	return count, ctx.GetStub().PutState("count", []byte(strconv.Itoa(count)))
+}
+
+func (c *counterContract) Count(ctx contractapi.TransactionContextInterface) (int, error) {
+	countBytes, err := ctx.GetStub().GetState("count")
+	if err != nil || countBytes == nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(countBytes))
+}
+
+func (c *counterContract) Caller(ctx contractapi.TransactionContextInterface) (string, error) {
+	return ctx.GetClientIdentity().GetMSPID()
+}
+
+func (c *counterContract) Reject(ctx contractapi.TransactionContextInterface) error {
+	return fmt.Errorf("counter is read-only")
+}
+
+/**
+*@dev startGateway() serves a peer emulator running the counter contract over the gateway service on a free local port
+*/
+
+func startGateway(t *testing.T) string {
+	t.Helper()
+
+	chaincode, err := contractapi.NewChaincode(new(counterContract))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := devpeer.NewPeer(chaincode, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := devpeer.NewGatewayServer(peer)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	return listener.Addr().String()
+}
+
+/**
+*@dev enrollIdentity() writes a self-signed certificate and its ECDSA key as an enrollment would, and reads them back
+*/
+
+func enrollIdentity(t *testing.T, mspID string) *Identity {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "reconciler", Organization: []string{mspID}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certificateFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key_sk")
+	err = os.WriteFile(certificateFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity, err := ReadIdentity(mspID, certificateFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity
+}
+
+func TestContractSubmitsAndEvaluates(t *testing.T) {
+	contract, err := Dial(startGateway(t), "", enrollIdentity(t, "Org1MSP"), "mychannel", "counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer contract.Close()
+
+	for want := 1; want <= 2; want++ {
+		result, err := contract.SubmitTransaction("Increment")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(result) != strconv.Itoa(want) {
+			t.Fatalf("expected submission %d to return %d, got %s", want, want, result)
+		}
+	}
+
+	count, err := contract.EvaluateTransaction("Count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(count) != "2" {
+		t.Fatalf("expected the submissions to have committed, got count %s", count)
+	}
+
+	caller, err := contract.EvaluateTransaction("Caller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(caller) != "Org1MSP" {
+		t.Fatalf("expected the chaincode to see the enrolled identity, got %s", caller)
+	}
+}
+
+func TestContractReportsRejections(t *testing.T) {
+	contract, err := Dial(startGateway(t), "", enrollIdentity(t, "Org1MSP"), "mychannel", "counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer contract.Close()
+
+	for _, call := range []func(string, ...string) ([]byte, error){contract.SubmitTransaction, contract.EvaluateTransaction} {
+		_, err = call("Reject")
+		var rejection *TransactionError
+		if !errors.As(err, &rejection) || rejection.Message != "counter is read-only" {
+			t.Fatalf("expected the chaincode's rejection, got %v", err)
+		}
+	}
+}
+
+func TestContractSeparatesUnreachableGateways(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	contract, err := Dial(address, "", enrollIdentity(t, "Org1MSP"), "mychannel", "counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer contract.Close()
+	contract.Timeout = time.Second
+
+	_, err = contract.EvaluateTransaction("Count")
+	var rejection *TransactionError
+	if err == nil || errors.As(err, &rejection) {
+		t.Fatalf("expected a connection failure rather than a rejection, got %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package gatewayclient
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-protos-go/msp"
+)
+
+/**
+*@dev Identity() is the enrolled identity transactions are signed with: its MSP ID, its X.509 certificate as PEM, and its private key
+*/
+
+type Identity struct {
+	MSPID       string
+	Certificate []byte
+	key         interface{}
+}
+
+/**
+*@dev ReadIdentity() loads an identity from the certificate and private key files an enrollment writes, e.g. signcerts/cert.pem and keystore/*_sk
+*
+* Fabric CAs issue ECDSA keys; Ed25519 keys are accepted too.
+*/
+
+func ReadIdentity(mspID string, certificateFile string, keyFile string) (*Identity, error) {
+	certificate, err := os.ReadFile(certificateFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity certificate: %v", err)
+	}
+	block, _ := pem.Decode(certificate)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("identity certificate %s is not a PEM certificate", certificateFile)
+	}
+
+	keyBytes, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity key: %v", err)
+	}
+	block, _ = pem.Decode(keyBytes)
+	if block == nil {
+		return nil, fmt.Errorf("identity key %s is not PEM", keyFile)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse identity key: %v", err)
+	}
+
+	switch key.(type) {
+	case *ecdsa.PrivateKey, ed25519.PrivateKey:
+	default:
+		return nil, fmt.Errorf("identity key %s is neither ECDSA nor Ed25519", keyFile)
+	}
+
+	return &Identity{MSPID: mspID, Certificate: certificate, key: key}, nil
+}
+
+/**
+*@dev creator() returns the serialized identity that proposals and transactions name as their creator
+*/
+
+func (id *Identity) creator() ([]byte, error) {
+	creator, err := proto.Marshal(&msp.SerializedIdentity{Mspid: id.MSPID, IdBytes: id.Certificate})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal serialized identity: %v", err)
+	}
+	return creator, nil
+}
+
+// ecdsaSignature is the ASN.1 form Fabric expects ECDSA signatures in
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+/**
+*@dev sign() signs a message as Fabric verifies it; ECDSA signatures are normalised to low S, which peers require
+*/
+
+func (id *Identity) sign(message []byte) ([]byte, error) {
+	switch key := id.key.(type) {
+	case ed25519.PrivateKey:
+		return ed25519.Sign(key, message), nil
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256(message)
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to sign: %v", err)
+		}
+
+		order := key.Params().N
+		if s.Cmp(new(big.Int).Rsh(order, 1)) > 0 {
+			s.Sub(order, s)
+		}
+
+		signature, err := asn1.Marshal(ecdsaSignature{R: r, S: s})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal signature: %v", err)
+		}
+		return signature, nil
+	default:
+		return nil, fmt.Errorf("identity has no signing key")
+	}
+}
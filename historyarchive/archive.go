@@ -0,0 +1,254 @@
+package historyarchive
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+/**
+*@dev Entry() represents one compacted history entry exactly as it was stored on the ledger
+*
+* Sequence 0 holds the history list kept before event sourcing; the rest are product events.
+*/
+
+type Entry struct {
+	Sequence uint64 `json:"sequence"`
+	Entry    string `json:"entry"`
+}
+
+/**
+*@dev Archive() represents the entries rolled into one history checkpoint, kept off-chain
+*/
+
+type Archive struct {
+	ProductID       uint64  `json:"productId"`
+	ThroughSequence uint64  `json:"throughSequence"`
+	PreviousRoot    string  `json:"previousRoot"`
+	Root            string  `json:"root"`
+	Entries         []Entry `json:"entries"`
+}
+
+/**
+*@dev Proof() represents the evidence that an archived entry was rolled into a checkpoint's root
+*
+* Previous is the chain hash before the entry and Following the entry hashes after it, in order.
+*/
+
+type Proof struct {
+	ProductID uint64   `json:"productId"`
+	Sequence  uint64   `json:"sequence"`
+	Entry     string   `json:"entry"`
+	Previous  string   `json:"previous"`
+	Following []string `json:"following"`
+	Root      string   `json:"root"`
+}
+
+/**
+*@dev EntryHash() hashes an entry's stored bytes with SHA-256
+*/
+
+func EntryHash(entry string) string {
+	sum := sha256.Sum256([]byte(entry))
+	return hex.EncodeToString(sum[:])
+}
+
+/**
+*@dev ChainHash() extends a hash chain by one entry: SHA-256 over the previous chain hash followed by the entry hash, both hex
+*/
+
+func ChainHash(previous string, entryHash string) string {
+	sum := sha256.Sum256([]byte(previous + entryHash))
+	return hex.EncodeToString(sum[:])
+}
+
+/**
+*@dev ComputeRoot() folds entries into the chain started by the previous checkpoint's root, or by "" for a product's first checkpoint
+*/
+
+func ComputeRoot(previousRoot string, entries []Entry) string {
+	root := previousRoot
+	for _, entry := range entries {
+		root = ChainHash(root, EntryHash(entry.Entry))
+	}
+	return root
+}
+
+/**
+*@dev Verify() checks that an archive's entries still produce its root
+*/
+
+func (a *Archive) Verify() error {
+	root := ComputeRoot(a.PreviousRoot, a.Entries)
+	if root != a.Root {
+		return fmt.Errorf("archive of product %d hashes to %s, not %s", a.ProductID, root, a.Root)
+	}
+	return nil
+}
+
+/**
+*@dev Prove() builds the proof that the archived entry with a sequence number belongs to the archive's root
+*/
+
+func (a *Archive) Prove(sequence uint64) (*Proof, error) {
+	previous := a.PreviousRoot
+	for i, entry := range a.Entries {
+		if entry.Sequence != sequence {
+			previous = ChainHash(previous, EntryHash(entry.Entry))
+			continue
+		}
+
+		following := []string{}
+		for _, later := range a.Entries[i+1:] {
+			following = append(following, EntryHash(later.Entry))
+		}
+
+		return &Proof{
+			ProductID: a.ProductID,
+			Sequence:  sequence,
+			Entry:     entry.Entry,
+			Previous:  previous,
+			Following: following,
+			Root:      a.Root,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("archive of product %d has no entry %d", a.ProductID, sequence)
+}
+
+/**
+*@dev VerifyProof() checks that a proof's entry hashes through its chain to its root
+*
+* The root must still be compared with the checkpoint on the ledger.
+*/
+
+func VerifyProof(proof Proof) bool {
+	root := ChainHash(proof.Previous, EntryHash(proof.Entry))
+	for _, entryHash := range proof.Following {
+		root = ChainHash(root, entryHash)
+	}
+	return root == proof.Root
+}
+
+/**
+*@dev ReadArchive() loads an archive file
+*/
+
+func ReadArchive(path string) (*Archive, error) {
+	archiveBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive: %v", err)
+	}
+
+	archive := new(Archive)
+	err = json.Unmarshal(archiveBytes, archive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal archive JSON: %v", err)
+	}
+
+	return archive, nil
+}
+
+/**
+*@dev WriteArchive() saves an archive file, refusing to overwrite an existing one
+*/
+
+func WriteArchive(path string, archive *Archive) error {
+	archiveBytes, err := json.MarshalIndent(archive, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal archive JSON: %v", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create archive: %v", err)
+	}
+
+	_, err = file.Write(archiveBytes)
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write archive: %v", err)
+	}
+
+	return nil
+}
+
+/**
+*@dev ChainBreak() represents a product event that does not follow on from the one before it
+*/
+
+type ChainBreak struct {
+	Sequence uint64 `json:"sequence"`
+	Detail   string `json:"detail"`
+}
+
+/**
+*@dev ChainVerifier() walks a product's stored events in order and records every break in their hash chain
+*
+* Each event carries the hash of the stored event before it. Events written before chaining carry none and are
+* accepted until the first chained event; from then on a missing hash is a break.
+*/
+
+type ChainVerifier struct {
+	Hash        string       `json:"hash"`
+	Sequence    uint64       `json:"sequence"`
+	ChainedFrom uint64       `json:"chainedFrom"`
+	Breaks      []ChainBreak `json:"breaks"`
+}
+
+// chainLink is the part of a stored product event the chain is checked on
+type chainLink struct {
+	Sequence     uint64 `json:"sequence"`
+	PreviousHash string `json:"previousHash"`
+}
+
+/**
+*@dev NewChainVerifier() starts a chain after the given event; pass a checkpoint's last entry hash and sequence, or "" and 0 for a full history
+*/
+
+func NewChainVerifier(previousHash string, previousSequence uint64) *ChainVerifier {
+	return &ChainVerifier{Hash: previousHash, Sequence: previousSequence, Breaks: []ChainBreak{}}
+}
+
+/**
+*@dev Add() checks the next stored entry against the chain; the pre-event history list at sequence 0 is not part of it
+*/
+
+func (v *ChainVerifier) Add(entry Entry) {
+	if entry.Sequence == 0 {
+		return
+	}
+
+	var link chainLink
+	err := json.Unmarshal([]byte(entry.Entry), &link)
+	if err != nil {
+		v.Breaks = append(v.Breaks, ChainBreak{Sequence: entry.Sequence, Detail: fmt.Sprintf("entry is not a product event: %v", err)})
+	} else if link.Sequence != entry.Sequence {
+		v.Breaks = append(v.Breaks, ChainBreak{Sequence: entry.Sequence, Detail: fmt.Sprintf("entry stored as %d claims sequence %d", entry.Sequence, link.Sequence)})
+	} else if entry.Sequence != v.Sequence+1 {
+		v.Breaks = append(v.Breaks, ChainBreak{Sequence: entry.Sequence, Detail: fmt.Sprintf("expected event %d", v.Sequence+1)})
+	} else if link.PreviousHash == "" && v.ChainedFrom == 0 {
+		// written before events were chained
+	} else if link.PreviousHash != v.Hash {
+		v.Breaks = append(v.Breaks, ChainBreak{Sequence: entry.Sequence, Detail: fmt.Sprintf("previous hash %q does not match %q", link.PreviousHash, v.Hash)})
+	} else if v.ChainedFrom == 0 {
+		v.ChainedFrom = entry.Sequence
+	}
+
+	v.Hash = EntryHash(entry.Entry)
+	v.Sequence = entry.Sequence
+}
+
+/**
+*@dev Intact() reports whether no break has been found
+*/
+
+func (v *ChainVerifier) Intact() bool {
+	return len(v.Breaks) == 0
+}
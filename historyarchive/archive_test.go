@@ -0,0 +1,218 @@
+package historyarchive
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// legacyHistory is the history list a product kept before event sourcing, archived as entry 0
+const legacyHistory = `[{"timestamp":1700000000,"action":"MOVEMENT","location":"Lagos depot"}]`
+
+/**
+*@dev chainedEvents() builds stored product events with sequences 1 to count, each carrying the hash of the one before
+*
+* The first event carries no hash, as the first event of a product does.
+*/
+
+func chainedEvents(count uint64) []Entry {
+	entries := []Entry{}
+	previousHash := ""
+	for sequence := uint64(1); sequence <= count; sequence++ {
+		entry := Entry{Sequence: sequence, Entry: fmt.Sprintf(`{"sequence":%d,"previousHash":%q,"type":"MOVEMENT","location":"Hub %d"}`, sequence, previousHash, sequence)}
+		entries = append(entries, entry)
+		previousHash = EntryHash(entry.Entry)
+	}
+	return entries
+}
+
+func testArchive() *Archive {
+	entries := append([]Entry{{Sequence: 0, Entry: legacyHistory}}, chainedEvents(4)...)
+	previousRoot := ComputeRoot("", []Entry{{Sequence: 0, Entry: "earlier checkpoint"}})
+	return &Archive{ProductID: 7, ThroughSequence: 4, PreviousRoot: previousRoot, Root: ComputeRoot(previousRoot, entries), Entries: entries}
+}
+
+func TestComputeRootExtendsEarlierCheckpoints(t *testing.T) {
+	entries := chainedEvents(4)
+
+	if ComputeRoot(ComputeRoot("", entries[:2]), entries[2:]) != ComputeRoot("", entries) {
+		t.Fatal("a root computed over two checkpoints differs from one computed over all their entries")
+	}
+	if ComputeRoot("previous", nil) != "previous" {
+		t.Fatal("an empty checkpoint changed the root")
+	}
+}
+
+func TestArchiveVerify(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(archive *Archive)
+		broken bool
+	}{
+		{name: "intact", modify: func(archive *Archive) {}},
+		{name: "tampered entry", modify: func(archive *Archive) {
+			archive.Entries[2].Entry = strings.Replace(archive.Entries[2].Entry, "Hub 2", "Hub 9", 1)
+		}, broken: true},
+		{name: "tampered legacy history", modify: func(archive *Archive) {
+			archive.Entries[0].Entry = strings.Replace(archive.Entries[0].Entry, "Lagos", "Accra", 1)
+		}, broken: true},
+		{name: "dropped entry", modify: func(archive *Archive) {
+			archive.Entries = append(archive.Entries[:3], archive.Entries[4:]...)
+		}, broken: true},
+		{name: "reordered entries", modify: func(archive *Archive) {
+			archive.Entries[1], archive.Entries[2] = archive.Entries[2], archive.Entries[1]
+		}, broken: true},
+		{name: "wrong previous root", modify: func(archive *Archive) {
+			archive.PreviousRoot = ""
+		}, broken: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			archive := testArchive()
+			test.modify(archive)
+
+			err := archive.Verify()
+			if test.broken && err == nil {
+				t.Fatal("archive verified after it was changed")
+			}
+			if !test.broken && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestVerifyProof(t *testing.T) {
+	archive := testArchive()
+
+	tests := []struct {
+		name     string
+		sequence uint64
+		modify   func(proof *Proof)
+		valid    bool
+	}{
+		{name: "legacy history", sequence: 0, modify: func(proof *Proof) {}, valid: true},
+		{name: "first event", sequence: 1, modify: func(proof *Proof) {}, valid: true},
+		{name: "last event", sequence: 4, modify: func(proof *Proof) {}, valid: true},
+		{name: "tampered entry", sequence: 2, modify: func(proof *Proof) {
+			proof.Entry = strings.Replace(proof.Entry, "Hub 2", "Hub 9", 1)
+		}},
+		{name: "dropped following entry", sequence: 2, modify: func(proof *Proof) {
+			proof.Following = proof.Following[1:]
+		}},
+		{name: "reordered following entries", sequence: 2, modify: func(proof *Proof) {
+			proof.Following[0], proof.Following[1] = proof.Following[1], proof.Following[0]
+		}},
+		{name: "wrong previous hash", sequence: 2, modify: func(proof *Proof) {
+			proof.Previous = archive.PreviousRoot
+		}},
+		{name: "another checkpoint's root", sequence: 2, modify: func(proof *Proof) {
+			proof.Root = archive.PreviousRoot
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proof, err := archive.Prove(test.sequence)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.modify(proof)
+
+			if VerifyProof(*proof) != test.valid {
+				t.Fatalf("expected the proof to verify %t", test.valid)
+			}
+		})
+	}
+
+	_, err := archive.Prove(5)
+	if err == nil {
+		t.Fatal("proved an entry the archive does not hold")
+	}
+}
+
+func TestChainVerifier(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(entries []Entry) []Entry
+		breaks []uint64
+	}{
+		{name: "intact", modify: func(entries []Entry) []Entry { return entries }},
+		{name: "legacy history first", modify: func(entries []Entry) []Entry {
+			return append([]Entry{{Sequence: 0, Entry: legacyHistory}}, entries...)
+		}},
+		{name: "tampered entry", modify: func(entries []Entry) []Entry {
+			entries[1].Entry = strings.Replace(entries[1].Entry, "Hub 2", "Hub 9", 1)
+			return entries
+		}, breaks: []uint64{3}},
+		{name: "dropped entry", modify: func(entries []Entry) []Entry {
+			return append(entries[:1], entries[2:]...)
+		}, breaks: []uint64{3}},
+		{name: "reordered entries", modify: func(entries []Entry) []Entry {
+			entries[1], entries[2] = entries[2], entries[1]
+			return entries
+		}, breaks: []uint64{3, 2, 4}},
+		{name: "entry stored under another sequence", modify: func(entries []Entry) []Entry {
+			entries[2].Sequence = 4
+			return entries[:3]
+		}, breaks: []uint64{4}},
+		{name: "hash removed after chaining began", modify: func(entries []Entry) []Entry {
+			entries[2].Entry = strings.Replace(entries[2].Entry, fmt.Sprintf("%q", EntryHash(entries[1].Entry)), `""`, 1)
+			return entries[:3]
+		}, breaks: []uint64{3}},
+		{name: "entry that is not an event", modify: func(entries []Entry) []Entry {
+			entries[3].Entry = "not JSON"
+			return entries
+		}, breaks: []uint64{4, 5}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verifier := NewChainVerifier("", 0)
+			for _, entry := range test.modify(chainedEvents(5)) {
+				verifier.Add(entry)
+			}
+
+			sequences := []uint64{}
+			for _, chainBreak := range verifier.Breaks {
+				sequences = append(sequences, chainBreak.Sequence)
+			}
+			if len(test.breaks) == 0 {
+				test.breaks = []uint64{}
+			}
+			if !reflect.DeepEqual(sequences, test.breaks) {
+				t.Fatalf("expected breaks at %v, got %v", test.breaks, verifier.Breaks)
+			}
+			if verifier.Intact() != (len(test.breaks) == 0) {
+				t.Fatalf("Intact() is %t with breaks %v", verifier.Intact(), verifier.Breaks)
+			}
+		})
+	}
+}
+
+func TestChainVerifierContinuesFromCheckpoint(t *testing.T) {
+	entries := chainedEvents(5)
+
+	verifier := NewChainVerifier(EntryHash(entries[2].Entry), 3)
+	for _, entry := range entries[3:] {
+		verifier.Add(entry)
+	}
+	if !verifier.Intact() || verifier.Sequence != 5 {
+		t.Fatalf("expected an intact chain through event 5, got %+v", verifier)
+	}
+
+	verifier = NewChainVerifier(EntryHash(entries[2].Entry), 3)
+	verifier.Add(entries[3])
+	verifier.Add(Entry{Sequence: 5, Entry: `{"sequence":5,"previousHash":""}`})
+	if verifier.ChainedFrom != 4 || verifier.Intact() {
+		t.Fatalf("expected the chain to begin at event 4 and an event without a hash after it to break it, got %+v", verifier)
+	}
+
+	verifier = NewChainVerifier("not the checkpoint's hash", 3)
+	verifier.Add(entries[3])
+	if verifier.Intact() {
+		t.Fatal("an event was accepted after a checkpoint it does not follow on from")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log"
+	"os"
+	"reflect"
+
+	"Quanta-Ledger/saga"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-contract-api-go/metadata"
+	"github.com/hyperledger/fabric-contract-api-go/serializer"
+)
+
+// devCommands are the development tools built into the binary with their build tag, keyed by the argument that runs them
+var devCommands = map[string]func(chaincode *contractapi.ContractChaincode, args []string) error{}
+
+func main() {
+	chaincode, err := newChaincode(&ProductDetailsContract{RoleMSPs: RoleMSPsFromEnv()})
+	if err != nil {
+		log.Panicf("error creating product details chaincode: %v", err)
+	}
+
+	if len(os.Args) > 1 && devCommands[os.Args[1]] != nil {
+		if err := devCommands[os.Args[1]](chaincode, os.Args[2:]); err != nil {
+			log.Fatalf("error running %s: %v", os.Args[1], err)
+		}
+		return
+	}
+
+	if err := chaincode.Start(); err != nil {
+		log.Panicf("error starting product details chaincode: %v", err)
+	}
+}
+
+/**
+*@dev newChaincode() creates the chaincode running the product details and saga contracts
+*/
+
+func newChaincode(contract *ProductDetailsContract) (*contractapi.ContractChaincode, error) {
+	chaincode, err := contractapi.NewChaincode(contract, saga.NewContract())
+	if err != nil {
+		return nil, err
+	}
+
+	chaincode.TransactionSerializer = new(argumentSerializer)
+	return chaincode, nil
+}
+
+/**
+*@dev argumentSerializer() converts transaction arguments as the JSON serializer does, and then to the parameter's own type
+*
+* The JSON serializer converts an argument of a named basic type, such as ProductState, to the underlying type only,
+* which the transaction cannot be called with.
+*/
+
+type argumentSerializer struct {
+	serializer.JSONSerializer
+}
+
+func (s *argumentSerializer) FromString(param string, fieldType reflect.Type, paramMetadata *metadata.ParameterMetadata, components *metadata.ComponentMetadata) (reflect.Value, error) {
+	converted, err := s.JSONSerializer.FromString(param, fieldType, paramMetadata, components)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+
+	if converted.Type() != fieldType && converted.Type().ConvertibleTo(fieldType) {
+		return converted.Convert(fieldType), nil
+	}
+	return converted, nil
+}
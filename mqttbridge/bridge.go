@@ -0,0 +1,365 @@
+package mqttbridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+*@dev Config() represents the bridge settings
+*
+* IsRejection tells a transaction the ledger rejected apart from one that could not be submitted, so rejections are not
+* retried. DeadLetter receives the readings the ledger rejected, which are dropped from the queue.
+*/
+
+type Config struct {
+	BrokerURL     string
+	ClientID      string
+	Topics        []string
+	BatchSize     int
+	FlushInterval time.Duration
+	MaxRetries    int
+	RetryBackoff  time.Duration
+	IsRejection   func(error) bool
+	DeadLetter    func(productID uint64, reading Reading, err error)
+}
+
+/**
+*@dev Submitter() submits a transaction to the product details chaincode
+*/
+
+type Submitter interface {
+	SubmitTransaction(name string, args ...string) ([]byte, error)
+}
+
+/**
+*@dev DevicePayload() represents the JSON a tracker publishes; absent measurements are left nil
+*
+* Sequence increases with every message the device publishes. Signatures holds the device's signature for each
+* measurement, keyed by reading kind.
+*/
+
+type DevicePayload struct {
+	DeviceID    string            `json:"deviceId"`
+	Sequence    uint64            `json:"sequence"`
+	Timestamp   uint64            `json:"timestamp"`
+	Temperature *float64          `json:"temperature"`
+	Humidity    *float64          `json:"humidity"`
+	Latitude    *float64          `json:"lat"`
+	Longitude   *float64          `json:"lon"`
+	Signatures  map[string]string `json:"signatures"`
+}
+
+/**
+*@dev Reading() mirrors the chaincode's TelemetryReading
+*/
+
+type Reading struct {
+	DeviceID  string  `json:"deviceId"`
+	Sequence  uint64  `json:"sequence"`
+	Timestamp uint64  `json:"timestamp"`
+	Kind      string  `json:"kind"`
+	Value     float64 `json:"value"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Signature string  `json:"signature"`
+}
+
+/**
+*@dev Bridge() turns tracker messages into telemetry transactions
+*
+* Movements are not submitted: a payload's location is not signed by the device, so any publisher could name one.
+* Positions reach the ledger as signed position readings instead.
+*/
+
+type Bridge struct {
+	config    Config
+	registry  Registry
+	submitter Submitter
+
+	mu      sync.Mutex
+	pending map[uint64][]Reading
+}
+
+func NewBridge(config Config, registry Registry, submitter Submitter) *Bridge {
+	if config.BatchSize <= 0 {
+		config.BatchSize = 50
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = 30 * time.Second
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = time.Second
+	}
+
+	return &Bridge{
+		config:    config,
+		registry:  registry,
+		submitter: submitter,
+		pending:   make(map[uint64][]Reading),
+	}
+}
+
+/**
+*@dev HandleMessage() maps one tracker message to its products and queues the readings
+*
+* The device ID comes from the payload, or from the topic level a subscribed filter matched with "+". Readings must
+* carry the timestamp the device signed them with. A product whose queue reaches BatchSize is flushed straight away;
+* a failed flush does not hold back the other products'.
+*/
+
+func (b *Bridge) HandleMessage(topic string, message []byte) error {
+	var payload DevicePayload
+	err := json.Unmarshal(message, &payload)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal payload on %s: %v", topic, err)
+	}
+
+	if payload.DeviceID == "" {
+		payload.DeviceID = b.deviceIDFromTopic(topic)
+	}
+	if payload.DeviceID == "" {
+		return fmt.Errorf("message on %s has no device ID", topic)
+	}
+
+	binding, ok := b.registry.Lookup(payload.DeviceID)
+	if !ok {
+		return fmt.Errorf("device %s is not registered", payload.DeviceID)
+	}
+
+	readings := payloadReadings(payload)
+	if len(readings) == 0 {
+		return nil
+	}
+	if payload.Timestamp == 0 || payload.Sequence == 0 {
+		return fmt.Errorf("readings from device %s have no timestamp or sequence", payload.DeviceID)
+	}
+
+	var full []uint64
+	b.mu.Lock()
+	for _, productID := range binding.ProductIDs {
+		b.pending[productID] = append(b.pending[productID], readings...)
+		if len(b.pending[productID]) >= b.config.BatchSize {
+			full = append(full, productID)
+		}
+	}
+	b.mu.Unlock()
+
+	var errs []error
+	for _, productID := range full {
+		err = b.flushProduct(productID)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+/**
+*@dev Run() flushes queued readings every FlushInterval until the context ends, then flushes once more
+*/
+
+func (b *Bridge) Run(ctx context.Context) {
+	ticker := time.NewTicker(b.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.Flush(); err != nil {
+				log.Printf("failed to flush telemetry: %v", err)
+			}
+		case <-ctx.Done():
+			if err := b.Flush(); err != nil {
+				log.Printf("failed to flush telemetry on shutdown: %v", err)
+			}
+			return
+		}
+	}
+}
+
+/**
+*@dev Flush() submits the queued readings of every product
+*/
+
+func (b *Bridge) Flush() error {
+	b.mu.Lock()
+	productIDs := make([]uint64, 0, len(b.pending))
+	for productID := range b.pending {
+		productIDs = append(productIDs, productID)
+	}
+	b.mu.Unlock()
+
+	var errs []error
+	for _, productID := range productIDs {
+		err := b.flushProduct(productID)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+/**
+*@dev flushProduct() submits a product's queued readings, putting them back in the queue if every retry fails
+*
+* A batch the ledger rejects is resubmitted one reading at a time, so only the rejected readings are dead-lettered.
+*/
+
+func (b *Bridge) flushProduct(productID uint64) error {
+	b.mu.Lock()
+	readings := b.pending[productID]
+	delete(b.pending, productID)
+	b.mu.Unlock()
+
+	if len(readings) == 0 {
+		return nil
+	}
+
+	readingsBytes, err := json.Marshal(readings)
+	if err != nil {
+		return fmt.Errorf("failed to marshal readings JSON: %v", err)
+	}
+
+	err = b.submit("RecordTelemetry", strconv.FormatUint(productID, 10), string(readingsBytes))
+	if err != nil && b.isRejection(err) && len(readings) == 1 {
+		b.deadLetter(productID, readings[0], err)
+		return nil
+	}
+	if err != nil && b.isRejection(err) {
+		return b.submitSeparately(productID, readings)
+	}
+	if err != nil {
+		b.requeue(productID, readings)
+		return err
+	}
+
+	return nil
+}
+
+/**
+*@dev submitSeparately() submits each reading of a rejected batch on its own, dead-lettering those the ledger rejects
+*/
+
+func (b *Bridge) submitSeparately(productID uint64, readings []Reading) error {
+	for i, reading := range readings {
+		readingBytes, err := json.Marshal([]Reading{reading})
+		if err != nil {
+			return fmt.Errorf("failed to marshal readings JSON: %v", err)
+		}
+
+		err = b.submit("RecordTelemetry", strconv.FormatUint(productID, 10), string(readingBytes))
+		if err != nil && b.isRejection(err) {
+			b.deadLetter(productID, reading, err)
+			continue
+		}
+		if err != nil {
+			b.requeue(productID, readings[i:])
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *Bridge) requeue(productID uint64, readings []Reading) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending[productID] = append(append([]Reading{}, readings...), b.pending[productID]...)
+}
+
+func (b *Bridge) deadLetter(productID uint64, reading Reading, err error) {
+	log.Printf("dropping %s reading of device %s for product %d: %v", reading.Kind, reading.DeviceID, productID, err)
+	if b.config.DeadLetter != nil {
+		b.config.DeadLetter(productID, reading, err)
+	}
+}
+
+func (b *Bridge) isRejection(err error) bool {
+	return b.config.IsRejection != nil && b.config.IsRejection(err)
+}
+
+/**
+*@dev submit() submits a transaction, retrying with exponential backoff until the ledger rejects it
+*/
+
+func (b *Bridge) submit(name string, args ...string) error {
+	backoff := b.config.RetryBackoff
+
+	var err error
+	for attempt := 0; attempt <= b.config.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		_, err = b.submitter.SubmitTransaction(name, args...)
+		if err == nil {
+			return nil
+		}
+		if b.isRejection(err) {
+			return err
+		}
+		log.Printf("attempt %d of %s failed: %v", attempt+1, name, err)
+	}
+
+	return fmt.Errorf("failed to submit %s after %d attempts: %v", name, b.config.MaxRetries+1, err)
+}
+
+/**
+*@dev deviceIDFromTopic() returns the topic level matched by the "+" wildcard of the first subscribed filter that matches
+*/
+
+func (b *Bridge) deviceIDFromTopic(topic string) string {
+	levels := strings.Split(topic, "/")
+	for _, filter := range b.config.Topics {
+		deviceID, matched := matchTopic(strings.Split(filter, "/"), levels)
+		if matched && deviceID != "" {
+			return deviceID
+		}
+	}
+	return ""
+}
+
+func matchTopic(filterLevels []string, levels []string) (string, bool) {
+	deviceID := ""
+	for i, filterLevel := range filterLevels {
+		if filterLevel == "#" {
+			return deviceID, true
+		}
+		if i >= len(levels) {
+			return "", false
+		}
+		if filterLevel == "+" {
+			if deviceID == "" {
+				deviceID = levels[i]
+			}
+		} else if filterLevel != levels[i] {
+			return "", false
+		}
+	}
+	return deviceID, len(filterLevels) == len(levels)
+}
+
+func payloadReadings(payload DevicePayload) []Reading {
+	readings := []Reading{}
+	if payload.Temperature != nil {
+		readings = append(readings, Reading{DeviceID: payload.DeviceID, Sequence: payload.Sequence, Timestamp: payload.Timestamp, Kind: "temperature", Value: *payload.Temperature, Signature: payload.Signatures["temperature"]})
+	}
+	if payload.Humidity != nil {
+		readings = append(readings, Reading{DeviceID: payload.DeviceID, Sequence: payload.Sequence, Timestamp: payload.Timestamp, Kind: "humidity", Value: *payload.Humidity, Signature: payload.Signatures["humidity"]})
+	}
+	if payload.Latitude != nil && payload.Longitude != nil {
+		readings = append(readings, Reading{DeviceID: payload.DeviceID, Sequence: payload.Sequence, Timestamp: payload.Timestamp, Kind: "position", Latitude: *payload.Latitude, Longitude: *payload.Longitude, Signature: payload.Signatures["position"]})
+	}
+	return readings
+}
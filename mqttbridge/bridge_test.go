@@ -0,0 +1,312 @@
+package mqttbridge
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// errRejected stands in for a transaction the ledger rejected
+var errRejected = errors.New("rejected by the ledger")
+
+type submission struct {
+	name string
+	args []string
+}
+
+/**
+*@dev fakeSubmitter() records submitted transactions and fails those its fail function picks
+*/
+
+type fakeSubmitter struct {
+	mu          sync.Mutex
+	submissions []submission
+	fail        func(name string, args []string) error
+}
+
+func (s *fakeSubmitter) SubmitTransaction(name string, args ...string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fail != nil {
+		if err := s.fail(name, args); err != nil {
+			return nil, err
+		}
+	}
+	s.submissions = append(s.submissions, submission{name: name, args: args})
+	return nil, nil
+}
+
+func (s *fakeSubmitter) named(name string) []submission {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	matching := []submission{}
+	for _, submitted := range s.submissions {
+		if submitted.name == name {
+			matching = append(matching, submitted)
+		}
+	}
+	return matching
+}
+
+func testConfig(topics ...string) Config {
+	return Config{
+		ClientID:      "bridge-test",
+		Topics:        topics,
+		BatchSize:     50,
+		FlushInterval: time.Hour,
+		RetryBackoff:  time.Millisecond,
+		IsRejection: func(err error) bool {
+			return errors.Is(err, errRejected)
+		},
+	}
+}
+
+/**
+*@dev startBroker() runs an embedded broker on a free local port and returns its URL
+*/
+
+func startBroker(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	server, err := StartEmbeddedBroker(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	return "tcp://" + address
+}
+
+func publish(t *testing.T, brokerURL string, topic string, payload string) {
+	t.Helper()
+
+	client := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(brokerURL).SetClientID("tracker-test"))
+	token := client.Connect()
+	if token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer client.Disconnect(100)
+
+	token = client.Publish(topic, 1, false, payload)
+	if token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the bridge")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBridgeSubmitsBrokerMessages(t *testing.T) {
+	brokerURL := startBroker(t)
+	submitter := new(fakeSubmitter)
+
+	config := testConfig("trackers/+/telemetry")
+	config.BrokerURL = brokerURL
+	config.BatchSize = 1
+	bridge := NewBridge(config, NewStaticRegistry(Binding{DeviceID: "tracker-1", ProductIDs: []uint64{1, 2}}), submitter)
+
+	client, err := bridge.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(100)
+
+	// The subscription is made once the connection is up, so publish until the bridge sees a message
+	waitFor(t, func() bool {
+		publish(t, brokerURL, "trackers/tracker-1/telemetry", `{"sequence":1,"timestamp":1700000000,"temperature":4.5,"location":"Lagos warehouse","signatures":{"temperature":"sig"}}`)
+		return len(submitter.named("RecordTelemetry")) >= 2
+	})
+
+	telemetry := submitter.named("RecordTelemetry")
+	products := map[string]bool{}
+	for _, batch := range telemetry {
+		products[batch.args[0]] = true
+	}
+	if !products["1"] || !products["2"] {
+		t.Fatalf("expected a telemetry batch for each product, got %v", telemetry)
+	}
+	var readings []Reading
+	err = json.Unmarshal([]byte(telemetry[0].args[1]), &readings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reading := readings[0]
+	if reading.DeviceID != "tracker-1" || reading.Sequence != 1 || reading.Kind != "temperature" || reading.Value != 4.5 || reading.Timestamp != 1700000000 || reading.Signature != "sig" {
+		t.Fatalf("unexpected reading %+v", reading)
+	}
+
+	if movements := submitter.named("LogProductMovement"); len(movements) != 0 {
+		t.Fatalf("expected the unsigned location not to be submitted, got %v", movements)
+	}
+}
+
+func TestBridgeRejectsReadingsWithoutTimestamp(t *testing.T) {
+	submitter := new(fakeSubmitter)
+	bridge := NewBridge(testConfig("trackers/+/telemetry"), NewStaticRegistry(Binding{DeviceID: "tracker-1", ProductIDs: []uint64{1}}), submitter)
+
+	err := bridge.HandleMessage("trackers/tracker-1/telemetry", []byte(`{"temperature":4.5}`))
+	if err == nil || !strings.Contains(err.Error(), "no timestamp or sequence") {
+		t.Fatalf("expected a missing timestamp error, got %v", err)
+	}
+
+	err = bridge.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(submitter.named("RecordTelemetry")) != 0 {
+		t.Fatal("readings without a timestamp were submitted")
+	}
+}
+
+func TestBridgeDoesNotMoveProductsFromUnsignedLocations(t *testing.T) {
+	submitter := new(fakeSubmitter)
+	bridge := NewBridge(testConfig("trackers/+/telemetry"), NewStaticRegistry(Binding{DeviceID: "tracker-1", ProductIDs: []uint64{1}}), submitter)
+
+	err := bridge.HandleMessage("trackers/tracker-1/telemetry", []byte(`{"sequence":1,"timestamp":1700000000,"location":"Accra depot"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bridge.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(submitter.submissions) != 0 {
+		t.Fatalf("expected a location alone to submit nothing, got %v", submitter.submissions)
+	}
+}
+
+func TestBridgeFlushesOtherProductsWhenOneFails(t *testing.T) {
+	submitter := &fakeSubmitter{fail: func(name string, args []string) error {
+		if args[0] == "1" {
+			return fmt.Errorf("peer unavailable")
+		}
+		return nil
+	}}
+	config := testConfig("trackers/+/telemetry")
+	config.BatchSize = 1
+	bridge := NewBridge(config, NewStaticRegistry(Binding{DeviceID: "tracker-1", ProductIDs: []uint64{1, 2, 3}}), submitter)
+
+	err := bridge.HandleMessage("trackers/tracker-1/telemetry", []byte(`{"sequence":1,"timestamp":1700000000,"temperature":4.5}`))
+	if err == nil {
+		t.Fatal("expected product 1's flush to fail")
+	}
+
+	telemetry := submitter.named("RecordTelemetry")
+	if len(telemetry) != 2 || telemetry[0].args[0] != "2" || telemetry[1].args[0] != "3" {
+		t.Fatalf("expected the other products to be flushed, got %v", telemetry)
+	}
+
+	// Product 1's readings stay queued for the next flush
+	submitter.fail = nil
+	err = bridge.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if telemetry := submitter.named("RecordTelemetry"); len(telemetry) != 3 || telemetry[2].args[0] != "1" {
+		t.Fatalf("expected product 1's readings to be resubmitted, got %v", telemetry)
+	}
+}
+
+func TestBridgeDeadLettersRejectedReadings(t *testing.T) {
+	submitter := &fakeSubmitter{fail: func(name string, args []string) error {
+		if name == "RecordTelemetry" && strings.Contains(args[1], `"signature":"forged"`) {
+			return errRejected
+		}
+		return nil
+	}}
+
+	var deadLetters []Reading
+	config := testConfig("trackers/+/telemetry")
+	config.DeadLetter = func(productID uint64, reading Reading, err error) {
+		deadLetters = append(deadLetters, reading)
+	}
+	bridge := NewBridge(config, NewStaticRegistry(Binding{DeviceID: "tracker-1", ProductIDs: []uint64{1}}), submitter)
+
+	for _, message := range []string{
+		`{"sequence":1,"timestamp":1700000000,"temperature":4.5,"signatures":{"temperature":"valid"}}`,
+		`{"sequence":2,"timestamp":1700000060,"temperature":9.5,"signatures":{"temperature":"forged"}}`,
+		`{"sequence":3,"timestamp":1700000120,"humidity":60,"signatures":{"humidity":"valid"}}`,
+	} {
+		err := bridge.HandleMessage("trackers/tracker-1/telemetry", []byte(message))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := bridge.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(deadLetters) != 1 || deadLetters[0].Signature != "forged" {
+		t.Fatalf("expected the forged reading to be dead-lettered, got %+v", deadLetters)
+	}
+	if telemetry := submitter.named("RecordTelemetry"); len(telemetry) != 2 {
+		t.Fatalf("expected the valid readings to be submitted on their own, got %v", telemetry)
+	}
+
+	// Nothing is left queued, so the next flush submits nothing
+	err = bridge.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if telemetry := submitter.named("RecordTelemetry"); len(telemetry) != 2 {
+		t.Fatalf("rejected readings were queued again: %v", telemetry)
+	}
+}
+
+func TestBridgeRequeuesReadingsWhenThePeerIsUnavailable(t *testing.T) {
+	failing := true
+	submitter := &fakeSubmitter{fail: func(name string, args []string) error {
+		if failing {
+			return fmt.Errorf("peer unavailable")
+		}
+		return nil
+	}}
+	bridge := NewBridge(testConfig("trackers/+/telemetry"), NewStaticRegistry(Binding{DeviceID: "tracker-1", ProductIDs: []uint64{1}}), submitter)
+
+	err := bridge.HandleMessage("trackers/tracker-1/telemetry", []byte(`{"sequence":1,"timestamp":1700000000,"temperature":4.5}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = bridge.Flush()
+	if err == nil {
+		t.Fatal("expected the flush to fail")
+	}
+
+	failing = false
+	err = bridge.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if telemetry := submitter.named("RecordTelemetry"); len(telemetry) != 1 {
+		t.Fatalf("expected the queued readings to be submitted, got %v", telemetry)
+	}
+}
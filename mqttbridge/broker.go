@@ -0,0 +1,34 @@
+package mqttbridge
+
+import (
+	"fmt"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+/**
+*@dev StartEmbeddedBroker() runs an in-process MQTT broker that accepts every client, for local runs without a real broker
+*/
+
+func StartEmbeddedBroker(address string) (*mochi.Server, error) {
+	server := mochi.New(nil)
+
+	err := server.AddHook(new(auth.AllowHook), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure embedded broker: %v", err)
+	}
+
+	err = server.AddListener(listeners.NewTCP("bridge", address, nil))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", address, err)
+	}
+
+	err = server.Serve()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start embedded broker: %v", err)
+	}
+
+	return server, nil
+}
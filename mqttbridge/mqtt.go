@@ -0,0 +1,53 @@
+package mqttbridge
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+/**
+*@dev Subscribe() connects to the broker and feeds every message on the configured topics to the bridge
+*/
+
+func (b *Bridge) Subscribe() (mqtt.Client, error) {
+	if len(b.config.Topics) == 0 {
+		return nil, fmt.Errorf("at least one topic is required")
+	}
+
+	filters := make(map[string]byte, len(b.config.Topics))
+	for _, topic := range b.config.Topics {
+		filters[topic] = 1
+	}
+
+	handler := func(client mqtt.Client, message mqtt.Message) {
+		err := b.HandleMessage(message.Topic(), message.Payload())
+		if err != nil {
+			log.Printf("failed to handle message on %s: %v", message.Topic(), err)
+		}
+	}
+
+	options := mqtt.NewClientOptions().
+		AddBroker(b.config.BrokerURL).
+		SetClientID(b.config.ClientID).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(5 * time.Second).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			// Subscriptions are renewed on every reconnect
+			token := client.SubscribeMultiple(filters, handler)
+			if token.Wait() && token.Error() != nil {
+				log.Printf("failed to subscribe to %v: %v", b.config.Topics, token.Error())
+			}
+		})
+
+	client := mqtt.NewClient(options)
+	token := client.Connect()
+	if token.Wait() && token.Error() != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", b.config.BrokerURL, token.Error())
+	}
+
+	return client, nil
+}
@@ -0,0 +1,82 @@
+package mqttbridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+/**
+*@dev Binding() represents what a tracker is attached to: one product, or every product in a shipment
+*/
+
+type Binding struct {
+	DeviceID   string   `json:"deviceId"`
+	ProductIDs []uint64 `json:"productIds"`
+	ShipmentID string   `json:"shipmentId,omitempty"`
+}
+
+/**
+*@dev Registry() maps device IDs to the products their readings belong to
+*/
+
+type Registry interface {
+	Lookup(deviceID string) (*Binding, bool)
+}
+
+/**
+*@dev StaticRegistry() is a Registry held in memory, usually loaded from a JSON file
+*/
+
+type StaticRegistry struct {
+	mu       sync.RWMutex
+	bindings map[string]Binding
+}
+
+func NewStaticRegistry(bindings ...Binding) *StaticRegistry {
+	registry := &StaticRegistry{bindings: make(map[string]Binding)}
+	for _, binding := range bindings {
+		registry.Bind(binding)
+	}
+	return registry
+}
+
+/**
+*@dev LoadRegistry() reads a JSON array of bindings from a file
+*/
+
+func LoadRegistry(path string) (*StaticRegistry, error) {
+	registryBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read device registry: %v", err)
+	}
+
+	var bindings []Binding
+	err = json.Unmarshal(registryBytes, &bindings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal device registry JSON: %v", err)
+	}
+
+	return NewStaticRegistry(bindings...), nil
+}
+
+/**
+*@dev Bind() attaches a device to products, replacing any earlier binding
+*/
+
+func (r *StaticRegistry) Bind(binding Binding) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bindings[binding.DeviceID] = binding
+}
+
+func (r *StaticRegistry) Lookup(deviceID string) (*Binding, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	binding, ok := r.bindings[deviceID]
+	if !ok {
+		return nil, false
+	}
+	return &binding, true
+}
@@ -0,0 +1,197 @@
+package reconcile
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/**
+*@dev ProductStates are the names of the chaincode's ProductState values, in order; keep them in step with the chaincode
+*/
+
+var ProductStates = []string{
+	"PRODUCT_REGISTERED",
+	"QUALITY_ASSURANCE",
+	"PRODUCT_TRANSIT",
+	"PRODUCT_IN_INVENTORY",
+	"PRODUCT_SOLD",
+	"PRODUCT_RECALLED",
+	"CONSUMPTION",
+	"PENDING",
+	"VALIDATING",
+	"PUBLISHING",
+	"PRODUCT_LEASED_OUT",
+	"PRODUCT_RETURNED",
+}
+
+/**
+*@dev Record() represents one product line of an ERP export
+*/
+
+type Record struct {
+	ProductID uint64 `json:"id"`
+	Location  string `json:"location"`
+	State     string `json:"state"`
+}
+
+/**
+*@dev ReadExport() reads an ERP export, as CSV or JSON depending on the file's extension
+*/
+
+func ReadExport(path string) ([]Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ERP export: %v", err)
+	}
+	defer file.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return ReadCSV(file)
+	case ".json":
+		return ReadJSON(file)
+	default:
+		return nil, fmt.Errorf("ERP export %s is neither .csv nor .json", path)
+	}
+}
+
+/**
+*@dev ReadCSV() reads an ERP export with a header row naming its id, location and state columns; other columns are ignored
+*/
+
+func ReadCSV(r io.Reader) ([]Record, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ERP export header: %v", err)
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case "id", "productid", "product_id":
+			columns["id"] = i
+		case "location", "state":
+			columns[name] = i
+		}
+	}
+	for _, name := range []string{"id", "location", "state"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("ERP export has no %s column", name)
+		}
+	}
+
+	records := []Record{}
+	for line := 2; ; line++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ERP export line %d: %v", line, err)
+		}
+
+		productID, err := strconv.ParseUint(strings.TrimSpace(row[columns["id"]]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse product ID on ERP export line %d: %v", line, err)
+		}
+
+		records = append(records, Record{
+			ProductID: productID,
+			Location:  strings.TrimSpace(row[columns["location"]]),
+			State:     strings.TrimSpace(row[columns["state"]]),
+		})
+	}
+
+	return records, checkDuplicates(records)
+}
+
+/**
+*@dev ReadJSON() reads an ERP export as a list of objects with id, location and state; a state may be a name or a number
+*/
+
+func ReadJSON(r io.Reader) ([]Record, error) {
+	var rows []struct {
+		ProductID uint64          `json:"id"`
+		Location  string          `json:"location"`
+		State     json.RawMessage `json:"state"`
+	}
+	err := json.NewDecoder(r).Decode(&rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal ERP export JSON: %v", err)
+	}
+
+	records := []Record{}
+	for _, row := range rows {
+		state := string(row.State)
+		var name string
+		if json.Unmarshal(row.State, &name) == nil {
+			state = name
+		}
+
+		records = append(records, Record{
+			ProductID: row.ProductID,
+			Location:  strings.TrimSpace(row.Location),
+			State:     strings.TrimSpace(state),
+		})
+	}
+
+	return records, checkDuplicates(records)
+}
+
+/**
+*@dev ParseState() reads an ERP state as a ProductState: its number, its name, or an ERP term that aliases maps to a name
+*/
+
+func ParseState(value string, aliases map[string]string) (int, error) {
+	if alias, ok := aliases[value]; ok {
+		value = alias
+	}
+
+	number, err := strconv.Atoi(value)
+	if err == nil {
+		if number < 0 || number >= len(ProductStates) {
+			return 0, fmt.Errorf("product state %d is out of range", number)
+		}
+		return number, nil
+	}
+
+	for state, name := range ProductStates {
+		if strings.EqualFold(name, value) {
+			return state, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown product state %q; map it to a ProductState name with a state alias", value)
+}
+
+/**
+*@dev StateName() names a ProductState, falling back to its number
+*/
+
+func StateName(state int) string {
+	if state < 0 || state >= len(ProductStates) {
+		return strconv.Itoa(state)
+	}
+	return ProductStates[state]
+}
+
+func checkDuplicates(records []Record) error {
+	seen := make(map[uint64]bool)
+	for _, record := range records {
+		if seen[record.ProductID] {
+			return fmt.Errorf("ERP export lists product %d more than once", record.ProductID)
+		}
+		seen[record.ProductID] = true
+	}
+	return nil
+}
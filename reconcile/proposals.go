@@ -0,0 +1,215 @@
+package reconcile
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+/**
+*@dev proposal statuses
+*/
+
+const (
+	PROPOSAL_PENDING  = "PENDING"
+	PROPOSAL_APPLIED  = "APPLIED"
+	PROPOSAL_DECLINED = "DECLINED"
+	PROPOSAL_FAILED   = "FAILED"
+	PROPOSAL_STALE    = "STALE"
+)
+
+/**
+*@dev Proposal() represents a ledger correction that waits for an operator to confirm it
+*
+* Expected holds the ledger value the correction replaces, so a proposal whose product has moved on since the report is not applied.
+*/
+
+type Proposal struct {
+	ProductID uint64   `json:"productId"`
+	Category  string   `json:"category"`
+	Function  string   `json:"function"`
+	Args      []string `json:"args"`
+	Expected  string   `json:"expected"`
+	Reason    string   `json:"reason"`
+	Status    string   `json:"status"`
+	Result    string   `json:"result,omitempty"`
+}
+
+/**
+*@dev Propose() turns a report's state and location mismatches into correction proposals
+*
+* Products missing on either side, unreadable or withheld need an operator to register, retire or grant them by hand, so they get no proposal.
+*/
+
+func Propose(report *Report, aliases map[string]string) ([]Proposal, error) {
+	proposals := []Proposal{}
+	for _, difference := range report.Differences {
+		productArg := strconv.FormatUint(difference.ProductID, 10)
+
+		switch difference.Category {
+		case DIFF_STATE_MISMATCH:
+			state, err := ParseState(difference.ERP.State, aliases)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse ERP state of product %d: %v", difference.ProductID, err)
+			}
+			proposals = append(proposals, Proposal{
+				ProductID: difference.ProductID,
+				Category:  difference.Category,
+				Function:  "UpdateProductState",
+				Args:      []string{productArg, strconv.Itoa(state)},
+				Expected:  StateName(*difference.Ledger.State),
+				Reason:    difference.Detail,
+				Status:    PROPOSAL_PENDING,
+			})
+		case DIFF_LOCATION_MISMATCH:
+			proposals = append(proposals, Proposal{
+				ProductID: difference.ProductID,
+				Category:  difference.Category,
+				Function:  "LogProductMovement",
+				Args:      []string{productArg, difference.ERP.Location},
+				Expected:  *difference.Ledger.Location,
+				Reason:    difference.Detail,
+				Status:    PROPOSAL_PENDING,
+			})
+		}
+	}
+
+	return proposals, nil
+}
+
+/**
+*@dev ApplyProposal() submits a pending proposal once confirm agrees to it, marking it stale if the ledger changed since the report
+*/
+
+func (r *Reconciler) ApplyProposal(proposal *Proposal, confirm func(Proposal) (bool, error)) error {
+	if proposal.Status != PROPOSAL_PENDING {
+		return nil
+	}
+
+	product, err := r.readProduct(proposal.ProductID)
+	if err != nil {
+		if !r.rejected(err) {
+			return err
+		}
+		proposal.Status = PROPOSAL_STALE
+		proposal.Result = fmt.Sprintf("product %d can no longer be read from the ledger: %v", proposal.ProductID, err)
+		return nil
+	}
+
+	var current *string
+	switch proposal.Category {
+	case DIFF_STATE_MISMATCH:
+		if product.State != nil {
+			stateName := StateName(*product.State)
+			current = &stateName
+		}
+	case DIFF_LOCATION_MISMATCH:
+		current = product.Location
+	}
+	if current == nil {
+		proposal.Status = PROPOSAL_STALE
+		proposal.Result = fmt.Sprintf("the ledger no longer shows the value %q the proposal was made against", proposal.Expected)
+		return nil
+	}
+
+	changed := *current != proposal.Expected
+	if proposal.Category == DIFF_LOCATION_MISMATCH {
+		changed = !sameLocation(*current, proposal.Expected)
+	}
+	if changed {
+		proposal.Status = PROPOSAL_STALE
+		proposal.Result = fmt.Sprintf("the ledger now has %q instead of %q", *current, proposal.Expected)
+		return nil
+	}
+
+	confirmed, err := confirm(*proposal)
+	if err != nil {
+		return err
+	}
+	if !confirmed {
+		proposal.Status = PROPOSAL_DECLINED
+		return nil
+	}
+
+	_, err = r.Ledger.SubmitTransaction(proposal.Function, proposal.Args...)
+	if err != nil {
+		if !r.rejected(err) {
+			return fmt.Errorf("failed to submit correction of product %d: %v", proposal.ProductID, err)
+		}
+		proposal.Status = PROPOSAL_FAILED
+		proposal.Result = err.Error()
+		return nil
+	}
+
+	proposal.Status = PROPOSAL_APPLIED
+	return nil
+}
+
+/**
+*@dev ReadReport() loads a report file
+*/
+
+func ReadReport(path string) (*Report, error) {
+	reportBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read report: %v", err)
+	}
+
+	report := new(Report)
+	err = json.Unmarshal(reportBytes, report)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal report JSON: %v", err)
+	}
+
+	return report, nil
+}
+
+/**
+*@dev WriteReport() saves a report file
+*/
+
+func WriteReport(path string, report *Report) error {
+	return writeJSON(path, "report", report)
+}
+
+/**
+*@dev ReadProposals() loads a proposals file
+*/
+
+func ReadProposals(path string) ([]Proposal, error) {
+	proposalsBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read proposals: %v", err)
+	}
+
+	var proposals []Proposal
+	err = json.Unmarshal(proposalsBytes, &proposals)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal proposals JSON: %v", err)
+	}
+
+	return proposals, nil
+}
+
+/**
+*@dev WriteProposals() saves a proposals file, which the operator's decisions are recorded back into as they are made
+*/
+
+func WriteProposals(path string, proposals []Proposal) error {
+	return writeJSON(path, "proposals", proposals)
+}
+
+func writeJSON(path string, name string, value interface{}) error {
+	valueBytes, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s JSON: %v", name, err)
+	}
+
+	err = os.WriteFile(path, append(valueBytes, '\n'), 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,133 @@
+package reconcile
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProposeCorrectsOnlyMismatches(t *testing.T) {
+	reconciler := testReconciler(testLedger())
+	reconciler.Scan = true
+
+	report, err := reconciler.Compare([]Record{
+		{ProductID: 2, Location: "Lagos depot", State: "in stock"},
+		{ProductID: 3, Location: "Lagos depot", State: "PRODUCT_IN_INVENTORY"},
+		{ProductID: 4, Location: "Lagos depot", State: "in stock"},
+		{ProductID: 5, Location: "Lagos depot", State: "in stock"},
+		{ProductID: 8, Location: "Lagos depot", State: "in stock"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proposals, err := Propose(report, reconciler.StateAliases)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	corrections := []string{}
+	for _, proposal := range proposals {
+		if proposal.Status != PROPOSAL_PENDING {
+			t.Fatalf("proposal for product %d starts as %s", proposal.ProductID, proposal.Status)
+		}
+		corrections = append(corrections, fmt.Sprintf("%s%v expecting %s", proposal.Function, proposal.Args, proposal.Expected))
+	}
+
+	// Withheld, unreadable and missing products are left to the operator
+	expected := []string{
+		"UpdateProductState[2 3] expecting PRODUCT_TRANSIT",
+		"LogProductMovement[2 Lagos depot] expecting Accra depot",
+		"LogProductMovement[3 Lagos depot] expecting Tema port",
+	}
+	if !reflect.DeepEqual(corrections, expected) {
+		t.Fatalf("expected proposals %v, got %v", expected, corrections)
+	}
+}
+
+func TestApplyProposal(t *testing.T) {
+	stateProposal := Proposal{ProductID: 2, Category: DIFF_STATE_MISMATCH, Function: "UpdateProductState", Args: []string{"2", "3"}, Expected: "PRODUCT_TRANSIT", Status: PROPOSAL_PENDING}
+	locationProposal := Proposal{ProductID: 3, Category: DIFF_LOCATION_MISMATCH, Function: "LogProductMovement", Args: []string{"3", "Lagos depot"}, Expected: "Tema port", Status: PROPOSAL_PENDING}
+
+	tests := []struct {
+		name      string
+		proposal  Proposal
+		modify    func(ledger *fakeLedger)
+		confirm   bool
+		status    string
+		result    string
+		confirmed bool
+	}{
+		{name: "state corrected", proposal: stateProposal, confirm: true, status: PROPOSAL_APPLIED, confirmed: true},
+		{name: "location corrected", proposal: locationProposal, confirm: true, status: PROPOSAL_APPLIED, confirmed: true},
+		{name: "location differing only in case", proposal: locationProposal, modify: func(ledger *fakeLedger) {
+			ledger.products[3] = `{"id":3,"state":3,"location":"TEMA PORT","custodian":"Org2MSP"}`
+		}, confirm: true, status: PROPOSAL_APPLIED, confirmed: true},
+		{name: "declined", proposal: stateProposal, status: PROPOSAL_DECLINED, confirmed: true},
+		{name: "state changed since the report", proposal: stateProposal, modify: func(ledger *fakeLedger) {
+			ledger.products[2] = `{"id":2,"state":4,"location":"Accra depot","custodian":"Org2MSP"}`
+		}, confirm: true, status: PROPOSAL_STALE, result: `now has "PRODUCT_SOLD"`},
+		{name: "product moved since the report", proposal: locationProposal, modify: func(ledger *fakeLedger) {
+			ledger.products[3] = `{"id":3,"state":3,"location":"Lagos depot","custodian":"Org2MSP"}`
+		}, confirm: true, status: PROPOSAL_STALE, result: `now has "Lagos depot"`},
+		{name: "state withheld since the report", proposal: stateProposal, modify: func(ledger *fakeLedger) {
+			ledger.products[2] = `{"id":2}`
+		}, confirm: true, status: PROPOSAL_STALE, result: "no longer shows"},
+		{name: "product unreadable since the report", proposal: stateProposal, modify: func(ledger *fakeLedger) {
+			ledger.products[2] = ""
+		}, confirm: true, status: PROPOSAL_STALE, result: "can no longer be read"},
+		{name: "correction rejected", proposal: stateProposal, modify: func(ledger *fakeLedger) {
+			ledger.rejects = map[string]bool{"UpdateProductState": true}
+		}, confirm: true, status: PROPOSAL_FAILED, result: "UpdateProductState rejected", confirmed: true},
+		{name: "already decided", proposal: Proposal{ProductID: 2, Category: DIFF_STATE_MISMATCH, Expected: "PRODUCT_TRANSIT", Status: PROPOSAL_DECLINED}, confirm: true, status: PROPOSAL_DECLINED},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ledger := testLedger()
+			if test.modify != nil {
+				test.modify(ledger)
+			}
+
+			proposal := test.proposal
+			confirmed := false
+			err := testReconciler(ledger).ApplyProposal(&proposal, func(Proposal) (bool, error) {
+				confirmed = true
+				return test.confirm, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if proposal.Status != test.status || !strings.Contains(proposal.Result, test.result) {
+				t.Fatalf("expected %s with a result containing %q, got %s: %s", test.status, test.result, proposal.Status, proposal.Result)
+			}
+			if confirmed != test.confirmed {
+				t.Fatalf("expected the operator to be asked %t, got %t", test.confirmed, confirmed)
+			}
+
+			applied := len(ledger.submitted) > 0
+			if applied != (test.status == PROPOSAL_APPLIED) {
+				t.Fatalf("expected a correction to be submitted only when applied, got %v", ledger.submitted)
+			}
+			if applied && !reflect.DeepEqual(ledger.submitted[0], append([]string{proposal.Function}, proposal.Args...)) {
+				t.Fatalf("expected %s%v to be submitted, got %v", proposal.Function, proposal.Args, ledger.submitted[0])
+			}
+		})
+	}
+}
+
+func TestApplyProposalStopsWhenLedgerUnreachable(t *testing.T) {
+	proposal := Proposal{ProductID: 2, Category: DIFF_STATE_MISMATCH, Function: "UpdateProductState", Args: []string{"2", "3"}, Expected: "PRODUCT_TRANSIT", Status: PROPOSAL_PENDING}
+
+	err := testReconciler(&fakeLedger{}).ApplyProposal(&proposal, func(Proposal) (bool, error) {
+		return true, nil
+	})
+	if err == nil {
+		t.Fatal("applied a proposal without reaching the ledger")
+	}
+	if proposal.Status != PROPOSAL_PENDING {
+		t.Fatalf("expected the proposal to stay pending for a later run, got %s", proposal.Status)
+	}
+}
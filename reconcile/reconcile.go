@@ -0,0 +1,305 @@
+package reconcile
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/**
+*@dev difference categories
+*/
+
+const (
+	DIFF_MISSING_ON_LEDGER = "MISSING_ON_LEDGER"
+	DIFF_MISSING_IN_ERP    = "MISSING_IN_ERP"
+	DIFF_STATE_MISMATCH    = "STATE_MISMATCH"
+	DIFF_LOCATION_MISMATCH = "LOCATION_MISMATCH"
+	DIFF_UNREADABLE        = "UNREADABLE"
+	DIFF_WITHHELD          = "WITHHELD"
+)
+
+/**
+*@dev ContractClient() submits and evaluates transactions on the product details chaincode, as a gateway contract does
+*/
+
+type ContractClient interface {
+	SubmitTransaction(name string, args ...string) ([]byte, error)
+	EvaluateTransaction(name string, args ...string) ([]byte, error)
+}
+
+/**
+*@dev Product() is the part of the chaincode's Product that is reconciled
+*
+* The chaincode leaves out the fields it withholds from a data-sharing partner, so a field missing from the JSON is nil
+* here and its value is unknown. An empty location is left out too, but the location is shared along with the custodian,
+* so a product with a custodian and no location has never moved.
+*/
+
+type Product struct {
+	ID        uint64  `json:"id"`
+	State     *int    `json:"state,omitempty"`
+	Location  *string `json:"location,omitempty"`
+	Custodian string  `json:"custodian,omitempty"`
+}
+
+/**
+*@dev Difference() represents one way the ERP and the ledger disagree about a product
+*/
+
+type Difference struct {
+	Category  string   `json:"category"`
+	ProductID uint64   `json:"productId"`
+	ERP       *Record  `json:"erp,omitempty"`
+	Ledger    *Product `json:"ledger,omitempty"`
+	Detail    string   `json:"detail"`
+}
+
+/**
+*@dev Report() represents the outcome of reconciling an ERP export with the ledger
+*/
+
+type Report struct {
+	Custodian      string       `json:"custodian"`
+	ERPRecords     int          `json:"erpRecords"`
+	LedgerProducts int          `json:"ledgerProducts"`
+	Matched        int          `json:"matched"`
+	Differences    []Difference `json:"differences"`
+}
+
+/**
+*@dev Reconciler() compares ERP exports with the ledger and corrects the ledger where the operator agrees
+*
+* The ERP is the system of record, so corrections bring the ledger in line with it, never the other way round.
+*/
+
+type Reconciler struct {
+	Ledger ContractClient
+	// Custodian is the organisation the ERP keeps stock for; ledger products in its custody that the ERP lacks are reported
+	Custodian string
+	// StateAliases map ERP state terms to ProductState names
+	StateAliases map[string]string
+	// Scan reads every product on the ledger to find those missing from the ERP; otherwise only the ERP's products are read
+	Scan bool
+	// IsRejection reports whether an error means the chaincode rejected the transaction, rather than the ledger being unreachable
+	IsRejection func(error) bool
+}
+
+/**
+*@dev Compare() reads the ledger's view of the exported products and lists the differences, ordered by product
+*
+* Product IDs are issued in sequence and never reused, so an ID above the ledger's last one is missing and any other
+* ID the caller cannot read is unreadable. A product whose state or location the ledger withholds is neither matched
+* nor mismatched, but reported as withheld.
+*/
+
+func (r *Reconciler) Compare(records []Record) (*Report, error) {
+	erpStates := make(map[uint64]int)
+	for _, record := range records {
+		state, err := ParseState(record.State, r.StateAliases)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ERP state of product %d: %v", record.ProductID, err)
+		}
+		erpStates[record.ProductID] = state
+	}
+
+	lastProductID, err := r.readLastProductID()
+	if err != nil {
+		return nil, err
+	}
+
+	products := make(map[uint64]*Product)
+	unreadable := make(map[uint64]string)
+	read := func(productID uint64) error {
+		if productID == 0 || productID > lastProductID || products[productID] != nil || unreadable[productID] != "" {
+			return nil
+		}
+
+		product, err := r.readProduct(productID)
+		if err != nil {
+			if !r.rejected(err) {
+				return err
+			}
+			unreadable[productID] = err.Error()
+			return nil
+		}
+		products[productID] = product
+		return nil
+	}
+
+	if r.Scan {
+		for productID := uint64(1); productID <= lastProductID; productID++ {
+			err = read(productID)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, record := range records {
+		err = read(record.ProductID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	report := &Report{
+		Custodian:      r.Custodian,
+		ERPRecords:     len(records),
+		LedgerProducts: len(products),
+		Differences:    []Difference{},
+	}
+
+	inERP := make(map[uint64]bool)
+	for i := range records {
+		record := &records[i]
+		inERP[record.ProductID] = true
+		product := products[record.ProductID]
+
+		switch {
+		case unreadable[record.ProductID] != "":
+			report.Differences = append(report.Differences, Difference{
+				Category:  DIFF_UNREADABLE,
+				ProductID: record.ProductID,
+				ERP:       record,
+				Detail:    unreadable[record.ProductID],
+			})
+			continue
+		case product == nil:
+			report.Differences = append(report.Differences, Difference{
+				Category:  DIFF_MISSING_ON_LEDGER,
+				ProductID: record.ProductID,
+				ERP:       record,
+				Detail:    fmt.Sprintf("the ERP lists product %d but the ledger has no such product", record.ProductID),
+			})
+			continue
+		}
+
+		matched := true
+		switch {
+		case product.State == nil:
+			matched = false
+			report.Differences = append(report.Differences, Difference{
+				Category:  DIFF_WITHHELD,
+				ProductID: record.ProductID,
+				ERP:       record,
+				Ledger:    product,
+				Detail:    fmt.Sprintf("the ledger withholds the state of product %d, so the ERP's %s cannot be checked", record.ProductID, StateName(erpStates[record.ProductID])),
+			})
+		case erpStates[record.ProductID] != *product.State:
+			matched = false
+			report.Differences = append(report.Differences, Difference{
+				Category:  DIFF_STATE_MISMATCH,
+				ProductID: record.ProductID,
+				ERP:       record,
+				Ledger:    product,
+				Detail:    fmt.Sprintf("the ERP has %s, the ledger %s", StateName(erpStates[record.ProductID]), StateName(*product.State)),
+			})
+		}
+		switch {
+		case product.Location == nil && strings.TrimSpace(record.Location) != "":
+			matched = false
+			report.Differences = append(report.Differences, Difference{
+				Category:  DIFF_WITHHELD,
+				ProductID: record.ProductID,
+				ERP:       record,
+				Ledger:    product,
+				Detail:    fmt.Sprintf("the ledger withholds the location of product %d, or it predates custody records and has never moved, so the ERP's %q cannot be checked", record.ProductID, record.Location),
+			})
+		case product.Location != nil && !sameLocation(record.Location, *product.Location):
+			matched = false
+			report.Differences = append(report.Differences, Difference{
+				Category:  DIFF_LOCATION_MISMATCH,
+				ProductID: record.ProductID,
+				ERP:       record,
+				Ledger:    product,
+				Detail:    fmt.Sprintf("the ERP has %q, the ledger %q", record.Location, *product.Location),
+			})
+		}
+		if matched {
+			report.Matched++
+		}
+	}
+
+	for productID, product := range products {
+		if !inERP[productID] && product.Custodian == r.Custodian {
+			report.Differences = append(report.Differences, Difference{
+				Category:  DIFF_MISSING_IN_ERP,
+				ProductID: productID,
+				Ledger:    product,
+				Detail:    fmt.Sprintf("the ledger has product %d in the custody of %s but the ERP does not list it", productID, r.Custodian),
+			})
+		}
+	}
+
+	sort.SliceStable(report.Differences, func(i, j int) bool {
+		return report.Differences[i].ProductID < report.Differences[j].ProductID
+	})
+
+	return report, nil
+}
+
+/**
+*@dev Counts() tallies a report's differences by category
+*/
+
+func (report *Report) Counts() map[string]int {
+	counts := make(map[string]int)
+	for _, difference := range report.Differences {
+		counts[difference.Category]++
+	}
+	return counts
+}
+
+/**
+*@dev readLastProductID() reads the ID of the product registered last on the ledger
+*/
+
+func (r *Reconciler) readLastProductID() (uint64, error) {
+	lastBytes, err := r.Ledger.EvaluateTransaction("GetLastProductID")
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the last product ID from the ledger: %v", err)
+	}
+
+	lastProductID, err := strconv.ParseUint(strings.TrimSpace(string(lastBytes)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse the last product ID: %v", err)
+	}
+
+	return lastProductID, nil
+}
+
+/**
+*@dev readProduct() reads a product from the ledger; an error the chaincode rejected the read with is returned as it is
+*/
+
+func (r *Reconciler) readProduct(productID uint64) (*Product, error) {
+	productBytes, err := r.Ledger.EvaluateTransaction("RetrieveProductDetails", strconv.FormatUint(productID, 10))
+	if err != nil {
+		if r.rejected(err) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to read product %d from the ledger: %v", productID, err)
+	}
+
+	product := new(Product)
+	err = json.Unmarshal(productBytes, product)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal product JSON: %v", err)
+	}
+	if product.Location == nil && product.Custodian != "" {
+		product.Location = new(string)
+	}
+
+	return product, nil
+}
+
+func (r *Reconciler) rejected(err error) bool {
+	return r.IsRejection != nil && r.IsRejection(err)
+}
+
+func sameLocation(erpLocation string, ledgerLocation string) bool {
+	return strings.EqualFold(strings.TrimSpace(erpLocation), strings.TrimSpace(ledgerLocation))
+}
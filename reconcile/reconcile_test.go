@@ -0,0 +1,179 @@
+package reconcile
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+/**
+*@dev rejection() stands in for a transaction the chaincode rejected
+*/
+
+type rejection struct {
+	message string
+}
+
+func (r *rejection) Error() string {
+	return r.message
+}
+
+func isRejection(err error) bool {
+	var rejected *rejection
+	return errors.As(err, &rejected)
+}
+
+/**
+*@dev fakeLedger() serves products as the chaincode returns them to the reconciling organisation, and records corrections
+*
+* A product whose JSON is "" is rejected as unreadable; a nil products map makes the ledger unreachable.
+*/
+
+type fakeLedger struct {
+	lastProductID uint64
+	products      map[uint64]string
+	rejects       map[string]bool
+	submitted     [][]string
+}
+
+func (l *fakeLedger) SubmitTransaction(name string, args ...string) ([]byte, error) {
+	if l.rejects[name] {
+		return nil, &rejection{message: fmt.Sprintf("%s rejected", name)}
+	}
+	l.submitted = append(l.submitted, append([]string{name}, args...))
+	return nil, nil
+}
+
+func (l *fakeLedger) EvaluateTransaction(name string, args ...string) ([]byte, error) {
+	if l.products == nil {
+		return nil, fmt.Errorf("connection refused")
+	}
+
+	switch name {
+	case "GetLastProductID":
+		return []byte(strconv.FormatUint(l.lastProductID, 10)), nil
+	case "RetrieveProductDetails":
+		productID, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		product, ok := l.products[productID]
+		if !ok || product == "" {
+			return nil, &rejection{message: fmt.Sprintf("no data-sharing agreement covers product %d", productID)}
+		}
+		return []byte(product), nil
+	}
+	return nil, fmt.Errorf("unexpected transaction %s", name)
+}
+
+/**
+*@dev testLedger() holds one product for each way a product can compare with the ERP
+*/
+
+func testLedger() *fakeLedger {
+	return &fakeLedger{
+		lastProductID: 7,
+		products: map[uint64]string{
+			1: `{"id":1,"state":3,"location":"kano store ","custodian":"Org1MSP"}`,
+			2: `{"id":2,"state":2,"location":"Accra depot","custodian":"Org2MSP"}`,
+			3: `{"id":3,"state":3,"location":"Tema port","custodian":"Org2MSP"}`,
+			4: `{"id":4}`,
+			5: "",
+			6: `{"id":6,"state":3,"location":"Kano store","custodian":"Org1MSP"}`,
+			7: `{"id":7,"state":0,"custodian":"Org2MSP"}`,
+		},
+	}
+}
+
+func testReconciler(ledger *fakeLedger) *Reconciler {
+	return &Reconciler{
+		Ledger:       ledger,
+		Custodian:    "Org1MSP",
+		StateAliases: map[string]string{"in stock": "PRODUCT_IN_INVENTORY"},
+		IsRejection:  isRejection,
+	}
+}
+
+func TestCompare(t *testing.T) {
+	type found struct {
+		category  string
+		productID uint64
+	}
+
+	tests := []struct {
+		name        string
+		records     []Record
+		scan        bool
+		matched     int
+		differences []found
+	}{
+		{name: "matching product", records: []Record{{ProductID: 1, Location: "Kano Store", State: "in stock"}}, matched: 1},
+		{name: "product that has never moved", records: []Record{{ProductID: 7, State: "0"}}, matched: 1},
+		{name: "missing on ledger", records: []Record{{ProductID: 8, Location: "Kano store", State: "in stock"}},
+			differences: []found{{DIFF_MISSING_ON_LEDGER, 8}}},
+		{name: "missing in ERP", records: []Record{{ProductID: 1, Location: "Kano store", State: "in stock"}}, scan: true, matched: 1,
+			differences: []found{{DIFF_MISSING_IN_ERP, 6}}},
+		{name: "state mismatch", records: []Record{{ProductID: 2, Location: "Accra depot", State: "in stock"}},
+			differences: []found{{DIFF_STATE_MISMATCH, 2}}},
+		{name: "location mismatch", records: []Record{{ProductID: 3, Location: "Lagos depot", State: "PRODUCT_IN_INVENTORY"}},
+			differences: []found{{DIFF_LOCATION_MISMATCH, 3}}},
+		{name: "state and location mismatch", records: []Record{{ProductID: 2, Location: "Lagos depot", State: "in stock"}},
+			differences: []found{{DIFF_STATE_MISMATCH, 2}, {DIFF_LOCATION_MISMATCH, 2}}},
+		{name: "withheld state and location", records: []Record{{ProductID: 4, Location: "Lagos depot", State: "in stock"}},
+			differences: []found{{DIFF_WITHHELD, 4}, {DIFF_WITHHELD, 4}}},
+		{name: "unreadable", records: []Record{{ProductID: 5, Location: "Lagos depot", State: "in stock"}},
+			differences: []found{{DIFF_UNREADABLE, 5}}},
+		{name: "ordered by product", records: []Record{{ProductID: 8, State: "in stock"}, {ProductID: 3, Location: "Lagos depot", State: "in stock"}, {ProductID: 1, Location: "Kano store", State: "in stock"}}, scan: true, matched: 1,
+			differences: []found{{DIFF_LOCATION_MISMATCH, 3}, {DIFF_MISSING_IN_ERP, 6}, {DIFF_MISSING_ON_LEDGER, 8}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reconciler := testReconciler(testLedger())
+			reconciler.Scan = test.scan
+
+			report, err := reconciler.Compare(test.records)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			differences := []found{}
+			for _, difference := range report.Differences {
+				differences = append(differences, found{difference.Category, difference.ProductID})
+			}
+			if test.differences == nil {
+				test.differences = []found{}
+			}
+			if !reflect.DeepEqual(differences, test.differences) {
+				t.Fatalf("expected differences %v, got %+v", test.differences, report.Differences)
+			}
+			if report.Matched != test.matched {
+				t.Fatalf("expected %d matched products, got %d", test.matched, report.Matched)
+			}
+		})
+	}
+}
+
+func TestCompareFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		ledger  *fakeLedger
+		records []Record
+		err     string
+	}{
+		{name: "unknown ERP state", ledger: testLedger(), records: []Record{{ProductID: 1, State: "on the shelf"}}, err: "unknown product state"},
+		{name: "unreachable ledger", ledger: &fakeLedger{}, records: []Record{{ProductID: 1, State: "in stock"}}, err: "connection refused"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := testReconciler(test.ledger).Compare(test.records)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
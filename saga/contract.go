@@ -0,0 +1,423 @@
+package saga
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+/**
+*@dev CONTRACT_NAME is the name the saga log is registered under; its transactions are invoked as saga:<function>
+*/
+
+const CONTRACT_NAME = "saga"
+
+/**
+*@dev SagaStatus() represents how far a saga has run forward or been rolled back
+*/
+
+type SagaStatus int
+
+const (
+	SAGA_RUNNING SagaStatus = iota
+	SAGA_COMPLETED
+	SAGA_COMPENSATING
+	SAGA_COMPENSATED
+)
+
+/**
+*@dev StepStatus() represents the state of one saga step
+*
+* A started step has a recorded intent but no outcome, so it may or may not have run on its chaincode.
+*/
+
+type StepStatus int
+
+const (
+	STEP_PENDING StepStatus = iota
+	STEP_STARTED
+	STEP_SUCCEEDED
+	STEP_FAILED
+	STEP_COMPENSATING
+	STEP_COMPENSATED
+)
+
+/**
+*@dev Action() represents a transaction on a chaincode, possibly on another channel
+*/
+
+type Action struct {
+	Channel   string   `json:"channel"`
+	Chaincode string   `json:"chaincode"`
+	Function  string   `json:"function"`
+	Args      []string `json:"args"`
+}
+
+/**
+*@dev Step() represents one step of a saga, the action that undoes it and what has been recorded about both
+*
+* BeginSaga only reads the name and actions; the rest is recorded as the saga runs.
+*/
+
+type Step struct {
+	Name                 string     `json:"name"`
+	Action               Action     `json:"action"`
+	Compensation         *Action    `json:"compensation,omitempty" metadata:",optional"`
+	Status               StepStatus `json:"status" metadata:",optional"`
+	Attempts             uint64     `json:"attempts" metadata:",optional"`
+	CompensationAttempts uint64     `json:"compensationAttempts" metadata:",optional"`
+	Result               string     `json:"result,omitempty" metadata:",optional"`
+	Error                string     `json:"error,omitempty" metadata:",optional"`
+	UpdatedAt            uint64     `json:"updatedAt" metadata:",optional"`
+}
+
+/**
+*@dev Saga() represents a business operation spanning several chaincodes, recorded step by step
+*/
+
+type Saga struct {
+	ID          string     `json:"id"`
+	Initiator   string     `json:"initiator"`
+	Status      SagaStatus `json:"status"`
+	Steps       []Step     `json:"steps"`
+	AbortReason string     `json:"abortReason,omitempty" metadata:",optional"`
+	CreatedAt   uint64     `json:"createdAt"`
+	UpdatedAt   uint64     `json:"updatedAt"`
+}
+
+/**
+*@dev Contract() is the on-ledger saga log; add it to a chaincode next to its own contract
+*/
+
+type Contract struct {
+	contractapi.Contract
+}
+
+func NewContract() *Contract {
+	contract := new(Contract)
+	contract.Name = CONTRACT_NAME
+	return contract
+}
+
+/**
+*@dev BeginSaga() records a new saga and its steps; only the initiating organisation can record its progress
+*/
+
+func (c *Contract) BeginSaga(ctx contractapi.TransactionContextInterface, sagaID string, steps []Step) error {
+	if sagaID == "" {
+		return fmt.Errorf("saga ID is required")
+	}
+	if len(steps) == 0 {
+		return fmt.Errorf("a saga needs at least one step")
+	}
+
+	existingBytes, err := ctx.GetStub().GetState(sagaKey(sagaID))
+	if err != nil {
+		return fmt.Errorf("failed to read saga from the ledger: %v", err)
+	}
+	if existingBytes != nil {
+		return fmt.Errorf("saga %s already exists", sagaID)
+	}
+
+	initiator, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+
+	timestamp, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	recorded := make([]Step, len(steps))
+	for i, step := range steps {
+		if step.Name == "" || step.Action.Chaincode == "" || step.Action.Function == "" {
+			return fmt.Errorf("step %d needs a name, a chaincode and a function", i)
+		}
+		recorded[i] = Step{
+			Name:         step.Name,
+			Action:       step.Action,
+			Compensation: step.Compensation,
+			Status:       STEP_PENDING,
+			UpdatedAt:    timestamp,
+		}
+	}
+
+	return putSaga(ctx, &Saga{
+		ID:        sagaID,
+		Initiator: initiator,
+		Status:    SAGA_RUNNING,
+		Steps:     recorded,
+		CreatedAt: timestamp,
+		UpdatedAt: timestamp,
+	})
+}
+
+/**
+*@dev RecordStepIntent() records that the next step is about to be submitted; a failed or unanswered step may be retried
+*/
+
+func (c *Contract) RecordStepIntent(ctx contractapi.TransactionContextInterface, sagaID string, step int) error {
+	saga, err := retrieveInitiatedSaga(ctx, sagaID)
+	if err != nil {
+		return err
+	}
+	if saga.Status != SAGA_RUNNING {
+		return fmt.Errorf("saga %s is not running", sagaID)
+	}
+	if step != NextStep(saga) {
+		return fmt.Errorf("step %d of saga %s is not the next step", step, sagaID)
+	}
+
+	saga.Steps[step].Status = STEP_STARTED
+	saga.Steps[step].Attempts++
+	saga.Steps[step].Error = ""
+	return updateSaga(ctx, saga, step)
+}
+
+/**
+*@dev RecordStepOutcome() records whether a started step succeeded; the saga completes with its last step
+*
+* Only report a failure when the chaincode rejected the transaction. If the outcome is unknown, leave the step started.
+* An outcome that arrives after the saga was aborted is refused, and its step, still started, is compensated.
+*/
+
+func (c *Contract) RecordStepOutcome(ctx contractapi.TransactionContextInterface, sagaID string, step int, succeeded bool, detail string) error {
+	saga, err := retrieveInitiatedSaga(ctx, sagaID)
+	if err != nil {
+		return err
+	}
+	if saga.Status != SAGA_RUNNING {
+		return fmt.Errorf("saga %s is not running", sagaID)
+	}
+	if step < 0 || step >= len(saga.Steps) || saga.Steps[step].Status != STEP_STARTED {
+		return fmt.Errorf("step %d of saga %s has not been started", step, sagaID)
+	}
+
+	if succeeded {
+		saga.Steps[step].Status = STEP_SUCCEEDED
+		saga.Steps[step].Result = detail
+		if step == len(saga.Steps)-1 {
+			saga.Status = SAGA_COMPLETED
+		}
+	} else {
+		saga.Steps[step].Status = STEP_FAILED
+		saga.Steps[step].Error = detail
+	}
+
+	return updateSaga(ctx, saga, step)
+}
+
+/**
+*@dev AbortSaga() stops a running saga so that its steps are compensated in reverse order
+*/
+
+func (c *Contract) AbortSaga(ctx contractapi.TransactionContextInterface, sagaID string, reason string) error {
+	saga, err := retrieveInitiatedSaga(ctx, sagaID)
+	if err != nil {
+		return err
+	}
+	if saga.Status != SAGA_RUNNING {
+		return fmt.Errorf("saga %s is not running", sagaID)
+	}
+
+	saga.Status = SAGA_COMPENSATING
+	saga.AbortReason = reason
+	if NextCompensation(saga) == -1 {
+		saga.Status = SAGA_COMPENSATED
+	}
+
+	return updateSaga(ctx, saga, -1)
+}
+
+/**
+*@dev RecordCompensationIntent() records that the next step to undo is about to be compensated
+*/
+
+func (c *Contract) RecordCompensationIntent(ctx contractapi.TransactionContextInterface, sagaID string, step int) error {
+	saga, err := retrieveInitiatedSaga(ctx, sagaID)
+	if err != nil {
+		return err
+	}
+	if saga.Status != SAGA_COMPENSATING {
+		return fmt.Errorf("saga %s is not being compensated", sagaID)
+	}
+	if step != NextCompensation(saga) {
+		return fmt.Errorf("step %d of saga %s is not the next step to compensate", step, sagaID)
+	}
+
+	saga.Steps[step].Status = STEP_COMPENSATING
+	saga.Steps[step].CompensationAttempts++
+	saga.Steps[step].Error = ""
+	return updateSaga(ctx, saga, step)
+}
+
+/**
+*@dev RecordCompensationOutcome() records whether a compensation succeeded; a failed one stays due and is retried
+*/
+
+func (c *Contract) RecordCompensationOutcome(ctx contractapi.TransactionContextInterface, sagaID string, step int, succeeded bool, detail string) error {
+	saga, err := retrieveInitiatedSaga(ctx, sagaID)
+	if err != nil {
+		return err
+	}
+	if step < 0 || step >= len(saga.Steps) || saga.Steps[step].Status != STEP_COMPENSATING {
+		return fmt.Errorf("compensation of step %d of saga %s has not been started", step, sagaID)
+	}
+
+	if succeeded {
+		saga.Steps[step].Status = STEP_COMPENSATED
+		saga.Steps[step].Result = detail
+		if NextCompensation(saga) == -1 {
+			saga.Status = SAGA_COMPENSATED
+		}
+	} else {
+		saga.Steps[step].Error = detail
+	}
+
+	return updateSaga(ctx, saga, step)
+}
+
+/**
+*@dev GetSaga() retrieves a saga
+*/
+
+func (c *Contract) GetSaga(ctx contractapi.TransactionContextInterface, sagaID string) (*Saga, error) {
+	return retrieveSaga(ctx, sagaID)
+}
+
+/**
+*@dev GetActiveSagas() retrieves every saga still running or being compensated, for a driver to resume
+*/
+
+func (c *Contract) GetActiveSagas(ctx contractapi.TransactionContextInterface) ([]*Saga, error) {
+	iterator, err := ctx.GetStub().GetStateByRange("SAGA-", "SAGA-~")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sagas from the ledger: %v", err)
+	}
+	defer iterator.Close()
+
+	sagas := []*Saga{}
+	for iterator.HasNext() {
+		result, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read saga from the ledger: %v", err)
+		}
+
+		saga := new(Saga)
+		err = json.Unmarshal(result.Value, saga)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal saga JSON: %v", err)
+		}
+		if saga.Status == SAGA_RUNNING || saga.Status == SAGA_COMPENSATING {
+			sagas = append(sagas, saga)
+		}
+	}
+
+	return sagas, nil
+}
+
+/**
+*@dev NextStep() returns the index of the first step that has not succeeded
+*/
+
+func NextStep(saga *Saga) int {
+	for i, step := range saga.Steps {
+		if step.Status != STEP_SUCCEEDED {
+			return i
+		}
+	}
+	return -1
+}
+
+/**
+*@dev NextCompensation() returns the index of the latest step that may have run and is not yet compensated, or -1
+*
+* Failed steps were rejected by their chaincode and have nothing to undo; started steps might have run.
+*/
+
+func NextCompensation(saga *Saga) int {
+	for i := len(saga.Steps) - 1; i >= 0; i-- {
+		switch saga.Steps[i].Status {
+		case STEP_STARTED, STEP_SUCCEEDED, STEP_COMPENSATING:
+			return i
+		}
+	}
+	return -1
+}
+
+func retrieveSaga(ctx contractapi.TransactionContextInterface, sagaID string) (*Saga, error) {
+	sagaBytes, err := ctx.GetStub().GetState(sagaKey(sagaID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read saga from the ledger: %v", err)
+	}
+	if sagaBytes == nil {
+		return nil, fmt.Errorf("saga %s does not exist", sagaID)
+	}
+
+	saga := new(Saga)
+	err = json.Unmarshal(sagaBytes, saga)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal saga JSON: %v", err)
+	}
+
+	return saga, nil
+}
+
+func retrieveInitiatedSaga(ctx contractapi.TransactionContextInterface, sagaID string) (*Saga, error) {
+	saga, err := retrieveSaga(ctx, sagaID)
+	if err != nil {
+		return nil, err
+	}
+
+	caller, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read submitter identity: %v", err)
+	}
+	if caller != saga.Initiator {
+		return nil, fmt.Errorf("only %s can record the progress of saga %s", saga.Initiator, sagaID)
+	}
+
+	return saga, nil
+}
+
+func updateSaga(ctx contractapi.TransactionContextInterface, saga *Saga, step int) error {
+	timestamp, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	saga.UpdatedAt = timestamp
+	if step >= 0 {
+		saga.Steps[step].UpdatedAt = timestamp
+	}
+
+	return putSaga(ctx, saga)
+}
+
+func putSaga(ctx contractapi.TransactionContextInterface, saga *Saga) error {
+	sagaBytes, err := json.Marshal(saga)
+	if err != nil {
+		return fmt.Errorf("failed to marshal saga JSON: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(sagaKey(saga.ID), sagaBytes)
+	if err != nil {
+		return fmt.Errorf("failed to put saga on the ledger: %v", err)
+	}
+
+	return nil
+}
+
+func txTimestamp(ctx contractapi.TransactionContextInterface) (uint64, error) {
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+	return uint64(timestamp.GetSeconds()), nil
+}
+
+func sagaKey(sagaID string) string {
+	return fmt.Sprintf("SAGA-%s", sagaID)
+}
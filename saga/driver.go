@@ -0,0 +1,232 @@
+package saga
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+/**
+*@dev ContractClient() submits and evaluates transactions on one chaincode, as a gateway contract does
+*/
+
+type ContractClient interface {
+	SubmitTransaction(name string, args ...string) ([]byte, error)
+	EvaluateTransaction(name string, args ...string) ([]byte, error)
+}
+
+/**
+*@dev Driver() runs sagas forward and rolls them back off-chain, recording every step in the saga log
+*
+* Actions and compensations must be idempotent: after a crash or a lost answer the driver cannot tell whether a
+* started step ran, so it submits the step again or, when rolling back, compensates it anyway.
+*/
+
+type Driver struct {
+	// Log is the chaincode hosting the saga contract
+	Log ContractClient
+	// Targets are the chaincodes steps run on, keyed by TargetKey(channel, chaincode)
+	Targets map[string]ContractClient
+	// MaxAttempts is how often an action is submitted before the saga is rolled back, or a compensation before the driver gives up for now
+	MaxAttempts  int
+	RetryBackoff time.Duration
+	// IsRejection reports whether an error means the chaincode rejected the transaction, so it did not commit
+	IsRejection func(error) bool
+}
+
+func TargetKey(channel string, chaincode string) string {
+	return channel + "/" + chaincode
+}
+
+/**
+*@dev Start() records a new saga and runs it to completion or rollback
+*/
+
+func (d *Driver) Start(sagaID string, steps []Step) (*Saga, error) {
+	stepsBytes, err := json.Marshal(steps)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal saga steps JSON: %v", err)
+	}
+
+	_, err = d.Log.SubmitTransaction(logFunction("BeginSaga"), sagaID, string(stepsBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin saga %s: %v", sagaID, err)
+	}
+
+	return d.Advance(sagaID)
+}
+
+/**
+*@dev Advance() continues a saga from whatever its log records until it has completed or been compensated
+*
+* A compensation that keeps failing leaves the saga compensating and returns an error; Recover picks it up later.
+*/
+
+func (d *Driver) Advance(sagaID string) (*Saga, error) {
+	attempts := make(map[string]int)
+	for {
+		saga, err := d.GetSaga(sagaID)
+		if err != nil {
+			return nil, err
+		}
+
+		switch saga.Status {
+		case SAGA_COMPLETED, SAGA_COMPENSATED:
+			return saga, nil
+		case SAGA_RUNNING:
+			err = d.runStep(saga, NextStep(saga), attempts)
+		case SAGA_COMPENSATING:
+			err = d.compensateStep(saga, NextCompensation(saga), attempts)
+		default:
+			err = fmt.Errorf("saga %s has unknown status %d", sagaID, saga.Status)
+		}
+		if err != nil {
+			return saga, err
+		}
+	}
+}
+
+/**
+*@dev Recover() advances every saga left running or compensating, e.g. after the driver restarts
+*/
+
+func (d *Driver) Recover() error {
+	sagasBytes, err := d.Log.EvaluateTransaction(logFunction("GetActiveSagas"))
+	if err != nil {
+		return fmt.Errorf("failed to read active sagas: %v", err)
+	}
+
+	var sagas []*Saga
+	err = json.Unmarshal(sagasBytes, &sagas)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal sagas JSON: %v", err)
+	}
+
+	failed := 0
+	for _, saga := range sagas {
+		_, err = d.Advance(saga.ID)
+		if err != nil {
+			log.Printf("saga %s: %v", saga.ID, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d sagas could not be finished", failed, len(sagas))
+	}
+
+	return nil
+}
+
+/**
+*@dev GetSaga() reads a saga from the log
+*/
+
+func (d *Driver) GetSaga(sagaID string) (*Saga, error) {
+	sagaBytes, err := d.Log.EvaluateTransaction(logFunction("GetSaga"), sagaID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read saga %s: %v", sagaID, err)
+	}
+
+	saga := new(Saga)
+	err = json.Unmarshal(sagaBytes, saga)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal saga JSON: %v", err)
+	}
+
+	return saga, nil
+}
+
+/**
+*@dev runStep() submits one forward step, or aborts the saga once the step has used up its attempts
+*/
+
+func (d *Driver) runStep(saga *Saga, index int, attempts map[string]int) error {
+	step := saga.Steps[index]
+	key := fmt.Sprintf("step-%d", index)
+	if attempts[key] >= d.maxAttempts() {
+		return d.record("AbortSaga", saga.ID, fmt.Sprintf("step %s failed after %d attempts: %s", step.Name, attempts[key], step.Error))
+	}
+	if attempts[key] > 0 {
+		time.Sleep(d.RetryBackoff)
+	}
+	attempts[key]++
+
+	err := d.record("RecordStepIntent", saga.ID, strconv.Itoa(index))
+	if err != nil {
+		return err
+	}
+
+	result, err := d.submit(step.Action)
+	if err == nil {
+		return d.record("RecordStepOutcome", saga.ID, strconv.Itoa(index), "true", string(result))
+	}
+	if d.IsRejection != nil && d.IsRejection(err) {
+		return d.record("RecordStepOutcome", saga.ID, strconv.Itoa(index), "false", err.Error())
+	}
+
+	// The step may have committed, so it stays started and is either retried or compensated
+	log.Printf("saga %s: step %s has no outcome: %v", saga.ID, step.Name, err)
+	return nil
+}
+
+/**
+*@dev compensateStep() submits the compensation of one step; a step without one is recorded as compensated
+*/
+
+func (d *Driver) compensateStep(saga *Saga, index int, attempts map[string]int) error {
+	step := saga.Steps[index]
+	key := fmt.Sprintf("compensation-%d", index)
+	if attempts[key] >= d.maxAttempts() {
+		return fmt.Errorf("compensation of step %s failed after %d attempts: %s", step.Name, attempts[key], step.Error)
+	}
+	if attempts[key] > 0 {
+		time.Sleep(d.RetryBackoff)
+	}
+	attempts[key]++
+
+	err := d.record("RecordCompensationIntent", saga.ID, strconv.Itoa(index))
+	if err != nil {
+		return err
+	}
+
+	if step.Compensation == nil {
+		return d.record("RecordCompensationOutcome", saga.ID, strconv.Itoa(index), "true", "no compensation defined")
+	}
+
+	result, err := d.submit(*step.Compensation)
+	if err != nil {
+		return d.record("RecordCompensationOutcome", saga.ID, strconv.Itoa(index), "false", err.Error())
+	}
+
+	return d.record("RecordCompensationOutcome", saga.ID, strconv.Itoa(index), "true", string(result))
+}
+
+func (d *Driver) submit(action Action) ([]byte, error) {
+	target, ok := d.Targets[TargetKey(action.Channel, action.Chaincode)]
+	if !ok {
+		return nil, fmt.Errorf("no connection to chaincode %s on channel %s", action.Chaincode, action.Channel)
+	}
+
+	return target.SubmitTransaction(action.Function, action.Args...)
+}
+
+func (d *Driver) record(function string, args ...string) error {
+	_, err := d.Log.SubmitTransaction(logFunction(function), args...)
+	if err != nil {
+		return fmt.Errorf("failed to record %s in the saga log: %v", function, err)
+	}
+	return nil
+}
+
+func (d *Driver) maxAttempts() int {
+	if d.MaxAttempts <= 0 {
+		return 3
+	}
+	return d.MaxAttempts
+}
+
+func logFunction(function string) string {
+	return CONTRACT_NAME + ":" + function
+}
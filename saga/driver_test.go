@@ -0,0 +1,463 @@
+package saga_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"Quanta-Ledger/devpeer"
+	"Quanta-Ledger/saga"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// The driver runs against fake chaincodes, each on its own in-process peer
+
+var driverIdentity = devpeer.Identity{MSPID: "Org1MSP"}
+
+/**
+*@dev network() is one test's saga log and fake chaincodes, with clients that can be made to fail
+*/
+
+type network struct {
+	log       *devpeer.LocalClient
+	payments  *flakyClient
+	logistics *flakyClient
+}
+
+/**
+*@dev flakyClient() loses the answer to the next failures submissions of a function, after the transaction has committed
+* when committed is set, as a dropped gateway connection would
+*/
+
+type flakyClient struct {
+	*devpeer.LocalClient
+	failures  map[string]int
+	committed bool
+}
+
+func (c *flakyClient) SubmitTransaction(name string, args ...string) ([]byte, error) {
+	if c.failures[name] == 0 {
+		return c.LocalClient.SubmitTransaction(name, args...)
+	}
+	c.failures[name]--
+
+	if c.committed {
+		_, err := c.LocalClient.SubmitTransaction(name, args...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("connection lost while submitting %s", name)
+}
+
+func newNetwork(t *testing.T) *network {
+	t.Helper()
+
+	return &network{
+		log:       &devpeer.LocalClient{Peer: newPeer(t, saga.NewContract()), Identity: driverIdentity},
+		payments:  &flakyClient{LocalClient: &devpeer.LocalClient{Peer: newPeer(t, new(PaymentsContract)), Identity: driverIdentity}, failures: map[string]int{}},
+		logistics: &flakyClient{LocalClient: &devpeer.LocalClient{Peer: newPeer(t, new(LogisticsContract)), Identity: driverIdentity}, failures: map[string]int{}},
+	}
+}
+
+func newPeer(t *testing.T, contract contractapi.ContractInterface) *devpeer.Peer {
+	t.Helper()
+
+	chaincode, err := contractapi.NewChaincode(contract)
+	if err != nil {
+		t.Fatalf("failed to create chaincode: %v", err)
+	}
+
+	peer, err := devpeer.NewPeer(chaincode, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return peer
+}
+
+func (n *network) driver() *saga.Driver {
+	return &saga.Driver{
+		Log: n.log,
+		Targets: map[string]saga.ContractClient{
+			saga.TargetKey("payments-channel", "payments"):   n.payments,
+			saga.TargetKey("logistics-channel", "logistics"): n.logistics,
+		},
+		MaxAttempts: 3,
+		IsRejection: func(err error) bool {
+			var rejection *devpeer.TransactionError
+			return errors.As(err, &rejection)
+		},
+	}
+}
+
+/**
+*@dev orderSteps() charges for an order and books its shipment, refunding and cancelling on rollback
+*/
+
+func orderSteps(orderID string, destination string) []saga.Step {
+	return []saga.Step{
+		{
+			Name:         "charge",
+			Action:       saga.Action{Channel: "payments-channel", Chaincode: "payments", Function: "Charge", Args: []string{orderID, "250"}},
+			Compensation: &saga.Action{Channel: "payments-channel", Chaincode: "payments", Function: "Refund", Args: []string{orderID}},
+		},
+		{
+			Name:         "ship",
+			Action:       saga.Action{Channel: "logistics-channel", Chaincode: "logistics", Function: "BookShipment", Args: []string{orderID, destination}},
+			Compensation: &saga.Action{Channel: "logistics-channel", Chaincode: "logistics", Function: "CancelShipment", Args: []string{orderID}},
+		},
+		{
+			Name:   "notify",
+			Action: saga.Action{Channel: "payments-channel", Chaincode: "payments", Function: "GetPayment", Args: []string{orderID}},
+		},
+	}
+}
+
+func TestDriverCompletesHappyPath(t *testing.T) {
+	n := newNetwork(t)
+
+	s, err := n.driver().Start("order-1", orderSteps("order-1", "Lagos"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectSaga(t, s, saga.SAGA_COMPLETED, saga.STEP_SUCCEEDED, saga.STEP_SUCCEEDED, saga.STEP_SUCCEEDED)
+	expectPayment(t, n, "order-1", "charged")
+	expectShipment(t, n, "order-1", "booked")
+}
+
+func TestDriverCompensatesRejectedStep(t *testing.T) {
+	n := newNetwork(t)
+
+	s, err := n.driver().Start("order-2", orderSteps("order-2", "nowhere"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectSaga(t, s, saga.SAGA_COMPENSATED, saga.STEP_COMPENSATED, saga.STEP_FAILED, saga.STEP_PENDING)
+	if s.AbortReason == "" {
+		t.Fatal("saga was compensated without an abort reason")
+	}
+	expectPayment(t, n, "order-2", "refunded")
+}
+
+func TestDriverRetriesLostAnswer(t *testing.T) {
+	n := newNetwork(t)
+	n.logistics.committed = true
+	n.logistics.failures["BookShipment"] = 2
+
+	s, err := n.driver().Start("order-3", orderSteps("order-3", "Accra"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectSaga(t, s, saga.SAGA_COMPLETED, saga.STEP_SUCCEEDED, saga.STEP_SUCCEEDED, saga.STEP_SUCCEEDED)
+	if s.Steps[1].Attempts != 3 {
+		t.Fatalf("shipment step was attempted %d times, expected 3", s.Steps[1].Attempts)
+	}
+	expectShipment(t, n, "order-3", "booked")
+}
+
+func TestDriverRecoversCrashedDriver(t *testing.T) {
+	n := newNetwork(t)
+
+	// The driver records its intent and submits the charge, then dies before recording the outcome
+	stepsBytes, err := json.Marshal(orderSteps("order-4", "Nairobi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = n.log.SubmitTransaction("saga:BeginSaga", "order-4", string(stepsBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = n.log.SubmitTransaction("saga:RecordStepIntent", "order-4", strconv.Itoa(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = n.payments.SubmitTransaction("Charge", "order-4", "250")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	driver := n.driver()
+	err = driver.Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := driver.GetSaga("order-4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSaga(t, s, saga.SAGA_COMPLETED, saga.STEP_SUCCEEDED, saga.STEP_SUCCEEDED, saga.STEP_SUCCEEDED)
+	expectPayment(t, n, "order-4", "charged")
+}
+
+func TestDriverResumesFailingCompensation(t *testing.T) {
+	n := newNetwork(t)
+	n.payments.failures["Refund"] = 3
+
+	driver := n.driver()
+	s, err := driver.Start("order-5", orderSteps("order-5", "nowhere"))
+	if err == nil {
+		t.Fatal("driver finished a saga whose compensation kept failing")
+	}
+	expectSaga(t, s, saga.SAGA_COMPENSATING, saga.STEP_COMPENSATING, saga.STEP_FAILED, saga.STEP_PENDING)
+	expectPayment(t, n, "order-5", "charged")
+
+	// The payments chaincode is reachable again when the driver next recovers
+	err = driver.Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = driver.GetSaga("order-5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSaga(t, s, saga.SAGA_COMPENSATED, saga.STEP_COMPENSATED, saga.STEP_FAILED, saga.STEP_PENDING)
+	expectPayment(t, n, "order-5", "refunded")
+}
+
+func TestLogRefusesOutcomeAfterAbort(t *testing.T) {
+	n := newNetwork(t)
+
+	stepsBytes, err := json.Marshal(orderSteps("order-6", "Dakar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = n.log.SubmitTransaction("saga:BeginSaga", "order-6", string(stepsBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for step := 0; step < 3; step++ {
+		_, err = n.log.SubmitTransaction("saga:RecordStepIntent", "order-6", strconv.Itoa(step))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if step < 2 {
+			_, err = n.log.SubmitTransaction("saga:RecordStepOutcome", "order-6", strconv.Itoa(step), "true", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// The saga is aborted while its last step has no outcome, and the outcome then arrives
+	_, err = n.log.SubmitTransaction("saga:AbortSaga", "order-6", "operator cancelled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = n.log.SubmitTransaction("saga:RecordStepOutcome", "order-6", "2", "true", "")
+	if err == nil {
+		t.Fatal("a step outcome was recorded after the saga was aborted")
+	}
+
+	s, err := n.driver().GetSaga("order-6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSaga(t, s, saga.SAGA_COMPENSATING, saga.STEP_SUCCEEDED, saga.STEP_SUCCEEDED, saga.STEP_STARTED)
+}
+
+func expectSaga(t *testing.T, s *saga.Saga, status saga.SagaStatus, steps ...saga.StepStatus) {
+	t.Helper()
+
+	if s == nil {
+		t.Fatal("no saga returned")
+	}
+	if s.Status != status {
+		t.Fatalf("saga %s has status %d, expected %d", s.ID, s.Status, status)
+	}
+	for i, expected := range steps {
+		if s.Steps[i].Status != expected {
+			t.Fatalf("step %s has status %d, expected %d", s.Steps[i].Name, s.Steps[i].Status, expected)
+		}
+	}
+}
+
+func expectPayment(t *testing.T, n *network, paymentID string, status string) {
+	t.Helper()
+
+	var payment Payment
+	evaluate(t, n.payments.LocalClient, &payment, "GetPayment", paymentID)
+	if payment.Status != status {
+		t.Fatalf("payment %s is %q, expected %q", paymentID, payment.Status, status)
+	}
+}
+
+func expectShipment(t *testing.T, n *network, shipmentID string, status string) {
+	t.Helper()
+
+	var shipment Shipment
+	evaluate(t, n.logistics.LocalClient, &shipment, "GetShipment", shipmentID)
+	if shipment.Status != status {
+		t.Fatalf("shipment %s is %q, expected %q", shipmentID, shipment.Status, status)
+	}
+}
+
+func evaluate(t *testing.T, client *devpeer.LocalClient, value interface{}, function string, args ...string) {
+	t.Helper()
+
+	valueBytes, err := client.EvaluateTransaction(function, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(valueBytes) == 0 {
+		return
+	}
+
+	err = json.Unmarshal(valueBytes, value)
+	if err != nil {
+		t.Fatalf("failed to unmarshal %s JSON: %v", function, err)
+	}
+}
+
+/**
+*@dev Payment() represents a charge held by the fake payments chaincode
+*/
+
+type Payment struct {
+	ID     string `json:"id"`
+	Amount int    `json:"amount"`
+	Status string `json:"status"`
+}
+
+/**
+*@dev PaymentsContract() stands in for the payments chaincode on another channel; both transactions are idempotent
+*/
+
+type PaymentsContract struct {
+	contractapi.Contract
+}
+
+func (c *PaymentsContract) Charge(ctx contractapi.TransactionContextInterface, paymentID string, amount int) error {
+	payment, err := c.GetPayment(ctx, paymentID)
+	if err != nil {
+		return err
+	}
+	if payment != nil {
+		if payment.Status != "charged" || payment.Amount != amount {
+			return fmt.Errorf("payment %s is already %s for %d", paymentID, payment.Status, payment.Amount)
+		}
+		return nil
+	}
+
+	return putJSON(ctx, "PAYMENT-"+paymentID, Payment{ID: paymentID, Amount: amount, Status: "charged"})
+}
+
+func (c *PaymentsContract) Refund(ctx contractapi.TransactionContextInterface, paymentID string) error {
+	payment, err := c.GetPayment(ctx, paymentID)
+	if err != nil {
+		return err
+	}
+	if payment == nil {
+		// Nothing was charged, so there is nothing to refund
+		return nil
+	}
+
+	payment.Status = "refunded"
+	return putJSON(ctx, "PAYMENT-"+paymentID, payment)
+}
+
+func (c *PaymentsContract) GetPayment(ctx contractapi.TransactionContextInterface, paymentID string) (*Payment, error) {
+	payment := new(Payment)
+	found, err := getJSON(ctx, "PAYMENT-"+paymentID, payment)
+	if err != nil || !found {
+		return nil, err
+	}
+	return payment, nil
+}
+
+/**
+*@dev Shipment() represents a booking held by the fake logistics chaincode
+*/
+
+type Shipment struct {
+	ID          string `json:"id"`
+	Destination string `json:"destination"`
+	Status      string `json:"status"`
+}
+
+/**
+*@dev LogisticsContract() stands in for the logistics chaincode on another channel; it has no route to "nowhere"
+*/
+
+type LogisticsContract struct {
+	contractapi.Contract
+}
+
+func (c *LogisticsContract) BookShipment(ctx contractapi.TransactionContextInterface, shipmentID string, destination string) error {
+	if destination == "nowhere" {
+		return fmt.Errorf("no route to %s", destination)
+	}
+
+	shipment, err := c.GetShipment(ctx, shipmentID)
+	if err != nil {
+		return err
+	}
+	if shipment != nil {
+		if shipment.Status != "booked" {
+			return fmt.Errorf("shipment %s is %s", shipmentID, shipment.Status)
+		}
+		return nil
+	}
+
+	return putJSON(ctx, "SHIPMENT-"+shipmentID, Shipment{ID: shipmentID, Destination: destination, Status: "booked"})
+}
+
+func (c *LogisticsContract) CancelShipment(ctx contractapi.TransactionContextInterface, shipmentID string) error {
+	shipment, err := c.GetShipment(ctx, shipmentID)
+	if err != nil {
+		return err
+	}
+	if shipment == nil {
+		return nil
+	}
+
+	shipment.Status = "cancelled"
+	return putJSON(ctx, "SHIPMENT-"+shipmentID, shipment)
+}
+
+func (c *LogisticsContract) GetShipment(ctx contractapi.TransactionContextInterface, shipmentID string) (*Shipment, error) {
+	shipment := new(Shipment)
+	found, err := getJSON(ctx, "SHIPMENT-"+shipmentID, shipment)
+	if err != nil || !found {
+		return nil, err
+	}
+	return shipment, nil
+}
+
+func putJSON(ctx contractapi.TransactionContextInterface, key string, value interface{}) error {
+	valueBytes, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s JSON: %v", key, err)
+	}
+
+	err = ctx.GetStub().PutState(key, valueBytes)
+	if err != nil {
+		return fmt.Errorf("failed to put %s on the ledger: %v", key, err)
+	}
+
+	return nil
+}
+
+func getJSON(ctx contractapi.TransactionContextInterface, key string, value interface{}) (bool, error) {
+	valueBytes, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s from the ledger: %v", key, err)
+	}
+	if valueBytes == nil {
+		return false, nil
+	}
+
+	err = json.Unmarshal(valueBytes, value)
+	if err != nil {
+		return false, fmt.Errorf("failed to unmarshal %s JSON: %v", key, err)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,199 @@
+package verification
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+/**
+*@dev Identifier() represents the product identifier a wholesaler asks the manufacturer to verify
+*/
+
+type Identifier struct {
+	GTIN         string `json:"gtin"`
+	SerialNumber string `json:"serialNumber"`
+	LotNumber    string `json:"lotNumber"`
+	ExpiryDate   string `json:"expiryDate"`
+}
+
+/**
+*@dev Request() represents a verification request as raised on the ledger by RequestReturnVerification
+*/
+
+type Request struct {
+	ID string `json:"id"`
+	Identifier
+}
+
+/**
+*@dev Response() represents the manufacturer's answer to a verification request
+*/
+
+type Response struct {
+	ID       string `json:"id"`
+	Verified bool   `json:"verified"`
+}
+
+/**
+*@dev Lookup() is implemented by the manufacturer's system of record for issued product identifiers
+*/
+
+type Lookup interface {
+	Verify(ctx context.Context, identifier Identifier) (bool, error)
+}
+
+/**
+*@dev ContractClient() submits and evaluates transactions on the product details chaincode
+*/
+
+type ContractClient interface {
+	SubmitTransaction(name string, args ...string) ([]byte, error)
+	EvaluateTransaction(name string, args ...string) ([]byte, error)
+}
+
+/**
+*@dev Handler() answers verification requests, either locally or by forwarding them to a remote responder
+*/
+
+type Handler interface {
+	Respond(ctx context.Context, request Request) (*Response, error)
+}
+
+/**
+*@dev StubLookup() is an in-memory Lookup for local development
+*/
+
+type StubLookup struct {
+	mu    sync.RWMutex
+	known map[Identifier]bool
+}
+
+func NewStubLookup(identifiers ...Identifier) *StubLookup {
+	lookup := &StubLookup{known: make(map[Identifier]bool)}
+	for _, identifier := range identifiers {
+		lookup.Add(identifier)
+	}
+	return lookup
+}
+
+/**
+*@dev Add() registers an identifier as issued by the manufacturer
+*/
+
+func (l *StubLookup) Add(identifier Identifier) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.known[identifier] = true
+}
+
+func (l *StubLookup) Verify(ctx context.Context, identifier Identifier) (bool, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.known[identifier], nil
+}
+
+/**
+*@dev Responder() answers verification requests against a Lookup and records the result on the ledger
+*/
+
+type Responder struct {
+	lookup Lookup
+	client ContractClient
+}
+
+/**
+*@dev NewResponder() creates a Responder; a nil client answers requests without recording them
+*/
+
+func NewResponder(lookup Lookup, client ContractClient) *Responder {
+	return &Responder{lookup: lookup, client: client}
+}
+
+/**
+*@dev Respond() verifies the identifier of a verification request and records the answer
+*
+* With a client, the identifier verified is the one the request holds on the ledger, and a request naming a different
+* identifier is refused, so an answer is never recorded against a request for an identifier that was not checked.
+*/
+
+func (r *Responder) Respond(ctx context.Context, request Request) (*Response, error) {
+	if request.ID == "" {
+		return nil, fmt.Errorf("verification request ID is required")
+	}
+
+	identifier := request.Identifier
+	if r.client != nil {
+		recorded, err := r.recordedRequest(request.ID)
+		if err != nil {
+			return nil, err
+		}
+		if request.Identifier != (Identifier{}) && request.Identifier != recorded.Identifier {
+			return nil, fmt.Errorf("identifier does not match the one recorded for verification request %s", request.ID)
+		}
+		identifier = recorded.Identifier
+	}
+
+	verified, err := r.lookup.Verify(ctx, identifier)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up identifier for request %s: %v", request.ID, err)
+	}
+
+	if r.client != nil {
+		_, err = r.client.SubmitTransaction("RespondToVerification", request.ID, strconv.FormatBool(verified))
+		if err != nil {
+			return nil, fmt.Errorf("failed to record verification response for request %s: %v", request.ID, err)
+		}
+	}
+
+	return &Response{ID: request.ID, Verified: verified}, nil
+}
+
+/**
+*@dev recordedRequest() loads a verification request as RequestReturnVerification recorded it
+*/
+
+func (r *Responder) recordedRequest(requestID string) (*Request, error) {
+	requestBytes, err := r.client.EvaluateTransaction("RetrieveVerificationRequest", requestID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve verification request %s: %v", requestID, err)
+	}
+
+	request := new(Request)
+	err = json.Unmarshal(requestBytes, request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal verification request JSON: %v", err)
+	}
+
+	return request, nil
+}
+
+func (r *Responder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	serveHandler(r, w, req)
+}
+
+func serveHandler(handler Handler, w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request Request
+	err := json.NewDecoder(req.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode verification request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	response, err := handler.Respond(req.Context(), request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,151 @@
+package verification
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var issued = Identifier{GTIN: "05012345678900", SerialNumber: "SN-1", LotNumber: "LOT-7", ExpiryDate: "2027-01-31"}
+
+// otherIssued is a second identifier the manufacturer really issued
+var otherIssued = Identifier{GTIN: "05012345678900", SerialNumber: "SN-2", LotNumber: "LOT-7", ExpiryDate: "2027-01-31"}
+
+/**
+*@dev fakeLedger() holds verification requests as the chaincode records them and the answers submitted for them
+*/
+
+type fakeLedger struct {
+	requests map[string]Identifier
+	answers  map[string]string
+}
+
+func newFakeLedger(requests map[string]Identifier) *fakeLedger {
+	return &fakeLedger{requests: requests, answers: make(map[string]string)}
+}
+
+func (l *fakeLedger) SubmitTransaction(name string, args ...string) ([]byte, error) {
+	if name != "RespondToVerification" {
+		return nil, fmt.Errorf("unexpected transaction %s", name)
+	}
+	l.answers[args[0]] = args[1]
+	return nil, nil
+}
+
+func (l *fakeLedger) EvaluateTransaction(name string, args ...string) ([]byte, error) {
+	if name != "RetrieveVerificationRequest" {
+		return nil, fmt.Errorf("unexpected transaction %s", name)
+	}
+	identifier, ok := l.requests[args[0]]
+	if !ok {
+		return nil, fmt.Errorf("verification request %s does not exist", args[0])
+	}
+	return json.Marshal(Request{ID: args[0], Identifier: identifier})
+}
+
+func TestResponderVerifiesTheRecordedIdentifier(t *testing.T) {
+	ledger := newFakeLedger(map[string]Identifier{"tx-1": issued, "tx-2": {GTIN: issued.GTIN, SerialNumber: "SN-9", LotNumber: "LOT-7", ExpiryDate: "2027-01-31"}})
+	responder := NewResponder(NewStubLookup(issued, otherIssued), ledger)
+
+	tests := []struct {
+		name     string
+		request  Request
+		verified bool
+		err      string
+	}{
+		{name: "issued identifier", request: Request{ID: "tx-1", Identifier: issued}, verified: true},
+		{name: "identifier left to the ledger", request: Request{ID: "tx-1"}, verified: true},
+		{name: "unissued identifier", request: Request{ID: "tx-2"}, verified: false},
+		{name: "mismatched identifier", request: Request{ID: "tx-2", Identifier: otherIssued}, err: "does not match"},
+		{name: "unknown request", request: Request{ID: "tx-3", Identifier: issued}, err: "does not exist"},
+		{name: "missing request ID", request: Request{Identifier: issued}, err: "ID is required"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			delete(ledger.answers, test.request.ID)
+
+			response, err := responder.Respond(context.Background(), test.request)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				if answer, ok := ledger.answers[test.request.ID]; ok {
+					t.Fatalf("expected no answer to be recorded, got %s", answer)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.Verified != test.verified {
+				t.Fatalf("expected verified %v, got %v", test.verified, response.Verified)
+			}
+			if ledger.answers[test.request.ID] != fmt.Sprint(test.verified) {
+				t.Fatalf("expected %v to be recorded, got %q", test.verified, ledger.answers[test.request.ID])
+			}
+		})
+	}
+}
+
+func TestResponderAnswersWithoutRecordingWhenOffline(t *testing.T) {
+	responder := NewResponder(NewStubLookup(issued), nil)
+
+	response, err := responder.Respond(context.Background(), Request{ID: "tx-1", Identifier: issued})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.Verified {
+		t.Fatal("expected the issued identifier to be verified")
+	}
+}
+
+func TestResponderServesHTTP(t *testing.T) {
+	ledger := newFakeLedger(map[string]Identifier{"tx-1": issued})
+	server := httptest.NewServer(NewResponder(NewStubLookup(issued, otherIssued), ledger))
+	defer server.Close()
+
+	post := func(request Request) *http.Response {
+		t.Helper()
+		requestBytes, err := json.Marshal(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post(server.URL, "application/json", bytes.NewReader(requestBytes))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := post(Request{ID: "tx-1", Identifier: otherIssued})
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK || len(ledger.answers) != 0 {
+		t.Fatalf("expected a mismatched identifier to be refused, got %s with answers %v", resp.Status, ledger.answers)
+	}
+
+	resp = post(Request{ID: "tx-1", Identifier: issued})
+	defer resp.Body.Close()
+	var response Response
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !response.Verified || ledger.answers["tx-1"] != "true" {
+		t.Fatalf("expected the request to be verified and recorded, got %s %+v", resp.Status, response)
+	}
+
+	resp, err = http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected GET to be refused, got %s", resp.Status)
+	}
+}
@@ -0,0 +1,111 @@
+package verification
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/**
+*@dev Router() routes verification requests to the responder registered for the GTIN's company prefix
+*/
+
+type Router struct {
+	mu     sync.RWMutex
+	routes map[string]Handler
+}
+
+func NewRouter() *Router {
+	return &Router{routes: make(map[string]Handler)}
+}
+
+/**
+*@dev Register() routes every GTIN starting with prefix to handler; the longest matching prefix wins
+*/
+
+func (r *Router) Register(prefix string, handler Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes[prefix] = handler
+}
+
+func (r *Router) Respond(ctx context.Context, request Request) (*Response, error) {
+	handler, err := r.route(request.GTIN)
+	if err != nil {
+		return nil, err
+	}
+	return handler.Respond(ctx, request)
+}
+
+func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	serveHandler(r, w, req)
+}
+
+func (r *Router) route(gtin string) (Handler, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	prefixes := make([]string, 0, len(r.routes))
+	for prefix := range r.routes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(gtin, prefix) {
+			return r.routes[prefix], nil
+		}
+	}
+
+	return nil, fmt.Errorf("no responder registered for GTIN %s", gtin)
+}
+
+/**
+*@dev RemoteResponder() forwards verification requests to a responder served over HTTP
+*/
+
+type RemoteResponder struct {
+	URL    string
+	Client *http.Client
+}
+
+func (r *RemoteResponder) Respond(ctx context.Context, request Request) (*Response, error) {
+	requestBytes, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal verification request JSON: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.URL, bytes.NewReader(requestBytes))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach responder %s: %v", r.URL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("responder %s returned %s", r.URL, resp.Status)
+	}
+
+	response := new(Response)
+	err = json.NewDecoder(resp.Body).Decode(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode verification response: %v", err)
+	}
+
+	return response, nil
+}
@@ -0,0 +1,75 @@
+package verification
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+/**
+*@dev namedHandler() answers every request as verified and remembers which requests reached it
+*/
+
+type namedHandler struct {
+	requests []Request
+}
+
+func (h *namedHandler) Respond(ctx context.Context, request Request) (*Response, error) {
+	h.requests = append(h.requests, request)
+	return &Response{ID: request.ID, Verified: true}, nil
+}
+
+func TestRouterPicksTheLongestPrefix(t *testing.T) {
+	fallback, company, division := new(namedHandler), new(namedHandler), new(namedHandler)
+	router := NewRouter()
+	router.Register("", fallback)
+	router.Register("0501234", company)
+	router.Register("050123456", division)
+
+	for gtin, handler := range map[string]*namedHandler{
+		"05012345678900": division,
+		"05012340000000": company,
+		"09999999999999": fallback,
+	} {
+		_, err := router.Respond(context.Background(), Request{ID: gtin, Identifier: Identifier{GTIN: gtin}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(handler.requests) == 0 || handler.requests[len(handler.requests)-1].ID != gtin {
+			t.Fatalf("expected GTIN %s to be routed to its longest prefix", gtin)
+		}
+	}
+}
+
+func TestRouterRefusesUnroutedGTINs(t *testing.T) {
+	router := NewRouter()
+	router.Register("0501234", new(namedHandler))
+
+	_, err := router.Respond(context.Background(), Request{ID: "tx-1", Identifier: Identifier{GTIN: "09999999999999"}})
+	if err == nil || !strings.Contains(err.Error(), "no responder registered") {
+		t.Fatalf("expected an unrouted GTIN to be refused, got %v", err)
+	}
+}
+
+func TestRouterForwardsToRemoteResponders(t *testing.T) {
+	ledger := newFakeLedger(map[string]Identifier{"tx-1": issued})
+	remote := httptest.NewServer(NewResponder(NewStubLookup(issued, otherIssued), ledger))
+	defer remote.Close()
+
+	router := NewRouter()
+	router.Register("0501234", &RemoteResponder{URL: remote.URL})
+
+	_, err := router.Respond(context.Background(), Request{ID: "tx-1", Identifier: otherIssued})
+	if err == nil || len(ledger.answers) != 0 {
+		t.Fatalf("expected the remote responder to refuse a mismatched identifier, got %v with answers %v", err, ledger.answers)
+	}
+
+	response, err := router.Respond(context.Background(), Request{ID: "tx-1", Identifier: issued})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.Verified || ledger.answers["tx-1"] != "true" {
+		t.Fatalf("expected the remote responder to verify and record the request, got %+v", response)
+	}
+}